@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Per-model access control lists. A model with an ACL in its sidecar is
+// private: it's listed and served only to admins and to the principals the
+// ACL names, and looks missing (404) to everyone else. Owners may also
+// change the ACL and publish new versions of the model. Principals are typed
+// so names from different credential kinds can't collide:
+//
+//	key:<api key name>   sub:<JWT subject>   cert:<certificate identity>
+//
+// Models without an ACL stay visible to every reader. The ACL of a
+// versioned model is kept on its base name and covers all its versions.
+
+// Principal prefixes.
+const (
+	principalKey     = "key:"
+	principalSubject = "sub:"
+	principalCert    = "cert:"
+)
+
+// maxACLEntries bounds the owners and readers of one ACL.
+const maxACLEntries = 256
+
+// modelACL lists who may see a private model.
+type modelACL struct {
+	Owners  []string `json:"owners"`
+	Readers []string `json:"readers,omitempty"`
+}
+
+// allows reports whether any of principals may read (or, with owner, manage)
+// the model.
+func (a *modelACL) allows(principals []string, owner bool) bool {
+	for _, p := range principals {
+		if slices.Contains(a.Owners, p) || (!owner && slices.Contains(a.Readers, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks that every entry is a typed principal.
+func (a *modelACL) validate() error {
+	if len(a.Owners) == 0 {
+		return errors.New("an ACL needs at least one owner")
+	}
+	if len(a.Owners)+len(a.Readers) > maxACLEntries {
+		return fmt.Errorf("an ACL holds at most %d principals", maxACLEntries)
+	}
+	for _, p := range slices.Concat(a.Owners, a.Readers) {
+		if err := validatePrincipal(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validatePrincipal checks that p is a typed principal.
+func validatePrincipal(p string) error {
+	kind, name, _ := strings.Cut(p, ":")
+	if name == "" || !slices.Contains([]string{principalKey, principalSubject, principalCert}, kind+":") {
+		return fmt.Errorf("invalid principal %q (want key:<name>, sub:<subject> or cert:<identity>)", p)
+	}
+	return nil
+}
+
+// principalsOf are the principals of a caller with the given certificate
+// identity, verified token claims and API key name, any of which may be
+// missing.
+func principalsOf(identity string, claims *jwtClaims, keyName string) []string {
+	var out []string
+	if keyName != "" {
+		out = append(out, principalKey+keyName)
+	}
+	if claims != nil && claims.Subject != "" {
+		out = append(out, principalSubject+claims.Subject)
+	}
+	if identity != "" {
+		out = append(out, principalCert+identity)
+	}
+	return out
+}
+
+func requestPrincipals(r *http.Request) []string {
+	name, _, _ := apiKeys.Lookup(requestAPIKey(r))
+	return principalsOf(requestIdentity(r), requestClaims(r), name)
+}
+
+func grpcPrincipals(ctx context.Context) []string {
+	name, _, _ := apiKeys.Lookup(grpcAPIKey(ctx))
+	return principalsOf(grpcIdentity(ctx), grpcClaims(ctx), name)
+}
+
+// modelACLOf is the ACL of the model named base, or nil when it's public.
+// An unreadable sidecar makes the model admin-only rather than public.
+func modelACLOf(base string) *modelACL {
+	meta, err := sidecars.Get(base)
+	if err != nil {
+		log.Printf("[registry] unable to read ACL of %s: %v", base, err)
+		return &modelACL{}
+	}
+	return meta.ACL
+}
+
+// modelFilter returns whether a caller who is admin (or not) with
+// principals may see the model named base.
+func modelFilter(admin bool, principals []string) func(base string) bool {
+	return func(base string) bool {
+		if admin {
+			return true
+		}
+		acl := modelACLOf(base)
+		return acl == nil || acl.allows(principals, false)
+	}
+}
+
+// requestModelFilter is modelFilter for r's caller.
+func requestModelFilter(r *http.Request) func(base string) bool {
+	if isAdmin(r) {
+		return modelFilter(true, nil)
+	}
+	return modelFilter(false, requestPrincipals(r))
+}
+
+// grpcModelFilter is modelFilter for a gRPC caller.
+func grpcModelFilter(ctx context.Context) func(base string) bool {
+	if grpcIsAdmin(ctx) {
+		return modelFilter(true, nil)
+	}
+	return modelFilter(false, grpcPrincipals(ctx))
+}
+
+// requireModelAccess answers 404 for models {name} that r's caller may not
+// see, as if they didn't exist.
+func requireModelAccess(modelDir string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			ref, err := parseModelRef(r, modelDir, mux.Vars(r)["name"])
+			if errors.As(err, new(invalidNameError)) || (err == nil && !requestModelFilter(r)(ref.Base())) {
+				http.Error(w, "model not found", http.StatusNotFound)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// requireModelOwner is requireModelAccess for routes that change a model:
+// on a private model the caller must also be an owner.
+func requireModelOwner(modelDir string, next http.HandlerFunc) http.HandlerFunc {
+	return requireModelAccess(modelDir, func(w http.ResponseWriter, r *http.Request) {
+		if ref, err := parseModelRef(r, modelDir, mux.Vars(r)["name"]); err == nil && r.Method != http.MethodOptions {
+			if acl := modelACLOf(ref.Base()); acl != nil && !isAdmin(r) && !acl.allows(requestPrincipals(r), true) {
+				http.Error(w, "only the model's owners can change it", http.StatusForbidden)
+				return
+			}
+		}
+		next(w, r)
+	})
+}
+
+// canManageACL reports why r's caller may not change the ACL acl (nil for a
+// public model), or nil. Admins always may; owners may; on a public model
+// any publisher may make it private.
+func canManageACL(r *http.Request, acl *modelACL) error {
+	if isAdmin(r) || acl == nil || acl.allows(requestPrincipals(r), true) {
+		return nil
+	}
+	return errors.New("only the model's owners can change its access")
+}
+
+// claimPrivate checks that r's caller may publish to ref and, for private
+// uploads, makes the model private to the caller before any bytes arrive.
+func claimPrivate(r *http.Request, ref modelRef, private bool) (int, error) {
+	acl := modelACLOf(ref.Base())
+	if acl != nil && !isAdmin(r) && !acl.allows(requestPrincipals(r), true) {
+		return http.StatusForbidden, errors.New("only the model's owners can publish to it")
+	}
+	if !private || acl != nil {
+		return 0, nil
+	}
+	owners := requestPrincipals(r)
+	if len(owners) == 0 {
+		return http.StatusBadRequest, errors.New("private uploads need an API key, bearer token or client certificate to own them")
+	}
+	if _, err := sidecars.Update(ref.Base(), func(m *modelMeta) { m.ACL = &modelACL{Owners: owners} }); err != nil {
+		log.Printf("[registry] upload %s: unable to write ACL: %v", ref.Name, err)
+		return http.StatusInternalServerError, errors.New("unable to record the model's ACL")
+	}
+	return 0, nil
+}
+
+// aclResponse is the body of GET and PUT /models/{name}/acl.
+type aclResponse struct {
+	Name    string   `json:"name"`
+	Private bool     `json:"private"`
+	Owners  []string `json:"owners"`
+	Readers []string `json:"readers"`
+}
+
+func newACLResponse(name string, acl *modelACL) aclResponse {
+	resp := aclResponse{Name: name, Owners: []string{}, Readers: []string{}}
+	if acl != nil {
+		resp.Private = true
+		resp.Owners = append(resp.Owners, acl.Owners...)
+		resp.Readers = append(resp.Readers, acl.Readers...)
+	}
+	return resp
+}
+
+// aclTarget resolves {name} for the ACL routes, answering 404 itself for
+// models that don't exist.
+func aclTarget(w http.ResponseWriter, r *http.Request, modelDir string) (modelRef, bool) {
+	ref, err := resolveModel(r, modelDir, mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ref, false
+	}
+	if _, err := statModel(r.Context(), ref); err != nil {
+		http.Error(w, "model not found", http.StatusNotFound)
+		return ref, false
+	}
+	return ref, true
+}
+
+// aclHandler returns the ACL of {name}.
+func aclHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, ok := aclTarget(w, r, modelDir)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, newACLResponse(ref.Base(), modelACLOf(ref.Base())))
+	}
+}
+
+// putACLHandler replaces the ACL of {name}. Callers other than admins must
+// stay owners, so they can't lock themselves out.
+func putACLHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, ok := aclTarget(w, r, modelDir)
+		if !ok {
+			return
+		}
+		var acl modelACL
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&acl); err != nil {
+			http.Error(w, "body must be a JSON object with owners and readers", http.StatusBadRequest)
+			return
+		}
+		if err := acl.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		base := ref.Base()
+		if err := canManageACL(r, modelACLOf(base)); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if !isAdmin(r) && !acl.allows(requestPrincipals(r), true) {
+			http.Error(w, "the new ACL must keep you as an owner", http.StatusBadRequest)
+			return
+		}
+		if _, err := sidecars.Update(base, func(m *modelMeta) { m.ACL = &acl }); err != nil {
+			log.Printf("[registry] unable to write ACL of %s: %v", base, err)
+			http.Error(w, "unable to save ACL", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[registry] %s is private: owners=%v readers=%v", base, acl.Owners, acl.Readers)
+		writeJSON(w, http.StatusOK, newACLResponse(base, &acl))
+	}
+}
+
+// deleteACLHandler makes {name} public again.
+func deleteACLHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, ok := aclTarget(w, r, modelDir)
+		if !ok {
+			return
+		}
+		base := ref.Base()
+		if err := canManageACL(r, modelACLOf(base)); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if _, err := sidecars.Update(base, func(m *modelMeta) { m.ACL = nil }); err != nil {
+			log.Printf("[registry] unable to write ACL of %s: %v", base, err)
+			http.Error(w, "unable to save ACL", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[registry] %s is public", base)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
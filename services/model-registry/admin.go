@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// adminToken guards admin-only routes. When empty (the lab default) admin
+// routes are open to anyone.
+var adminToken string
+
+// isAdmin reports whether r's caller has the admin role: it carries the
+// admin token, either as a Bearer token, as the password of Basic
+// credentials (for OCI clients) or in X-Admin-Token, or an admin
+// certificate, token or API key. Without any of those configured every
+// caller is admin.
+func isAdmin(r *http.Request) bool {
+	return requestRole(r) == roleAdmin
+}
+
+// requestAdminToken is the admin token candidate r carries.
+func requestAdminToken(r *http.Request) string {
+	got := r.Header.Get("X-Admin-Token")
+	if auth := r.Header.Get("Authorization"); got == "" && strings.HasPrefix(auth, "Bearer ") {
+		got = strings.TrimPrefix(auth, "Bearer ")
+	} else if _, pass, ok := r.BasicAuth(); got == "" && ok {
+		got = pass
+	}
+	return got
+}
+
+// adminTokenMatches reports whether got is the configured admin token.
+func adminTokenMatches(got string) bool {
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(got), []byte(adminToken)) == 1
+}
+
+// requireAdmin rejects callers without the admin role.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return requireRole(roleAdmin, next)
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"model-registry/registrypb"
+)
+
+// API key authentication.
+//
+// Keys are named and come from MODEL_REGISTRY_API_KEYS, from the file named
+// by MODEL_REGISTRY_API_KEYS_FILE, or from POST /admin/api-keys. Once any
+// key exists (or MODEL_REGISTRY_REQUIRE_API_KEY is set) every request except
+// the /healthz and /readyz probes and CORS preflights must carry one, in
+// X-API-Key, as a Bearer token or as the password of Basic credentials (for
+// OCI clients). The admin token and a verified client certificate pass too,
+// as does a one-time download link. Each key has a role, reader unless
+// created otherwise (see rbac.go), and its name is added to the request's log
+// line. Only SHA-256 hashes of keys are kept, in memory and, for keys created
+// through the API, in MODEL_DIR/.registry/api-keys.json.
+const (
+	apiKeyHeader    = "X-API-Key"
+	apiKeyPrefix    = "mr_"
+	minAPIKeyLength = 16
+
+	// downloadRouteName names the model download route, which one-time
+	// links may use without a key.
+	downloadRouteName = "download"
+)
+
+// API key sources.
+const (
+	apiKeySourceConfig = "config"
+	apiKeySourceAPI    = "api"
+)
+
+// apiKeyNamePattern restricts key names to what reads well in log lines.
+var apiKeyNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+var errAPIKeyExists = errors.New("an API key with that name already exists")
+
+// apiKeys holds the configured keys; set up in main.
+var apiKeys *apiKeyStore
+
+// apiKey is one named key, as persisted.
+type apiKey struct {
+	Name     string     `json:"name"`
+	Hash     string     `json:"sha256"`
+	Role     role       `json:"role"`
+	Source   string     `json:"-"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"-"`
+}
+
+// apiKeyView is a key as the admin API lists it, without its hash.
+type apiKeyView struct {
+	Name     string     `json:"name"`
+	Role     role       `json:"role"`
+	Source   string     `json:"source"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// apiKeyCreated answers POST /admin/api-keys; the key is never shown again.
+type apiKeyCreated struct {
+	apiKeyView
+	Key string `json:"key"`
+}
+
+// apiKeyStore maps key hashes to named keys. Keys created through the API
+// are written through to path; last-use times live in memory.
+type apiKeyStore struct {
+	mu       sync.Mutex
+	path     string
+	required bool
+	byHash   map[string]*apiKey
+	byName   map[string]*apiKey
+}
+
+// newAPIKeyStore loads the persisted keys and adds the configured ones,
+// given as name:key pairs with their roles by name (reader when missing).
+// Keys are required when any exist or require is set.
+func newAPIKeyStore(modelDir string, pairs []string, roles map[string]role, require bool) (*apiKeyStore, error) {
+	s := &apiKeyStore{
+		path:   filepath.Join(modelDir, stateDirName, "api-keys.json"),
+		byHash: map[string]*apiKey{},
+		byName: map[string]*apiKey{},
+	}
+	configured, err := parseConfiguredKeys(pairs, roles)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range configured {
+		s.add(k)
+	}
+	b, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var saved []*apiKey
+		if err := json.Unmarshal(b, &saved); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.path, err)
+		}
+		for _, k := range saved {
+			k.Source = apiKeySourceAPI
+			if k.Role == roleNone {
+				k.Role = roleReader // saved before keys had roles
+			}
+			if err := s.add(k); err != nil {
+				return nil, err
+			}
+		}
+	}
+	s.required = require || len(s.byName) > 0
+	return s, nil
+}
+
+// parseConfiguredKeys turns name:key pairs and roles by name into keys.
+func parseConfiguredKeys(pairs []string, roles map[string]role) ([]*apiKey, error) {
+	parsed := &apiKeyStore{byHash: map[string]*apiKey{}, byName: map[string]*apiKey{}}
+	var keys []*apiKey
+	now := time.Now().UTC()
+	for _, pair := range pairs {
+		name, key, ok := strings.Cut(pair, ":")
+		if !ok || !apiKeyNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid API key entry %q (want name:key)", name)
+		}
+		if len(key) < minAPIKeyLength {
+			return nil, fmt.Errorf("API key %s is shorter than %d characters", name, minAPIKeyLength)
+		}
+		ro, ok := roles[name]
+		if !ok {
+			ro = roleReader
+		}
+		k := &apiKey{Name: name, Hash: hashAPIKey(key), Role: ro, Source: apiKeySourceConfig, Created: now}
+		if err := parsed.add(k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	for name := range roles {
+		if _, ok := parsed.byName[name]; !ok {
+			return nil, fmt.Errorf("role given for unknown API key %s", name)
+		}
+	}
+	return keys, nil
+}
+
+// configuredAPIKeys returns the name:key pairs and roles c configures,
+// reading MODEL_REGISTRY_API_KEYS_FILE.
+func configuredAPIKeys(c configAuth) ([]string, map[string]role, error) {
+	pairs := slices.Clone(c.APIKeys)
+	if c.APIKeysFile != "" {
+		filePairs, err := readAPIKeysFile(c.APIKeysFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("MODEL_REGISTRY_API_KEYS_FILE: %v", err)
+		}
+		pairs = append(pairs, filePairs...)
+	}
+	roles, err := parseKeyRoles(c.APIKeyRoles)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid MODEL_REGISTRY_API_KEY_ROLES: %v", err)
+	}
+	return pairs, roles, nil
+}
+
+// readAPIKeysFile returns the name:key lines of path, skipping blank lines
+// and # comments.
+func readAPIKeysFile(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pairs []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			pairs = append(pairs, line)
+		}
+	}
+	return pairs, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// add indexes k; the caller must hold s.mu or own s.
+func (s *apiKeyStore) add(k *apiKey) error {
+	if _, ok := s.byName[k.Name]; ok {
+		return fmt.Errorf("duplicate API key name %q", k.Name)
+	}
+	if _, ok := s.byHash[k.Hash]; ok {
+		return fmt.Errorf("API key %s is configured twice", k.Name)
+	}
+	s.byName[k.Name] = k
+	s.byHash[k.Hash] = k
+	return nil
+}
+
+// save writes the API-created keys; the caller must hold s.mu.
+func (s *apiKeyStore) save() error {
+	saved := []apiKey{}
+	for _, k := range s.byName {
+		if k.Source == apiKeySourceAPI {
+			saved = append(saved, *k)
+		}
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Name < saved[j].Name })
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Required reports whether requests must authenticate; nil-safe.
+func (s *apiKeyStore) Required() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.required
+}
+
+// Reconfigure replaces the configured keys, leaving those created through
+// the API alone, and reports whether anything changed. Keys that stay keep
+// their last use. On error nothing changes.
+func (s *apiKeyStore) Reconfigure(pairs []string, roles map[string]role, require bool) (bool, error) {
+	configured, err := parseConfiguredKeys(pairs, roles)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := &apiKeyStore{byHash: map[string]*apiKey{}, byName: map[string]*apiKey{}}
+	changed := false
+	for _, k := range configured {
+		if old := s.byName[k.Name]; old != nil && old.Source == apiKeySourceConfig && old.Hash == k.Hash && old.Role == k.Role {
+			k = old
+		} else {
+			changed = true
+		}
+		next.add(k)
+	}
+	for _, k := range s.byName {
+		switch {
+		case k.Source == apiKeySourceAPI:
+			if err := next.add(k); err != nil {
+				return false, fmt.Errorf("%v (created through the API)", err)
+			}
+		case next.byName[k.Name] != k:
+			changed = true
+		}
+	}
+	required := require || len(next.byName) > 0
+	changed = changed || required != s.required
+	s.byHash, s.byName, s.required = next.byHash, next.byName, required
+	return changed, nil
+}
+
+// Lookup returns the name and role of key, recording its use.
+func (s *apiKeyStore) Lookup(key string) (string, role, bool) {
+	if s == nil || key == "" {
+		return "", roleNone, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.byHash[hashAPIKey(key)]
+	if !ok {
+		return "", roleNone, false
+	}
+	now := time.Now().UTC()
+	k.LastUsed = &now
+	return k.Name, k.Role, true
+}
+
+// Grants reports whether any key has at least role ro; nil-safe.
+func (s *apiKeyStore) Grants(ro role) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.byName {
+		if k.Role >= ro {
+			return true
+		}
+	}
+	return false
+}
+
+// Create mints a key named name with role ro.
+func (s *apiKeyStore) Create(name string, ro role) (apiKeyCreated, error) {
+	var raw [24]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return apiKeyCreated{}, err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(raw[:])
+	k := &apiKey{Name: name, Hash: hashAPIKey(key), Role: ro, Source: apiKeySourceAPI, Created: time.Now().UTC()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byName[name]; ok {
+		return apiKeyCreated{}, errAPIKeyExists
+	}
+	s.add(k)
+	if err := s.save(); err != nil {
+		delete(s.byName, k.Name)
+		delete(s.byHash, k.Hash)
+		return apiKeyCreated{}, err
+	}
+	s.required = true
+	return apiKeyCreated{apiKeyView: k.view(), Key: key}, nil
+}
+
+// Remove revokes an API-created key. Configured keys can't be removed here;
+// found is true for them and err says why.
+func (s *apiKeyStore) Remove(name string) (found bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.byName[name]
+	if !ok {
+		return false, nil
+	}
+	if k.Source != apiKeySourceAPI {
+		return true, errors.New("configured API keys can only be removed from the configuration")
+	}
+	delete(s.byName, k.Name)
+	delete(s.byHash, k.Hash)
+	if err := s.save(); err != nil {
+		s.add(k)
+		return true, err
+	}
+	return true, nil
+}
+
+// List returns the keys by name.
+func (s *apiKeyStore) List() []apiKeyView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []apiKeyView{}
+	for _, k := range s.byName {
+		out = append(out, k.view())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (k *apiKey) view() apiKeyView {
+	v := apiKeyView{Name: k.Name, Role: k.Role, Source: k.Source, Created: k.Created}
+	if k.LastUsed != nil {
+		t := *k.LastUsed
+		v.LastUsed = &t
+	}
+	return v
+}
+
+// requestAPIKey is the key r carries, if any.
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return key
+	}
+	if auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return auth
+	}
+	if _, pass, ok := r.BasicAuth(); ok {
+		return pass
+	}
+	return ""
+}
+
+// apiKeyName is the name of the key r carries, for log lines.
+func apiKeyName(r *http.Request) string {
+	if !apiKeys.Required() {
+		return ""
+	}
+	name, _, _ := apiKeys.Lookup(requestAPIKey(r))
+	return name
+}
+
+// authenticated reports whether r may use the registry when keys are
+// required.
+func authenticated(r *http.Request) bool {
+	if _, _, ok := apiKeys.Lookup(requestAPIKey(r)); ok {
+		return true
+	}
+	if adminTokenMatches(requestAdminToken(r)) {
+		return true
+	}
+	if requestIdentity(r) != "" || requestClaims(r) != nil || scoreboardRequest(r) {
+		return true
+	}
+	// One-time links are for callers without credentials; the download
+	// handler checks the token itself.
+	route := mux.CurrentRoute(r)
+	return route != nil && route.GetName() == downloadRouteName && r.URL.Query().Has("token")
+}
+
+// authRequired reports whether requests must authenticate: keys are
+// required or bearer tokens are verified.
+func authRequired() bool {
+	return apiKeys.Required() || jwtAuth != nil
+}
+
+// apiKeyMiddleware refuses unauthenticated requests once keys are required.
+func apiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authRequired() && r.Method != http.MethodOptions && !isProbe(r) && !authenticated(r) && !unauthenticatedPull(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="model-registry"`)
+			http.Error(w, "API key or bearer token required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// grpcAPIKey is the key a gRPC call carries in the x-api-key or
+// authorization (Bearer) metadata.
+func grpcAPIKey(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get("x-api-key"); len(v) > 0 {
+		return v[0]
+	} else if v := md.Get("authorization"); len(v) > 0 {
+		return strings.TrimPrefix(v[0], "Bearer ")
+	}
+	return ""
+}
+
+// grpcAuthenticated is authenticated for gRPC calls.
+func grpcAuthenticated(ctx context.Context) bool {
+	if _, _, ok := apiKeys.Lookup(grpcAPIKey(ctx)); ok {
+		return true
+	}
+	return adminTokenMatches(grpcAdminToken(ctx)) || grpcIdentity(ctx) != "" || grpcClaims(ctx) != nil
+}
+
+// grpcAuthUnary and grpcAuthStream apply apiKeyMiddleware's rule to gRPC.
+func grpcAuthUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if authRequired() && !grpcAuthenticated(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "API key or bearer token required")
+	}
+	return handler(ctx, req)
+}
+
+func grpcAuthStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	pull := info.FullMethod == registrypb.ModelRegistry_StreamModel_FullMethodName && vulns.Enabled(vulnUnauthPulls)
+	if authRequired() && !grpcAuthenticated(ss.Context()) && !pull {
+		return status.Error(codes.Unauthenticated, "API key or bearer token required")
+	}
+	return handler(srv, ss)
+}
+
+// apiKeyRequest is the body of POST /admin/api-keys.
+type apiKeyRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role"` // reader (the default), publisher or admin
+}
+
+// listAPIKeysHandler lists the keys without their secrets.
+func listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"keys": apiKeys.List()})
+}
+
+// createAPIKeyHandler mints a key and returns it once.
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "body must be a JSON object with name", http.StatusBadRequest)
+		return
+	}
+	if !apiKeyNamePattern.MatchString(req.Name) {
+		http.Error(w, "name must be 1-64 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	ro, err := parseRole(req.Role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	k, err := apiKeys.Create(req.Name, ro)
+	switch {
+	case err == errAPIKeyExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		log.Printf("[registry] unable to save API key: %v", err)
+		http.Error(w, "unable to save API key", http.StatusInternalServerError)
+	default:
+		log.Printf("[registry] API key %s created with role %s", k.Name, k.Role)
+		writeJSON(w, http.StatusCreated, k)
+	}
+}
+
+// deleteAPIKeyHandler revokes a key created through the API.
+func deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	found, err := apiKeys.Remove(name)
+	switch {
+	case !found:
+		http.Error(w, "API key not found", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("[registry] API key %s revoked", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
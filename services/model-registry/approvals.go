@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Approval gates. With MODEL_REGISTRY_PROMOTION_APPROVAL set, a promotion
+// that would move a model to production doesn't: it files an approval
+// request, answered with 202, and the model stays where it is until an admin
+// other than the requester approves it. Requests, and what became of them,
+// are kept in .registry/approvals.json and never removed, so the file is the
+// trail of who asked for and who cleared every production release. A
+// request goes stale when the model's content or stage changes before a
+// decision, since what was reviewed is no longer what would be promoted.
+
+// Approval states.
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+	approvalStale    = "stale"
+)
+
+// approvalStates is the set accepted by GET /approvals?state=.
+var approvalStates = map[string]bool{approvalPending: true, approvalApproved: true, approvalRejected: true, approvalStale: true}
+
+// approvalResults counts approval requests and decisions by outcome.
+var approvalResults = metrics.Counter("promotion_approvals_total", "Promotion approval requests and decisions by result", "result")
+
+// approvalRequest is one request for a promotion to production.
+type approvalRequest struct {
+	ID          string     `json:"id"`
+	Model       string     `json:"model"`
+	From        string     `json:"from"`
+	To          string     `json:"to"`
+	Sha256      string     `json:"sha256,omitempty"` // content that was asked for
+	Reason      string     `json:"reason,omitempty"`
+	RequestedBy []string   `json:"requested_by"` // principals
+	RequestedAt time.Time  `json:"requested_at"`
+	State       string     `json:"state"`
+	DecidedBy   []string   `json:"decided_by,omitempty"`
+	DecidedAt   *time.Time `json:"decided_at,omitempty"`
+	Comment     string     `json:"comment,omitempty"` // the decider's reason
+}
+
+// approvalStore holds every approval request, oldest first.
+type approvalStore struct {
+	mu       sync.Mutex
+	path     string
+	requests []*approvalRequest
+}
+
+// approvals is nil unless MODEL_REGISTRY_PROMOTION_APPROVAL is set.
+var approvals *approvalStore
+
+func newApprovalStore(modelDir string) (*approvalStore, error) {
+	s := &approvalStore{path: filepath.Join(modelDir, stateDirName, "approvals.json")}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.requests); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save writes the requests out; callers hold s.mu.
+func (s *approvalStore) save() error {
+	data, err := json.MarshalIndent(s.requests, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// pending is the pending request for model, or nil; callers hold s.mu.
+func (s *approvalStore) pending(model string) *approvalRequest {
+	for _, a := range s.requests {
+		if a.Model == model && a.State == approvalPending {
+			return a
+		}
+	}
+	return nil
+}
+
+// get is the request id, or nil; callers hold s.mu.
+func (s *approvalStore) get(id string) *approvalRequest {
+	for _, a := range s.requests {
+		if a.ID == id {
+			return a
+		}
+	}
+	return nil
+}
+
+// newApprovalID returns a random request ID.
+func newApprovalID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// sharesPrincipal reports whether a and b name a common principal.
+func sharesPrincipal(a, b []string) bool {
+	for _, p := range a {
+		if slices.Contains(b, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestApproval files a request to move name, whose sidecar is meta, to
+// the stage to, and answers 202 with it; a model has one pending request at
+// a time.
+func requestApproval(w http.ResponseWriter, r *http.Request, name string, meta modelMeta, to, reason string) {
+	s := approvals
+	a := &approvalRequest{
+		ID:          newApprovalID(),
+		Model:       name,
+		From:        modelStage(meta),
+		To:          to,
+		Sha256:      meta.Sha256,
+		Reason:      reason,
+		RequestedBy: requestPrincipals(r),
+		RequestedAt: time.Now().UTC(),
+		State:       approvalPending,
+	}
+	if a.RequestedBy == nil {
+		a.RequestedBy = []string{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p := s.pending(name); p != nil {
+		http.Error(w, "approval "+p.ID+" for this model is already pending", http.StatusConflict)
+		return
+	}
+	s.requests = append(s.requests, a)
+	if err := s.save(); err != nil {
+		s.requests = s.requests[:len(s.requests)-1]
+		log.Printf("[registry] unable to record approval request for %s: %v", name, err)
+		http.Error(w, "unable to record approval request", http.StatusInternalServerError)
+		return
+	}
+	approvalResults.Inc("requested")
+	log.Printf("[registry] approval %s: %s from %s to %s requested (by=%q reason=%q)", a.ID, name, a.From, a.To, strings.Join(a.RequestedBy, ","), reason)
+	events.Publish(eventApprovalRequested, name, withIdentity(requestIdentity(r), map[string]any{"id": a.ID, "from": a.From, "stage": a.To, "reason": reason, "client": clientIP(r)}))
+	writeJSON(w, http.StatusAccepted, a)
+}
+
+// decide records the decision state on a pending request by r's caller.
+// Callers hold s.mu.
+func (s *approvalStore) decide(r *http.Request, a *approvalRequest, state, comment string) error {
+	prev := *a
+	now := time.Now().UTC()
+	a.State, a.DecidedBy, a.DecidedAt, a.Comment = state, requestPrincipals(r), &now, comment
+	if err := s.save(); err != nil {
+		*a = prev
+		return err
+	}
+	approvalResults.Inc(state)
+	log.Printf("[registry] approval %s: %s %s (by=%q comment=%q)", a.ID, a.Model, state, strings.Join(a.DecidedBy, ","), comment)
+	events.Publish(eventApprovalDecided, a.Model, withIdentity(requestIdentity(r), map[string]any{"id": a.ID, "state": state, "stage": a.To, "comment": comment, "client": clientIP(r)}))
+	return nil
+}
+
+// approvalDecision reads the optional {"comment": "..."} body of approve and
+// reject, answering itself for a bad body or an unknown or decided request.
+func approvalDecision(w http.ResponseWriter, r *http.Request) (*approvalRequest, string, bool) {
+	var req struct {
+		Comment string `json:"comment"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, `body must be empty or a JSON object like {"comment": "reviewed eval report"}`, http.StatusBadRequest)
+		return nil, "", false
+	}
+	a := approvals.get(mux.Vars(r)["id"])
+	switch {
+	case a == nil:
+		http.Error(w, "approval not found", http.StatusNotFound)
+		return nil, "", false
+	case a.State != approvalPending:
+		http.Error(w, "approval is "+a.State, http.StatusConflict)
+		return nil, "", false
+	}
+	return a, req.Comment, true
+}
+
+// approveHandler serves POST /approvals/{id}/approve: the promotion happens,
+// provided the caller is identified, isn't the requester and the model is
+// still what was asked for.
+func approveHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := approvals
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		a, comment, ok := approvalDecision(w, r)
+		if !ok {
+			return
+		}
+		approver := requestPrincipals(r)
+		switch {
+		case len(approver) == 0:
+			http.Error(w, "approvals need an API key, bearer token or client certificate to identify the approver", http.StatusForbidden)
+			return
+		case sharesPrincipal(approver, a.RequestedBy):
+			http.Error(w, "a promotion must be approved by someone other than its requester", http.StatusForbidden)
+			return
+		}
+
+		meta, err := sidecars.Get(a.Model)
+		if err != nil {
+			log.Printf("[registry] approval %s: unable to read %s: %v", a.ID, a.Model, err)
+			http.Error(w, "unable to promote model", http.StatusInternalServerError)
+			return
+		}
+		ref, err := parseModelRef(nil, modelDir, a.Model)
+		if err == nil {
+			_, err = statModel(r.Context(), ref)
+		}
+		if err != nil || meta.Sha256 != a.Sha256 || modelStage(meta) != a.From {
+			if err := s.decide(r, a, approvalStale, "model changed since the request"); err != nil {
+				log.Printf("[registry] approval %s: unable to record decision: %v", a.ID, err)
+			}
+			http.Error(w, "the model changed since the promotion was requested; request it again", http.StatusConflict)
+			return
+		}
+
+		promotion := stagePromotion{At: time.Now().UTC(), By: strings.Join(a.RequestedBy, ","), Reason: a.Reason, ApprovedBy: strings.Join(approver, ","), Approval: a.ID}
+		meta, conflict, err := promoteModel(a.Model, a.To, &promotion, false)
+		if err != nil {
+			log.Printf("[registry] unable to promote %s: %v", a.Model, err)
+			http.Error(w, "unable to promote model", http.StatusInternalServerError)
+			return
+		}
+		if conflict != "" {
+			http.Error(w, conflict, http.StatusConflict)
+			return
+		}
+		if err := s.decide(r, a, approvalApproved, comment); err != nil {
+			log.Printf("[registry] approval %s: unable to record decision: %v", a.ID, err)
+		}
+		promoted(r, a.Model, promotion)
+		writeJSON(w, http.StatusOK, map[string]any{"approval": a, "model": promoteResponse{Name: a.Model, Stage: meta.Stage, Promotions: meta.Promotions}})
+	}
+}
+
+// rejectHandler serves POST /approvals/{id}/reject; the model stays where it
+// is. Admins may reject any request, and requesters withdraw their own.
+func rejectHandler(w http.ResponseWriter, r *http.Request) {
+	s := approvals
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, comment, ok := approvalDecision(w, r)
+	if !ok {
+		return
+	}
+	if !isAdmin(r) && !sharesPrincipal(requestPrincipals(r), a.RequestedBy) {
+		http.Error(w, "only admins and the requester can reject a promotion", http.StatusForbidden)
+		return
+	}
+	if err := s.decide(r, a, approvalRejected, comment); err != nil {
+		log.Printf("[registry] approval %s: unable to record decision: %v", a.ID, err)
+		http.Error(w, "unable to record decision", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// listApprovalsHandler serves GET /approvals, oldest first, optionally
+// filtered by ?state= and ?model=.
+func listApprovalsHandler(w http.ResponseWriter, r *http.Request) {
+	state, model := r.URL.Query().Get("state"), r.URL.Query().Get("model")
+	if state != "" && !approvalStates[state] {
+		http.Error(w, "unknown state "+strconv.Quote(state), http.StatusBadRequest)
+		return
+	}
+	s := approvals
+	s.mu.Lock()
+	out := []approvalRequest{}
+	for _, a := range s.requests {
+		if (state == "" || a.State == state) && (model == "" || a.Model == model) {
+			out = append(out, *a)
+		}
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"approvals": out})
+}
+
+// approvalHandler serves GET /approvals/{id}.
+func approvalHandler(w http.ResponseWriter, r *http.Request) {
+	s := approvals
+	s.mu.Lock()
+	a := s.get(mux.Vars(r)["id"])
+	var out approvalRequest
+	if a != nil {
+		out = *a
+	}
+	s.mu.Unlock()
+	if a == nil {
+		http.Error(w, "approval not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/metadata"
+)
+
+// Attack telemetry. With MODEL_REGISTRY_ATTACKS on, requests that look like
+// the lab's attacks are recorded as attack events in .registry/attacks.jsonl:
+// path traversal attempts, bursts of failed authentication, a caller pulling
+// an abnormal volume of model bytes, and honeypot downloads. Each event says
+// whether the attack worked. Events are scored per team, the client address
+// or the value of MODEL_REGISTRY_ATTACK_TEAM_HEADER, and GET /score serves
+// the scores to the lab scoreboard. The file is replayed at startup, so
+// scores survive a restart until DELETE /attacks starts a new round.
+
+// Attack kinds.
+const (
+	attackTraversal  = "path_traversal"
+	attackBruteForce = "credential_brute_force"
+	attackVolume     = "download_volume"
+	attackHoneypot   = "honeypot"
+)
+
+const (
+	defaultAttackAuthFailures = 10
+	defaultAttackAuthWindow   = time.Minute
+	defaultAttackVolume       = 1 << 30
+	defaultAttackVolumeWindow = 10 * time.Minute
+
+	defaultAttackLimit = 100
+	maxAttackLimit     = 1000
+
+	scoreRouteName        = "score"
+	scoreboardTokenHeader = "X-Scoreboard-Token"
+)
+
+// attackPoints is what a team scores for the first attempt and the first
+// success of each kind; repeats add nothing.
+var attackPoints = map[string]attackScore{
+	attackTraversal:  {Attempt: 10, Success: 100},
+	attackBruteForce: {Attempt: 10, Success: 50},
+	attackVolume:     {Success: 50},
+	attackHoneypot:   {Success: 25},
+}
+
+type attackScore struct {
+	Attempt int `json:"attempt"`
+	Success int `json:"success"`
+}
+
+// teamPattern is what a team header value must look like; others fall
+// back to the client address.
+var teamPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,64}$`)
+
+// attacks records attack events; nil when MODEL_REGISTRY_ATTACKS is off.
+var attacks *attackLog
+
+// scoreboardToken lets the scoreboard read /score and verify flags without
+// admin credentials; MODEL_REGISTRY_SCOREBOARD_TOKEN.
+var scoreboardToken string
+
+// attackEvent is one detected attack.
+type attackEvent struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"kind"`
+	Team       string    `json:"team"`
+	Client     string    `json:"client"`
+	Principals []string  `json:"principals,omitempty"`
+	Success    bool      `json:"success"`
+	Model      string    `json:"model,omitempty"`
+	Detail     string    `json:"detail"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// attackConfig holds the detection thresholds.
+type attackConfig struct {
+	authFailures int           // failed authentications from one client...
+	authWindow   time.Duration // ...within this long are brute force
+	volume       int64         // model bytes to one team...
+	volumeWindow time.Duration // ...within this long are abnormal
+	teamHeader   string
+}
+
+// achievement is a team's record for one attack kind.
+type achievement struct {
+	Kind         string     `json:"kind"`
+	Attempts     int        `json:"attempts"`
+	Successes    int        `json:"successes"`
+	First        time.Time  `json:"first"`
+	FirstSuccess *time.Time `json:"first_success,omitempty"`
+	Points       int        `json:"points"`
+}
+
+// teamScore is one team in GET /score.
+type teamScore struct {
+	Team         string         `json:"team"`
+	Score        int            `json:"score"`
+	Achievements []*achievement `json:"achievements"`
+}
+
+// attackWindow counts toward a threshold within a fixed window.
+type attackWindow struct {
+	start    time.Time
+	count    int64
+	reported bool
+}
+
+// add counts n at now, starting a new window once every has passed, and
+// reports whether the count just reached limit.
+func (w *attackWindow) add(now time.Time, n, limit int64, every time.Duration) bool {
+	if now.Sub(w.start) > every {
+		*w = attackWindow{start: now}
+	}
+	w.count += n
+	if w.count >= limit && !w.reported {
+		w.reported = true
+		return true
+	}
+	return false
+}
+
+// attackLog appends attack events to a JSON lines file and keeps the
+// scores in memory.
+type attackLog struct {
+	cfg  attackConfig
+	path string
+
+	mu       sync.Mutex
+	f        *os.File
+	nextID   int64
+	teams    map[string]map[string]*achievement // team, kind
+	failures map[string]*attackWindow           // by client
+	volume   map[string]*attackWindow           // by team
+}
+
+func newAttackLog(modelDir string, cfg attackConfig) (*attackLog, error) {
+	path := filepath.Join(modelDir, stateDirName, "attacks.jsonl")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	a := &attackLog{cfg: cfg, path: path, teams: map[string]map[string]*achievement{},
+		failures: map[string]*attackWindow{}, volume: map[string]*attackWindow{}}
+	if err := a.replay(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	a.f = f
+	return a, nil
+}
+
+// replay scores the events already in the file.
+func (a *attackLog) replay() error {
+	file, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		var ev attackEvent
+		if json.Unmarshal(sc.Bytes(), &ev) != nil {
+			continue
+		}
+		a.score(ev)
+		a.nextID = max(a.nextID, ev.ID)
+	}
+	return sc.Err()
+}
+
+// score adds ev to its team's achievements. Callers hold a.mu.
+func (a *attackLog) score(ev attackEvent) {
+	kinds := a.teams[ev.Team]
+	if kinds == nil {
+		kinds = map[string]*achievement{}
+		a.teams[ev.Team] = kinds
+	}
+	ach := kinds[ev.Kind]
+	if ach == nil {
+		ach = &achievement{Kind: ev.Kind, First: ev.Time}
+		kinds[ev.Kind] = ach
+	}
+	ach.Attempts++
+	if ev.Success {
+		if ach.Successes == 0 {
+			t := ev.Time
+			ach.FirstSuccess = &t
+		}
+		ach.Successes++
+	}
+	pts := attackPoints[ev.Kind]
+	ach.Points = pts.Attempt
+	if ach.Successes > 0 {
+		ach.Points += pts.Success
+	}
+}
+
+// Record stores and scores ev, then logs and publishes it.
+func (a *attackLog) Record(ev attackEvent) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.nextID++
+	ev.ID, ev.Time = a.nextID, time.Now().UTC()
+	a.score(ev)
+	if line, err := json.Marshal(ev); err == nil {
+		if _, err := a.f.Write(append(line, '\n')); err != nil {
+			log.Printf("[registry] unable to write attack event %d: %v", ev.ID, err)
+		}
+	}
+	a.mu.Unlock()
+
+	log.Printf("[registry] ATTACK %s by team %s from %s success=%t: %s", ev.Kind, ev.Team, ev.Client, ev.Success, ev.Detail)
+	events.Publish(eventAttack, ev.Model, map[string]any{
+		"id": ev.ID, "kind": ev.Kind, "team": ev.Team, "client": ev.Client, "success": ev.Success, "detail": ev.Detail,
+	})
+}
+
+// Observe looks at an HTTP request once it has been answered with status
+// and n bytes.
+func (a *attackLog) Observe(r *http.Request, route *mux.Route, status int, n int64) {
+	if a == nil || isProbe(r) || r.Method == http.MethodOptions {
+		return
+	}
+	ev := a.requestEvent(r)
+
+	if name, ok := strings.CutPrefix(r.URL.Path, "/models/"); ok && slices.Contains(strings.Split(name, "/"), "..") {
+		ev.Kind, ev.Success = attackTraversal, status == http.StatusOK || status == http.StatusPartialContent
+		ev.Detail = fmt.Sprintf("%s %s answered %d", r.Method, r.URL.Path, status)
+		a.Record(ev)
+	}
+
+	now := time.Now()
+	authed := len(ev.Principals) > 0 || adminTokenMatches(requestAdminToken(r))
+	var bruteForce, cracked bool
+	a.mu.Lock()
+	w := a.failures[ev.Client]
+	switch {
+	case status == http.StatusUnauthorized:
+		if w == nil {
+			w = &attackWindow{}
+			a.failures[ev.Client] = w
+		}
+		bruteForce = w.add(now, 1, int64(a.cfg.authFailures), a.cfg.authWindow)
+	case w == nil:
+	case now.Sub(w.start) > 2*a.cfg.authWindow:
+		// Too long after the burst for a success to be its doing.
+		delete(a.failures, ev.Client)
+	case w.reported && status < 400 && authed:
+		cracked = true
+		delete(a.failures, ev.Client)
+	}
+	a.mu.Unlock()
+	if bruteForce {
+		ev.Kind, ev.Success = attackBruteForce, false
+		ev.Detail = fmt.Sprintf("%d failed authentications within %s", a.cfg.authFailures, a.cfg.authWindow)
+		a.Record(ev)
+	}
+	if cracked {
+		ev.Kind, ev.Success = attackBruteForce, true
+		ev.Detail = "authenticated after a burst of failed attempts"
+		if len(ev.Principals) > 0 {
+			ev.Detail = "authenticated as " + strings.Join(ev.Principals, ",") + " after a burst of failed attempts"
+		}
+		a.Record(ev)
+	}
+
+	if route != nil && route.GetName() == downloadRouteName && status < 400 {
+		a.Downloaded(ev, strings.TrimPrefix(r.URL.Path, "/models/"), n)
+	}
+}
+
+// Downloaded counts n model bytes sent to ev's team.
+func (a *attackLog) Downloaded(ev attackEvent, model string, n int64) {
+	if a == nil || a.cfg.volume <= 0 {
+		return
+	}
+	a.mu.Lock()
+	w := a.volume[ev.Team]
+	if w == nil {
+		w = &attackWindow{}
+		a.volume[ev.Team] = w
+	}
+	hit := w.add(time.Now(), n, a.cfg.volume, a.cfg.volumeWindow)
+	a.mu.Unlock()
+	if hit {
+		ev.Kind, ev.Success, ev.Model = attackVolume, true, model
+		ev.Detail = fmt.Sprintf("%d or more model bytes within %s, last %s", a.cfg.volume, a.cfg.volumeWindow, model)
+		a.Record(ev)
+	}
+}
+
+// team names r's team: the team header if set and well-formed, else the
+// client address.
+func (a *attackLog) team(r *http.Request) string {
+	if a.cfg.teamHeader != "" {
+		if v := r.Header.Get(a.cfg.teamHeader); teamPattern.MatchString(v) {
+			return v
+		}
+	}
+	return clientIP(r)
+}
+
+// grpcTeam is team for a gRPC call, whose metadata may carry the header.
+func (a *attackLog) grpcTeam(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok && a.cfg.teamHeader != "" {
+		if v := md.Get(a.cfg.teamHeader); len(v) > 0 && teamPattern.MatchString(v[0]) {
+			return v[0]
+		}
+	}
+	return grpcClient(ctx)
+}
+
+// requestEvent starts an attack event for r.
+func (a *attackLog) requestEvent(r *http.Request) attackEvent {
+	return attackEvent{Team: a.team(r), Client: clientIP(r), Principals: requestPrincipals(r), RequestID: requestID(r.Context())}
+}
+
+// grpcEvent starts an attack event for a gRPC call.
+func (a *attackLog) grpcEvent(ctx context.Context) attackEvent {
+	return attackEvent{Team: a.grpcTeam(ctx), Client: grpcClient(ctx), Principals: grpcPrincipals(ctx), RequestID: requestID(ctx)}
+}
+
+// Scores returns every team, highest score first.
+func (a *attackLog) Scores() []teamScore {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := []teamScore{}
+	for team, kinds := range a.teams {
+		ts := teamScore{Team: team, Achievements: []*achievement{}}
+		for _, ach := range kinds {
+			c := *ach
+			ts.Achievements = append(ts.Achievements, &c)
+			ts.Score += ach.Points
+		}
+		sort.Slice(ts.Achievements, func(i, j int) bool { return ts.Achievements[i].Kind < ts.Achievements[j].Kind })
+		out = append(out, ts)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		return out[i].Team < out[j].Team
+	})
+	return out
+}
+
+// Reset empties the file and the scores.
+func (a *attackLog) Reset() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.f.Truncate(0); err != nil {
+		return err
+	}
+	a.teams = map[string]map[string]*achievement{}
+	a.failures = map[string]*attackWindow{}
+	a.volume = map[string]*attackWindow{}
+	return nil
+}
+
+// Query returns the newest limit events of kind and team (either may be
+// empty), newest first, and how many matched in all.
+func (a *attackLog) Query(kind, team string, limit int) ([]attackEvent, int, error) {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	var matched []attackEvent
+	total := 0
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		var ev attackEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil || (kind != "" && ev.Kind != kind) || (team != "" && ev.Team != team) {
+			continue
+		}
+		total++
+		if matched = append(matched, ev); len(matched) > limit {
+			matched = matched[1:]
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, 0, err
+	}
+	slices.Reverse(matched)
+	return matched, total, nil
+}
+
+// attacksResponse is the body of GET /attacks.
+type attacksResponse struct {
+	Attacks []attackEvent `json:"attacks"`
+	Total   int           `json:"total"`
+}
+
+// scoreResponse is the body of GET /score.
+type scoreResponse struct {
+	Teams  []teamScore            `json:"teams"`
+	Points map[string]attackScore `json:"points"`
+	Time   string                 `json:"time"`
+}
+
+// attacksHandler serves GET /attacks: ?kind=, ?team= and ?limit=.
+func attacksHandler(w http.ResponseWriter, r *http.Request) {
+	if attacks == nil {
+		http.Error(w, "attack telemetry is off (MODEL_REGISTRY_ATTACKS)", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	kind := q.Get("kind")
+	if _, ok := attackPoints[kind]; kind != "" && !ok {
+		http.Error(w, fmt.Sprintf("unknown kind %q", kind), http.StatusBadRequest)
+		return
+	}
+	limit := defaultAttackLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAttackLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxAttackLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	evs, total, err := attacks.Query(kind, q.Get("team"), limit)
+	if err != nil {
+		log.Printf("[registry] unable to read attack events: %v", err)
+		http.Error(w, "unable to read attack events", http.StatusInternalServerError)
+		return
+	}
+	if evs == nil {
+		evs = []attackEvent{}
+	}
+	writeJSON(w, http.StatusOK, attacksResponse{Attacks: evs, Total: total})
+}
+
+// resetAttacksHandler serves DELETE /attacks, which starts a new round.
+func resetAttacksHandler(w http.ResponseWriter, r *http.Request) {
+	if attacks == nil {
+		http.Error(w, "attack telemetry is off (MODEL_REGISTRY_ATTACKS)", http.StatusNotFound)
+		return
+	}
+	if err := attacks.Reset(); err != nil {
+		log.Printf("[registry] unable to reset attack events: %v", err)
+		http.Error(w, "unable to reset attack events", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[registry] attack events and scores reset by %s", clientIP(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scoreHandler serves GET /score.
+func scoreHandler(w http.ResponseWriter, r *http.Request) {
+	if attacks == nil {
+		http.Error(w, "attack telemetry is off (MODEL_REGISTRY_ATTACKS)", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, scoreResponse{Teams: attacks.Scores(), Points: attackPoints, Time: time.Now().UTC().Format(time.RFC3339)})
+}
+
+// scoreboardTokenMatches reports whether r carries the scoreboard token.
+func scoreboardTokenMatches(r *http.Request) bool {
+	got := r.Header.Get(scoreboardTokenHeader)
+	return scoreboardToken != "" && subtle.ConstantTimeCompare([]byte(got), []byte(scoreboardToken)) == 1
+}
+
+// scoreboardRequest reports whether r is the scoreboard calling one of its
+// routes, which it may do without other credentials.
+func scoreboardRequest(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil || (route.GetName() != scoreRouteName && route.GetName() != flagVerifyRouteName) {
+		return false
+	}
+	return scoreboardTokenMatches(r)
+}
+
+// requireScoreboard lets the scoreboard through, and admins.
+func requireScoreboard(next http.HandlerFunc) http.HandlerFunc {
+	admin := requireAdmin(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if scoreboardTokenMatches(r) {
+			next(w, r)
+			return
+		}
+		admin(w, r)
+	}
+}
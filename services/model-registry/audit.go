@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The download audit log. Every model pull (HTTP, gRPC and OCI blob) is
+// appended to .registry/audit.jsonl when it ends, whether or not it
+// completed: who pulled it (client address, certificate identity, API key,
+// token subject), what (model or blob digest and byte range), when, how much
+// was sent and the result. Records are never rewritten; GET /audit filters
+// them for admins. Unlike events and webhooks, the log survives restarts
+// and doesn't depend on a subscriber being around.
+
+const (
+	// Download results.
+	auditComplete   = "complete"
+	auditIncomplete = "incomplete"
+
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// audit is the audit log; nil when MODEL_REGISTRY_AUDIT is off.
+var audit *auditLog
+
+// auditRecord is one pull.
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Protocol   string    `json:"protocol"` // http, grpc or oci
+	Model      string    `json:"model,omitempty"`
+	Digest     string    `json:"digest,omitempty"` // OCI blob pulls
+	Client     string    `json:"client"`
+	Identity   string    `json:"identity,omitempty"`
+	Key        string    `json:"key,omitempty"`
+	Subject    string    `json:"sub,omitempty"`
+	Offset     int64     `json:"offset"`
+	Length     int64     `json:"length"`
+	Bytes      int64     `json:"bytes"`
+	Result     string    `json:"result"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// principals are the record's caller as ACL principals.
+func (rec *auditRecord) principals() []string {
+	var claims *jwtClaims
+	if rec.Subject != "" {
+		claims = &jwtClaims{Subject: rec.Subject}
+	}
+	return principalsOf(rec.Identity, claims, rec.Key)
+}
+
+// auditLog appends records to a JSON lines file.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func newAuditLog(modelDir string) (*auditLog, error) {
+	path := filepath.Join(modelDir, stateDirName, "audit.jsonl")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path, f: f}, nil
+}
+
+// Record appends rec, synced to disk so a crash loses no pull.
+func (a *auditLog) Record(rec auditRecord) {
+	if a == nil {
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(append(line, '\n')); err != nil {
+		log.Printf("[registry] unable to write audit record for %s%s: %v", rec.Model, rec.Digest, err)
+		return
+	}
+	a.f.Sync()
+}
+
+// auditCaller fills rec's caller fields from ctx and the credentials of a
+// request.
+func auditCaller(rec *auditRecord, ctx context.Context, client, identity string, claims *jwtClaims, key string) {
+	rec.RequestID = requestID(ctx)
+	rec.Client, rec.Identity = client, identity
+	if claims != nil {
+		rec.Subject = claims.Subject
+	}
+	if name, _, ok := apiKeys.Lookup(key); ok {
+		rec.Key = name
+	}
+}
+
+// recordHTTPPull audits a pull served to r.
+func recordHTTPPull(r *http.Request, protocol, model, digest string, rng byteRange, n int64, complete bool, start time.Time) {
+	if audit == nil {
+		return
+	}
+	rec := auditRecord{Protocol: protocol, Model: model, Digest: digest, Offset: rng.Start, Length: rng.Length, Bytes: n}
+	auditCaller(&rec, r.Context(), clientIP(r), requestIdentity(r), requestClaims(r), requestAPIKey(r))
+	audit.Record(finishAudit(rec, complete, start))
+}
+
+// recordGRPCPull audits a gRPC pull.
+func recordGRPCPull(ctx context.Context, model string, offset, length, n int64, complete bool, start time.Time) {
+	if audit == nil {
+		return
+	}
+	rec := auditRecord{Protocol: "grpc", Model: model, Offset: offset, Length: length, Bytes: n}
+	auditCaller(&rec, ctx, grpcClient(ctx), grpcIdentity(ctx), grpcClaims(ctx), grpcAPIKey(ctx))
+	audit.Record(finishAudit(rec, complete, start))
+}
+
+func finishAudit(rec auditRecord, complete bool, start time.Time) auditRecord {
+	rec.Time = time.Now().UTC()
+	rec.DurationMS = time.Since(start).Milliseconds()
+	rec.Result = auditIncomplete
+	if complete {
+		rec.Result = auditComplete
+	}
+	return rec
+}
+
+// auditFilter selects records for GET /audit.
+type auditFilter struct {
+	model     string // exact name, or base name covering every version
+	digest    string
+	client    string
+	principal string // key:, sub: or cert: as in ACLs
+	result    string
+	protocol  string
+	since     time.Time
+	until     time.Time
+}
+
+func (f auditFilter) match(rec *auditRecord) bool {
+	if f.model != "" && rec.Model != f.model && strings.SplitN(rec.Model, "@", 2)[0] != f.model {
+		return false
+	}
+	if f.principal != "" && !slices.Contains(rec.principals(), f.principal) {
+		return false
+	}
+	return (f.digest == "" || rec.Digest == f.digest) &&
+		(f.client == "" || rec.Client == f.client) &&
+		(f.result == "" || rec.Result == f.result) &&
+		(f.protocol == "" || rec.Protocol == f.protocol) &&
+		(f.since.IsZero() || !rec.Time.Before(f.since)) &&
+		(f.until.IsZero() || rec.Time.Before(f.until))
+}
+
+// Query returns the newest limit records matching f, newest first, and how
+// many matched in all. Appends aren't blocked meanwhile; a line still being
+// written fails to parse and is skipped.
+func (a *auditLog) Query(f auditFilter, limit int) ([]auditRecord, int, error) {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	var matched []auditRecord
+	total := 0
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil || !f.match(&rec) {
+			continue
+		}
+		total++
+		// Only the newest limit records are kept while scanning.
+		if matched = append(matched, rec); len(matched) > limit {
+			matched = matched[1:]
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, 0, err
+	}
+	slices.Reverse(matched)
+	return matched, total, nil
+}
+
+// auditResponse is the body of GET /audit.
+type auditResponse struct {
+	Records []auditRecord `json:"records"`
+	Total   int           `json:"total"`
+}
+
+// parseAuditFilter reads the query of GET /audit.
+func parseAuditFilter(r *http.Request) (auditFilter, int, error) {
+	q := r.URL.Query()
+	f := auditFilter{
+		model:     q.Get("model"),
+		digest:    q.Get("digest"),
+		client:    q.Get("client"),
+		principal: q.Get("principal"),
+		result:    q.Get("result"),
+		protocol:  q.Get("protocol"),
+	}
+	if f.principal != "" {
+		if err := validatePrincipal(f.principal); err != nil {
+			return f, 0, err
+		}
+	}
+	switch f.result {
+	case "", auditComplete, auditIncomplete:
+	default:
+		return f, 0, fmt.Errorf("result must be %s or %s", auditComplete, auditIncomplete)
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &f.since}, {"until", &f.until}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, 0, fmt.Errorf("%s must be an RFC 3339 time", p.name)
+			}
+			*p.dst = t
+		}
+	}
+	limit := defaultAuditLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return f, 0, fmt.Errorf("limit must be a positive integer")
+		}
+		limit = min(n, maxAuditLimit)
+	}
+	return f, limit, nil
+}
+
+// auditHandler serves GET /audit.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if audit == nil {
+		http.Error(w, "the audit log is disabled", http.StatusNotFound)
+		return
+	}
+	f, limit, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	records, total, err := audit.Query(f, limit)
+	if err != nil {
+		log.Printf("[registry] unable to read the audit log: %v", err)
+		http.Error(w, "unable to read the audit log", http.StatusInternalServerError)
+		return
+	}
+	if records == nil {
+		records = []auditRecord{}
+	}
+	writeJSON(w, http.StatusOK, auditResponse{Records: records, Total: total})
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Azure Blob Storage driver.
+//
+// With STORAGE_DRIVER=azure the models of the primary backend are block
+// blobs in one container. Uploads larger than a block are staged block by
+// block and committed with a block list. Requests are authorized with the
+// account's Shared Key, or carry a SAS token instead.
+const (
+	azureAPIVersion       = "2021-08-06"
+	defaultAzureBlockSize = 64 << 20
+	maxAzureBlockSize     = 4000 << 20
+	maxAzureBlocks        = 50000
+)
+
+// azureContainer is a Storage talking to one container over the Blob REST API.
+type azureContainer struct {
+	endpoint  *url.URL // account URL; its path is part of every blob's
+	account   string
+	name      string
+	prefix    string // blob name prefix models live under, "" or ending in "/"
+	key       []byte // decoded Shared Key, nil with a SAS token
+	sas       url.Values
+	blockSize int64
+	client    *http.Client
+}
+
+func newAzureContainer(endpoint, account, name, prefix string, blockSize int64) (*azureContainer, error) {
+	if account == "" || name == "" {
+		return nil, errors.New("MODEL_REGISTRY_AZURE_ACCOUNT and MODEL_REGISTRY_AZURE_CONTAINER are required")
+	}
+	if endpoint == "" {
+		endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("endpoint %q is not an http(s) URL", endpoint)
+	}
+	if blockSize <= 0 || blockSize > maxAzureBlockSize {
+		return nil, fmt.Errorf("block size %d is outside 1..%d", blockSize, maxAzureBlockSize)
+	}
+	c := &azureContainer{
+		endpoint:  u,
+		account:   account,
+		name:      name,
+		prefix:    objectPrefix(prefix),
+		blockSize: blockSize,
+		client:    &http.Client{Transport: traceTransport(nil)},
+	}
+	if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		if c.sas, err = url.ParseQuery(strings.TrimPrefix(sas, "?")); err != nil {
+			return nil, fmt.Errorf("AZURE_STORAGE_SAS_TOKEN: %v", err)
+		}
+	} else if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		if c.key, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return nil, fmt.Errorf("AZURE_STORAGE_KEY is not base64: %v", err)
+		}
+	} else {
+		return nil, errors.New("set AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN")
+	}
+	return c, nil
+}
+
+// String names the container and prefix for logs.
+func (c *azureContainer) String() string {
+	return "azure://" + c.account + "/" + c.name + "/" + c.prefix
+}
+
+// readAzureError turns a failed response into a storageError; missing blobs
+// become fs.ErrNotExist. HEAD responses have no body, only x-ms-error-code.
+func readAzureError(resp *http.Response, key string) error {
+	e := &storageError{Driver: storageDriverAzure, Status: resp.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(body, e)
+	if e.Code == "" {
+		e.Code = resp.Header.Get("X-Ms-Error-Code")
+	}
+	if resp.StatusCode == http.StatusNotFound && (e.Code == "" || e.Code == "BlobNotFound") {
+		return &fs.PathError{Op: storageDriverAzure, Path: key, Err: fs.ErrNotExist}
+	}
+	return e
+}
+
+// url returns the URL of key (without the prefix) with the given query; an
+// empty key addresses the container itself.
+func (c *azureContainer) url(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(c.endpoint.Path, "/") + "/" + c.name
+	if key != "" {
+		u.Path += "/" + c.prefix + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	for k, v := range c.sas {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return &u
+}
+
+// do authorizes and sends a request for key.
+func (c *azureContainer) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "", body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = c.url(key, query)
+	req.Host = req.URL.Host
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	if c.key != nil {
+		signAzure(req, c.account, c.key, query)
+	}
+	return c.client.Do(req)
+}
+
+func (c *azureContainer) Stat(ctx context.Context, key string) (os.FileInfo, error) {
+	return c.stat(ctx, key)
+}
+
+func (c *azureContainer) stat(ctx context.Context, key string) (*objectInfo, error) {
+	resp, err := c.do(ctx, http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readAzureError(resp, key)
+	}
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &objectInfo{key: key, size: resp.ContentLength, modTime: mtime, etag: resp.Header.Get("ETag")}, nil
+}
+
+// Open looks key up; the blob's reads only succeed while its ETag is
+// unchanged, so a download never mixes two uploads.
+func (c *azureContainer) Open(ctx context.Context, key string) (storageObject, error) {
+	info, err := c.stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &azureObject{c: c, ctx: ctx, info: info}, nil
+}
+
+// azureObject is a blob looked up by Open. It keeps the caller's context,
+// which bounds its reads.
+type azureObject struct {
+	c    *azureContainer
+	ctx  context.Context
+	info *objectInfo
+}
+
+func (o *azureObject) Info() os.FileInfo { return o.info }
+
+// Range streams length bytes from offset with one ranged Get Blob.
+func (o *azureObject) Range(offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	header := http.Header{"X-Ms-Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	if o.info.etag != "" {
+		header.Set("If-Match", o.info.etag)
+	}
+	resp, err := o.c.do(o.ctx, http.MethodGet, o.info.key, nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent && (resp.StatusCode != http.StatusOK || offset != 0) {
+		defer resp.Body.Close()
+		return nil, readAzureError(resp, o.info.key)
+	}
+	return resp.Body, nil
+}
+
+func (o *azureObject) Close() error { return nil }
+
+// Put stores the body with one Put Blob up to the block size, as staged
+// blocks committed by a block list beyond it.
+func (c *azureContainer) Put(ctx context.Context, key string, body *spooledBody) error {
+	defer body.Discard()
+	src, size := body.ReaderAt(), body.Size
+	if size <= c.blockSize {
+		header := http.Header{"X-Ms-Blob-Type": {"BlockBlob"}}
+		resp, err := c.do(ctx, http.MethodPut, key, nil, header, io.NewSectionReader(src, 0, size), size)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			return readAzureError(resp, key)
+		}
+		return nil
+	}
+	return c.putBlocks(ctx, key, src, size)
+}
+
+// azureBlockList is the body of a Put Block List request.
+type azureBlockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Latest  []string `xml:"Latest"`
+}
+
+// putBlocks stages src in blocks of at least the configured block size
+// (larger when the blob wouldn't fit in maxAzureBlocks) and commits them.
+// Blocks of a failed upload are never committed; Azure drops them after a
+// week and the blob keeps its old content meanwhile.
+func (c *azureContainer) putBlocks(ctx context.Context, key string, src io.ReaderAt, size int64) error {
+	blockSize := max(c.blockSize, (size+maxAzureBlocks-1)/maxAzureBlocks)
+	var list azureBlockList
+	for off, n := int64(0), 0; off < size; off, n = off+blockSize, n+1 {
+		length := min(blockSize, size-off)
+		// Block ids must all have the same length within a blob.
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%06d", n)))
+		query := url.Values{"comp": {"block"}, "blockid": {id}}
+		resp, err := c.do(ctx, http.MethodPut, key, query, nil, io.NewSectionReader(src, off, length), length)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			return readAzureError(resp, key)
+		}
+		list.Latest = append(list.Latest, id)
+	}
+
+	body, err := xml.Marshal(list)
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+	header := http.Header{"Content-Type": {"application/xml"}}
+	resp, err := c.do(ctx, http.MethodPut, key, url.Values{"comp": {"blocklist"}}, header, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return readAzureError(resp, key)
+	}
+	return nil
+}
+
+// Delete removes key.
+func (c *azureContainer) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return readAzureError(resp, key)
+	}
+	return nil
+}
+
+// azureListResult is the body of a List Blobs response.
+type azureListResult struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ETag          string `xml:"Etag"`
+			ContentLength int64  `xml:"Content-Length"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// List returns the models in the container like scanModels does for a
+// directory: .gguf blobs under the prefix, including those in virtual
+// directories in recursive mode, skipping hidden path segments, sorted by
+// name.
+func (c *azureContainer) List(ctx context.Context) ([]modelFile, error) {
+	var out []modelFile
+	query := url.Values{"restype": {"container"}, "comp": {"list"}}
+	if c.prefix != "" {
+		query.Set("prefix", c.prefix)
+	}
+	if !recursive {
+		query.Set("delimiter", "/")
+	}
+	for {
+		resp, err := c.do(ctx, http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var page azureListResult
+		if resp.StatusCode != http.StatusOK {
+			err = readAzureError(resp, "")
+		} else {
+			err = xml.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range page.Blobs {
+			name, ok := objectModelName(blob.Name, c.prefix)
+			if !ok {
+				continue
+			}
+			mtime, _ := http.ParseTime(blob.Properties.LastModified)
+			out = append(out, modelFile{Name: name, Info: &objectInfo{key: name, size: blob.Properties.ContentLength, modTime: mtime, etag: blob.Properties.ETag}})
+		}
+		if page.NextMarker == "" {
+			break
+		}
+		query.Set("marker", page.NextMarker)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// signAzure adds a Shared Key Authorization header to req. The standard
+// headers the service signs are taken from req, Content-Length left empty
+// when zero; the date travels in x-ms-date. query is the request's own
+// parameters, before any SAS token is merged in.
+func signAzure(req *http.Request, account string, key []byte, query url.Values) {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	h := req.Header.Get
+	lines := []string{
+		req.Method,
+		h("Content-Encoding"),
+		h("Content-Language"),
+		length,
+		h("Content-MD5"),
+		h("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		h("If-Modified-Since"),
+		h("If-Match"),
+		h("If-None-Match"),
+		h("If-Unmodified-Since"),
+		h("Range"),
+	}
+
+	var msHeaders []string
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			msHeaders = append(msHeaders, k+":"+strings.TrimSpace(strings.Join(v, ",")))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + account + req.URL.EscapedPath()
+	names := make([]string, 0, len(query))
+	for k := range query {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		vals := append([]string(nil), query[k]...)
+		sort.Strings(vals)
+		resource += "\n" + strings.ToLower(k) + ":" + strings.Join(vals, ",")
+	}
+
+	toSign := strings.Join(lines, "\n") + "\n" + strings.Join(msHeaders, "\n") + "\n" + resource
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(toSign))
+	req.Header.Set("Authorization", "SharedKey "+account+":"+base64.StdEncoding.EncodeToString(m.Sum(nil)))
+}
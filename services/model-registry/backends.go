@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Storage backends.
+//
+// MODEL_DIR is the primary backend, named "local". Additional filesystem
+// backends can be mounted with MODEL_REGISTRY_BACKENDS="archive=/mnt/archive".
+// A request picks a backend either with a name prefix in the path
+// (/models/archive:llama.gguf) or with the X-Storage-Backend header; the
+// prefix wins when both are present. Unqualified requests use the primary
+// backend. Because ':' introduces a backend, model names must not contain one.
+const (
+	primaryBackend = "local"
+	backendHeader  = "X-Storage-Backend"
+	backendAll     = "all"
+)
+
+// backends maps backend name to its root directory, including the primary.
+var backends = map[string]string{}
+
+// parseBackends parses "name=dir,name=dir" and adds the primary backend.
+func parseBackends(spec, modelDir string) (map[string]string, error) {
+	out := map[string]string{primaryBackend: modelDir}
+	for _, item := range splitList(spec) {
+		name, dir, ok := strings.Cut(item, "=")
+		name, dir = strings.TrimSpace(name), strings.TrimSpace(dir)
+		if !ok || name == "" || dir == "" {
+			return nil, fmt.Errorf("entry %q is not name=dir", item)
+		}
+		if name == primaryBackend || name == backendAll || strings.ContainsAny(name, ":/") {
+			return nil, fmt.Errorf("backend name %q is reserved or invalid", name)
+		}
+		out[name] = dir
+	}
+	return out, nil
+}
+
+// modelRef is a model name resolved to the backend that stores it.
+type modelRef struct {
+	Backend string
+	Dir     string // backend root
+	File    string // name relative to Dir
+	Name    string // qualified name; equals File on the primary backend
+	Version string // set for one version of a versioned model; Name then ends in "@<version>"
+}
+
+// Path returns the on-disk location of the model.
+func (m modelRef) Path() string {
+	if m.Version != "" {
+		return filepath.Join(versionsDir(m.Dir, m.File), m.Version+filepath.Ext(m.File))
+	}
+	return filepath.Join(m.Dir, m.File)
+}
+
+// qualifiedName is how a model in backend is named in responses and used as
+// the key for registry state (sidecars, stats).
+func qualifiedName(backend, file string) string {
+	if backend == primaryBackend {
+		return file
+	}
+	return backend + ":" + file
+}
+
+// errUnknownBackend is returned for a backend name that isn't configured.
+type errUnknownBackend string
+
+func (e errUnknownBackend) Error() string {
+	return fmt.Sprintf("unknown storage backend %q", string(e))
+}
+
+// resolveModel splits an optional "backend:" prefix (or the X-Storage-Backend
+// header) off name and locates the backend. modelDir is the primary backend.
+// A name without an "@version" suffix resolves to the model's newest version
+// when it is versioned.
+func resolveModel(r *http.Request, modelDir, name string) (modelRef, error) {
+	ref, err := parseModelRef(r, modelDir, name)
+	if err != nil {
+		return ref, err
+	}
+	return ref.resolveLatest(), nil
+}
+
+// invalidNameError is returned for a name no model can have, such as the
+// registry's own state under .registry; lookups answer it as not found.
+type invalidNameError struct{ error }
+
+// parseModelRef is resolveModel without picking a version for plain names.
+// Names must follow the upload rules (a model extension, no hidden or ".."
+// segments) unless r is a path_traversal download.
+func parseModelRef(r *http.Request, modelDir, name string) (modelRef, error) {
+	return lookupModelRef(r, modelDir, name, traversalRequest(r))
+}
+
+// lookupModelRef is parseModelRef, taking the name as given if asGiven.
+func lookupModelRef(r *http.Request, modelDir, name string, asGiven bool) (modelRef, error) {
+	backend := primaryBackend
+	if r != nil {
+		if h := r.Header.Get(backendHeader); h != "" {
+			backend = h
+		}
+	}
+	if prefix, rest, ok := strings.Cut(name, ":"); ok {
+		backend, name = prefix, rest
+	}
+	name, version, versioned := strings.Cut(name, versionSep)
+	if err := validUploadName(name); err != nil && !asGiven {
+		return modelRef{}, invalidNameError{err}
+	}
+	var ref modelRef
+	if backend == primaryBackend {
+		ref = modelRef{Backend: primaryBackend, Dir: modelDir, File: name, Name: name}
+	} else {
+		dir, ok := backends[backend]
+		if !ok {
+			return modelRef{}, errUnknownBackend(backend)
+		}
+		ref = modelRef{Backend: backend, Dir: dir, File: name, Name: qualifiedName(backend, name)}
+	}
+	if versioned {
+		return ref.withVersion(version)
+	}
+	return ref, nil
+}
+
+// fileRef is the ref for a model found by scanModels in backend.
+func fileRef(backend, dir string, f modelFile) modelRef {
+	ref := modelRef{Backend: backend, Dir: dir, File: f.Name, Name: qualifiedName(backend, f.Name)}
+	if f.Version != "" {
+		ref, _ = ref.withVersion(f.Version)
+	}
+	return ref
+}
+
+// listBackends returns the backends a listing should cover: the one named by
+// ?backend= (or the header), every backend for "all", else the primary.
+func listBackends(r *http.Request, modelDir string) ([]string, error) {
+	backend := r.URL.Query().Get("backend")
+	if backend == "" {
+		backend = r.Header.Get(backendHeader)
+	}
+	return backendScope(backend)
+}
+
+// backendScope returns the backends named by backend: every one for "all",
+// the primary when empty.
+func backendScope(backend string) ([]string, error) {
+	switch backend {
+	case "", primaryBackend:
+		return []string{primaryBackend}, nil
+	case backendAll:
+		names := make([]string, 0, len(backends))
+		for name := range backends {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	if _, ok := backends[backend]; !ok {
+		return nil, errUnknownBackend(backend)
+	}
+	return []string{backend}, nil
+}
+
+// backendDir returns the root directory of backend; modelDir for the primary.
+func backendDir(backend, modelDir string) string {
+	if backend == primaryBackend {
+		return modelDir
+	}
+	return backends[backend]
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Content-addressable blob store.
+//
+// With MODEL_REGISTRY_BLOB_STORE=true every uploaded model is also kept under
+// its SHA-256 as MODEL_DIR/.registry/blobs/sha256/<hex>, a hard link to the
+// named file, and the sidecar's sha256 is the pointer from name to digest.
+// Uploading content the store already has links the name to the existing
+// blob instead of keeping a second copy. GET /blobs/sha256:<hex> pulls by
+// digest, for callers allowed to pull a model with that content; the
+// content is checked against the digest before it is served.
+const blobDigestPrefix = "sha256:"
+
+var blobDigestPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// blobs is the blob store; nil unless MODEL_REGISTRY_BLOB_STORE is set.
+var blobs *blobStore
+
+// blobStore keeps blobs as hard links into the model directory. Link and
+// Release are serialized so a blob isn't dropped while it gains a name.
+type blobStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func newBlobStore(modelDir string) *blobStore {
+	return &blobStore{dir: filepath.Join(modelDir, stateDirName, "blobs", "sha256")}
+}
+
+func (s *blobStore) path(sum string) string {
+	return filepath.Join(s.dir, sum)
+}
+
+// parseBlobDigest accepts "sha256:<hex>" or the bare hex digest.
+func parseBlobDigest(d string) (string, error) {
+	sum := strings.TrimPrefix(d, blobDigestPrefix)
+	if !blobDigestPattern.MatchString(sum) {
+		return "", fmt.Errorf("invalid digest %q (want sha256:<64 hex digits>)", d)
+	}
+	return sum, nil
+}
+
+// Link records the model file at path under sum. If the store already holds
+// a sound copy of that content, path is replaced by a link to it and
+// deduplicated is true; the shared file's mtime is bumped since the content
+// was just published again. A stored copy that no longer matches its digest
+// is replaced by the new file.
+func (s *blobStore) Link(path, sum string) (deduplicated bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return false, err
+	}
+	bp := s.path(sum)
+	if info, err := os.Stat(bp); err == nil {
+		if got, err := digests.SHA256(bp, info); err == nil && got == sum {
+			tmp := filepath.Join(filepath.Dir(path), ".blob-"+filepath.Base(path))
+			os.Remove(tmp)
+			if err := os.Link(bp, tmp); err != nil {
+				return false, err
+			}
+			if err := os.Rename(tmp, path); err != nil {
+				os.Remove(tmp)
+				return false, err
+			}
+			now := time.Now()
+			return true, os.Chtimes(path, now, now)
+		}
+		log.Printf("[registry] blob %s failed verification; replacing it", sum)
+	}
+	tmp := bp + ".tmp"
+	os.Remove(tmp)
+	if err := os.Link(path, tmp); err != nil {
+		return false, err
+	}
+	return false, os.Rename(tmp, bp)
+}
+
+// Release drops the blob for sum once no sidecar points at it any more.
+func (s *blobStore) Release(sum string) {
+	if sum == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sidecars.References(sum) {
+		return
+	}
+	if err := os.Remove(s.path(sum)); err == nil {
+		log.Printf("[registry] released blob %s", sum)
+	} else if !os.IsNotExist(err) {
+		log.Printf("[registry] unable to release blob %s: %v", sum, err)
+	}
+}
+
+// References reports whether any sidecar records sum as its model's digest.
+func (s *sidecarStore) References(sum string) bool {
+	found := false
+	filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".json") {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		var m modelMeta
+		if json.Unmarshal(data, &m) == nil && m.Sha256 == sum {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found
+}
+
+// Referrers returns the models whose sidecars record sum as their digest.
+func (s *sidecarStore) Referrers(sum string) []string {
+	var names []string
+	filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".json") {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		var m modelMeta
+		if json.Unmarshal(data, &m) == nil && m.Sha256 == sum {
+			if rel, err := filepath.Rel(s.dir, strings.TrimSuffix(p, ".json")); err == nil {
+				names = append(names, filepath.ToSlash(rel))
+			}
+		}
+		return nil
+	})
+	return names
+}
+
+// blobServable reports whether r's caller may pull the content sum: some
+// model holding it must be visible to them, unexpired and, unless they are
+// an admin, not quarantined. A digest is no way around a model's checks.
+func blobServable(r *http.Request, modelDir, sum string) bool {
+	allowed := requestModelFilter(r)
+	for _, name := range sidecars.Referrers(sum) {
+		ref, err := parseModelRef(nil, modelDir, name)
+		if err != nil || !allowed(ref.Base()) {
+			continue
+		}
+		info, err := statModel(r.Context(), ref)
+		if err != nil {
+			continue
+		}
+		if _, expired := expiry.Check(ref.Name, info.ModTime()); expired || (isQuarantined(ref.Name, info) && !isAdmin(r)) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// blobHandler streams the blob for {digest}, provided blobServable allows it.
+func blobHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sum, err := parseBlobDigest(mux.Vars(r)["digest"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !blobServable(r, modelDir, sum) {
+			http.Error(w, "blob not found", http.StatusNotFound)
+			return
+		}
+		serveBlob(w, r, blobs.path(sum), sum)
+	}
+}
+
+// serveBlob streams the file at path as the content with digest sum. The
+// file's SHA-256 is checked (from the digest cache while the file is
+// unchanged) before anything is sent, so a file modified on disk is refused
+// rather than served. Blobs are immutable: the digest is the ETag, and a
+// single Range is honored.
+func serveBlob(w http.ResponseWriter, r *http.Request, path, sum string) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "blob not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "unable to open blob", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "unable to stat blob", http.StatusInternalServerError)
+		return
+	}
+	got, err := digests.SHA256(f.Name(), info)
+	if err != nil {
+		http.Error(w, "unable to hash blob", http.StatusInternalServerError)
+		return
+	}
+	if got != sum {
+		log.Printf("[registry] blob %s failed verification: content hashes to %s", sum, got)
+		http.Error(w, "blob content does not match its digest", http.StatusInternalServerError)
+		return
+	}
+
+	if checkNotModified(w, r, `"`+blobDigestPrefix+sum+`"`) {
+		return
+	}
+	size := info.Size()
+	rng := byteRange{Start: 0, Length: size}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set(checksumTrailer, sum)
+	w.Header().Set(ociDigestHeader, blobDigestPrefix+sum)
+	code := http.StatusOK
+	if h := r.Header.Get("Range"); h != "" {
+		br, err := parseRange(h, size)
+		if err == errEmptyRange {
+			writeRangeNotSatisfiable(w, size)
+			return
+		} else if err == nil {
+			rng, code = br, http.StatusPartialContent
+			w.Header().Set("Content-Range", rng.contentRange(size))
+		}
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(rng.Length, 10))
+	w.WriteHeader(code)
+	if r.Method == http.MethodHead {
+		return
+	}
+	start := time.Now()
+	n, err := io.Copy(egress.Writer(r.Context(), w), io.NewSectionReader(f, rng.Start, rng.Length))
+	if err != nil {
+		log.Printf("[registry] blob stream error: %v", err)
+	}
+	recordHTTPPull(r, "oci", "", blobDigestPrefix+sum, rng, n, err == nil && n == rng.Length, start)
+}
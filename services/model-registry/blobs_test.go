@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestBlobHonorsQuarantine(t *testing.T) {
+	dir := newTestRegistry(t)
+	blobs = newBlobStore(dir)
+	t.Cleanup(func() { blobs = nil })
+	content := []byte("GGUF quarantined content")
+	writeTestModel(t, dir, "q.gguf", content)
+	sum := sha256Hex(content)
+	if err := os.MkdirAll(blobs.dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blobs.path(sum), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sidecars.Update("q.gguf", func(m *modelMeta) { m.Sha256 = sum }); err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/blobs/{digest}", blobHandler(dir)).Methods(http.MethodGet)
+	pull := func() int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/blobs/sha256:"+sum, nil))
+		return w.Code
+	}
+	if got := pull(); got != http.StatusOK {
+		t.Fatalf("blob of an available model: status = %d, want 200", got)
+	}
+
+	quarantinePeriod, adminToken = time.Hour, "admin-secret"
+	t.Cleanup(func() { quarantinePeriod, adminToken = 0, "" })
+	if got := pull(); got != http.StatusNotFound {
+		t.Errorf("blob of a quarantined model: status = %d, want 404", got)
+	}
+}
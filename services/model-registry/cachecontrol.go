@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// defaultCacheControl suits versioned model files, which never change
+	// under the same name.
+	defaultCacheControl = "public, max-age=31536000, immutable"
+	// aliasCacheControl applies to mutable alias names such as "latest".
+	aliasCacheControl = "no-cache"
+)
+
+// cacheRule maps a name glob to a Cache-Control value.
+type cacheRule struct {
+	glob  string
+	value string
+}
+
+// cachePolicy picks the Cache-Control header for a model download.
+//
+// Precedence: the first matching per-model override (in configured order),
+// then the built-in alias rule (names containing "latest" get no-cache), then
+// the global default. An empty global default sends no header.
+type cachePolicy struct {
+	global    string
+	overrides []cacheRule
+}
+
+var cacheControl = &cachePolicy{global: defaultCacheControl}
+
+// builtinCacheRules are consulted after configured overrides.
+var builtinCacheRules = []cacheRule{
+	{glob: "*latest*", value: aliasCacheControl},
+}
+
+// parseCacheRules parses "glob=value;glob=value". Entries are separated by
+// ';' because Cache-Control values themselves contain commas.
+func parseCacheRules(spec string) ([]cacheRule, error) {
+	var rules []cacheRule
+	for _, item := range strings.Split(spec, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		glob, value, ok := strings.Cut(item, "=")
+		glob, value = strings.TrimSpace(glob), strings.TrimSpace(value)
+		if !ok || glob == "" {
+			return nil, fmt.Errorf("entry %q is not glob=value", item)
+		}
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("bad glob %q: %v", glob, err)
+		}
+		rules = append(rules, cacheRule{glob: glob, value: value})
+	}
+	return rules, nil
+}
+
+// For returns the Cache-Control value for name. Globs are matched against
+// both the full (possibly nested) name and its base name.
+func (p *cachePolicy) For(name string) string {
+	for _, rules := range [][]cacheRule{p.overrides, builtinCacheRules} {
+		for _, rule := range rules {
+			if ok, _ := path.Match(rule.glob, name); ok {
+				return rule.value
+			}
+			if ok, _ := path.Match(rule.glob, path.Base(name)); ok {
+				return rule.value
+			}
+		}
+	}
+	return p.global
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestCachePolicyFor(t *testing.T) {
+	rules, err := parseCacheRules("llama-*.gguf=public, max-age=60; team/*=private, no-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &cachePolicy{global: defaultCacheControl, overrides: rules}
+
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"llama-7b.gguf", "public, max-age=60"},          // matching rule
+		{"team/sub/llama-7b.gguf", "public, max-age=60"}, // matched by base name
+		{"team/mistral.gguf", "private, no-store"},       // full nested name
+		{"mistral-7b.gguf", defaultCacheControl},         // no rule matches
+		{"mistral-latest.gguf", aliasCacheControl},       // built-in alias rule
+		{"llama-latest.gguf", "public, max-age=60"},      // overrides come first
+	} {
+		if got := p.For(tc.name); got != tc.want {
+			t.Errorf("For(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	if got := (&cachePolicy{}).For("mistral-7b.gguf"); got != "" {
+		t.Errorf("For without a global default = %q, want none", got)
+	}
+}
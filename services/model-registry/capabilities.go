@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// capabilitiesResponse is used by /capabilities
+type capabilitiesResponse struct {
+	Features map[string]bool  `json:"features"`
+	Limits   map[string]int64 `json:"limits"`
+	Formats  []string         `json:"formats"` // from MODEL_EXTS
+	Notice   string           `json:"notice,omitempty"`
+}
+
+// capabilitiesCache holds the rendered /capabilities body and its ETag. The
+// body only depends on configuration, so it is built once and rebuilt only
+// when Invalidate is called after a config change.
+type capabilitiesCache struct {
+	mu   sync.Mutex
+	body []byte
+	etag string
+}
+
+var capabilities = &capabilitiesCache{}
+
+// buildCapabilities describes the features and limits active in this process.
+func buildCapabilities() capabilitiesResponse {
+	return capabilitiesResponse{
+		Features: map[string]bool{
+			"delta":            true,
+			"chunk_index":      true,
+			"select":           true,
+			"shards":           true,
+			"sessions":         true,
+			"checksum_trailer": true,
+			"zstd_models":      compressModels,
+			"quarantine":       quarantinePeriod > 0,
+			"max_model_age":    expiry.maxAge > 0,
+			"rate_limit_ip":    limits().ip != nil,
+			"rate_limit_model": limits().model != nil,
+			"rate_limit_user":  limits().clientLimited(),
+			"admin_auth":       adminToken != "",
+			"api_keys":         apiKeys.Required(),
+			"chaos":            chaos != nil,
+			"download_tokens":  downloadTokens != nil,
+			"verify_all":       true,
+			"origin_tier":      tier != nil,
+			"tls":              tlsEnabled,
+			"mtls":             mtlsEnabled,
+			"rbac":             rolesEnforced(),
+			"jwt":              jwtAuth != nil,
+			"one_time_tokens":  true,
+			"digest":           true,
+			"model_cards":      true,
+			"blob_store":       blobs != nil,
+			"oci":              ociEnabled,
+			"grpc":             grpcEnabled,
+			"hub_mirror":       hub != nil,
+			"upstream_proxy":   upstream != nil,
+			"s3_sync":          s3Syncer != nil,
+			"storage_s3":       storageDriver == storageDriverS3,
+			"storage_azure":    storageDriver == storageDriverAzure,
+			"storage_gcs":      storageDriver == storageDriverGCS,
+			"storage_chunks":   chunkStorage != nil,
+			"manifest":         true,
+			"changes":          true,
+			"promotion":        true,
+			"approvals":        approvals != nil,
+			"provenance":       true,
+			"upload":           !readOnly,
+			"resumable_upload": !readOnly,
+			"read_only":        readOnly,
+			"webhooks":         true,
+			"signed_uploads":   uploadVerifier != nil,
+			"format_check":     validateUploads,
+			"notice":           notice != "",
+			"tracing":          tracing != nil,
+			"audit":            audit != nil,
+			"attack_telemetry": attacks != nil,
+			"ctf_flags":        ctfFlags != nil,
+		},
+		Limits: map[string]int64{
+			"max_shards":                 maxShardCount,
+			"max_streams":                int64(streams.maxTotal),
+			"max_model_streams":          int64(streams.maxPerModel),
+			"max_range_requests":         ranges.max,
+			"checksum_concurrency":       int64(cap(checksumSlots)),
+			"egress_bytes_per_sec":       int64(egress.rate),
+			"stream_bytes_per_sec":       streamLimit,
+			"manifest_hash_budget":       int64(manifestHashBudget),
+			"change_log_size":            int64(catalog.maxLog),
+			"max_upload_size":            maxUploadSize,
+			"quota_bytes":                quotas.limits[primaryBackend],
+			"max_card_size":              maxCardSize,
+			"upload_spool_bytes":         spoolThreshold,
+			"upload_session_ttl_seconds": int64(uploadSessionTTL.Seconds()),
+			"recent_max":                 int64(recent.max),
+			"delta_block_size":           int64(deltaBlockSize),
+			"chunk_avg_size":             chunkAvgSize(),
+			"quarantine_seconds":         int64(quarantinePeriod.Seconds()),
+			"max_model_age_hours":        int64(expiry.maxAge.Hours()),
+		},
+		Formats: modelFormats(),
+		Notice:  notice,
+	}
+}
+
+// modelFormats names the formats of modelExts, e.g. ["gguf", "onnx"].
+func modelFormats() []string {
+	exts := modelExts()
+	formats := make([]string, len(exts))
+	for i, ext := range exts {
+		formats[i] = modelFormat(ext)
+	}
+	return formats
+}
+
+// get returns the cached body and ETag, rendering them on first use.
+func (c *capabilitiesCache) get() ([]byte, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.body == nil {
+		body, _ := json.Marshal(buildCapabilities())
+		sum := sha256.Sum256(body)
+		c.body = append(body, '\n')
+		c.etag = `"caps-` + hex.EncodeToString(sum[:8]) + `"`
+	}
+	return c.body, c.etag
+}
+
+// Invalidate forces the next request to re-render the capabilities.
+func (c *capabilitiesCache) Invalidate() {
+	c.mu.Lock()
+	c.body, c.etag = nil, ""
+	c.mu.Unlock()
+}
+
+// capabilitiesHandler reports what this registry instance supports.
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	body, etag := capabilities.get()
+	if checkNotModified(w, r, etag) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
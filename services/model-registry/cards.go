@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Model cards are Markdown documents attached to a model, stored with the
+// sidecars under MODEL_DIR/.registry/cards/<name>.md. The sidecar keeps a
+// short summary so listings don't have to read every card.
+const (
+	maxCardSize    = 1 << 20
+	cardSummaryLen = 200
+)
+
+// cardResponse is used by PUT /models/{name}/card
+type cardResponse struct {
+	Name    string `json:"name"`
+	Size    int    `json:"size"`
+	Summary string `json:"summary"`
+}
+
+// cards holds the model cards.
+var cards = &cardStore{}
+
+// cardStore reads and writes documents attached to models, one file per
+// name: model cards, and provenance documents.
+type cardStore struct {
+	mu  sync.Mutex
+	dir string
+	ext string
+}
+
+func newCardStore(modelDir string) *cardStore {
+	return &cardStore{dir: filepath.Join(modelDir, stateDirName, "cards"), ext: ".md"}
+}
+
+func (s *cardStore) path(name string) string {
+	return filepath.Join(s.dir, name+s.ext)
+}
+
+// Get returns the card of name, or os.ErrNotExist.
+func (s *cardStore) Get(name string) ([]byte, error) {
+	return os.ReadFile(s.path(name))
+}
+
+// Put replaces the card of name atomically.
+func (s *cardStore) Put(name string, card []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(s.path(name)), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path(name) + ".tmp"
+	if err := os.WriteFile(tmp, card, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(name))
+}
+
+// Delete removes the card of name, if any.
+func (s *cardStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// cardSummary returns the first paragraph of a card's prose: front matter,
+// headings, HTML comments and blank lines are skipped, lines are joined, and
+// the result is cut to cardSummaryLen runes.
+func cardSummary(card []byte) string {
+	lines := strings.Split(strings.ReplaceAll(string(card), "\r\n", "\n"), "\n")
+	if len(lines) > 0 && strings.TrimSpace(lines[0]) == "---" {
+		for i := 1; i < len(lines); i++ {
+			if t := strings.TrimSpace(lines[i]); t == "---" || t == "..." {
+				lines = lines[i+1:]
+				break
+			}
+		}
+	}
+	var para []string
+	inComment := false
+	for _, line := range lines {
+		t := strings.TrimSpace(line)
+		switch {
+		case inComment:
+			inComment = !strings.Contains(t, "-->")
+			continue
+		case strings.HasPrefix(t, "<!--"):
+			inComment = !strings.Contains(t, "-->")
+			continue
+		case t == "" || strings.HasPrefix(t, "#"):
+			if len(para) > 0 {
+				return truncateRunes(strings.Join(para, " "), cardSummaryLen)
+			}
+			continue
+		}
+		para = append(para, t)
+	}
+	return truncateRunes(strings.Join(para, " "), cardSummaryLen)
+}
+
+// truncateRunes shortens s to at most n runes, marking the cut with "…".
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	return strings.TrimSpace(string(r[:n-1])) + "…"
+}
+
+// cardHandler returns the Markdown card of {name}.
+func cardHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := resolveModel(r, modelDir, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		card, err := cards.Get(ref.Name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				http.Error(w, "model has no card", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "unable to read card", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(len(card)))
+		w.Write(card)
+	}
+}
+
+// putCardHandler attaches the Markdown in the body to {name}, replacing any
+// earlier card; an empty body removes it. Versioned models take a card per
+// version, so a plain name must not resolve to one.
+func putCardHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := parseModelRef(r, modelDir, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if latest := ref.resolveLatest(); latest.Version != "" && ref.Version == "" {
+			http.Error(w, errVersionedModel.Error(), http.StatusBadRequest)
+			return
+		}
+		name := ref.Name
+		if info, err := statModel(r.Context(), ref); err != nil || info.IsDir() {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		}
+		card, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCardSize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "card exceeds "+strconv.Itoa(maxCardSize)+" bytes", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "unable to read card", http.StatusBadRequest)
+			return
+		}
+		if !utf8.Valid(card) {
+			http.Error(w, "card must be UTF-8 Markdown", http.StatusBadRequest)
+			return
+		}
+
+		if len(card) == 0 {
+			err = cards.Delete(name)
+		} else {
+			err = cards.Put(name, card)
+		}
+		if err != nil {
+			log.Printf("[registry] unable to store card of %s: %v", name, err)
+			http.Error(w, "unable to store card", http.StatusInternalServerError)
+			return
+		}
+		summary := cardSummary(card)
+		if _, err := sidecars.Update(name, func(m *modelMeta) { m.CardSummary = summary }); err != nil {
+			log.Printf("[registry] card of %s stored but not its summary: %v", name, err)
+		}
+		if len(card) == 0 {
+			log.Printf("[registry] removed card of %s", name)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		log.Printf("[registry] stored card of %s (%d bytes)", name, len(card))
+		writeJSON(w, http.StatusOK, cardResponse{Name: name, Size: len(card), Summary: summary})
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recursive enables nested layouts: models may live in subdirectories of
+// MODEL_DIR and are addressed by their slash separated relative path.
+var recursive bool
+
+// modelFile is one candidate model found while scanning MODEL_DIR.
+type modelFile struct {
+	Name    string // relative, slash separated
+	Path    string // on disk
+	Info    os.FileInfo
+	Version string // newest version, for versioned models
+}
+
+// Key is the name registry state is kept under: Name, plus "@<version>" for
+// versioned models.
+func (f modelFile) Key() string {
+	if f.Version == "" {
+		return f.Name
+	}
+	return f.Name + versionSep + f.Version
+}
+
+// dirGroup is one directory in a group=dir listing.
+type dirGroup struct {
+	Count  int      `json:"count"`
+	Size   int64    `json:"size"`
+	Models []string `json:"models"`
+}
+
+// groupedListResponse is used by /models?group=dir
+type groupedListResponse struct {
+	Groups map[string]*dirGroup `json:"groups"`
+	Total  int                  `json:"total"`
+}
+
+// namePattern is the mux variable used for model names in routes.
+func namePattern() string {
+	if recursive {
+		return "{name:.+}"
+	}
+	return "{name}"
+}
+
+// validateModelDir rejects a MODEL_DIR pointing at a regular file, a common
+// misconfiguration, at boot instead of failing obscurely later. A missing
+// directory is fine here; it is created or required afterwards.
+func validateModelDir(modelDir string) error {
+	if info, err := os.Stat(modelDir); err == nil && !info.IsDir() {
+		return fmt.Errorf("MODEL_DIR %s exists but is not a directory (mode %s)", modelDir, info.Mode())
+	}
+	return nil
+}
+
+// scanModels returns the files in modelDir with any configured model
+// extension, descending into subdirectories in recursive mode, plus the
+// newest version of each versioned model. Hidden entries (including the registry's own state
+// directory) are skipped. Results are sorted by name.
+func scanModels(modelDir string) ([]modelFile, error) {
+	out, err := scanPlainModels(modelDir)
+	if err != nil {
+		return nil, err
+	}
+	versioned, err := scanVersioned(modelDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(versioned) == 0 {
+		return out, nil
+	}
+	plain := make(map[string]bool, len(out))
+	for _, f := range out {
+		plain[f.Name] = true
+	}
+	for _, f := range versioned {
+		if !plain[f.Name] {
+			out = append(out, f)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// scanPlainModels lists the model files stored directly in modelDir.
+func scanPlainModels(modelDir string) ([]modelFile, error) {
+	// The directory was validated at boot, but a remount or a stray mv can
+	// swap it for something else at runtime.
+	info, err := os.Stat(modelDir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("model path %s is no longer a directory (mode %s)", modelDir, info.Mode())
+	}
+
+	var out []modelFile
+	if !recursive {
+		entries, err := os.ReadDir(modelDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() || !isModelFile(e.Name()) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue // removed since ReadDir
+			}
+			out = append(out, modelFile{Name: e.Name(), Path: filepath.Join(modelDir, e.Name()), Info: info})
+		}
+		return out, nil
+	}
+
+	err = filepath.WalkDir(modelDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == modelDir {
+				return err
+			}
+			return nil // unreadable subtree; keep listing the rest
+		}
+		if p != modelDir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !isModelFile(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(modelDir, p)
+		if err != nil {
+			return nil
+		}
+		out = append(out, modelFile{Name: filepath.ToSlash(rel), Path: p, Info: info})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// modelExtensions holds the extensions of servable model files, set from
+// MODEL_EXTS; a reload swaps it.
+var modelExtensions atomic.Pointer[[]string]
+
+// modelExts returns the extensions of servable model files.
+func modelExts() []string {
+	if exts := modelExtensions.Load(); exts != nil {
+		return *exts
+	}
+	return []string{".gguf"}
+}
+
+// parseModelExts parses MODEL_EXTS, a comma separated list of extensions
+// with or without the leading dot, e.g. "gguf,safetensors".
+func parseModelExts(spec string) ([]string, error) {
+	var exts []string
+	for _, ext := range splitList(spec) {
+		ext = "." + strings.TrimPrefix(ext, ".")
+		if len(ext) < 2 || strings.ContainsAny(ext[1:], "./\\ ") {
+			return nil, fmt.Errorf("invalid model extension %q", ext)
+		}
+		if !slices.Contains(exts, ext) {
+			exts = append(exts, ext)
+		}
+	}
+	if len(exts) == 0 {
+		return nil, errors.New("at least one model extension is required")
+	}
+	return exts, nil
+}
+
+// isModelFile reports whether a file name looks like a servable model;
+// only files with one of modelExts are listed to keep the catalog concise.
+func isModelFile(name string) bool {
+	return !strings.HasPrefix(name, ".") && slices.Contains(modelExts(), filepath.Ext(name))
+}
+
+// modelFormat names the format of a model from its extension, e.g. "gguf".
+func modelFormat(name string) string {
+	return strings.TrimPrefix(path.Ext(name), ".")
+}
+
+// groupByDir organizes already-filtered models by their parent directory
+// ("." for the top level) with per-directory counts and sizes.
+func groupByDir(models []modelFile) map[string]*dirGroup {
+	groups := map[string]*dirGroup{}
+	for _, m := range models {
+		dir := path.Dir(m.Name)
+		g, ok := groups[dir]
+		if !ok {
+			g = &dirGroup{Models: []string{}}
+			groups[dir] = g
+		}
+		g.Count++
+		g.Size += m.Info.Size()
+		g.Models = append(g.Models, m.Name)
+	}
+	return groups
+}
+
+// catalogRecord is what the catalog version tracks per model: a change to any
+// field is a new catalog version.
+type catalogRecord struct {
+	Size     int64
+	Modified time.Time
+	Status   string
+}
+
+// catalogTracker numbers successive states of the catalog. Requests that scan
+// the whole registry report what they saw via Observe; the version only moves
+// when that differs from the previous observation, and the differences are
+// appended to a bounded change log for /changes. Versions live in memory and
+// restart from 1 on boot, so anything exposing them also carries bootID.
+type catalogTracker struct {
+	mu      sync.Mutex
+	version uint64
+	records map[string]catalogRecord
+	log     []catalogChange
+	maxLog  int
+	floor   uint64 // oldest version /changes can still answer from
+}
+
+var catalog = newCatalogTracker(defaultChangeLogSize)
+
+func newCatalogTracker(maxLog int) *catalogTracker {
+	if maxLog <= 0 {
+		maxLog = defaultChangeLogSize
+	}
+	return &catalogTracker{version: 1, floor: 1, maxLog: maxLog}
+}
+
+// Observe records the current catalog and returns its version.
+func (t *catalogTracker) Observe(records map[string]catalogRecord) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.records == nil {
+		t.records = records
+		return t.version
+	}
+
+	var diff []catalogChange
+	for name, rec := range records {
+		prev, ok := t.records[name]
+		switch {
+		case !ok:
+			diff = append(diff, catalogChange{Name: name, Change: changeAdded})
+		case prev.Size != rec.Size || !prev.Modified.Equal(rec.Modified) || prev.Status != rec.Status:
+			diff = append(diff, catalogChange{Name: name, Change: changeModified})
+		}
+	}
+	for name := range t.records {
+		if _, ok := records[name]; !ok {
+			diff = append(diff, catalogChange{Name: name, Change: changeRemoved})
+		}
+	}
+	if len(diff) == 0 {
+		return t.version
+	}
+
+	t.version++
+	t.records = records
+	version := catalogVersionString(t.version)
+	for i := range diff {
+		diff[i].version = t.version
+		data := map[string]any{"catalog_version": version}
+		if rec, ok := records[diff[i].Name]; ok {
+			data["size"], data["modified"], data["status"] = rec.Size, rec.Modified, rec.Status
+		}
+		events.Publish(catalogEventTypes[diff[i].Change], diff[i].Name, data)
+	}
+	t.log = append(t.log, diff...)
+	t.trim()
+	return t.version
+}
+
+// catalogScans wakes watchCatalog early; nil unless it runs.
+var catalogScans chan struct{}
+
+// watchCatalog observes the catalog every interval, and soon after
+// rescanCatalog is called, so its changes reach /events without anyone
+// polling /manifest or /changes.
+func watchCatalog(modelDir string, every time.Duration) {
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-timer.C:
+		case <-catalogScans:
+			timer.Stop()
+		}
+		if items, err := scanCatalog(modelDir); err != nil {
+			log.Printf("[registry] unable to scan catalog: %v", err)
+		} else {
+			catalog.Observe(catalogRecords(items))
+		}
+		timer.Reset(every)
+	}
+}
+
+// rescanCatalog asks watchCatalog, if running, to look at the catalog now,
+// after a handler changed it.
+func rescanCatalog() {
+	select {
+	case catalogScans <- struct{}{}:
+	default:
+	}
+}
+
+// catalogVersionHeader carries the catalog version on whole-registry responses.
+const catalogVersionHeader = "X-Catalog-Version"
+
+// catalogVersionString renders v as the opaque "<boot>.<n>" clients echo back.
+func catalogVersionString(v uint64) string {
+	return bootID + "." + strconv.FormatUint(v, 10)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateModelDirRejectsFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "models")
+	if err := os.WriteFile(file, []byte("not a directory"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := validateModelDir(file)
+	if err == nil {
+		t.Fatal("validateModelDir accepted a regular file")
+	}
+	if !strings.Contains(err.Error(), "is not a directory") {
+		t.Errorf("error = %q, want it to say the path is not a directory", err)
+	}
+	if _, err := scanModels(file); err == nil {
+		t.Error("scanModels listed a regular file")
+	}
+
+	for _, ok := range []string{dir, filepath.Join(dir, "missing")} {
+		if err := validateModelDir(ok); err != nil {
+			t.Errorf("validateModelDir(%s) = %v, want nil", ok, err)
+		}
+	}
+}
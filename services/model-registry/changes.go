@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultChangeLogSize is how many per-model changes the catalog keeps.
+const defaultChangeLogSize = 10000
+
+// Kinds of catalog change.
+const (
+	changeAdded    = "added"
+	changeModified = "changed"
+	changeRemoved  = "removed"
+)
+
+// catalogChange is one model's change in one catalog version.
+type catalogChange struct {
+	Name    string `json:"name"`
+	Change  string `json:"change"`
+	Version string `json:"version"` // set when rendering
+	version uint64
+}
+
+// changesResponse is used by /changes
+type changesResponse struct {
+	Version string          `json:"version"`
+	Since   string          `json:"since"`
+	Oldest  string          `json:"oldest"`
+	Resync  bool            `json:"resync"`
+	Changes []catalogChange `json:"changes"`
+}
+
+// trim drops whole versions from the front of the log until it fits, moving
+// the floor past them. The caller must hold t.mu.
+func (t *catalogTracker) trim() {
+	for len(t.log) > t.maxLog {
+		v := t.log[0].version
+		i := 0
+		for i < len(t.log) && t.log[i].version == v {
+			i++
+		}
+		t.log = t.log[i:]
+		t.floor = v
+	}
+}
+
+// Since returns the changes after version since, folded to one entry per
+// model, and false when the log no longer reaches back that far.
+func (t *catalogTracker) Since(since uint64) ([]catalogChange, uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if since < t.floor || since > t.version {
+		return nil, t.floor, false
+	}
+
+	type span struct{ first, last catalogChange }
+	spans := map[string]*span{}
+	for _, c := range t.log {
+		if c.version <= since {
+			continue
+		}
+		if s, ok := spans[c.Name]; ok {
+			s.last = c
+		} else {
+			spans[c.Name] = &span{first: c, last: c}
+		}
+	}
+
+	// Net effect from the client's point of view: a model added and removed
+	// again never existed, one added and then changed is simply added.
+	out := []catalogChange{}
+	for _, s := range spans {
+		c := s.last
+		switch {
+		case s.first.Change == changeAdded && s.last.Change == changeRemoved:
+			continue
+		case s.first.Change == changeAdded:
+			c.Change = changeAdded
+		case s.first.Change == changeRemoved && s.last.Change != changeRemoved:
+			c.Change = changeModified // removed and re-added
+		}
+		c.Version = catalogVersionString(c.version)
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, t.floor, true
+}
+
+// parseCatalogVersion parses a "<boot>.<n>" version. ok is false for a
+// version from another boot of the registry.
+func parseCatalogVersion(s string) (v uint64, ok bool, err error) {
+	boot, n, found := strings.Cut(s, ".")
+	if !found {
+		return 0, false, strconv.ErrSyntax
+	}
+	if v, err = strconv.ParseUint(n, 10, 64); err != nil {
+		return 0, false, err
+	}
+	return v, boot == bootID, nil
+}
+
+// changesHandler reports models added, changed or removed since the catalog
+// version in ?since=. When that version predates the change log (or another
+// boot of the registry) it answers resync=true with no changes, and the
+// client should fetch /manifest and continue from the version returned here.
+func changesHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sinceParam := r.URL.Query().Get("since")
+		if sinceParam == "" {
+			http.Error(w, "since is required", http.StatusBadRequest)
+			return
+		}
+		since, sameBoot, err := parseCatalogVersion(sinceParam)
+		if err != nil {
+			http.Error(w, "since must be a catalog version", http.StatusBadRequest)
+			return
+		}
+
+		items, err := scanCatalog(modelDir)
+		if err != nil {
+			log.Printf("[registry] unable to list models for changes: %v", err)
+			http.Error(w, "unable to list models", http.StatusInternalServerError)
+			return
+		}
+		version := catalog.Observe(catalogRecords(items))
+
+		resp := changesResponse{
+			Version: catalogVersionString(version),
+			Since:   sinceParam,
+			Changes: []catalogChange{},
+		}
+		changes, floor, ok := catalog.Since(since)
+		resp.Oldest = catalogVersionString(floor)
+		if !sameBoot || !ok {
+			resp.Resync = true
+		} else {
+			allowed := requestModelFilter(r)
+			for _, c := range changes {
+				if base, _, _ := strings.Cut(c.Name, versionSep); allowed(base) {
+					resp.Changes = append(resp.Changes, c)
+				}
+			}
+		}
+		w.Header().Set(catalogVersionHeader, resp.Version)
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chaosHeader marks responses that had a fault injected so they can be told
+// apart from genuine failures on the client side too.
+const chaosHeader = "X-Chaos-Injected"
+
+// chaosConfig injects latency and 503s into a fraction of requests so client
+// retry logic can be exercised. A nil config disables chaos mode.
+type chaosConfig struct {
+	rate      float64 // fraction of requests affected
+	minDelay  time.Duration
+	maxDelay  time.Duration
+	errorRate float64 // fraction of affected requests answered with 503
+}
+
+var chaos *chaosConfig
+
+// parseChaos builds a chaos config from its env values. delay is "d" or
+// "min-max" (uniformly distributed). A zero or empty rate returns nil.
+func parseChaos(rate, delay, errorRate string) (*chaosConfig, error) {
+	if rate == "" {
+		return nil, nil
+	}
+	c := &chaosConfig{}
+	var err error
+	if c.rate, err = parseFraction(rate); err != nil {
+		return nil, fmt.Errorf("rate: %v", err)
+	}
+	if c.rate == 0 {
+		return nil, nil
+	}
+	if errorRate != "" {
+		if c.errorRate, err = parseFraction(errorRate); err != nil {
+			return nil, fmt.Errorf("error rate: %v", err)
+		}
+	}
+	if delay != "" {
+		rawMin, rawMax, isRange := strings.Cut(delay, "-")
+		if c.minDelay, err = time.ParseDuration(rawMin); err != nil || c.minDelay < 0 {
+			return nil, fmt.Errorf("delay %q is not a duration or min-max range", delay)
+		}
+		c.maxDelay = c.minDelay
+		if isRange {
+			if c.maxDelay, err = time.ParseDuration(rawMax); err != nil || c.maxDelay < c.minDelay {
+				return nil, fmt.Errorf("delay %q is not a duration or min-max range", delay)
+			}
+		}
+	}
+	if c.maxDelay == 0 && c.errorRate == 0 {
+		return nil, fmt.Errorf("rate is set but neither a delay nor an error rate is configured")
+	}
+	return c, nil
+}
+
+// parseFraction parses a probability in [0, 1].
+func parseFraction(raw string) (float64, error) {
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || f < 0 || f > 1 {
+		return 0, fmt.Errorf("must be a number between 0 and 1, got %q", raw)
+	}
+	return f, nil
+}
+
+// delay draws one injected latency from the configured range.
+func (c *chaosConfig) delay() time.Duration {
+	if c.maxDelay == c.minDelay {
+		return c.minDelay
+	}
+	return c.minDelay + time.Duration(rand.Int63n(int64(c.maxDelay-c.minDelay)+1))
+}
+
+// chaosMiddleware applies chaos mode to every routed request except
+// preflights and liveness probes.
+func chaosMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if chaos == nil || r.Method == http.MethodOptions || isProbe(r) || rand.Float64() >= chaos.rate {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var injected []string
+		if d := chaos.delay(); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+				return
+			}
+			injected = append(injected, "delay="+d.String())
+		}
+		fail := chaos.errorRate > 0 && rand.Float64() < chaos.errorRate
+		if fail {
+			injected = append(injected, "status=503")
+		}
+		if len(injected) > 0 {
+			log.Printf("[registry] chaos: injected fault %s into %s %s", strings.Join(injected, " "), r.Method, r.URL.Path)
+			w.Header().Set(chaosHeader, strings.Join(injected, "; "))
+		}
+		if fail {
+			http.Error(w, "service unavailable (chaos injected)", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
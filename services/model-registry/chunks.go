@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Chunk indexes let a client rebuild a model from whatever file it already
+// holds, zsync-style, when the registry can't build a delta for it: the
+// client's copy was modified, or the version it has is gone from the
+// registry.
+//
+// Index format (integers are big-endian):
+//
+//	header  "MRCHUNK1" | model sha256 (32 bytes) | model size (uint64) | block size (uint32)
+//	block   weak checksum (uint32) | sha256 of the block (32 bytes)
+//
+// Blocks cover the model in order; the last one may be shorter. The weak
+// checksum is the delta encoder's rsync rolling sum (a | b<<16), so a client
+// can roll it over its own file, confirm hits with the block digest, and
+// fetch only the blocks it lacks with Range requests.
+const (
+	chunkIndexMagic       = "MRCHUNK1"
+	chunkIndexContentType = "application/vnd.crash-pay.model-chunks"
+)
+
+// chunksHandler streams the chunk index of {name} at deltaBlockSize. Indexes
+// are cached on disk keyed by the model's digest and the block size.
+func chunksHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := resolveModel(r, modelDir, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p := ref.Path()
+		info, err := os.Stat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		}
+		sum, err := digests.SHA256(p, info)
+		if err != nil {
+			http.Error(w, "unable to hash model", http.StatusInternalServerError)
+			return
+		}
+		bs := deltaBlockSize
+		w.Header().Set("X-Chunk-Block-Size", strconv.Itoa(bs))
+		if checkNotModified(w, r, fmt.Sprintf(`"%s-%d"`, sum, bs)) {
+			return
+		}
+
+		cacheDir := filepath.Join(modelDir, stateDirName, "chunks")
+		cachePath := filepath.Join(cacheDir, fmt.Sprintf("%s-%d.idx", sum, bs))
+		deltaLocks.Lock(cachePath)
+		if _, err := os.Stat(cachePath); os.IsNotExist(err) {
+			if err = buildChunkIndex(cacheDir, cachePath, p, sum, bs); err != nil {
+				deltaLocks.Unlock(cachePath)
+				log.Printf("[registry] chunk index of %s failed: %v", ref.Name, err)
+				http.Error(w, "unable to index model", http.StatusInternalServerError)
+				return
+			}
+		}
+		deltaLocks.Unlock(cachePath)
+
+		f, err := os.Open(cachePath)
+		if err != nil {
+			http.Error(w, "unable to open chunk index", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		idx, err := f.Stat()
+		if err != nil {
+			http.Error(w, "unable to stat chunk index", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", chunkIndexContentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(idx.Size(), 10))
+		w.Header().Set("X-Chunk-Model-Sha256", sum)
+		if r.Method == http.MethodHead {
+			return
+		}
+		if _, err := io.Copy(egress.Writer(r.Context(), w), f); err != nil {
+			log.Printf("[registry] chunk index stream error: %v", err)
+		}
+	}
+}
+
+// buildChunkIndex writes the index of the model at p to a temp file and
+// atomically moves it to dst. It reads the whole model, so it takes a
+// checksum slot.
+func buildChunkIndex(dir, dst, p, sum string, bs int) error {
+	raw, err := hex.DecodeString(sum)
+	if err != nil {
+		return err
+	}
+	checksumSlots <- struct{}{}
+	defer func() { <-checksumSlots }()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	model, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer model.Close()
+	info, err := model.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".chunks-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	out := bufio.NewWriterSize(tmp, 1<<20)
+	out.WriteString(chunkIndexMagic)
+	out.Write(raw)
+	binary.Write(out, binary.BigEndian, uint64(info.Size()))
+	binary.Write(out, binary.BigEndian, uint32(bs))
+	in := bufio.NewReaderSize(model, 1<<20)
+	buf := make([]byte, bs)
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			a, b := weakSum(buf[:n])
+			block := sha256.Sum256(buf[:n])
+			binary.Write(out, binary.BigEndian, a|b<<16)
+			out.Write(block[:])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := out.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chunk-level deduplication.
+//
+// STORAGE_DRIVER=chunks stores each model as content-defined chunks under
+// MODEL_DIR/.registry/cas/sha256, plus a recipe under .registry/recipes
+// listing the chunks in order. Cut points depend on the content around them
+// (a gear rolling hash), not on offsets, so models that share long runs of
+// bytes, such as quantizations of one base that keep some tensors at the same
+// type, share those chunks on disk however the runs are aligned. Reads
+// assemble the chunks back into the model. Every chunk has a reference count:
+// one per occurrence in a recipe, plus pins held by uploads writing it and
+// downloads reading it. The garbage collector only removes chunks whose count
+// is zero.
+const (
+	defaultChunkAvgSize    = 1 << 20
+	defaultChunkGCInterval = time.Hour
+	minChunkAvgSize        = 4 << 10
+)
+
+// chunkStorage is the chunk store when STORAGE_DRIVER=chunks, else nil.
+var chunkStorage *chunkStore
+
+// gearTable drives the rolling hash. It's fixed (splitmix64 from a constant
+// seed) so that the same content is cut the same way across restarts.
+var gearTable = func() (t [256]uint64) {
+	x := uint64(0)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// chunkRecipe is how a model is put back together.
+type chunkRecipe struct {
+	Size     int64      `json:"size"`
+	Sha256   string     `json:"sha256"`
+	Modified time.Time  `json:"modified"`
+	Chunks   []chunkRef `json:"chunks"`
+}
+
+// chunkRef is one chunk of a recipe.
+type chunkRef struct {
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// chunkEntry is a stored chunk's size and reference count.
+type chunkEntry struct {
+	size int64
+	refs int
+}
+
+// chunkStore implements Storage over chunks and recipes. mu guards the
+// reference counts and the recipes, so a recipe and the counts it accounts
+// for always change together.
+type chunkStore struct {
+	mu        sync.Mutex
+	recipes   string // recipe directory
+	dir       string // chunk directory
+	minSize   int
+	avgSize   int
+	maxSize   int
+	threshold uint64 // cut after minSize when the hash is below this
+	entries   map[string]*chunkEntry
+	logical   map[string]int64 // model name -> size
+	lastGC    *chunkGCResult
+}
+
+// chunkGCResult is what one collection removed.
+type chunkGCResult struct {
+	Time    time.Time `json:"time"`
+	Removed int       `json:"removed"`
+	Freed   int64     `json:"freed_bytes"`
+}
+
+// chunkStats is used by GET /admin/chunks
+type chunkStats struct {
+	Models       int            `json:"models"`
+	Chunks       int            `json:"chunks"`
+	LogicalBytes int64          `json:"logical_bytes"`
+	StoredBytes  int64          `json:"stored_bytes"`
+	Ratio        float64        `json:"dedup_ratio"` // logical / stored
+	Unreferenced int            `json:"unreferenced"`
+	Reclaimable  int64          `json:"reclaimable_bytes"`
+	AvgSize      int            `json:"avg_chunk_size"`
+	LastGC       *chunkGCResult `json:"last_gc,omitempty"`
+}
+
+// newChunkStore opens the store in modelDir, counting references from the
+// recipes on disk. Chunk files no recipe references (left by an upload the
+// registry didn't finish) are counted at zero for the next collection.
+func newChunkStore(modelDir string, avgSize int) (*chunkStore, error) {
+	if avgSize < minChunkAvgSize {
+		return nil, fmt.Errorf("average chunk size must be at least %d bytes", minChunkAvgSize)
+	}
+	s := &chunkStore{
+		recipes:   filepath.Join(modelDir, stateDirName, "recipes"),
+		dir:       filepath.Join(modelDir, stateDirName, "cas", "sha256"),
+		minSize:   avgSize / 4,
+		avgSize:   avgSize,
+		maxSize:   avgSize * 4,
+		threshold: math.MaxUint64 / uint64(avgSize-avgSize/4),
+		entries:   map[string]*chunkEntry{},
+		logical:   map[string]int64{},
+	}
+	for _, d := range []string{s.recipes, s.dir} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	err := filepath.WalkDir(s.recipes, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".json") {
+			return err
+		}
+		rel, _ := filepath.Rel(s.recipes, p)
+		name := strings.TrimSuffix(filepath.ToSlash(rel), ".json")
+		rec, err := s.readRecipe(name)
+		if err != nil {
+			log.Printf("[registry] ignoring unreadable chunk recipe %s: %v", p, err)
+			return nil
+		}
+		s.logical[name] = rec.Size
+		for _, c := range rec.Chunks {
+			s.ref(c, 1)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		sum := d.Name()
+		if !blobDigestPattern.MatchString(sum) {
+			os.Remove(p) // a temp file from an interrupted write
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if _, ok := s.entries[sum]; !ok {
+			s.entries[sum] = &chunkEntry{size: info.Size()}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *chunkStore) String() string {
+	return fmt.Sprintf("content-defined chunks under %s (average %d bytes)", filepath.Dir(s.dir), s.avgSize)
+}
+
+func (s *chunkStore) chunkPath(sum string) string {
+	return filepath.Join(s.dir, sum[:2], sum)
+}
+
+func (s *chunkStore) recipePath(name string) string {
+	return filepath.Join(s.recipes, filepath.FromSlash(name)+".json")
+}
+
+func (s *chunkStore) readRecipe(name string) (*chunkRecipe, error) {
+	b, err := os.ReadFile(s.recipePath(name))
+	if err != nil {
+		return nil, err
+	}
+	var rec chunkRecipe
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// ref adds delta references to c; the caller must hold s.mu.
+func (s *chunkStore) ref(c chunkRef, delta int) {
+	e := s.entries[c.Sha256]
+	if e == nil {
+		e = &chunkEntry{size: c.Size}
+		s.entries[c.Sha256] = e
+	}
+	e.refs += delta
+}
+
+// refAll adds delta references to every chunk in cs.
+func (s *chunkStore) refAll(cs []chunkRef, delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range cs {
+		s.ref(c, delta)
+	}
+}
+
+// cut returns the length of the chunk at the start of p: the first point
+// past minSize where the rolling hash drops below the threshold, or maxSize,
+// or all of p when it's shorter (the end of the model).
+func (s *chunkStore) cut(p []byte) int {
+	n := min(len(p), s.maxSize)
+	if n <= s.minSize {
+		return n
+	}
+	var h uint64
+	// The hash only depends on the last 64 bytes, so start just before the
+	// first allowed cut.
+	for i := max(s.minSize-64, 0); i < n; i++ {
+		h = h<<1 + gearTable[p[i]]
+		if i >= s.minSize && h < s.threshold {
+			return i + 1
+		}
+	}
+	return n
+}
+
+func (s *chunkStore) List(ctx context.Context) ([]modelFile, error) {
+	var out []modelFile
+	err := filepath.WalkDir(s.recipes, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != s.recipes && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(s.recipes, p)
+		name, ok := strings.CutSuffix(filepath.ToSlash(rel), ".json")
+		if !ok {
+			return nil
+		}
+		if name, ok = objectModelName(name, ""); !ok {
+			return nil
+		}
+		rec, err := s.readRecipe(name)
+		if err != nil {
+			return nil // replaced or deleted meanwhile
+		}
+		out = append(out, modelFile{Name: name, Info: rec.info(name)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func (r *chunkRecipe) info(name string) *objectInfo {
+	return &objectInfo{key: name, size: r.Size, modTime: r.Modified, etag: r.Sha256}
+}
+
+func (s *chunkStore) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	rec, err := s.readRecipe(name)
+	if err != nil {
+		return nil, err
+	}
+	return rec.info(name), nil
+}
+
+// Open pins the recipe's chunks until Close, so a model replaced or deleted
+// mid-download keeps its chunks until the download is done.
+func (s *chunkStore) Open(ctx context.Context, name string) (storageObject, error) {
+	s.mu.Lock()
+	rec, err := s.readRecipe(name)
+	if err == nil {
+		for _, c := range rec.Chunks {
+			s.ref(c, 1)
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	o := &chunkObject{s: s, rec: rec, info: rec.info(name), offsets: make([]int64, len(rec.Chunks)+1)}
+	for i, c := range rec.Chunks {
+		o.offsets[i+1] = o.offsets[i] + c.Size
+	}
+	return o, nil
+}
+
+// Put cuts the body into chunks, writes the ones not stored yet and then
+// swaps in the new recipe, releasing the chunks of the one it replaces.
+func (s *chunkStore) Put(ctx context.Context, name string, body *spooledBody) error {
+	defer body.Discard()
+	var chunks []chunkRef
+	release := func() { s.refAll(chunks, -1) }
+
+	src := io.NewSectionReader(body.ReaderAt(), 0, body.Size)
+	buf := make([]byte, s.maxSize)
+	filled := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			release()
+			return err
+		}
+		n, err := io.ReadFull(src, buf[filled:])
+		filled += n
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			release()
+			return err
+		}
+		if filled == 0 {
+			break
+		}
+		size := s.cut(buf[:filled])
+		data := buf[:size]
+		sum := sha256.Sum256(data)
+		c := chunkRef{Sha256: hex.EncodeToString(sum[:]), Size: int64(size)}
+		s.refAll([]chunkRef{c}, 1)
+		chunks = append(chunks, c)
+		if err := s.writeChunk(c.Sha256, data); err != nil {
+			release()
+			return err
+		}
+		filled = copy(buf, buf[size:filled])
+	}
+
+	rec := chunkRecipe{Size: body.Size, Sha256: body.Sha256, Modified: time.Now().UTC(), Chunks: chunks}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		release()
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, _ := s.readRecipe(name)
+	if err := s.writeRecipe(name, b); err != nil {
+		for _, c := range chunks {
+			s.ref(c, -1)
+		}
+		return err
+	}
+	if old != nil {
+		for _, c := range old.Chunks {
+			s.ref(c, -1)
+		}
+	}
+	s.logical[name] = rec.Size
+	return nil
+}
+
+// writeChunk stores data as sum unless it's already there. Concurrent
+// writers of one chunk write the same bytes, so the last rename wins
+// harmlessly.
+func (s *chunkStore) writeChunk(sum string, data []byte) error {
+	p := s.chunkPath(sum)
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".chunk-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// writeRecipe atomically replaces the recipe of name; the caller must hold
+// s.mu.
+func (s *chunkStore) writeRecipe(name string, b []byte) error {
+	p := s.recipePath(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// Delete removes the recipe; its chunks lose a reference and are left to
+// the collector.
+func (s *chunkStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, err := s.readRecipe(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(s.recipePath(name)); err != nil {
+		return err
+	}
+	for _, c := range rec.Chunks {
+		s.ref(c, -1)
+	}
+	delete(s.logical, name)
+	return nil
+}
+
+// GC removes every chunk nothing references.
+func (s *chunkStore) GC() chunkGCResult {
+	res := chunkGCResult{Time: time.Now().UTC()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sum, e := range s.entries {
+		if e.refs > 0 {
+			continue
+		}
+		if err := os.Remove(s.chunkPath(sum)); err != nil && !os.IsNotExist(err) {
+			log.Printf("[registry] chunk gc: unable to remove %s: %v", sum, err)
+			continue
+		}
+		delete(s.entries, sum)
+		res.Removed++
+		res.Freed += e.size
+	}
+	s.lastGC = &res
+	if res.Removed > 0 {
+		log.Printf("[registry] chunk gc: removed %d chunks, %d bytes", res.Removed, res.Freed)
+	}
+	return res
+}
+
+// janitor collects garbage every interval.
+func (s *chunkStore) janitor(every time.Duration) {
+	for range time.Tick(every) {
+		s.GC()
+	}
+}
+
+func (s *chunkStore) Stats() chunkStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := chunkStats{Models: len(s.logical), Chunks: len(s.entries), AvgSize: s.avgSize, LastGC: s.lastGC}
+	for _, n := range s.logical {
+		st.LogicalBytes += n
+	}
+	for _, e := range s.entries {
+		st.StoredBytes += e.size
+		if e.refs <= 0 {
+			st.Unreferenced++
+			st.Reclaimable += e.size
+		}
+	}
+	if st.StoredBytes > 0 {
+		st.Ratio = math.Round(float64(st.LogicalBytes)/float64(st.StoredBytes)*100) / 100
+	}
+	return st
+}
+
+// chunkObject is a model opened from its recipe; offsets[i] is where chunk
+// i starts.
+type chunkObject struct {
+	s       *chunkStore
+	rec     *chunkRecipe
+	info    *objectInfo
+	offsets []int64
+	once    sync.Once
+}
+
+func (o *chunkObject) Info() os.FileInfo { return o.info }
+
+// Range assembles length bytes from offset out of the chunks they span.
+func (o *chunkObject) Range(offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length < 0 || offset+length > o.rec.Size {
+		return nil, fmt.Errorf("range %d+%d is outside the model's %d bytes", offset, length, o.rec.Size)
+	}
+	i := sort.Search(len(o.rec.Chunks), func(i int) bool { return o.offsets[i+1] > offset })
+	return &chunkReader{o: o, idx: i, pos: offset, end: offset + length}, nil
+}
+
+func (o *chunkObject) Close() error {
+	o.once.Do(func() { o.s.refAll(o.rec.Chunks, -1) })
+	return nil
+}
+
+// chunkReader reads across chunk files in order. Chunks read from their
+// first byte to their last are checked against their digest, so corruption
+// fails the read instead of going out.
+type chunkReader struct {
+	o        *chunkObject
+	idx      int // chunk holding pos
+	pos, end int64
+	f        *os.File
+	h        hash.Hash // nil when the current chunk isn't read in full
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.pos >= r.end {
+		return 0, io.EOF
+	}
+	c, start := r.o.rec.Chunks[r.idx], r.o.offsets[r.idx]
+	if r.f == nil {
+		f, err := os.Open(r.o.s.chunkPath(c.Sha256))
+		if err != nil {
+			return 0, fmt.Errorf("chunk %s of %s: %w", c.Sha256, r.o.info.key, err)
+		}
+		if _, err := f.Seek(r.pos-start, io.SeekStart); err != nil {
+			f.Close()
+			return 0, err
+		}
+		r.f, r.h = f, nil
+		if r.pos == start && r.end >= start+c.Size {
+			r.h = sha256.New()
+		}
+	}
+	n, err := r.f.Read(p[:min(int64(len(p)), r.end-r.pos, start+c.Size-r.pos)])
+	if r.h != nil {
+		r.h.Write(p[:n])
+	}
+	r.pos += int64(n)
+	if r.pos == start+c.Size || (err == io.EOF && n == 0) {
+		r.f.Close()
+		r.f = nil
+		if r.pos < start+c.Size {
+			return n, fmt.Errorf("chunk %s of %s is truncated", c.Sha256, r.o.info.key)
+		}
+		if r.h != nil && hex.EncodeToString(r.h.Sum(nil)) != c.Sha256 {
+			return n, fmt.Errorf("chunk %s of %s fails verification", c.Sha256, r.o.info.key)
+		}
+		r.idx++
+		return n, nil
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *chunkReader) Close() error {
+	if r.f != nil {
+		r.f.Close()
+	}
+	return nil
+}
+
+// chunkStatsHandler reports deduplication and what a collection would free.
+func chunkStatsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, chunkStorage.Stats())
+}
+
+// chunkGCHandler runs a collection now.
+func chunkGCHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, chunkStorage.GC())
+}
+
+// chunkAvgSize is the chunk store's average chunk size, or 0 without one.
+func chunkAvgSize() int64 {
+	if chunkStorage == nil {
+		return 0
+	}
+	return int64(chunkStorage.avgSize)
+}
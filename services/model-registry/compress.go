@@ -0,0 +1,186 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content codings the registry can send.
+const (
+	encodingZstd = "zstd"
+	encodingGzip = "gzip"
+)
+
+// jsonEncodings are the codings offered for JSON, preferred first when the
+// client weighs them equally.
+var jsonEncodings = []string{encodingZstd, encodingGzip}
+
+// compressJSON turns on zstd or gzip for JSON responses to clients that
+// accept either. Clients sending "Save-Data: on" get it regardless.
+var compressJSON bool
+
+// compressModels turns on zstd for full model downloads to clients that
+// accept it; set from MODEL_REGISTRY_COMPRESS_MODELS.
+var compressModels bool
+
+// zstdLevel is the encoder level for zstd responses, from
+// MODEL_REGISTRY_ZSTD_LEVEL.
+var zstdLevel = zstd.SpeedDefault
+
+// saveData reports whether the client asked for reduced data usage.
+func saveData(r *http.Request) bool {
+	return strings.EqualFold(strings.TrimSpace(r.Header.Get("Save-Data")), "on")
+}
+
+// negotiateEncoding picks the coding from offered (in preference order) the
+// client's Accept-Encoding weighs highest, or "" for none. Codings with q=0
+// are refused, and "*" stands for any coding not listed.
+func negotiateEncoding(r *http.Request, offered []string) string {
+	weights := map[string]float64{}
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+			q := 1.0
+			if k, val, ok := strings.Cut(strings.ReplaceAll(params, " ", ""), "="); ok && strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(val, 64); err == nil {
+					q = f
+				}
+			}
+			weights[strings.ToLower(strings.TrimSpace(name))] = q
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, enc := range offered {
+		q, ok := weights[enc]
+		if !ok {
+			q = weights["*"]
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// parseZstdLevel parses fastest, default, better or best.
+func parseZstdLevel(s string) (zstd.EncoderLevel, error) {
+	ok, level := zstd.EncoderLevelFromString(s)
+	if !ok {
+		return 0, fmt.Errorf("unknown level %q (want fastest, default, better or best)", s)
+	}
+	return level, nil
+}
+
+// zstdEncoders reuses encoders, which are costly to set up.
+var zstdEncoders sync.Pool
+
+// newZstdWriter returns an encoder writing to w at zstdLevel; Close finishes
+// the frame and returns the encoder to the pool.
+func newZstdWriter(w io.Writer) *zstdWriter {
+	enc, _ := zstdEncoders.Get().(*zstd.Encoder)
+	if enc == nil {
+		enc, _ = zstd.NewWriter(w, zstd.WithEncoderLevel(zstdLevel), zstd.WithEncoderConcurrency(1))
+	} else {
+		enc.Reset(w)
+	}
+	return &zstdWriter{enc}
+}
+
+type zstdWriter struct {
+	*zstd.Encoder
+}
+
+func (z *zstdWriter) Close() error {
+	err := z.Encoder.Close()
+	zstdEncoders.Put(z.Encoder)
+	return err
+}
+
+// compressMiddleware compresses JSON responses when compression is enabled
+// or the client sent Save-Data, and the client accepts zstd or gzip.
+func compressMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &compressWriter{ResponseWriter: w}
+		if compressJSON || saveData(r) {
+			cw.encoding = negotiateEncoding(r, jsonEncodings)
+		}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter decides at WriteHeader time whether the body is JSON and, if
+// so, advertises the negotiating headers in Vary and optionally compresses
+// it.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string // negotiated coding, "" for none
+	decided  bool
+	enc      io.WriteCloser
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if !c.decided {
+		c.decided = true
+		h := c.Header()
+		mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+		if mt == "application/json" && h.Get("Content-Encoding") == "" {
+			h.Add("Vary", "Accept-Encoding")
+			h.Add("Vary", "Save-Data")
+			if c.encoding != "" && code != http.StatusNoContent && code != http.StatusNotModified {
+				h.Set("Content-Encoding", c.encoding)
+				h.Del("Content-Length")
+				// The encoded bytes differ, so a strong validator no longer applies
+				if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+					h.Set("ETag", "W/"+etag)
+				}
+				if c.encoding == encodingZstd {
+					c.enc = newZstdWriter(c.ResponseWriter)
+				} else {
+					c.enc = gzip.NewWriter(c.ResponseWriter)
+				}
+			}
+		}
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.decided {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.enc != nil {
+		return c.enc.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+// Close flushes any compressed stream.
+func (c *compressWriter) Close() {
+	if c.enc != nil {
+		c.enc.Close()
+	}
+}
+
+// Flush lets streaming handlers (SSE) flush through the wrapper.
+func (c *compressWriter) Flush() {
+	if f, ok := c.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// etagMatches reports whether the request's If-None-Match matches etag using
+// the weak comparison RFC 9110 prescribes for If-None-Match.
+func etagMatches(r *http.Request, etag string) bool {
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" {
+		return false
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(inm, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == want {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotModified sets the ETag header and, if the client already has that
+// representation, answers 304 and returns true so the caller can skip
+// building the body.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// ifRangeMatches reports whether a Range header should be honored given the
+// request's If-Range: always without one, otherwise only if it names the
+// current etag (strong comparison, as RFC 9110 requires). Dates aren't
+// supported and so never match, which falls back to the full file.
+func ifRangeMatches(r *http.Request, etag string) bool {
+	ir := r.Header.Get("If-Range")
+	return ir == "" || (ir == etag && !strings.HasPrefix(ir, "W/"))
+}
+
+// fileETag is a strong validator for a model file revision, changing
+// whenever its size or mtime does, like the digest cache key.
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// writeJSONConditional is writeJSON for 200 responses that are cheap to build
+// but worth not resending: the ETag is a hash of the rendered body, so
+// pollers get 304 Not Modified until anything in it changes.
+func writeJSONConditional(w http.ResponseWriter, r *http.Request, tag string, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[registry] writeJSON encode err: %v", err)
+		http.Error(w, "unable to encode response", http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(body)
+	if checkNotModified(w, r, `"`+tag+`-`+hex.EncodeToString(sum[:8])+`"`) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The config file. MODEL_REGISTRY_CONFIG names a TOML file with the core
+// settings (ports, model directory, TLS, auth, limits) as typed keys; the
+// environment wins over it, so one file can ship with a deployment and
+// single settings still be overridden per instance. Every other variable
+// can go in the file's [env] table by name. Only the TOML settings need is
+// understood: tables, strings, integers, floats, booleans, single-line
+// arrays and comments.
+
+// Config is the registry's core settings. Each field is read from the first
+// of its env variables that is set, else from its file key, else it keeps
+// its default.
+type Config struct {
+	ModelDir  string `toml:"model_dir" env:"MODEL_DIR"`
+	CreateDir bool   `toml:"create_dir" env:"MODEL_REGISTRY_CREATE_DIR"`
+	Port      string `toml:"port" env:"MODEL_REGISTRY_INTERNAL_PORT,PORT"`
+	GRPCPort  string `toml:"grpc_port" env:"MODEL_REGISTRY_GRPC_PORT"`
+
+	TLS    configTLS    `toml:"tls"`
+	Auth   configAuth   `toml:"auth"`
+	Limits configLimits `toml:"limits"`
+
+	env map[string]string // the [env] table
+}
+
+// configTLS is the [tls] table.
+type configTLS struct {
+	CertFile     string   `toml:"cert_file" env:"MODEL_REGISTRY_TLS_CERT_FILE,TLS_CERT_FILE"`
+	KeyFile      string   `toml:"key_file" env:"MODEL_REGISTRY_TLS_KEY_FILE,TLS_KEY_FILE"`
+	SelfSigned   bool     `toml:"self_signed" env:"MODEL_REGISTRY_TLS_SELF_SIGNED"`
+	Hosts        []string `toml:"hosts" env:"MODEL_REGISTRY_TLS_HOSTS"`
+	ClientCA     string   `toml:"client_ca" env:"MODEL_REGISTRY_TLS_CLIENT_CA"`
+	ClientAuth   string   `toml:"client_auth" env:"MODEL_REGISTRY_TLS_CLIENT_AUTH"`
+	RedirectPort string   `toml:"redirect_port" env:"MODEL_REGISTRY_HTTP_REDIRECT_PORT"`
+}
+
+// configAuth is the [auth] table.
+type configAuth struct {
+	AdminToken          string        `toml:"admin_token" env:"MODEL_REGISTRY_ADMIN_TOKEN"`
+	APIKeys             []string      `toml:"api_keys" env:"MODEL_REGISTRY_API_KEYS"`
+	APIKeysFile         string        `toml:"api_keys_file" env:"MODEL_REGISTRY_API_KEYS_FILE"`
+	APIKeyRoles         string        `toml:"api_key_roles" env:"MODEL_REGISTRY_API_KEY_ROLES"`
+	RequireAPIKey       bool          `toml:"require_api_key" env:"MODEL_REGISTRY_REQUIRE_API_KEY"`
+	AdminIdentities     string        `toml:"admin_identities" env:"MODEL_REGISTRY_ADMIN_IDENTITIES"`
+	PublisherIdentities string        `toml:"publisher_identities" env:"MODEL_REGISTRY_PUBLISHER_IDENTITIES"`
+	JWKSURL             string        `toml:"jwks_url" env:"MODEL_REGISTRY_JWKS_URL,JWKS_URL"`
+	JWKSRefresh         time.Duration `toml:"jwks_refresh" env:"MODEL_REGISTRY_JWKS_REFRESH"`
+	JWTIssuer           string        `toml:"jwt_issuer" env:"MODEL_REGISTRY_JWT_ISSUER,OAUTH_ISSUER"`
+	JWTAudience         []string      `toml:"jwt_audience" env:"MODEL_REGISTRY_JWT_AUDIENCE"`
+	JWTAdminRoles       string        `toml:"jwt_admin_roles" env:"MODEL_REGISTRY_JWT_ADMIN_ROLES"`
+	JWTPublisherRoles   string        `toml:"jwt_publisher_roles" env:"MODEL_REGISTRY_JWT_PUBLISHER_ROLES"`
+}
+
+// configLimits is the [limits] table.
+type configLimits struct {
+	MaxUploadSize      int64  `toml:"max_upload_size" env:"MODEL_REGISTRY_MAX_UPLOAD_SIZE"`
+	RateLimitIP        string `toml:"rate_limit_ip" env:"MODEL_REGISTRY_RATE_LIMIT_IP"`
+	RateLimitModel     string `toml:"rate_limit_model" env:"MODEL_REGISTRY_RATE_LIMIT_MODEL"`
+	RateLimitClient    string `toml:"rate_limit_client" env:"MODEL_REGISTRY_RATE_LIMIT_CLIENT"`
+	RateLimitOverrides string `toml:"rate_limit_overrides" env:"MODEL_REGISTRY_RATE_LIMIT_OVERRIDES"`
+	MaxStreams         int    `toml:"max_streams" env:"MODEL_REGISTRY_MAX_STREAMS"`
+	MaxModelStreams    int    `toml:"max_model_streams" env:"MODEL_REGISTRY_MAX_MODEL_STREAMS"`
+	EgressLimit        int64  `toml:"egress_limit" env:"MODEL_REGISTRY_EGRESS_LIMIT"`
+	StreamLimit        int64  `toml:"stream_limit" env:"MODEL_REGISTRY_STREAM_LIMIT,MAX_STREAM_BPS"`
+	Quota              int64  `toml:"quota" env:"MODEL_REGISTRY_QUOTA"`
+}
+
+// configEnv holds the [env] table of the config file loaded at startup,
+// which getenv and its siblings fall back to.
+var configEnv map[string]string
+
+// configKeyPattern matches table names and keys.
+var configKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// lookupEnv returns k from the environment, or else from the [env] table,
+// or else from the scenario's defaults.
+func lookupEnv(k string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	if v := configEnv[k]; v != "" {
+		return v
+	}
+	return scenarioEnv[k]
+}
+
+// getenv is getenv against c's [env] table rather than the startup one.
+func (c *Config) getenv(k, fallback string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	if v := c.env[k]; v != "" {
+		return v
+	}
+	if v := scenarioEnv[k]; v != "" {
+		return v
+	}
+	return fallback
+}
+
+func defaultConfig() Config {
+	var c Config
+	c.ModelDir = defaultModelDir
+	c.CreateDir = true
+	c.Port = "8050"
+	c.TLS.ClientAuth = clientAuthRequire
+	c.Auth.JWKSRefresh = defaultJWKSRefresh
+	c.Auth.JWTAudience = []string{defaultJWTAudience}
+	return c
+}
+
+// configSetting is one field of Config.
+type configSetting struct {
+	key   string   // file key, e.g. tls.cert_file
+	env   []string // variables overriding it, first wins
+	field reflect.Value
+}
+
+// settings lists c's fields.
+func (c *Config) settings() []configSetting {
+	var out []configSetting
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		for i := range v.NumField() {
+			f := v.Type().Field(i)
+			tag, ok := f.Tag.Lookup("toml")
+			if !ok {
+				continue
+			}
+			key := prefix + tag
+			if f.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), key+".")
+				continue
+			}
+			out = append(out, configSetting{key: key, env: strings.Split(f.Tag.Get("env"), ","), field: v.Field(i)})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return out
+}
+
+// name is how errors refer to the setting at key: its file key and its
+// variable.
+func (c *Config) name(key string) string {
+	for _, s := range c.settings() {
+		if s.key == key {
+			return fmt.Sprintf("%s (%s)", key, s.env[0])
+		}
+	}
+	return key
+}
+
+// loadConfig reads the config file at path, if any, applies the
+// environment over it and validates the result.
+func loadConfig(path string) (Config, error) {
+	c := defaultConfig()
+	values := map[string]string{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+		if values, err = parseConfigFile(string(data)); err != nil {
+			return c, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	known := map[string]bool{}
+	typed := map[string]string{}
+	for _, s := range c.settings() {
+		known[s.key] = true
+		for _, name := range s.env {
+			typed[name] = s.key
+		}
+	}
+	c.env = map[string]string{}
+	for key, v := range values {
+		name, ok := strings.CutPrefix(key, "env.")
+		switch {
+		case ok && typed[name] != "":
+			return c, fmt.Errorf("%s: set %s instead of env.%s", path, typed[name], name)
+		case ok:
+			c.env[name] = v
+		case !known[key]:
+			return c, fmt.Errorf("%s: unknown setting %s", path, key)
+		}
+	}
+
+	for _, s := range c.settings() {
+		src, raw, ok := s.key, "", false
+		for _, name := range s.env {
+			if raw = os.Getenv(name); raw != "" {
+				src, ok = name, true
+				break
+			}
+		}
+		if !ok {
+			if raw, ok = values[s.key]; !ok {
+				continue
+			}
+		}
+		if err := setConfigField(s.field, raw); err != nil {
+			return c, fmt.Errorf("invalid %s: %v", src, err)
+		}
+	}
+	return c, c.validate()
+}
+
+// setConfigField parses raw into f.
+func setConfigField(f reflect.Value, raw string) error {
+	switch {
+	case f.Type() == reflect.TypeFor[time.Duration]():
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+	case f.Kind() == reflect.String:
+		f.SetString(raw)
+	case f.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("want true or false, got %q", raw)
+		}
+		f.SetBool(b)
+	case f.Kind() == reflect.Int || f.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("want an integer, got %q", raw)
+		}
+		f.SetInt(n)
+	case f.Kind() == reflect.Slice:
+		f.Set(reflect.ValueOf(splitList(raw)))
+	}
+	return nil
+}
+
+// validate checks c as a whole; each problem is reported.
+func (c *Config) validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if c.ModelDir == "" {
+		fail("%s must not be empty", c.name("model_dir"))
+	}
+	for _, p := range []struct{ key, port string }{{"port", c.Port}, {"grpc_port", c.GRPCPort}, {"tls.redirect_port", c.TLS.RedirectPort}} {
+		if p.port == "" && p.key != "port" {
+			continue
+		}
+		if n, err := strconv.Atoi(p.port); err != nil || n < 1 || n > 65535 {
+			fail("%s must be a port number, got %q", c.name(p.key), p.port)
+		}
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		fail("%s and %s must be set together", c.name("tls.cert_file"), c.name("tls.key_file"))
+	}
+	if c.TLS.SelfSigned && c.TLS.CertFile != "" {
+		fail("%s can't be combined with %s", c.name("tls.self_signed"), c.name("tls.cert_file"))
+	}
+	tlsOn := c.TLS.CertFile != "" || c.TLS.SelfSigned
+	if c.TLS.ClientCA != "" && !tlsOn {
+		fail("%s requires TLS to be configured", c.name("tls.client_ca"))
+	}
+	if c.TLS.RedirectPort != "" && !tlsOn {
+		fail("%s requires TLS to be configured", c.name("tls.redirect_port"))
+	}
+	if c.TLS.ClientAuth != clientAuthRequire && c.TLS.ClientAuth != clientAuthOptional {
+		fail("%s must be %s or %s, got %q", c.name("tls.client_auth"), clientAuthRequire, clientAuthOptional, c.TLS.ClientAuth)
+	}
+
+	if c.Auth.JWKSURL == "" && (c.Auth.JWTAdminRoles != "" || c.Auth.JWTPublisherRoles != "") {
+		fail("%s and %s need %s", c.name("auth.jwt_admin_roles"), c.name("auth.jwt_publisher_roles"), c.name("auth.jwks_url"))
+	}
+
+	for _, l := range []struct {
+		key string
+		n   int64
+	}{
+		{"limits.max_upload_size", c.Limits.MaxUploadSize},
+		{"limits.max_streams", int64(c.Limits.MaxStreams)},
+		{"limits.max_model_streams", int64(c.Limits.MaxModelStreams)},
+		{"limits.egress_limit", c.Limits.EgressLimit},
+		{"limits.stream_limit", c.Limits.StreamLimit},
+		{"limits.quota", c.Limits.Quota},
+	} {
+		if l.n < 0 {
+			fail("%s must not be negative", c.name(l.key))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parseConfigFile reads TOML into flat "table.key" values, with arrays
+// comma-joined as they would be in a variable.
+func parseConfigFile(data string) (map[string]string, error) {
+	values := map[string]string{}
+	table := ""
+	for i, line := range strings.Split(data, "\n") {
+		line, _, _ = cutOutsideQuotes(line, '#')
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if name, ok := strings.CutPrefix(line, "["); ok {
+			if name, ok = strings.CutSuffix(name, "]"); !ok || !configKeyPattern.MatchString(strings.TrimSpace(name)) {
+				return nil, fmt.Errorf("line %d: invalid table %q", i+1, line)
+			}
+			table = strings.TrimSpace(name) + "."
+			continue
+		}
+		key, raw, ok := strings.Cut(line, "=")
+		if key = strings.TrimSpace(key); !ok || !configKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("line %d: want key = value, got %q", i+1, line)
+		}
+		v, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", i+1, key, err)
+		}
+		if _, dup := values[table+key]; dup {
+			return nil, fmt.Errorf("line %d: %s%s is set twice", i+1, table, key)
+		}
+		values[table+key] = v
+	}
+	return values, nil
+}
+
+// parseConfigValue parses one TOML value.
+func parseConfigValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") || strings.Contains(raw[1:len(raw)-1], "'") {
+			return "", fmt.Errorf("unterminated string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case strings.HasPrefix(raw, "["):
+		inner, ok := strings.CutSuffix(raw[1:], "]")
+		if !ok {
+			return "", fmt.Errorf("arrays must be on one line")
+		}
+		var items []string
+		for rest := inner; strings.TrimSpace(rest) != ""; {
+			var item string
+			item, rest, _ = cutOutsideQuotes(rest, ',')
+			if strings.HasPrefix(strings.TrimSpace(item), "[") {
+				return "", fmt.Errorf("nested arrays aren't supported")
+			}
+			v, err := parseConfigValue(strings.TrimSpace(item))
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(v, ",") {
+				return "", fmt.Errorf("array items can't contain commas")
+			}
+			items = append(items, v)
+		}
+		return strings.Join(items, ","), nil
+	case raw == "true" || raw == "false":
+		return raw, nil
+	}
+	digits := strings.ReplaceAll(raw, "_", "")
+	if n, err := strconv.ParseInt(digits, 10, 64); err == nil {
+		return strconv.FormatInt(n, 10), nil
+	}
+	if _, err := strconv.ParseFloat(digits, 64); err == nil {
+		return digits, nil
+	}
+	return "", fmt.Errorf("unsupported value %q (quote strings)", raw)
+}
+
+// cutOutsideQuotes cuts s around the first sep not inside a string.
+func cutOutsideQuotes(s string, sep byte) (before, after string, found bool) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultCORSHeaders is the static Access-Control-Allow-Headers list sent in
+// wildcard mode and the default safelist in reflect mode.
+const defaultCORSHeaders = "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization, If-None-Match, If-Range, Range, X-Admin-Token, X-API-Key, X-Download-Session, X-Request-ID, X-Storage-Backend, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset"
+
+// corsConfig controls the CORS middleware.
+//
+// With origins ["*"] (the open lab default) every origin is allowed and the
+// static header list is sent. Otherwise only listed origins are echoed back,
+// and on preflight only the requested headers that appear in the safelist are
+// reflected, so custom client headers work without echoing arbitrary values.
+type corsConfig struct {
+	origins  map[string]bool
+	wildcard bool
+	headers  map[string]bool // lower-cased safelist
+	maxAge   int             // Access-Control-Max-Age on preflights, seconds
+}
+
+// defaultCORSMaxAge lets browsers reuse a preflight result for five minutes.
+const defaultCORSMaxAge = 300
+
+var cors = newCORSConfig("*", defaultCORSHeaders, defaultCORSMaxAge)
+
+func newCORSConfig(origins, headers string, maxAge int) *corsConfig {
+	c := &corsConfig{origins: map[string]bool{}, headers: map[string]bool{}, maxAge: maxAge}
+	for _, o := range splitList(origins) {
+		if o == "*" {
+			c.wildcard = true
+		}
+		c.origins[o] = true
+	}
+	for _, h := range splitList(headers) {
+		c.headers[strings.ToLower(h)] = true
+	}
+	return c
+}
+
+// splitList splits a comma separated list, trimming blanks.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// allowedRequestHeaders filters Access-Control-Request-Headers by the safelist.
+func (c *corsConfig) allowedRequestHeaders(requested string) string {
+	var allowed []string
+	for _, h := range splitList(requested) {
+		if c.headers[strings.ToLower(h)] {
+			allowed = append(allowed, h)
+		}
+	}
+	return strings.Join(allowed, ", ")
+}
+
+// corsMiddleware sets CORS headers on every routed request and answers
+// preflights directly.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if origin := r.Header.Get("Origin"); origin != "" && vulns.Enabled(vulnWildcardCORS) {
+			// Deliberately unsafe: any site may read responses with the
+			// visitor's credentials.
+			h.Add("Vary", "Origin")
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Credentials", "true")
+			if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				h.Set("Access-Control-Allow-Headers", requested)
+			}
+		} else if cors.wildcard {
+			h.Set("Access-Control-Allow-Origin", "*")
+			h.Set("Access-Control-Allow-Headers", defaultCORSHeaders)
+		} else {
+			h.Add("Vary", "Origin")
+			if origin := r.Header.Get("Origin"); origin != "" && cors.origins[origin] {
+				h.Set("Access-Control-Allow-Origin", origin)
+				if r.Method == http.MethodOptions {
+					h.Add("Vary", "Access-Control-Request-Headers")
+					if allowed := cors.allowedRequestHeaders(r.Header.Get("Access-Control-Request-Headers")); allowed != "" {
+						h.Set("Access-Control-Allow-Headers", allowed)
+					}
+				}
+			}
+		}
+		h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+
+		// Handle preflight OPTIONS requests; a max age of 0 tells browsers
+		// not to cache the result at all
+		if r.Method == http.MethodOptions {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(cors.maxAge))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
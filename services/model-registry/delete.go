@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// streams counts downloads in flight per model so a delete can refuse to pull
+// a file out from under them, and caps how many run at once.
+var streams = &streamTracker{active: map[string]int{}, deleting: map[string]bool{}}
+
+// streamRetryAfter is the Retry-After sent when the stream caps are full;
+// the streams holding the slots are big downloads, so retrying at once
+// rarely helps.
+const streamRetryAfter = 5 * time.Second
+
+var (
+	errStreamDeleting = errors.New("model not found")
+	errStreamsFull    = errors.New("too many concurrent downloads")
+	errModelStreams   = errors.New("too many concurrent downloads of this model")
+)
+
+// streamTracker pairs per-model stream counts with a delete lock: while a
+// delete holds a model no new stream starts, and a delete only starts when no
+// stream is running. maxTotal and maxPerModel, when non-zero, cap the streams
+// in flight across the node and per model.
+type streamTracker struct {
+	mu          sync.Mutex
+	maxTotal    int
+	maxPerModel int
+	total       int
+	active      map[string]int
+	deleting    map[string]bool
+	rejected    int64
+	version     uint64 // bumped on every change, used for /stats ETags
+}
+
+// streamStats is the streams section of the /stats response.
+type streamStats struct {
+	Active        int   `json:"active"`
+	Limit         int   `json:"limit"`
+	PerModelLimit int   `json:"per_model_limit"`
+	Rejected      int64 `json:"rejected_total"`
+}
+
+// Begin registers a stream of name. It fails with errStreamDeleting while
+// name is being deleted and, when capped (HEAD requests aren't), with
+// errStreamsFull or errModelStreams while the caps are reached.
+func (t *streamTracker) Begin(name string, capped bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.deleting[name] {
+		return errStreamDeleting
+	}
+	if capped {
+		var err error
+		if t.maxTotal > 0 && t.total >= t.maxTotal {
+			err = errStreamsFull
+		} else if t.maxPerModel > 0 && t.active[name] >= t.maxPerModel {
+			err = errModelStreams
+		}
+		if err != nil {
+			t.rejected++
+			t.version++
+			return err
+		}
+	}
+	t.active[name]++
+	t.total++
+	t.version++
+	return nil
+}
+
+func (t *streamTracker) End(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active[name]--; t.active[name] <= 0 {
+		delete(t.active, name)
+	}
+	t.total--
+	t.version++
+}
+
+// Stats returns a snapshot of the counters.
+func (t *streamTracker) Stats() streamStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return streamStats{Active: t.total, Limit: t.maxTotal, PerModelLimit: t.maxPerModel, Rejected: t.rejected}
+}
+
+// Version changes whenever the counters do.
+func (t *streamTracker) Version() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.version
+}
+
+// writeStreamsFull answers 503 with Retry-After for a stream refused by the
+// caps.
+func writeStreamsFull(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(streamRetryAfter.Seconds())))
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
+
+// BeginDelete locks name for deletion. It returns the number of streams in
+// flight, and ok only when there are none.
+func (t *streamTracker) BeginDelete(name string) (active int, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n := t.active[name]; n > 0 || t.deleting[name] {
+		return n, false
+	}
+	t.deleting[name] = true
+	return 0, true
+}
+
+func (t *streamTracker) EndDelete(name string) {
+	t.mu.Lock()
+	delete(t.deleting, name)
+	t.mu.Unlock()
+}
+
+// deleteResponse is used by DELETE /models/{name}
+type deleteResponse struct {
+	Name          string `json:"name"`
+	Deleted       bool   `json:"deleted"`
+	Size          int64  `json:"size,omitempty"`
+	ActiveStreams int    `json:"active_streams,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+// Delete removes the sidecar of name, if any.
+func (s *sidecarStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// deleteHandler removes a model, its sidecar and its card. It answers 409 without
+// touching anything while the model is being downloaded or uploaded. With an
+// origin tier only the local copy is removed. Versioned models are deleted
+// one version at a time, as {name}@{version}.
+func deleteHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := parseModelRef(r, modelDir, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Deleting "the newest version" by accident is too easy with a plain name.
+		if latest := ref.resolveLatest(); latest.Version != "" && ref.Version == "" {
+			http.Error(w, errVersionedModel.Error(), http.StatusBadRequest)
+			return
+		}
+		info, err := statModel(r.Context(), ref)
+		if err != nil || info.IsDir() {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		}
+		resp, err := deleteModel(r.Context(), ref, info, requestIdentity(r), map[string]any{"client": clientIP(r)})
+		if err != nil {
+			log.Printf("[registry] unable to delete %s: %v", ref.Name, err)
+			http.Error(w, "unable to delete model", http.StatusInternalServerError)
+			return
+		}
+		if !resp.Deleted {
+			writeJSON(w, http.StatusConflict, resp)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// deleteModel removes the model at ref, whose file is info, with its
+// sidecar, card, provenance and series, and publishes model.deleted with
+// data. It holds the model's write slot throughout, so no upload can start
+// under the name halfway through. A model that is being written or
+// downloaded, a pinned one or a tagged version is left alone: the response
+// then has a Reason and Deleted is false.
+func deleteModel(ctx context.Context, ref modelRef, info os.FileInfo, identity string, data map[string]any) (deleteResponse, error) {
+	name := ref.Name
+	if !writes.Begin(name) {
+		return deleteResponse{Name: name, Reason: "an upload or delete of this model is in progress"}, nil
+	}
+	defer writes.End(name)
+	if pins.Covers(name) {
+		return deleteResponse{Name: name, Reason: "model is pinned; unpin it first"}, nil
+	}
+	if t := tags.TagsOf(ref.Base(), ref.Version); ref.Version != "" && len(t) > 0 {
+		return deleteResponse{Name: name, Reason: "version is tagged " + strings.Join(t, ", ") + "; move the tags first"}, nil
+	}
+	active, ok := streams.BeginDelete(name)
+	if !ok {
+		return deleteResponse{Name: name, ActiveStreams: active, Reason: "model is being downloaded"}, nil
+	}
+	defer streams.EndDelete(name)
+
+	if err := removeModel(ctx, ref); err != nil {
+		return deleteResponse{Name: name}, err
+	}
+	if ref.Version != "" {
+		os.Remove(versionsDir(ref.Dir, ref.File)) // only succeeds once it's empty
+	}
+	meta, _ := sidecars.Get(name)
+	if err := sidecars.Delete(name); err != nil {
+		log.Printf("[registry] deleted %s but not its sidecar: %v", name, err)
+	}
+	if err := cards.Delete(name); err != nil {
+		log.Printf("[registry] deleted %s but not its card: %v", name, err)
+	}
+	if err := provenance.Delete(name); err != nil {
+		log.Printf("[registry] deleted %s but not its provenance: %v", name, err)
+	}
+	if blobs != nil {
+		blobs.Release(meta.Sha256)
+	}
+	modelBytes.Delete(name)
+	honeypotHits.Delete(name)
+	lastUse.Forget(name)
+	log.Printf("[registry] deleted %s (%d bytes)", name, info.Size())
+	data["size"] = info.Size()
+	events.Publish(eventModelDeleted, name, withIdentity(identity, data))
+	rescanCatalog()
+	return deleteResponse{Name: name, Deleted: true, Size: info.Size()}, nil
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Delta downloads let a client that already holds one model rebuild another
+// from a small patch instead of fetching the whole file.
+//
+// Patch format (integers are big-endian):
+//
+//	header  "MRDELTA1" | base sha256 (32 bytes) | target sha256 (32 bytes) | target size (uint64)
+//	op 0x01 COPY offset uint64, length uint64   append base[offset:offset+length]
+//	op 0x02 DATA length uint64, <length bytes>  append the literal bytes
+//	op 0x00 END
+//
+// To apply, check that the local base file hashes to the header's base digest,
+// replay the ops in order into an empty output, and verify the output against
+// the target digest and size. The encoder matches fixed-size blocks of the
+// base (rsync-style weak rolling checksum, confirmed byte-for-byte), so COPY
+// offsets are always within the base file.
+
+const (
+	deltaMagic            = "MRDELTA1"
+	deltaContentType      = "application/vnd.crash-pay.model-delta"
+	defaultDeltaBlockSize = 64 << 10
+	deltaMaxLiteral       = 4 << 20
+
+	deltaOpEnd  = 0x00
+	deltaOpCopy = 0x01
+	deltaOpData = 0x02
+)
+
+// deltaBlockSize is the base-file block granularity used for matching.
+var deltaBlockSize = defaultDeltaBlockSize
+
+// deltaLocks serializes concurrent builds of the same delta.
+var deltaLocks = newKeyedMutex()
+
+// deltaBase resolves the base a delta to target starts from: ?from= names a
+// model, or just a version of target's model, and ?from_sha256= is the
+// digest of the file the client holds, looked up among target's versions.
+func deltaBase(r *http.Request, modelDir string, target modelRef) (modelRef, int, error) {
+	from, fromSum := r.URL.Query().Get("from"), strings.ToLower(r.URL.Query().Get("from_sha256"))
+	switch {
+	case from != "" && fromSum != "":
+		return modelRef{}, http.StatusBadRequest, errors.New("from and from_sha256 can't be combined")
+	case fromSum != "":
+		if len(fromSum) != 64 || strings.Trim(fromSum, "0123456789abcdef") != "" {
+			return modelRef{}, http.StatusBadRequest, errors.New("from_sha256 must be 64 hex digits")
+		}
+		if target.Version == "" {
+			return modelRef{}, http.StatusBadRequest, errors.New("from_sha256 needs a versioned model")
+		}
+		plain := target
+		plain.Name, plain.Version = target.Base(), ""
+		versions, err := listVersions(plain.Dir, plain.File)
+		if err != nil {
+			return modelRef{}, http.StatusInternalServerError, err
+		}
+		for i := len(versions) - 1; i >= 0; i-- {
+			v := versions[i]
+			if v.Version == target.Version {
+				continue
+			}
+			ref, _ := plain.withVersion(v.Version)
+			if sum, err := digests.ModelSHA256(r.Context(), ref, v.Info); err == nil && sum == fromSum {
+				return ref, 0, nil
+			}
+		}
+		return modelRef{}, http.StatusNotFound, fmt.Errorf("no version of %s has sha256 %s", plain.Name, fromSum)
+	case from == "":
+		return modelRef{}, http.StatusBadRequest, errors.New("from or from_sha256 is required")
+	case target.Version != "" && !strings.Contains(from, versionSep) && validVersion(from) == nil && filepath.Ext(from) == "":
+		plain := target
+		plain.Name, plain.Version = target.Base(), ""
+		ref, err := plain.withVersion(from)
+		if err != nil {
+			return ref, http.StatusBadRequest, err
+		}
+		return ref.resolveLatest(), 0, nil
+	}
+	base, err := resolveModel(r, modelDir, from)
+	if err != nil {
+		return base, http.StatusBadRequest, err
+	}
+	if !requestModelFilter(r)(base.Base()) {
+		return base, http.StatusNotFound, errors.New("base model not found")
+	}
+	return base, 0, nil
+}
+
+// deltaServable refuses, as streamHandler would, a model that has expired
+// or that is quarantined and r isn't an admin; what names it in the error.
+func deltaServable(w http.ResponseWriter, r *http.Request, ref modelRef, info os.FileInfo, what string) bool {
+	if age, expired := expiry.Check(ref.Name, info.ModTime()); expired {
+		w.Header().Set("X-Model-Age", strconv.FormatInt(int64(age.Seconds()), 10))
+		http.Error(w, fmt.Sprintf("%s expired: age %s exceeds %s", what, age.Round(time.Second), expiry.maxAge), http.StatusGone)
+		return false
+	}
+	if isQuarantined(ref.Name, info) && !isAdmin(r) {
+		http.Error(w, what+" is quarantined", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// deltaHandler streams a patch that turns the base deltaBase picks into
+// {name}. Computed patches are cached on disk keyed by the two files'
+// digests.
+func deltaHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target, err := resolveModel(r, modelDir, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		base, code, err := deltaBase(r, modelDir, target)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		name, from := target.Name, base.Name
+		if from == name {
+			http.Error(w, "from must differ from the target model", http.StatusBadRequest)
+			return
+		}
+		if filepath.Ext(base.File) != filepath.Ext(target.File) {
+			http.Error(w, "cannot diff models of different formats", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		targetInfo, err := statModel(r.Context(), target)
+		if err != nil || !targetInfo.Mode().IsRegular() {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		}
+		baseInfo, err := statModel(r.Context(), base)
+		if err != nil || !baseInfo.Mode().IsRegular() {
+			http.Error(w, "base model not found", http.StatusBadRequest)
+			return
+		}
+		if !deltaServable(w, r, target, targetInfo, "model") || !deltaServable(w, r, base, baseInfo, "base model") {
+			return
+		}
+
+		targetSum, err := digests.ModelSHA256(r.Context(), target, targetInfo)
+		if err != nil {
+			http.Error(w, "unable to hash model", http.StatusInternalServerError)
+			return
+		}
+		baseSum, err := digests.ModelSHA256(r.Context(), base, baseInfo)
+		if err != nil {
+			http.Error(w, "unable to hash base model", http.StatusInternalServerError)
+			return
+		}
+
+		cacheDir := filepath.Join(modelDir, stateDirName, "deltas")
+		cachePath := filepath.Join(cacheDir, baseSum+"-"+targetSum+".delta")
+
+		deltaLocks.Lock(cachePath)
+		if _, err := os.Stat(cachePath); os.IsNotExist(err) {
+			err = buildDeltaFile(r.Context(), cacheDir, cachePath, base, target, baseSum, targetSum)
+			if err != nil {
+				deltaLocks.Unlock(cachePath)
+				log.Printf("[registry] delta %s -> %s failed: %v", from, name, err)
+				http.Error(w, "unable to compute delta", http.StatusInternalServerError)
+				return
+			}
+		}
+		deltaLocks.Unlock(cachePath)
+
+		f, err := os.Open(cachePath)
+		if err != nil {
+			http.Error(w, "unable to open delta", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, "unable to stat delta", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", deltaContentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, path.Base(base.File)+".."+path.Base(target.File)+".delta"))
+		w.Header().Set("X-Delta-Base", from)
+		w.Header().Set("X-Delta-Base-Sha256", baseSum)
+		w.Header().Set("X-Delta-Target-Sha256", targetSum)
+		if _, err := io.Copy(egress.Writer(r.Context(), w), f); err != nil {
+			log.Printf("[registry] delta stream error: %v", err)
+		}
+	}
+}
+
+// buildDeltaFile writes the patch to a temp file and atomically moves it to dst.
+func buildDeltaFile(ctx context.Context, dir, dst string, baseRef, targetRef modelRef, baseSum, targetSum string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".delta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	base, err := openModel(ctx, baseRef)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	defer base.Close()
+	target, err := openModel(ctx, targetRef)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	defer target.Close()
+
+	if err := writeDelta(tmp, base, target, baseSum, targetSum); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// writeDelta encodes target as COPY/DATA ops against base.
+func writeDelta(out io.Writer, base, target storageObject, baseSum, targetSum string) error {
+	baseInfo, targetInfo := base.Info(), target.Info()
+	body, err := target.Range(0, targetInfo.Size())
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	enc := &deltaEncoder{w: bufio.NewWriterSize(out, 1<<20)}
+	if err := enc.header(baseSum, targetSum, targetInfo.Size()); err != nil {
+		return err
+	}
+
+	bs := deltaBlockSize
+	baseAt := objectReader(base)
+	index, err := indexBlocks(baseAt, baseInfo.Size(), bs)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReaderSize(body, 1<<20)
+	lit := make([]byte, bs, deltaMaxLiteral+bs)
+	n, err := io.ReadFull(r, lit)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return enc.finish(lit[:n])
+	} else if err != nil {
+		return err
+	}
+
+	probe := make([]byte, bs)
+	a, b := weakSum(lit)
+	for {
+		win := lit[len(lit)-bs:]
+		if offs, ok := index[a|b<<16]; ok {
+			if off, ok := matchBlock(baseAt, offs, win, probe); ok {
+				if err := enc.data(lit[:len(lit)-bs]); err != nil {
+					return err
+				}
+				if err := enc.copy(off, int64(bs)); err != nil {
+					return err
+				}
+				lit = lit[:bs]
+				n, err := io.ReadFull(r, lit)
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return enc.finish(lit[:n])
+				} else if err != nil {
+					return err
+				}
+				a, b = weakSum(lit)
+				continue
+			}
+		}
+
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return enc.finish(lit)
+		} else if err != nil {
+			return err
+		}
+		out := lit[len(lit)-bs]
+		lit = append(lit, c)
+		a = (a - uint32(out) + uint32(c)) & 0xffff
+		b = (b - uint32(bs)*uint32(out) + a) & 0xffff
+
+		// Bound memory: flush literals that can no longer be part of a match.
+		if len(lit) >= deltaMaxLiteral+bs {
+			if err := enc.data(lit[:len(lit)-bs]); err != nil {
+				return err
+			}
+			lit = lit[:copy(lit, lit[len(lit)-bs:])]
+		}
+	}
+}
+
+// indexBlocks maps the weak checksum of every full block of base to its offsets.
+func indexBlocks(base io.ReaderAt, size int64, bs int) (map[uint32][]int64, error) {
+	index := make(map[uint32][]int64)
+	r := bufio.NewReaderSize(io.NewSectionReader(base, 0, size), 1<<20)
+	buf := make([]byte, bs)
+	for off := int64(0); off+int64(bs) <= size; off += int64(bs) {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		a, b := weakSum(buf)
+		index[a|b<<16] = append(index[a|b<<16], off)
+	}
+	return index, nil
+}
+
+// matchBlock confirms a weak checksum hit by comparing the actual bytes.
+func matchBlock(base io.ReaderAt, offs []int64, win, probe []byte) (int64, bool) {
+	for _, off := range offs {
+		if _, err := base.ReadAt(probe, off); err != nil {
+			continue
+		}
+		if bytes.Equal(probe, win) {
+			return off, true
+		}
+	}
+	return 0, false
+}
+
+// weakSum is the rsync rolling checksum of p, split into its two 16-bit halves.
+func weakSum(p []byte) (a, b uint32) {
+	for i, c := range p {
+		a += uint32(c)
+		b += uint32(len(p)-i) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+// deltaEncoder writes patch ops, coalescing adjacent COPY ops.
+type deltaEncoder struct {
+	w       *bufio.Writer
+	copying bool
+	copyOff int64
+	copyLen int64
+}
+
+func (e *deltaEncoder) header(baseSum, targetSum string, size int64) error {
+	baseRaw, err := hex.DecodeString(baseSum)
+	if err != nil {
+		return err
+	}
+	targetRaw, err := hex.DecodeString(targetSum)
+	if err != nil {
+		return err
+	}
+	e.w.WriteString(deltaMagic)
+	e.w.Write(baseRaw)
+	e.w.Write(targetRaw)
+	return binary.Write(e.w, binary.BigEndian, uint64(size))
+}
+
+func (e *deltaEncoder) copy(off, n int64) error {
+	if e.copying && e.copyOff+e.copyLen == off {
+		e.copyLen += n
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.copying, e.copyOff, e.copyLen = true, off, n
+	return nil
+}
+
+func (e *deltaEncoder) flushCopy() error {
+	if !e.copying {
+		return nil
+	}
+	e.copying = false
+	e.w.WriteByte(deltaOpCopy)
+	binary.Write(e.w, binary.BigEndian, uint64(e.copyOff))
+	return binary.Write(e.w, binary.BigEndian, uint64(e.copyLen))
+}
+
+func (e *deltaEncoder) data(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.w.WriteByte(deltaOpData)
+	binary.Write(e.w, binary.BigEndian, uint64(len(p)))
+	_, err := e.w.Write(p)
+	return err
+}
+
+// finish emits any trailing literals and the END op.
+func (e *deltaEncoder) finish(tail []byte) error {
+	if err := e.data(tail); err != nil {
+		return err
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.w.WriteByte(deltaOpEnd)
+	return e.w.Flush()
+}
+
+// keyedMutex hands out one mutex per key, freeing it when unused.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+func (k *keyedMutex) Lock(key string) {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+	l.Lock()
+}
+
+// TryLock acquires key's mutex only if nobody holds it.
+func (k *keyedMutex) TryLock(key string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.locks[key]; ok {
+		return false
+	}
+	l := &keyedLock{refs: 1}
+	l.Lock()
+	k.locks[key] = l
+	return true
+}
+
+func (k *keyedMutex) Unlock(key string) {
+	k.mu.Lock()
+	l := k.locks[key]
+	l.refs--
+	if l.refs == 0 {
+		delete(k.locks, key)
+	}
+	k.mu.Unlock()
+	l.Unlock()
+}
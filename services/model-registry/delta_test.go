@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDeltaRefusesQuarantinedModels(t *testing.T) {
+	dir := newTestRegistry(t)
+	writeTestModel(t, dir, "base.gguf", []byte("GGUF base model bytes"))
+	writeTestModel(t, dir, "target.gguf", []byte("GGUF target model bytes"))
+	quarantinePeriod, adminToken = time.Hour, "admin-secret"
+	t.Cleanup(func() { quarantinePeriod, adminToken = 0, "" })
+
+	r := mux.NewRouter()
+	r.HandleFunc("/models/"+namePattern()+"/delta", deltaHandler(dir)).Methods(http.MethodGet)
+	delta := func() int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/models/target.gguf/delta?from=base.gguf", nil))
+		return w.Code
+	}
+	if got := delta(); got != http.StatusForbidden {
+		t.Errorf("quarantined target: status = %d, want 403", got)
+	}
+
+	now := time.Now().UTC()
+	if _, err := sidecars.Update("target.gguf", func(m *modelMeta) { m.ReleasedAt = &now }); err != nil {
+		t.Fatal(err)
+	}
+	if got := delta(); got != http.StatusForbidden {
+		t.Errorf("quarantined base: status = %d, want 403", got)
+	}
+
+	if _, err := sidecars.Update("base.gguf", func(m *modelMeta) { m.ReleasedAt = &now }); err != nil {
+		t.Fatal(err)
+	}
+	if got := delta(); got != http.StatusOK {
+		t.Errorf("released models: status = %d, want 200", got)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// digestKey identifies a file revision and digest algorithm; a change in size
+// or mtime invalidates any cached digest.
+type digestKey struct {
+	path    string
+	size    int64
+	modTime time.Time
+	algo    string
+}
+
+// digestCache memoizes digests of model files so repeated requests
+// don't re-read multi-GB files.
+type digestCache struct {
+	mu      sync.Mutex
+	entries map[digestKey]string
+}
+
+var digests = &digestCache{entries: make(map[digestKey]string)}
+
+// defaultChecksumConcurrency bounds how many files are hashed at once.
+const defaultChecksumConcurrency = 2
+
+// checksumSlots is a semaphore shared by everything that reads whole model
+// files to hash them, so digest work can't saturate the disk.
+var checksumSlots = make(chan struct{}, defaultChecksumConcurrency)
+
+// checksumTrailer carries a model's SHA-256 on download responses.
+const checksumTrailer = "X-Checksum-Sha256"
+
+// acceptsTrailers reports whether the client can receive HTTP trailers.
+// HTTP/2 always supports them; HTTP/1.1 clients must send "TE: trailers".
+func acceptsTrailers(r *http.Request) bool {
+	if r.ProtoMajor >= 2 {
+		return true
+	}
+	for _, v := range r.Header.Values("TE") {
+		for _, t := range strings.Split(v, ",") {
+			t, _, _ = strings.Cut(t, ";")
+			if strings.EqualFold(strings.TrimSpace(t), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Cached returns the SHA-256 for path if it is known for this revision.
+func (c *digestCache) Cached(path string, info os.FileInfo) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.entries[revisionKey(path, info, algoSHA256)]
+	return d, ok
+}
+
+// Peek returns the cached digests among algos without computing any, and
+// whether every one of them was cached.
+func (c *digestCache) Peek(path string, info os.FileInfo, algos []string) (map[string]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]string, len(algos))
+	for _, algo := range algos {
+		if d, ok := c.entries[revisionKey(path, info, algo)]; ok {
+			out[algo] = d
+		}
+	}
+	return out, len(out) == len(algos)
+}
+
+// Put records a SHA-256 computed elsewhere (e.g. while streaming).
+func (c *digestCache) Put(path string, info os.FileInfo, sum string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.put(revisionKey(path, info, algoSHA256), sum)
+}
+
+func revisionKey(path string, info os.FileInfo, algo string) digestKey {
+	return digestKey{path: path, size: info.Size(), modTime: info.ModTime(), algo: algo}
+}
+
+// put stores sum under key, dropping stale revisions of the same path and
+// any older digest for the same algorithm. The caller must hold c.mu.
+func (c *digestCache) put(key digestKey, sum string) {
+	for k := range c.entries {
+		if k.path == key.path && (k.algo == key.algo || k.size != key.size || !k.modTime.Equal(key.modTime)) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = sum
+}
+
+// SHA256 returns the hex SHA-256 of the file at path, using the cache when the
+// file is unchanged.
+func (c *digestCache) SHA256(path string, info os.FileInfo) (string, error) {
+	sums, err := c.Digests(path, info, []string{algoSHA256})
+	if err != nil {
+		return "", err
+	}
+	return sums[algoSHA256], nil
+}
+
+// Digests returns the hex digests of the file at path for each of algos.
+// Cached values are reused; the rest are computed together in a single read.
+func (c *digestCache) Digests(path string, info os.FileInfo, algos []string) (map[string]string, error) {
+	return c.digests(path, info, algos, func() (io.ReadCloser, error) { return os.Open(path) })
+}
+
+// ModelDigests is Digests for the model at ref, read from its store; the
+// cache is keyed by ref.Path() whichever store that is.
+func (c *digestCache) ModelDigests(ctx context.Context, ref modelRef, info os.FileInfo, algos []string) (map[string]string, error) {
+	return c.digests(ref.Path(), info, algos, func() (io.ReadCloser, error) { return openModelContent(ctx, ref, info.Size()) })
+}
+
+// ModelSHA256 is SHA256 for the model at ref.
+func (c *digestCache) ModelSHA256(ctx context.Context, ref modelRef, info os.FileInfo) (string, error) {
+	sums, err := c.ModelDigests(ctx, ref, info, []string{algoSHA256})
+	if err != nil {
+		return "", err
+	}
+	return sums[algoSHA256], nil
+}
+
+func (c *digestCache) digests(path string, info os.FileInfo, algos []string, open func() (io.ReadCloser, error)) (map[string]string, error) {
+	out := make(map[string]string, len(algos))
+	var missing []string
+	c.mu.Lock()
+	for _, algo := range algos {
+		if d, ok := c.entries[revisionKey(path, info, algo)]; ok {
+			out[algo] = d
+			digestLookups.Inc("hit")
+		} else {
+			missing = append(missing, algo)
+			digestLookups.Inc("miss")
+		}
+	}
+	c.mu.Unlock()
+	if len(missing) == 0 {
+		return out, nil
+	}
+
+	checksumSlots <- struct{}{}
+	defer func() { <-checksumSlots }()
+
+	f, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashers := make([]hash.Hash, len(missing))
+	writers := make([]io.Writer, len(missing))
+	for i, algo := range missing {
+		hashers[i] = checksumAlgos[algo]()
+		writers[i] = hashers[i]
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	for i, algo := range missing {
+		d := hex.EncodeToString(hashers[i].Sum(nil))
+		c.put(revisionKey(path, info, algo), d)
+		out[algo] = d
+	}
+	c.mu.Unlock()
+	return out, nil
+}
+
+// algoSHA256 is the digest used for trailers, deltas and integrity checks.
+const algoSHA256 = "sha256"
+
+// checksumAlgos are the digests the registry knows how to compute.
+var checksumAlgos = map[string]func() hash.Hash{
+	"md5":      md5.New,
+	"sha1":     sha1.New,
+	algoSHA256: sha256.New,
+	"sha384":   sha512.New384,
+	"sha512":   sha512.New,
+}
+
+// defaultChecksumAlgos is the enabled set unless MODEL_REGISTRY_CHECKSUM_ALGOS
+// says otherwise.
+const defaultChecksumAlgos = "sha256,sha512"
+
+// enabledAlgos are the algorithms clients may request with ?algo=.
+var enabledAlgos = map[string]bool{algoSHA256: true, "sha512": true}
+
+// parseChecksumAlgos validates a comma separated list of algorithm names.
+func parseChecksumAlgos(spec string) (map[string]bool, error) {
+	out := map[string]bool{}
+	for _, name := range splitList(spec) {
+		name = strings.ToLower(name)
+		if _, ok := checksumAlgos[name]; !ok {
+			return nil, fmt.Errorf("unsupported checksum algorithm %q", name)
+		}
+		out[name] = true
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("at least one algorithm is required")
+	}
+	return out, nil
+}
+
+// requestedAlgos parses ?algo=sha256,sha512 against the enabled set.
+func requestedAlgos(spec string) ([]string, error) {
+	var algos []string
+	seen := map[string]bool{}
+	for _, name := range splitList(spec) {
+		name = strings.ToLower(name)
+		if !enabledAlgos[name] {
+			return nil, fmt.Errorf("unsupported checksum algorithm %q (enabled: %s)", name, strings.Join(enabledAlgoNames(), ", "))
+		}
+		if !seen[name] {
+			seen[name] = true
+			algos = append(algos, name)
+		}
+	}
+	return algos, nil
+}
+
+// enabledAlgoNames lists the enabled algorithms in sorted order.
+func enabledAlgoNames() []string {
+	names := make([]string, 0, len(enabledAlgos))
+	for name := range enabledAlgos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// digestResponse is used by /models/{name}/digest
+type digestResponse struct {
+	Name    string            `json:"name"`
+	Version string            `json:"version,omitempty"`
+	Size    int64             `json:"size"`
+	Digests map[string]string `json:"digests"`
+}
+
+// digestHandler returns the digests of {name} for verifying a pulled copy:
+// every enabled algorithm (SHA-256 and SHA-512 by default) unless ?algo=
+// narrows the set.
+func digestHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := resolveModel(r, modelDir, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		algos, err := requestedAlgos(r.URL.Query().Get("algo"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(algos) == 0 {
+			algos = enabledAlgoNames()
+		}
+		info, err := statModel(r.Context(), ref)
+		if err != nil || info.IsDir() {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		}
+		sums, err := digests.ModelDigests(r.Context(), ref, info, algos)
+		if err != nil {
+			log.Printf("[registry] unable to hash %s: %v", ref.Name, err)
+			http.Error(w, "unable to hash model", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, digestResponse{Name: ref.Name, Version: ref.Version, Size: info.Size(), Digests: sums})
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import "syscall"
+
+// diskUsage reports the size of the filesystem holding dir and the space
+// left on it for unprivileged writers, in bytes.
+func diskUsage(dir string) (total, free uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Blocks * uint64(st.Bsize), st.Bavail * uint64(st.Bsize), nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// downloadTokenHeader carries the per-download token issued at the start
+	// of every /models/{name} GET when tracking is enabled.
+	downloadTokenHeader = "X-Download-Token"
+
+	defaultDownloadTokenTTL = 5 * time.Minute
+)
+
+// downloadTokens correlates a download's start with its outcome. Nil when
+// MODEL_REGISTRY_DOWNLOAD_TOKENS is off.
+var downloadTokens *downloadTokenTracker
+
+// downloadToken is the state kept for one issued token.
+type downloadToken struct {
+	Model   string
+	Started time.Time
+	Done    bool
+}
+
+// downloadTokenTracker is a short-lived map of issued tokens. Entries are
+// dropped after ttl; ones dropped before their download finished are logged
+// so stuck transfers show up.
+type downloadTokenTracker struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	tokens map[string]*downloadToken
+}
+
+func newDownloadTokenTracker(ttl time.Duration) *downloadTokenTracker {
+	if ttl <= 0 {
+		ttl = defaultDownloadTokenTTL
+	}
+	return &downloadTokenTracker{ttl: ttl, tokens: make(map[string]*downloadToken)}
+}
+
+// Issue records the start of a download of model and returns its token. A nil
+// tracker returns "".
+func (t *downloadTokenTracker) Issue(model string) string {
+	if t == nil {
+		return ""
+	}
+	var raw [8]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return ""
+	}
+	tok := hex.EncodeToString(raw[:])
+
+	t.mu.Lock()
+	t.tokens[tok] = &downloadToken{Model: model, Started: time.Now()}
+	t.mu.Unlock()
+	return tok
+}
+
+// Finish marks tok's download as ended and returns how long it ran.
+func (t *downloadTokenTracker) Finish(tok string) (time.Duration, bool) {
+	if t == nil || tok == "" {
+		return 0, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dt, ok := t.tokens[tok]
+	if !ok {
+		return 0, false
+	}
+	dt.Done = true
+	return time.Since(dt.Started), true
+}
+
+// expire drops tokens older than ttl.
+func (t *downloadTokenTracker) expire() {
+	cutoff := time.Now().Add(-t.ttl)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for tok, dt := range t.tokens {
+		if dt.Started.After(cutoff) {
+			continue
+		}
+		if !dt.Done {
+			log.Printf("[registry] download %s: model=%s still running after %s, no longer tracked", tok, dt.Model, t.ttl)
+		}
+		delete(t.tokens, tok)
+	}
+}
+
+// janitor periodically expires old tokens.
+func (t *downloadTokenTracker) janitor() {
+	for range time.Tick(t.ttl / 2) {
+		t.expire()
+	}
+}
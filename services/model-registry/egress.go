@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// egressChunk is the most a stream sends per reservation; small chunks
+	// interleave concurrent streams so none is starved.
+	egressChunk = 32 << 10
+
+	// egressWindow is the span the reported current rate is averaged over.
+	egressWindow = 5
+)
+
+// egress meters (and optionally caps) outbound model bytes for the whole node.
+var egress = newEgressLimiter(0)
+
+// streamLimit caps each download on its own in bytes/sec, under the node-wide
+// egress cap; 0 is unlimited.
+var streamLimit int64
+
+// egressLimiter is a token bucket shared by every download. Each write
+// reserves its bytes up front and sleeps until the bucket can pay for them;
+// reservations let the balance go negative, so waiting streams are served in
+// order rather than racing for refills. A zero rate only meters traffic.
+type egressLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes/sec, 0 = unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	total   int64
+	buckets [egressWindow]int64 // bytes per second, indexed by unix second
+	stamps  [egressWindow]int64
+}
+
+// egressStats is the egress section of the /stats response.
+type egressStats struct {
+	LimitBytesPerSec   int64 `json:"limit_bytes_per_sec"`
+	CurrentBytesPerSec int64 `json:"current_bytes_per_sec"`
+	BytesTotal         int64 `json:"bytes_total"`
+}
+
+func newEgressLimiter(rate int64) *egressLimiter {
+	l := &egressLimiter{rate: float64(rate), last: time.Now()}
+	// One second of traffic, but never less than a chunk or no write could
+	// ever be paid for in full.
+	l.burst = l.rate
+	if l.burst < egressChunk {
+		l.burst = egressChunk
+	}
+	l.tokens = l.burst
+	return l
+}
+
+// wait reserves n bytes and blocks until they may be sent or ctx ends.
+func (l *egressLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.record(now, n)
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// record adds n bytes to the per-second meter. The caller must hold l.mu.
+func (l *egressLimiter) record(now time.Time, n int) {
+	sec := now.Unix()
+	i := sec % egressWindow
+	if l.stamps[i] != sec {
+		l.stamps[i], l.buckets[i] = sec, 0
+	}
+	l.buckets[i] += int64(n)
+	l.total += int64(n)
+}
+
+// Stats reports the cap, the average rate over the last egressWindow seconds
+// and the running total.
+func (l *egressLimiter) Stats() egressStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now().Unix()
+	var sum int64
+	for i := range l.buckets {
+		if now-l.stamps[i] < egressWindow {
+			sum += l.buckets[i]
+		}
+	}
+	return egressStats{
+		LimitBytesPerSec:   int64(l.rate),
+		CurrentBytesPerSec: sum / egressWindow,
+		BytesTotal:         l.total,
+	}
+}
+
+// Writer wraps w so writes draw from the shared egress budget and, with
+// streamLimit set, from a budget of their own.
+func (l *egressLimiter) Writer(ctx context.Context, w io.Writer) io.Writer {
+	e := &egressWriter{l: l, ctx: ctx, w: w}
+	if streamLimit > 0 {
+		e.stream = newEgressLimiter(streamLimit)
+	}
+	return e
+}
+
+type egressWriter struct {
+	l      *egressLimiter
+	stream *egressLimiter // nil without a per-stream cap
+	ctx    context.Context
+	w      io.Writer
+}
+
+func (e *egressWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > egressChunk {
+			chunk = chunk[:egressChunk]
+		}
+		if e.stream != nil {
+			if err := e.stream.wait(e.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		if err := e.l.wait(e.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := e.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
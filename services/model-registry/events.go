@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Registry event types.
+const (
+	eventDownloadStarted   = "download.started"
+	eventDownloadFinished  = "download.finished"
+	eventModelUploaded     = "model.uploaded"
+	eventModelDeleted      = "model.deleted"
+	eventModelTagged       = "model.tagged"
+	eventModelPromoted     = "model.promoted"
+	eventApprovalRequested = "approval.requested" // a promotion to production awaits approval
+	eventApprovalDecided   = "approval.decided"   // it was approved, rejected or went stale
+	eventAttack            = "attack.detected"    // attack telemetry recorded an attack
+	eventHoneypot          = "honeypot.triggered" // a honeypot model's download started
+
+	// Catalog changes as /changes reports them: a model entering, leaving or
+	// changing in the default listing.
+	eventModelAdded   = "model.added"
+	eventModelRemoved = "model.removed"
+	eventModelUpdated = "model.updated"
+)
+
+// catalogEventTypes maps catalog change kinds to event types.
+var catalogEventTypes = map[string]string{
+	changeAdded:    eventModelAdded,
+	changeRemoved:  eventModelRemoved,
+	changeModified: eventModelUpdated,
+}
+
+const (
+	defaultEventBuffer         = 64
+	defaultCatalogScanInterval = 10 * time.Second
+	sseHeartbeat               = 15 * time.Second
+)
+
+// registryEvent is one entry on the event stream.
+type registryEvent struct {
+	ID    uint64         `json:"id"`
+	Type  string         `json:"type"`
+	Model string         `json:"model,omitempty"`
+	Time  time.Time      `json:"time"`
+	Data  map[string]any `json:"data,omitempty"`
+}
+
+// eventBroker fans registry events out to subscribers. Each subscriber has a
+// bounded buffer; a subscriber that falls behind is dropped instead of
+// blocking the publisher (which is usually a request handler).
+type eventBroker struct {
+	mu      sync.Mutex
+	nextID  uint64
+	bufSize int
+	subs    map[chan registryEvent]struct{}
+	dropped int64
+}
+
+var events = newEventBroker(defaultEventBuffer)
+
+func newEventBroker(bufSize int) *eventBroker {
+	if bufSize <= 0 {
+		bufSize = defaultEventBuffer
+	}
+	return &eventBroker{bufSize: bufSize, subs: make(map[chan registryEvent]struct{})}
+}
+
+// Publish sends ev to every subscriber, and to the webhooks subscribed to
+// its type, without blocking.
+func (b *eventBroker) Publish(typ, model string, data map[string]any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	ev := registryEvent{ID: b.nextID, Type: typ, Model: model, Time: time.Now().UTC(), Data: data}
+	webhooks.Notify(ev)
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			// Slow consumer: cut it loose so producers never wait.
+			delete(b.subs, ch)
+			close(ch)
+			b.dropped++
+			log.Printf("[registry] dropped slow event subscriber (total dropped=%d)", b.dropped)
+		}
+	}
+}
+
+// Subscribe registers a new subscriber. The returned channel is closed when
+// the subscriber is dropped or cancel is called.
+func (b *eventBroker) Subscribe() (<-chan registryEvent, func()) {
+	ch := make(chan registryEvent, b.bufSize)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// Close disconnects every subscriber, e.g. so SSE streams end on shutdown.
+func (b *eventBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// eventsHandler streams registry events as Server-Sent Events until the
+// client disconnects or is dropped for falling behind. ?type= takes a comma
+// separated list of event types to limit the stream to.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	var only map[string]bool
+	if spec := r.URL.Query().Get("type"); spec != "" {
+		only = map[string]bool{}
+		for _, typ := range splitList(spec) {
+			only[typ] = true
+		}
+	}
+
+	ch, cancel := events.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case ev, ok := <-ch:
+			if !ok {
+				return // dropped as a slow consumer
+			}
+			if only != nil && !only[ev.Type] {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modelExpiry hides models older than a configured age. Models matching one of
+// the exempt globs, and pinned ones, are never expired. A zero maxAge disables the check.
+type modelExpiry struct {
+	maxAge time.Duration
+	exempt []string
+
+	mu      sync.Mutex
+	expired map[string]bool // names already reported as expired
+}
+
+var expiry = newModelExpiry(0, nil)
+
+func newModelExpiry(maxAge time.Duration, exempt []string) *modelExpiry {
+	return &modelExpiry{maxAge: maxAge, exempt: exempt, expired: make(map[string]bool)}
+}
+
+// parseGlobList splits a comma separated list of filepath.Match patterns.
+func parseGlobList(spec string) ([]string, error) {
+	var globs []string
+	for _, g := range strings.Split(spec, ",") {
+		g = strings.TrimSpace(g)
+		if g == "" {
+			continue
+		}
+		if _, err := filepath.Match(g, ""); err != nil {
+			return nil, err
+		}
+		globs = append(globs, g)
+	}
+	return globs, nil
+}
+
+// matchAny reports whether name matches any of globs.
+func matchAny(globs []string, name string) bool {
+	for _, g := range globs {
+		if ok, _ := filepath.Match(g, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Check reports whether the model with the given mtime is expired and its age.
+// It works off the mtime the caller already has from stat, so it costs no I/O.
+func (e *modelExpiry) Check(name string, modTime time.Time) (age time.Duration, expired bool) {
+	age = time.Since(modTime)
+	if e.maxAge <= 0 || age <= e.maxAge || matchAny(e.exempt, name) || pins.Covers(name) {
+		e.mu.Lock()
+		delete(e.expired, name) // replaced by a fresh file, or policy changed
+		e.mu.Unlock()
+		return age, false
+	}
+
+	e.mu.Lock()
+	if !e.expired[name] {
+		e.expired[name] = true
+		log.Printf("[registry] model %s expired: age %s exceeds max %s", name, age.Round(time.Second), e.maxAge)
+	}
+	e.mu.Unlock()
+	return age, true
+}
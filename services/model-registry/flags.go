@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// CTF flags. The file named by MODEL_REGISTRY_FLAGS_FILE lists challenges,
+// each planting one model per team with that team's flag in its GGUF
+// metadata, at the end of the file, or both. Model names and metadata are
+// templates, so one entry covers every team. Flags are derived from
+// MODEL_REGISTRY_FLAG_SECRET, the team and the challenge, so nothing needs
+// storing: the same secret plants the same flags after a restart, and
+// POST /flags/verify recomputes them to check a submission.
+
+const (
+	defaultFlagPrefix   = "CRASHPAY"
+	flagTokenLen        = 32 // hex characters of the HMAC
+	minFlagSecretLength = 16
+
+	flagVerifyRouteName = "flags_verify"
+)
+
+// flagsFile is the layout of MODEL_REGISTRY_FLAGS_FILE.
+type flagsFile struct {
+	Prefix     string          `json:"prefix"` // flags look like PREFIX{token}
+	Teams      []string        `json:"teams"`
+	Challenges []flagChallenge `json:"challenges"`
+}
+
+// flagChallenge plants a model per team. Model and the metadata values are
+// text/template templates over {{.Team}}, {{.Challenge}} and {{.Flag}}.
+type flagChallenge struct {
+	Name         string            `json:"name"`
+	Model        string            `json:"model"`
+	Architecture string            `json:"architecture"`
+	Size         int64             `json:"size"`
+	Metadata     map[string]string `json:"metadata"`
+	Trailer      bool              `json:"trailer"`  // append the flag after the padding
+	Honeypot     bool              `json:"honeypot"` // alert on downloads of the models
+}
+
+// plantedFlag is one team's flag for one challenge.
+type plantedFlag struct {
+	Team      string `json:"team"`
+	Challenge string `json:"challenge"`
+	Model     string `json:"model"`
+	Flag      string `json:"flag"`
+
+	data     []byte
+	honeypot bool
+}
+
+// flagSet is every planted flag.
+type flagSet struct {
+	secret []byte
+	prefix string
+	flags  []plantedFlag
+}
+
+// ctfFlags is the flag set; nil without MODEL_REGISTRY_FLAGS_FILE.
+var ctfFlags *flagSet
+
+// flagData is what the templates see.
+type flagData struct {
+	Team, Challenge, Flag string
+}
+
+// loadFlags reads the flags file and renders every team's models. teams,
+// if set, replaces the file's team list.
+func loadFlags(file, secret, teams string) (*flagSet, error) {
+	if len(secret) < minFlagSecretLength {
+		return nil, fmt.Errorf("MODEL_REGISTRY_FLAG_SECRET must be at least %d characters", minFlagSecretLength)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var ff flagsFile
+	if err := json.Unmarshal(data, &ff); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if teams != "" {
+		ff.Teams = splitList(teams)
+	}
+	if ff.Prefix == "" {
+		ff.Prefix = defaultFlagPrefix
+	}
+	if len(ff.Teams) == 0 || len(ff.Challenges) == 0 {
+		return nil, fmt.Errorf("%s: at least one team and one challenge are required", file)
+	}
+	for _, t := range ff.Teams {
+		if !teamPattern.MatchString(t) {
+			return nil, fmt.Errorf("invalid team %q (up to 64 letters, digits and _.:-)", t)
+		}
+	}
+
+	s := &flagSet{secret: []byte(secret), prefix: ff.Prefix}
+	names := map[string]bool{}
+	if activeScenario != nil {
+		for _, d := range activeScenario.Decoys {
+			names[d.Name] = true
+		}
+	}
+	challenges := map[string]bool{}
+	for _, c := range ff.Challenges {
+		if c.Name == "" || challenges[c.Name] {
+			return nil, fmt.Errorf("%s: every challenge needs a unique name", file)
+		}
+		challenges[c.Name] = true
+		if c.Size < 0 || c.Size > maxDecoySize {
+			return nil, fmt.Errorf("challenge %s: size must be between 0 and %d", c.Name, maxDecoySize)
+		}
+		for _, team := range ff.Teams {
+			f, err := s.render(c, team)
+			if err != nil {
+				return nil, fmt.Errorf("challenge %s: %w", c.Name, err)
+			}
+			if names[f.Model] {
+				return nil, fmt.Errorf("challenge %s: model %s is planted twice", c.Name, f.Model)
+			}
+			names[f.Model] = true
+			s.flags = append(s.flags, f)
+		}
+	}
+	return s, nil
+}
+
+// flag returns team's flag for challenge.
+func (s *flagSet) flag(team, challenge string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte("flag\x00" + challenge + "\x00" + team))
+	return s.prefix + "{" + hex.EncodeToString(mac.Sum(nil))[:flagTokenLen] + "}"
+}
+
+// render builds team's model for c.
+func (s *flagSet) render(c flagChallenge, team string) (plantedFlag, error) {
+	fd := flagData{Team: team, Challenge: c.Name, Flag: s.flag(team, c.Name)}
+	name, err := renderFlagTemplate(c.Model, fd)
+	if err != nil {
+		return plantedFlag{}, fmt.Errorf("model: %w", err)
+	}
+	if path.Ext(name) != ".gguf" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		return plantedFlag{}, fmt.Errorf("model %q must be a top-level .gguf name", name)
+	}
+	d := decoyModel{Name: name, Architecture: c.Architecture, Size: c.Size, Metadata: map[string]string{}}
+	for k, v := range c.Metadata {
+		if d.Metadata[k], err = renderFlagTemplate(v, fd); err != nil {
+			return plantedFlag{}, fmt.Errorf("metadata %s: %w", k, err)
+		}
+	}
+	var trailer []byte
+	if c.Trailer {
+		trailer = []byte("\n" + fd.Flag + "\n")
+		d.Size -= int64(len(trailer))
+	}
+	return plantedFlag{Team: team, Challenge: c.Name, Model: name, Flag: fd.Flag,
+		data: append(decoyGGUF(d), trailer...), honeypot: c.Honeypot}, nil
+}
+
+func renderFlagTemplate(text string, fd flagData) (string, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, fd); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// plant writes every flag model whose stored content differs, e.g. after
+// the secret changed. Flag models belong to the registry, so whatever has
+// the name is replaced. tmpDir takes spooled bodies.
+func (s *flagSet) plant(tmpDir string) error {
+	ctx := context.Background()
+	for _, f := range s.flags {
+		if !isModelFile(f.Model) {
+			return fmt.Errorf("flag model %s isn't a model under MODEL_EXTS", f.Model)
+		}
+		if f.honeypot {
+			if decoyHoneypots == nil {
+				decoyHoneypots = map[string]bool{}
+			}
+			decoyHoneypots[f.Model] = true
+		}
+		same, err := storedContentIs(ctx, f.Model, f.data)
+		if err != nil {
+			return fmt.Errorf("flag model %s: %w", f.Model, err)
+		}
+		if same {
+			continue
+		}
+		if err := putModel(ctx, f.Model, f.data, tmpDir); err != nil {
+			return fmt.Errorf("flag model %s: %w", f.Model, err)
+		}
+	}
+	log.Printf("[registry] planted %d CTF flags for %d teams", len(s.flags), len(s.teams()))
+	return nil
+}
+
+// teams returns the team names, sorted.
+func (s *flagSet) teams() []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, f := range s.flags {
+		if !seen[f.Team] {
+			seen[f.Team] = true
+			out = append(out, f.Team)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// storedContentIs reports whether the model name exists with exactly data.
+func storedContentIs(ctx context.Context, name string, data []byte) (bool, error) {
+	obj, err := storage.Open(ctx, name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer obj.Close()
+	if obj.Info().Size() != int64(len(data)) {
+		return false, nil
+	}
+	body, err := obj.Range(0, int64(len(data)))
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(got, data), nil
+}
+
+// lookup returns the planted flag equal to flag, comparing in constant time.
+func (s *flagSet) lookup(flag string) (plantedFlag, bool) {
+	var found plantedFlag
+	ok := false
+	for _, f := range s.flags {
+		if subtle.ConstantTimeCompare([]byte(flag), []byte(f.Flag)) == 1 {
+			found, ok = f, true
+		}
+	}
+	return found, ok
+}
+
+// flagVerifyRequest is the body of POST /flags/verify.
+type flagVerifyRequest struct {
+	Team string `json:"team"`
+	Flag string `json:"flag"`
+}
+
+// flagVerifyResponse is its answer. A flag of another team is not valid
+// for the submitting one; Owner says whose it is.
+type flagVerifyResponse struct {
+	Valid     bool   `json:"valid"`
+	Team      string `json:"team,omitempty"`
+	Challenge string `json:"challenge,omitempty"`
+	Owner     string `json:"owner,omitempty"`
+}
+
+// verifyFlagHandler serves POST /flags/verify. Without a team the flag is
+// valid if it is anyone's.
+func verifyFlagHandler(w http.ResponseWriter, r *http.Request) {
+	if ctfFlags == nil {
+		http.Error(w, "no CTF flags planted (MODEL_REGISTRY_FLAGS_FILE)", http.StatusNotFound)
+		return
+	}
+	var req flagVerifyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil || req.Flag == "" {
+		http.Error(w, `body must be a JSON object like {"team": "red", "flag": "CRASHPAY{...}"}`, http.StatusBadRequest)
+		return
+	}
+	resp := flagVerifyResponse{Team: req.Team}
+	if f, ok := ctfFlags.lookup(strings.TrimSpace(req.Flag)); ok {
+		resp.Challenge, resp.Owner = f.Challenge, f.Team
+		resp.Valid = req.Team == "" || req.Team == f.Team
+		if !resp.Valid {
+			log.Printf("[registry] team %s submitted the %s flag of team %s", req.Team, f.Challenge, f.Team)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// listFlagsHandler serves GET /flags: every planted flag, for instructors.
+func listFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	if ctfFlags == nil {
+		http.Error(w, "no CTF flags planted (MODEL_REGISTRY_FLAGS_FILE)", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"flags": ctfFlags.flags})
+}
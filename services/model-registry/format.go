@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Upload-time format checks. A model's extension says nothing about the
+// bytes behind it, so before an upload is stored its header is parsed and
+// checked against the file. For GGUF that's the magic and version, every
+// metadata value, every tensor info, and tensor data offsets that are aligned
+// and inside the file; for safetensors, the JSON header and tensor byte
+// ranges that fit their dtype and shape and the file. A body failing any of
+// these is refused with a 422 instead of being served as a model. Tensor data
+// itself isn't read. Formats without a header worth checking (onnx, bin) are
+// stored as sent.
+
+// ggufDefaultAlignment is the tensor data alignment of files without
+// general.alignment.
+const ggufDefaultAlignment = 32
+
+// validateUploads enables the checks; MODEL_REGISTRY_VALIDATE_UPLOADS.
+var validateUploads = true
+
+// checkModelFormat reports why body isn't a usable model of the format
+// name's extension says, or nil.
+func checkModelFormat(name string, body *spooledBody) error {
+	switch modelFormat(name) {
+	case "gguf":
+		return checkGGUF(body)
+	case "safetensors":
+		if _, err := readSafetensorsHeader(body.ReaderAt(), body.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkGGUF reports why body isn't a usable GGUF model, or nil.
+func checkGGUF(body *spooledBody) error {
+	src := io.NewSectionReader(body.ReaderAt(), 0, min(body.Size, ggufMaxHeaderLen))
+	g := &ggufReader{r: bufio.NewReaderSize(src, 64<<10)}
+	h, err := g.header()
+	switch {
+	case err == errNotGGUF && isSafetensors(body):
+		return errors.New("this is a safetensors file, not GGUF")
+	case err == errNotGGUF:
+		return errors.New("not a GGUF file (bad magic)")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("GGUF header is truncated")
+	case err != nil:
+		return fmt.Errorf("invalid GGUF header: %w", err)
+	}
+
+	align := uint64(ggufDefaultAlignment)
+	if v, ok := h.Metadata["general.alignment"]; ok {
+		if align, ok = ggufUint(v); !ok || align == 0 || align&(align-1) != 0 {
+			return fmt.Errorf("invalid general.alignment %v", v)
+		}
+	}
+	var last uint64
+	err = g.tensorInfos(h.TensorCount, func(elems, offset uint64) error {
+		if offset%align != 0 {
+			return fmt.Errorf("tensor data offset %d isn't aligned to %d bytes", offset, align)
+		}
+		last = max(last, offset)
+		return nil
+	})
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.New("GGUF tensor infos are truncated")
+	} else if err != nil {
+		return fmt.Errorf("invalid GGUF tensor info: %w", err)
+	}
+
+	pos, _ := src.Seek(0, io.SeekCurrent)
+	end := uint64(pos) - uint64(g.r.Buffered()) // end of the tensor infos
+	data := (end + align - 1) / align * align
+	if h.TensorCount > 0 && data+last >= uint64(body.Size) {
+		return fmt.Errorf("tensor data at offset %d is past the end of the file (%d bytes)", data+last, body.Size)
+	}
+	return nil
+}
+
+// isSafetensors reports whether body starts like a safetensors file.
+func isSafetensors(body *spooledBody) bool {
+	_, err := readSafetensorsHeader(body.ReaderAt(), body.Size)
+	return err != errNotSafetensors
+}
+
+// safetensorsMaxHeader bounds the JSON header, as the reference
+// implementation does.
+const safetensorsMaxHeader = 100 << 20
+
+var errNotSafetensors = errors.New("not a safetensors file")
+
+// safetensorsDtypeSizes are the element sizes of safetensors dtypes.
+var safetensorsDtypeSizes = map[string]uint64{
+	"BOOL": 1, "U8": 1, "I8": 1, "F8_E4M3": 1, "F8_E5M2": 1,
+	"U16": 2, "I16": 2, "F16": 2, "BF16": 2,
+	"U32": 4, "I32": 4, "F32": 4,
+	"U64": 8, "I64": 8, "F64": 8,
+}
+
+// safetensorsHeader is the safetensors section of the metadata response.
+type safetensorsHeader struct {
+	TensorCount    int               `json:"tensor_count"`
+	ParameterCount uint64            `json:"parameter_count"`
+	Dtypes         map[string]int    `json:"dtypes"` // tensors per dtype
+	Metadata       map[string]string `json:"metadata,omitempty"`
+}
+
+// safetensorsTensor is one entry of a safetensors header.
+type safetensorsTensor struct {
+	Dtype   string   `json:"dtype"`
+	Shape   []uint64 `json:"shape"`
+	Offsets []uint64 `json:"data_offsets"`
+}
+
+// readSafetensorsHeader parses and checks the header of the size byte
+// safetensors file in r: a little-endian uint64 length, then a JSON object
+// of tensors (and optional string metadata) whose byte ranges, relative to
+// the end of the header, must match their dtype and shape and fit the file.
+// It returns errNotSafetensors for files that don't start like one.
+func readSafetensorsHeader(r io.ReaderAt, size int64) (*safetensorsHeader, error) {
+	var prefix [9]byte
+	if _, err := r.ReadAt(prefix[:], 0); err != nil || prefix[8] != '{' {
+		return nil, errNotSafetensors
+	}
+	n := binary.LittleEndian.Uint64(prefix[:8])
+	if n > safetensorsMaxHeader || n > uint64(size)-8 {
+		return nil, errNotSafetensors
+	}
+	raw := make([]byte, n)
+	if _, err := r.ReadAt(raw, 8); err != nil {
+		return nil, err
+	}
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, fmt.Errorf("invalid safetensors header: %w", err)
+	}
+	data := uint64(size) - 8 - n
+	h := &safetensorsHeader{Dtypes: map[string]int{}}
+	for name, v := range entries {
+		if name == "__metadata__" {
+			if err := json.Unmarshal(v, &h.Metadata); err != nil {
+				return nil, fmt.Errorf("invalid safetensors __metadata__: %w", err)
+			}
+			continue
+		}
+		var t safetensorsTensor
+		if err := json.Unmarshal(v, &t); err != nil {
+			return nil, fmt.Errorf("safetensors tensor %q: %w", name, err)
+		}
+		elemSize, ok := safetensorsDtypeSizes[t.Dtype]
+		if !ok {
+			return nil, fmt.Errorf("safetensors tensor %q has unknown dtype %q", name, t.Dtype)
+		}
+		if len(t.Shape) > ggufMaxDims {
+			return nil, fmt.Errorf("safetensors tensor %q has %d dimensions", name, len(t.Shape))
+		}
+		elems := uint64(1)
+		for _, d := range t.Shape {
+			hi, lo := bits.Mul64(elems, d)
+			if hi != 0 {
+				return nil, fmt.Errorf("safetensors tensor %q size overflows", name)
+			}
+			elems = lo
+		}
+		if len(t.Offsets) != 2 || t.Offsets[0] > t.Offsets[1] || t.Offsets[1] > data {
+			return nil, fmt.Errorf("safetensors tensor %q data_offsets %v are outside the %d data bytes", name, t.Offsets, data)
+		}
+		if hi, want := bits.Mul64(elems, elemSize); hi != 0 || t.Offsets[1]-t.Offsets[0] != want {
+			return nil, fmt.Errorf("safetensors tensor %q holds %d bytes, its dtype and shape need %d", name, t.Offsets[1]-t.Offsets[0], want)
+		}
+		h.TensorCount++
+		h.ParameterCount += elems
+		h.Dtypes[t.Dtype]++
+	}
+	return h, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Garbage collection. Crashes, dropped connections and killed processes
+// leave things behind that nothing else cleans up: upload sessions nobody
+// comes back to, temp files from spooling, hub pulls, tiering and delta
+// patches, and blobs whose models were deleted while the store was off.
+// The collector finds them every MODEL_REGISTRY_GC_INTERVAL, and on POST
+// /admin/gc; with MODEL_REGISTRY_GC_DRY_RUN it only reports what it would
+// remove.
+
+const (
+	defaultGCInterval = time.Hour
+	defaultGCTempAge  = time.Hour
+	maxGCItems        = 1000 // listed in a result; the totals count all
+)
+
+// Kinds of garbage.
+const (
+	gcUploadSession = "upload_session"
+	gcTempFile      = "temp_file"
+	gcBlob          = "blob"
+	gcChunk         = "chunk"
+)
+
+// gcTempPrefixes are the names temp files get before they are renamed into
+// place. Files ending in .tmp count too, but only inside the state dir.
+var gcTempPrefixes = []string{".upload-", ".hub-", ".tier-", ".delta-", ".chunks-", ".chunk-", ".blob-"}
+
+var (
+	gcRemovedFiles = metrics.Counter("gc_removed_files_total", "Files removed by garbage collection by kind", "kind")
+	gcFreedBytes   = metrics.Counter("gc_reclaimed_bytes_total", "Bytes reclaimed by garbage collection by kind", "kind")
+)
+
+// gcItem is one piece of garbage.
+type gcItem struct {
+	Kind  string `json:"kind"`
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+// gcTotal sums the items of a kind.
+type gcTotal struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// gcResult is one collection, used by /admin/gc.
+type gcResult struct {
+	Time      time.Time          `json:"time"`
+	DryRun    bool               `json:"dry_run"`
+	Duration  string             `json:"duration"`
+	Files     int                `json:"files"`
+	Bytes     int64              `json:"bytes"` // reclaimed, or reclaimable on a dry run
+	Kinds     map[string]gcTotal `json:"kinds"`
+	Items     []gcItem           `json:"items"`
+	Truncated bool               `json:"truncated,omitempty"`
+}
+
+func (res *gcResult) add(items ...gcItem) {
+	for _, it := range items {
+		t := res.Kinds[it.Kind]
+		t.Files++
+		t.Bytes += it.Bytes
+		res.Kinds[it.Kind] = t
+		res.Files++
+		res.Bytes += it.Bytes
+		if len(res.Items) < maxGCItems {
+			res.Items = append(res.Items, it)
+		} else {
+			res.Truncated = true
+		}
+		if !res.DryRun {
+			gcRemovedFiles.Inc(it.Kind)
+			gcFreedBytes.Add(float64(it.Bytes), it.Kind)
+		}
+	}
+}
+
+// garbageCollector runs one collection at a time and keeps the last result.
+type garbageCollector struct {
+	modelDir string
+	tempAge  time.Duration // temp files younger than this may be in use
+	dryRun   bool          // MODEL_REGISTRY_GC_DRY_RUN, for scheduled runs
+
+	run  sync.Mutex
+	mu   sync.Mutex
+	last *gcResult
+}
+
+// collector is the garbage collector, always set.
+var collector *garbageCollector
+
+func newGarbageCollector(modelDir string, tempAge time.Duration, dryRun bool) *garbageCollector {
+	return &garbageCollector{modelDir: modelDir, tempAge: tempAge, dryRun: dryRun}
+}
+
+// Collect removes the garbage, or with dryRun lists it.
+func (c *garbageCollector) Collect(dryRun bool) *gcResult {
+	c.run.Lock()
+	defer c.run.Unlock()
+	start := time.Now()
+	res := &gcResult{Time: start.UTC(), DryRun: dryRun, Kinds: map[string]gcTotal{}, Items: []gcItem{}}
+	res.add(sweepUploadSessions(c.modelDir, dryRun)...)
+	res.add(c.tempFiles(dryRun)...)
+	if blobs != nil {
+		res.add(c.blobs(dryRun)...)
+	}
+	if chunkStorage != nil {
+		c.chunks(res, dryRun)
+	}
+	res.Duration = time.Since(start).Round(time.Millisecond).String()
+
+	c.mu.Lock()
+	c.last = res
+	c.mu.Unlock()
+	switch {
+	case res.Files == 0:
+	case dryRun:
+		log.Printf("[registry] gc dry run: %d files, %d bytes reclaimable", res.Files, res.Bytes)
+	default:
+		log.Printf("[registry] gc: removed %d files, %d bytes", res.Files, res.Bytes)
+	}
+	return res
+}
+
+// Last returns the latest result, or nil before the first run.
+func (c *garbageCollector) Last() *gcResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// janitor collects garbage every interval.
+func (c *garbageCollector) janitor(every time.Duration) {
+	for range time.Tick(every) {
+		c.Collect(c.dryRun)
+	}
+}
+
+// tempFiles removes temp files older than tempAge anywhere under the model
+// directory. Upload sessions keep their own files and are left to
+// sweepUploadSessions.
+func (c *garbageCollector) tempFiles(dryRun bool) []gcItem {
+	state := filepath.Join(c.modelDir, stateDirName)
+	sessions := uploadSessionsDir(c.modelDir)
+	cutoff := time.Now().Add(-c.tempAge)
+	var items []gcItem
+	filepath.WalkDir(c.modelDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if p == sessions {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isGCTempFile(d.Name(), strings.HasPrefix(p, state+string(filepath.Separator))) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		if !dryRun {
+			if err := os.Remove(p); err != nil {
+				log.Printf("[registry] gc: unable to remove %s: %v", p, err)
+				return nil
+			}
+		}
+		items = append(items, gcItem{Kind: gcTempFile, Path: p, Bytes: info.Size()})
+		return nil
+	})
+	return items
+}
+
+func isGCTempFile(name string, inState bool) bool {
+	for _, prefix := range gcTempPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return inState && strings.HasSuffix(name, ".tmp")
+}
+
+// blobs removes blobs no sidecar points at. Blobs younger than tempAge are
+// kept, since an upload links its blob before writing the sidecar. Blobs
+// are hard links, so the bytes only come back when the model file is gone
+// too; a blob whose file still has another name counts zero bytes.
+func (c *garbageCollector) blobs(dryRun bool) []gcItem {
+	blobs.mu.Lock()
+	defer blobs.mu.Unlock()
+	entries, err := os.ReadDir(blobs.dir)
+	if err != nil {
+		return nil
+	}
+	referenced := sidecars.Digests()
+	cutoff := time.Now().Add(-c.tempAge)
+	var items []gcItem
+	for _, e := range entries {
+		sum := e.Name()
+		if !blobDigestPattern.MatchString(sum) || referenced[sum] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		size := info.Size()
+		if linkCount(info) > 1 {
+			size = 0
+		}
+		if !dryRun {
+			if err := os.Remove(blobs.path(sum)); err != nil {
+				log.Printf("[registry] gc: unable to remove blob %s: %v", sum, err)
+				continue
+			}
+		}
+		items = append(items, gcItem{Kind: gcBlob, Path: blobs.path(sum), Bytes: size})
+	}
+	return items
+}
+
+// chunks collects unreferenced chunks. The chunk store doesn't list them,
+// so they appear in the totals only.
+func (c *garbageCollector) chunks(res *gcResult, dryRun bool) {
+	var t gcTotal
+	if dryRun {
+		st := chunkStorage.Stats()
+		t = gcTotal{Files: st.Unreferenced, Bytes: st.Reclaimable}
+	} else {
+		r := chunkStorage.GC()
+		t = gcTotal{Files: r.Removed, Bytes: r.Freed}
+		gcRemovedFiles.Add(float64(t.Files), gcChunk)
+		gcFreedBytes.Add(float64(t.Bytes), gcChunk)
+	}
+	if t.Files == 0 {
+		return
+	}
+	res.Kinds[gcChunk] = t
+	res.Files += t.Files
+	res.Bytes += t.Bytes
+}
+
+// linkCount is the number of names info's file has.
+func linkCount(info fs.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
+
+// gcHandler serves POST /admin/gc: collect now. ?dry_run=true only lists
+// the garbage; without it MODEL_REGISTRY_GC_DRY_RUN decides.
+func gcHandler(w http.ResponseWriter, r *http.Request) {
+	dryRun := collector.dryRun
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "dry_run must be true or false", http.StatusBadRequest)
+			return
+		}
+		dryRun = b
+	}
+	writeJSON(w, http.StatusOK, collector.Collect(dryRun))
+}
+
+// lastGCHandler serves GET /admin/gc: the latest result.
+func lastGCHandler(w http.ResponseWriter, r *http.Request) {
+	res := collector.Last()
+	if res == nil {
+		http.Error(w, "no garbage collection has run yet", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Digests returns the SHA-256 of every model with a sidecar.
+func (s *sidecarStore) Digests() map[string]bool {
+	sums := map[string]bool{}
+	filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".json") {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		var m modelMeta
+		if json.Unmarshal(data, &m) == nil && m.Sha256 != "" {
+			sums[m.Sha256] = true
+		}
+		return nil
+	})
+	return sums
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Google Cloud Storage driver.
+//
+// With STORAGE_DRIVER=gcs the models of the primary backend are objects in
+// one bucket, reached over the JSON API. Uploads larger than a chunk go up
+// as resumable uploads, one chunk per request. Access tokens come from the
+// service account key in GOOGLE_APPLICATION_CREDENTIALS or, without one,
+// from the metadata server.
+const (
+	defaultGCSEndpoint  = "https://storage.googleapis.com"
+	defaultGCSChunkSize = 64 << 20
+	gcsChunkQuantum     = 256 << 10 // resumable chunks are multiples of this
+	gcsScope            = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcsMetadataHost     = "metadata.google.internal"
+)
+
+// gcsBucket is a Storage talking to one bucket over the JSON API.
+type gcsBucket struct {
+	endpoint  string
+	name      string
+	prefix    string // object name prefix models live under, "" or ending in "/"
+	chunkSize int64
+	tokens    *gcsTokenSource // nil sends requests unauthenticated
+	client    *http.Client
+}
+
+func newGCSBucket(endpoint, name, prefix string, chunkSize int64) (*gcsBucket, error) {
+	if name == "" {
+		return nil, errors.New("MODEL_REGISTRY_GCS_BUCKET is required")
+	}
+	custom := endpoint != ""
+	if !custom {
+		endpoint = defaultGCSEndpoint
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("endpoint %q is not an http(s) URL", endpoint)
+	}
+	if chunkSize <= 0 || chunkSize%gcsChunkQuantum != 0 {
+		return nil, fmt.Errorf("chunk size %d is not a multiple of %d", chunkSize, gcsChunkQuantum)
+	}
+	b := &gcsBucket{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		name:      name,
+		prefix:    objectPrefix(prefix),
+		chunkSize: chunkSize,
+		client:    &http.Client{Transport: traceTransport(nil)},
+	}
+	// An emulator behind a custom endpoint usually takes no credentials.
+	if file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); file != "" {
+		ts, err := newServiceAccountTokens(file, b.client)
+		if err != nil {
+			return nil, err
+		}
+		b.tokens = ts
+	} else if !custom {
+		b.tokens = newMetadataTokens(getenv("GCE_METADATA_HOST", gcsMetadataHost), b.client)
+	}
+	return b, nil
+}
+
+// String names the bucket and prefix for logs.
+func (b *gcsBucket) String() string {
+	return "gs://" + b.name + "/" + b.prefix
+}
+
+// gcsErrorBody is the body of a failed JSON API response.
+type gcsErrorBody struct {
+	Error struct {
+		Message string `json:"message"`
+		Errors  []struct {
+			Reason string `json:"reason"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+// readGCSError turns a failed response into a storageError; 404s become
+// fs.ErrNotExist.
+func readGCSError(resp *http.Response, key string) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return &fs.PathError{Op: storageDriverGCS, Path: key, Err: fs.ErrNotExist}
+	}
+	e := &storageError{Driver: storageDriverGCS, Status: resp.StatusCode}
+	var body gcsErrorBody
+	if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body) == nil {
+		e.Message = body.Error.Message
+		if len(body.Error.Errors) > 0 {
+			e.Code = body.Error.Errors[0].Reason
+		}
+	}
+	return e
+}
+
+// objectURL returns the JSON API URL of key (without the prefix).
+func (b *gcsBucket) objectURL(key string, query url.Values) string {
+	u := b.endpoint + "/storage/v1/b/" + url.PathEscape(b.name) + "/o/" + url.PathEscape(b.prefix+key)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// do authorizes and sends a request to rawURL.
+func (b *gcsBucket) do(ctx context.Context, method, rawURL string, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if b.tokens != nil {
+		token, err := b.tokens.Token(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("gcs: unable to get an access token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return b.client.Do(req)
+}
+
+// gcsObjectResource is the part of an object's metadata the driver uses.
+// The API sends 64-bit numbers as strings.
+type gcsObjectResource struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size,string"`
+	Updated    time.Time `json:"updated"`
+	Generation string    `json:"generation"`
+}
+
+func (o gcsObjectResource) info(key string) *objectInfo {
+	return &objectInfo{key: key, size: o.Size, modTime: o.Updated, etag: o.Generation}
+}
+
+func (b *gcsBucket) Stat(ctx context.Context, key string) (os.FileInfo, error) {
+	return b.stat(ctx, key)
+}
+
+func (b *gcsBucket) stat(ctx context.Context, key string) (*objectInfo, error) {
+	resp, err := b.do(ctx, http.MethodGet, b.objectURL(key, nil), nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readGCSError(resp, key)
+	}
+	var obj gcsObjectResource
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return nil, err
+	}
+	return obj.info(key), nil
+}
+
+// Open looks key up; the object's reads only succeed while its generation
+// is unchanged, so a download never mixes two uploads.
+func (b *gcsBucket) Open(ctx context.Context, key string) (storageObject, error) {
+	info, err := b.stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsObject{b: b, ctx: ctx, info: info}, nil
+}
+
+// gcsObject is an object looked up by Open. It keeps the caller's context,
+// which bounds its reads.
+type gcsObject struct {
+	b    *gcsBucket
+	ctx  context.Context
+	info *objectInfo
+}
+
+func (o *gcsObject) Info() os.FileInfo { return o.info }
+
+// Range streams length bytes from offset with one ranged media download.
+func (o *gcsObject) Range(offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	query := url.Values{"alt": {"media"}}
+	if o.info.etag != "" {
+		query.Set("ifGenerationMatch", o.info.etag)
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	resp, err := o.b.do(o.ctx, http.MethodGet, o.b.objectURL(o.info.key, query), header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent && (resp.StatusCode != http.StatusOK || offset != 0) {
+		defer resp.Body.Close()
+		return nil, readGCSError(resp, o.info.key)
+	}
+	return resp.Body, nil
+}
+
+func (o *gcsObject) Close() error { return nil }
+
+// uploadURL returns the upload endpoint for key with the given upload type.
+func (b *gcsBucket) uploadURL(key, uploadType string) string {
+	query := url.Values{"uploadType": {uploadType}, "name": {b.prefix + key}}
+	return b.endpoint + "/upload/storage/v1/b/" + url.PathEscape(b.name) + "/o?" + query.Encode()
+}
+
+// Put stores the body with one media upload up to the chunk size, as a
+// resumable upload beyond it.
+func (b *gcsBucket) Put(ctx context.Context, key string, body *spooledBody) error {
+	defer body.Discard()
+	src, size := body.ReaderAt(), body.Size
+	if size <= b.chunkSize {
+		header := http.Header{"Content-Type": {"application/octet-stream"}}
+		resp, err := b.do(ctx, http.MethodPost, b.uploadURL(key, "media"), header, io.NewSectionReader(src, 0, size), size)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return readGCSError(resp, key)
+		}
+		return nil
+	}
+	return b.putResumable(ctx, key, src, size)
+}
+
+// putResumable starts a resumable upload session and sends src to it one
+// chunk per request, canceling the session on any failure.
+func (b *gcsBucket) putResumable(ctx context.Context, key string, src io.ReaderAt, size int64) (err error) {
+	header := http.Header{
+		"X-Upload-Content-Type":   {"application/octet-stream"},
+		"X-Upload-Content-Length": {strconv.FormatInt(size, 10)},
+	}
+	resp, err := b.do(ctx, http.MethodPost, b.uploadURL(key, "resumable"), header, nil, 0)
+	if err != nil {
+		return err
+	}
+	session := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusOK {
+		err = readGCSError(resp, key)
+	} else if session == "" {
+		err = errors.New("gcs: resumable upload started without a session URI")
+	}
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			// A fresh context: the upload's own may be what was canceled.
+			if resp, cancelErr := b.do(context.Background(), http.MethodDelete, session, nil, nil, 0); cancelErr == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	for off := int64(0); off < size; off += b.chunkSize {
+		length := min(b.chunkSize, size-off)
+		header := http.Header{"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", off, off+length-1, size)}}
+		resp, err := b.do(ctx, http.MethodPut, session, header, io.NewSectionReader(src, off, length), length)
+		if err != nil {
+			return err
+		}
+		last := off+length == size
+		switch {
+		case !last && resp.StatusCode == http.StatusPermanentRedirect: // 308: send the next chunk
+		case last && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated):
+		default:
+			defer resp.Body.Close()
+			return readGCSError(resp, key)
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// Delete removes key.
+func (b *gcsBucket) Delete(ctx context.Context, key string) error {
+	resp, err := b.do(ctx, http.MethodDelete, b.objectURL(key, nil), nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return readGCSError(resp, key)
+	}
+	return nil
+}
+
+// gcsListResult is the body of an objects list response.
+type gcsListResult struct {
+	Items         []gcsObjectResource `json:"items"`
+	NextPageToken string              `json:"nextPageToken"`
+}
+
+// List returns the models in the bucket like scanModels does for a
+// directory: .gguf objects under the prefix, including those under deeper
+// prefixes in recursive mode, skipping hidden path segments, sorted by name.
+func (b *gcsBucket) List(ctx context.Context) ([]modelFile, error) {
+	var out []modelFile
+	query := url.Values{}
+	if b.prefix != "" {
+		query.Set("prefix", b.prefix)
+	}
+	if !recursive {
+		query.Set("delimiter", "/")
+	}
+	for {
+		u := b.endpoint + "/storage/v1/b/" + url.PathEscape(b.name) + "/o"
+		if len(query) > 0 {
+			u += "?" + query.Encode()
+		}
+		resp, err := b.do(ctx, http.MethodGet, u, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var page gcsListResult
+		if resp.StatusCode != http.StatusOK {
+			err = readGCSError(resp, "")
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Items {
+			name, ok := objectModelName(obj.Name, b.prefix)
+			if !ok {
+				continue
+			}
+			out = append(out, modelFile{Name: name, Info: obj.info(name)})
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// gcsTokenSource hands out OAuth access tokens, fetching a new one shortly
+// before the cached one expires.
+type gcsTokenSource struct {
+	fetch func(ctx context.Context) (token string, expiresIn int64, err error)
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (s *gcsTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Until(s.expires) > time.Minute {
+		return s.token, nil
+	}
+	token, expiresIn, err := s.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	s.token, s.expires = token, time.Now().Add(time.Duration(expiresIn)*time.Second)
+	return token, nil
+}
+
+// gcsTokenResponse is the body of a token endpoint or metadata server reply.
+type gcsTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func readTokenResponse(resp *http.Response) (string, int64, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return "", 0, fmt.Errorf("token endpoint answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var t gcsTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", 0, err
+	}
+	if t.AccessToken == "" {
+		return "", 0, errors.New("token endpoint sent no access token")
+	}
+	return t.AccessToken, t.ExpiresIn, nil
+}
+
+// newMetadataTokens gets the default service account's tokens from the
+// metadata server of the instance the registry runs on.
+func newMetadataTokens(host string, client *http.Client) *gcsTokenSource {
+	return &gcsTokenSource{fetch: func(ctx context.Context) (string, int64, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", 0, err
+		}
+		return readTokenResponse(resp)
+	}}
+}
+
+// gcsServiceAccount is the part of a service account key file the driver uses.
+type gcsServiceAccount struct {
+	Type        string `json:"type"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// newServiceAccountTokens exchanges JWTs signed with the key in file for
+// access tokens, as the OAuth 2.0 JWT bearer flow does.
+func newServiceAccountTokens(file string, client *http.Client) (*gcsTokenSource, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var sa gcsServiceAccount
+	if err := json.Unmarshal(b, &sa); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if sa.Type != "service_account" || sa.ClientEmail == "" || sa.TokenURI == "" {
+		return nil, fmt.Errorf("%s is not a service account key", file)
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s: private_key is not PEM", file)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("%s: private_key is not an RSA key", file)
+	}
+
+	return &gcsTokenSource{fetch: func(ctx context.Context) (string, int64, error) {
+		now := time.Now().Unix()
+		claims, _ := json.Marshal(map[string]any{
+			"iss":   sa.ClientEmail,
+			"scope": gcsScope,
+			"aud":   sa.TokenURI,
+			"iat":   now,
+			"exp":   now + 3600,
+		})
+		enc := base64.RawURLEncoding
+		unsigned := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString(claims)
+		sum := sha256.Sum256([]byte(unsigned))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			return "", 0, err
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, sa.TokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", 0, err
+		}
+		return readTokenResponse(resp)
+	}}, nil
+}
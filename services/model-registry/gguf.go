@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"sync"
+)
+
+// GGUF header parsing for /models/{name}/metadata and detailed listings. Only
+// the fixed header, the metadata key/value section and the tensor infos are
+// read; tensor data is never touched.
+
+const ggufMagic = 0x46554747 // "GGUF" little-endian
+
+// Limits that keep a malformed or hostile file from making the parser
+// allocate or read without bound.
+const (
+	ggufMaxKeys      = 1 << 16
+	ggufMaxString    = 1 << 20
+	ggufMaxArray     = 1 << 24
+	ggufInlineArray  = 16 // longer arrays (e.g. tokenizer vocabularies) are summarized
+	ggufMaxHeaderLen = 256 << 20
+	ggufMaxTensors   = 1 << 20
+	ggufMaxDims      = 8
+)
+
+var errNotGGUF = errors.New("not a GGUF file")
+
+// GGUF metadata value types.
+const (
+	ggufUint8 uint32 = iota
+	ggufInt8
+	ggufUint16
+	ggufInt16
+	ggufUint32
+	ggufInt32
+	ggufFloat32
+	ggufBool
+	ggufString
+	ggufArray
+	ggufUint64
+	ggufInt64
+	ggufFloat64
+)
+
+var ggufTypeNames = map[uint32]string{
+	ggufUint8: "uint8", ggufInt8: "int8", ggufUint16: "uint16", ggufInt16: "int16",
+	ggufUint32: "uint32", ggufInt32: "int32", ggufFloat32: "float32", ggufBool: "bool",
+	ggufString: "string", ggufArray: "array", ggufUint64: "uint64", ggufInt64: "int64",
+	ggufFloat64: "float64",
+}
+
+// ggufFileTypes names the values of general.file_type (llama_ftype), in the
+// spelling parseQuant uses for file names.
+var ggufFileTypes = map[uint64]string{
+	0: "F32", 1: "F16", 2: "Q4_0", 3: "Q4_1", 7: "Q8_0", 8: "Q5_0", 9: "Q5_1",
+	10: "Q2_K", 11: "Q3_K_S", 12: "Q3_K_M", 13: "Q3_K_L", 14: "Q4_K_S",
+	15: "Q4_K_M", 16: "Q5_K_S", 17: "Q5_K_M", 18: "Q6_K", 19: "IQ2_XXS",
+	20: "IQ2_XS", 21: "Q2_K_S", 22: "IQ3_XS", 23: "IQ3_XXS", 24: "IQ1_S",
+	25: "IQ4_NL", 26: "IQ3_S", 27: "IQ3_M", 28: "IQ2_S", 29: "IQ2_M",
+	30: "IQ4_XS", 31: "IQ1_M", 32: "BF16", 36: "TQ1_0", 37: "TQ2_0",
+}
+
+// ggufHeader is the gguf section of the metadata response. The summary
+// fields are derived from well-known keys and from the tensor infos, and are
+// omitted when the file doesn't have them.
+type ggufHeader struct {
+	Version        uint32         `json:"version"`
+	TensorCount    uint64         `json:"tensor_count"`
+	Architecture   string         `json:"architecture,omitempty"`
+	Quantization   string         `json:"quantization,omitempty"`
+	ContextLength  uint64         `json:"context_length,omitempty"`
+	ParameterCount uint64         `json:"parameter_count,omitempty"`
+	Metadata       map[string]any `json:"metadata"`
+}
+
+// ggufArraySummary stands in for arrays too long to return inline.
+type ggufArraySummary struct {
+	Type   string `json:"type"`
+	Length uint64 `json:"length"`
+}
+
+// ggufCache memoizes parsed headers per file revision, like the digest cache.
+var ggufCache = struct {
+	mu      sync.Mutex
+	entries map[digestKey]*ggufHeader
+}{entries: map[digestKey]*ggufHeader{}}
+
+// readGGUFHeader parses the header of the file at path, using the cache when
+// the file is unchanged. It returns errNotGGUF for files without the magic.
+func readGGUFHeader(path string, info os.FileInfo) (*ggufHeader, error) {
+	return ggufHeaderOf(path, info, func() (io.ReadCloser, error) { return os.Open(path) })
+}
+
+// readModelGGUFHeader is readGGUFHeader for the model at ref, read from its
+// store.
+func readModelGGUFHeader(ctx context.Context, ref modelRef, info os.FileInfo) (*ggufHeader, error) {
+	return ggufHeaderOf(ref.Path(), info, func() (io.ReadCloser, error) { return openModelContent(ctx, ref, ggufMaxHeaderLen) })
+}
+
+func ggufHeaderOf(path string, info os.FileInfo, open func() (io.ReadCloser, error)) (*ggufHeader, error) {
+	key := revisionKey(path, info, "gguf")
+	ggufCache.mu.Lock()
+	h, ok := ggufCache.entries[key]
+	ggufCache.mu.Unlock()
+	if ok {
+		return h, nil
+	}
+
+	f, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h, err = parseGGUFHeader(io.LimitReader(f, ggufMaxHeaderLen))
+	if err != nil {
+		return nil, err
+	}
+
+	ggufCache.mu.Lock()
+	for k := range ggufCache.entries {
+		if k.path == path {
+			delete(ggufCache.entries, k)
+		}
+	}
+	ggufCache.entries[key] = h
+	ggufCache.mu.Unlock()
+	return h, nil
+}
+
+// ggufReader decodes little-endian GGUF primitives; v1 files use 32-bit
+// lengths and counts where later versions use 64-bit ones.
+type ggufReader struct {
+	r       *bufio.Reader
+	version uint32
+	buf     [8]byte
+}
+
+func parseGGUFHeader(src io.Reader) (*ggufHeader, error) {
+	g := &ggufReader{r: bufio.NewReaderSize(src, 64<<10)}
+	h, err := g.header()
+	if err != nil {
+		return nil, err
+	}
+	// Tensor infos follow the metadata. A file cut short here still has a
+	// usable header, it just lacks a parameter count.
+	if n, err := g.parameterCount(h.TensorCount); err == nil {
+		h.ParameterCount = n
+	}
+	return h, nil
+}
+
+// header reads the fixed header and the metadata key/value section.
+func (g *ggufReader) header() (*ggufHeader, error) {
+	magic, err := g.u32()
+	if err != nil || magic != ggufMagic {
+		return nil, errNotGGUF
+	}
+	if g.version, err = g.u32(); err != nil {
+		return nil, err
+	}
+	if g.version < 1 || g.version > 3 {
+		return nil, fmt.Errorf("unsupported GGUF version %d", g.version)
+	}
+	h := &ggufHeader{Version: g.version, Metadata: map[string]any{}}
+	if h.TensorCount, err = g.count(); err != nil {
+		return nil, err
+	}
+	kvs, err := g.count()
+	if err != nil {
+		return nil, err
+	}
+	if kvs > ggufMaxKeys {
+		return nil, fmt.Errorf("GGUF header declares %d metadata keys", kvs)
+	}
+	for i := uint64(0); i < kvs; i++ {
+		key, err := g.str()
+		if err != nil {
+			return nil, err
+		}
+		typ, err := g.u32()
+		if err != nil {
+			return nil, err
+		}
+		v, err := g.value(typ)
+		if err != nil {
+			return nil, fmt.Errorf("GGUF key %q: %w", key, err)
+		}
+		h.Metadata[key] = v
+	}
+	h.summarize()
+	return h, nil
+}
+
+// summarize fills in the summary fields from the metadata.
+func (h *ggufHeader) summarize() {
+	h.Architecture, _ = h.Metadata["general.architecture"].(string)
+	if ft, ok := ggufUint(h.Metadata["general.file_type"]); ok {
+		h.Quantization = ggufFileTypes[ft]
+	}
+	if h.Architecture != "" {
+		h.ContextLength, _ = ggufUint(h.Metadata[h.Architecture+".context_length"])
+	}
+}
+
+// parameterCount reads n tensor infos and sums their element counts.
+func (g *ggufReader) parameterCount(n uint64) (uint64, error) {
+	var total uint64
+	err := g.tensorInfos(n, func(elems, offset uint64) error {
+		var carry uint64
+		if total, carry = bits.Add64(total, elems, 0); carry != 0 {
+			return errors.New("parameter count overflows")
+		}
+		return nil
+	})
+	return total, err
+}
+
+// tensorInfos reads n tensor infos, passing each tensor's element count and
+// data offset to fn.
+func (g *ggufReader) tensorInfos(n uint64, fn func(elems, offset uint64) error) error {
+	if n > ggufMaxTensors {
+		return fmt.Errorf("GGUF header declares %d tensors", n)
+	}
+	for i := uint64(0); i < n; i++ {
+		if _, err := g.str(); err != nil {
+			return err
+		}
+		dims, err := g.u32()
+		if err != nil {
+			return err
+		}
+		if dims > ggufMaxDims {
+			return fmt.Errorf("tensor with %d dimensions", dims)
+		}
+		elems := uint64(1)
+		for d := uint32(0); d < dims; d++ {
+			size, err := g.count()
+			if err != nil {
+				return err
+			}
+			hi, lo := bits.Mul64(elems, size)
+			if hi != 0 {
+				return errors.New("tensor size overflows")
+			}
+			elems = lo
+		}
+		if _, err := g.u32(); err != nil { // type
+			return err
+		}
+		offset, err := g.u64()
+		if err != nil {
+			return err
+		}
+		if err := fn(elems, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ggufUint returns an unsigned integer metadata value of any width.
+func ggufUint(v any) (uint64, bool) {
+	switch n := v.(type) {
+	case uint8:
+		return uint64(n), true
+	case uint16:
+		return uint64(n), true
+	case uint32:
+		return uint64(n), true
+	case uint64:
+		return n, true
+	case int32:
+		return uint64(n), n >= 0
+	case int64:
+		return uint64(n), n >= 0
+	}
+	return 0, false
+}
+
+func (g *ggufReader) fixed(n int) ([]byte, error) {
+	if _, err := io.ReadFull(g.r, g.buf[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return g.buf[:n], nil
+}
+
+func (g *ggufReader) u32() (uint32, error) {
+	b, err := g.fixed(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (g *ggufReader) u64() (uint64, error) {
+	b, err := g.fixed(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// count reads a length or count field.
+func (g *ggufReader) count() (uint64, error) {
+	if g.version == 1 {
+		n, err := g.u32()
+		return uint64(n), err
+	}
+	return g.u64()
+}
+
+func (g *ggufReader) str() (string, error) {
+	n, err := g.count()
+	if err != nil {
+		return "", err
+	}
+	if n > ggufMaxString {
+		return "", fmt.Errorf("string of %d bytes exceeds %d", n, ggufMaxString)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(g.r, b); err != nil {
+		return "", io.ErrUnexpectedEOF
+	}
+	return string(b), nil
+}
+
+// value reads one metadata value of typ.
+func (g *ggufReader) value(typ uint32) (any, error) {
+	switch typ {
+	case ggufUint8, ggufInt8, ggufBool:
+		b, err := g.fixed(1)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case ggufInt8:
+			return int8(b[0]), nil
+		case ggufBool:
+			return b[0] != 0, nil
+		}
+		return b[0], nil
+	case ggufUint16, ggufInt16:
+		b, err := g.fixed(2)
+		if err != nil {
+			return nil, err
+		}
+		v := binary.LittleEndian.Uint16(b)
+		if typ == ggufInt16 {
+			return int16(v), nil
+		}
+		return v, nil
+	case ggufUint32, ggufInt32, ggufFloat32:
+		v, err := g.u32()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case ggufInt32:
+			return int32(v), nil
+		case ggufFloat32:
+			return jsonFloat(float64(math.Float32frombits(v))), nil
+		}
+		return v, nil
+	case ggufUint64, ggufInt64, ggufFloat64:
+		v, err := g.u64()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case ggufInt64:
+			return int64(v), nil
+		case ggufFloat64:
+			return jsonFloat(math.Float64frombits(v)), nil
+		}
+		return v, nil
+	case ggufString:
+		return g.str()
+	case ggufArray:
+		return g.array()
+	}
+	return nil, fmt.Errorf("unknown value type %d", typ)
+}
+
+// array reads an array value. Short arrays are returned in full; longer ones
+// are skipped over and summarized by element type and length.
+func (g *ggufReader) array() (any, error) {
+	elem, err := g.u32()
+	if err != nil {
+		return nil, err
+	}
+	n, err := g.count()
+	if err != nil {
+		return nil, err
+	}
+	if n > ggufMaxArray {
+		return nil, fmt.Errorf("array of %d elements exceeds %d", n, ggufMaxArray)
+	}
+	if elem == ggufArray {
+		return nil, errors.New("nested arrays are not supported")
+	}
+	name, ok := ggufTypeNames[elem]
+	if !ok {
+		return nil, fmt.Errorf("unknown array element type %d", elem)
+	}
+	if n <= ggufInlineArray {
+		out := make([]any, 0, n)
+		for i := uint64(0); i < n; i++ {
+			v, err := g.value(elem)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}
+	for i := uint64(0); i < n; i++ {
+		if elem == ggufString {
+			l, err := g.count()
+			if err != nil {
+				return nil, err
+			}
+			if l > ggufMaxString {
+				return nil, fmt.Errorf("string of %d bytes exceeds %d", l, ggufMaxString)
+			}
+			if _, err := g.r.Discard(int(l)); err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			continue
+		}
+		if _, err := g.value(elem); err != nil {
+			return nil, err
+		}
+	}
+	return ggufArraySummary{Type: name, Length: n}, nil
+}
+
+// jsonFloat keeps NaN and infinities, which JSON can't represent, as strings.
+func jsonFloat(f float64) any {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Sprint(f)
+	}
+	return f
+}
@@ -1,7 +1,17 @@
 module model-registry
 
-go 1.21
+go 1.25.0
 
 require (
 	github.com/gorilla/mux v1.8.0
-) 
\ No newline at end of file
+	github.com/klauspost/compress v1.20.1
+	google.golang.org/grpc v1.84.0
+	google.golang.org/protobuf v1.36.11
+)
+
+require (
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260706201446-f0a921348800 // indirect
+)
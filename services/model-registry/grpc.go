@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"model-registry/registrypb"
+)
+
+// gRPC API.
+//
+// MODEL_REGISTRY_GRPC_PORT serves the ModelRegistry service from
+// registrypb/registry.proto on a second port, for internal services that
+// would rather call ListModels, GetMetadata and StreamModel than speak HTTP
+// downloads. It shares the catalog, lifecycle rules, rate limits and egress
+// budget with the HTTP API, and the TLS certificate when one is configured.
+
+// grpcEnabled is set when MODEL_REGISTRY_GRPC_PORT serves the API.
+var grpcEnabled bool
+
+// grpcServer implements registrypb.ModelRegistryServer over modelDir.
+type grpcServer struct {
+	registrypb.UnimplementedModelRegistryServer
+	modelDir string
+}
+
+// newGRPCServer returns a gRPC server with the registry service registered;
+// creds is nil for plaintext.
+func newGRPCServer(modelDir string, creds credentials.TransportCredentials) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(grpcTraceUnary, grpcLogUnary, grpcJWTUnary, grpcAuthUnary, grpcRateLimitUnary),
+		grpc.ChainStreamInterceptor(grpcTraceStream, grpcLogStream, grpcJWTStream, grpcAuthStream, grpcRateLimitStream),
+	}
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+	s := grpc.NewServer(opts...)
+	registrypb.RegisterModelRegistryServer(s, &grpcServer{modelDir: modelDir})
+	return s
+}
+
+// serveGRPC listens on addr until s is stopped.
+func serveGRPC(s *grpc.Server, addr string) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("fatal: %v", err)
+	}
+	log.Printf("[registry] gRPC listening on %s", addr)
+	if err := s.Serve(lis); err != nil {
+		log.Fatalf("fatal: %v", err)
+	}
+}
+
+// stopGRPC lets in-flight calls finish until ctx is done, then cuts them off.
+func stopGRPC(ctx context.Context, s *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.Stop()
+	}
+}
+
+// grpcLogUnary and grpcLogStream log calls like loggingMiddleware logs
+// requests, with the status code in place of the HTTP status.
+func grpcLogUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	id := grpcRequestID(ctx)
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, id))
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	resp, err := handler(ctx, req)
+	logGRPC(ctx, info.FullMethod, err, start)
+	return resp, err
+}
+
+func grpcLogStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	id := grpcRequestID(ss.Context())
+	ss.SetHeader(metadata.Pairs(requestIDHeader, id))
+	ctx := context.WithValue(ss.Context(), requestIDKey{}, id)
+	err := handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	logGRPC(ctx, info.FullMethod, err, start)
+	return err
+}
+
+func logGRPC(ctx context.Context, method string, err error, start time.Time) {
+	e := accessEntry{
+		RequestID: requestID(ctx),
+		Method:    "grpc",
+		Path:      method,
+		Code:      status.Code(err).String(),
+		Duration:  time.Since(start),
+		Client:    grpcClient(ctx),
+		Identity:  grpcIdentity(ctx),
+	}
+	if c := grpcClaims(ctx); c != nil {
+		e.Subject = c.Subject
+	}
+	if name, _, ok := apiKeys.Lookup(grpcAPIKey(ctx)); ok {
+		e.Key = name
+	}
+	logAccess(e)
+}
+
+// grpcIsAdmin is isAdmin for gRPC calls.
+func grpcIsAdmin(ctx context.Context) bool {
+	return grpcRole(ctx) == roleAdmin
+}
+
+// grpcAdminToken is the admin token candidate of a gRPC call: the
+// x-admin-token or authorization (Bearer) metadata.
+func grpcAdminToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get("x-admin-token"); len(v) > 0 {
+		return v[0]
+	} else if v := md.Get("authorization"); len(v) > 0 {
+		return strings.TrimPrefix(v[0], "Bearer ")
+	}
+	return ""
+}
+
+// grpcClient is the caller's address for download events.
+func grpcClient(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+func modelProto(name, version string, info os.FileInfo) *registrypb.Model {
+	return &registrypb.Model{
+		Name:     name,
+		Size:     info.Size(),
+		Modified: timestamppb.New(info.ModTime()),
+		Status:   modelStatus(name, info),
+		Version:  version,
+	}
+}
+
+func (s *grpcServer) ListModels(ctx context.Context, req *registrypb.ListModelsRequest) (*registrypb.ListModelsResponse, error) {
+	scope, err := backendScope(req.Backend)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	resp := &registrypb.ListModelsResponse{}
+	allowed := grpcModelFilter(ctx)
+	for _, backend := range scope {
+		found, err := backendStorage(backend, s.modelDir).List(ctx)
+		if err != nil {
+			log.Printf("[registry] unable to list backend %s: %v", backend, err)
+			return nil, status.Error(codes.Internal, "unable to list models")
+		}
+		if backend == primaryBackend && tier != nil {
+			found = append(found, tier.Uncached(found)...)
+		}
+		for _, f := range found {
+			f.Name = qualifiedName(backend, f.Name)
+			if st := modelStatus(f.Key(), f.Info); st == statusExpired || st == statusQuarantined || !strings.HasPrefix(f.Name, req.Prefix) || !allowed(f.Name) {
+				continue
+			}
+			m := modelProto(f.Key(), f.Version, f.Info)
+			m.Name = f.Name
+			resp.Models = append(resp.Models, m)
+		}
+	}
+	return resp, nil
+}
+
+// grpcNameError maps a failed lookup of a requested name to a status; names
+// no model can have are not found, as over HTTP.
+func grpcNameError(err error) error {
+	if errors.As(err, new(invalidNameError)) {
+		return status.Error(codes.NotFound, "model not found")
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+func (s *grpcServer) GetMetadata(ctx context.Context, req *registrypb.GetMetadataRequest) (*registrypb.GetMetadataResponse, error) {
+	ref, err := resolveModel(nil, s.modelDir, req.Name)
+	if err != nil {
+		return nil, grpcNameError(err)
+	}
+	if !grpcModelFilter(ctx)(ref.Base()) {
+		return nil, status.Error(codes.NotFound, "model not found")
+	}
+	algos, err := requestedAlgos(strings.Join(req.Algos, ","))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	info, err := statModel(ctx, ref)
+	if err != nil || info.IsDir() {
+		return nil, status.Error(codes.NotFound, "model not found")
+	}
+
+	all := algos
+	if !slices.Contains(algos, algoSHA256) {
+		all = append([]string{algoSHA256}, algos...)
+	}
+	sums, err := digests.ModelDigests(ctx, ref, info, all)
+	if err != nil {
+		log.Printf("[registry] unable to hash %s: %v", ref.Name, err)
+		return nil, status.Error(codes.Internal, "unable to hash model")
+	}
+	resp := &registrypb.GetMetadataResponse{
+		Model:  modelProto(ref.Name, ref.Version, info),
+		Sha256: sums[algoSHA256],
+	}
+	if len(algos) > 0 {
+		resp.Digests = make(map[string]string, len(algos))
+		for _, algo := range algos {
+			resp.Digests[algo] = sums[algo]
+		}
+	}
+	switch h, err := readModelGGUFHeader(ctx, ref, info); {
+	case err == nil:
+		resp.Gguf = &registrypb.GGUFHeader{
+			Version:        h.Version,
+			TensorCount:    h.TensorCount,
+			Architecture:   h.Architecture,
+			Quantization:   h.Quantization,
+			ContextLength:  h.ContextLength,
+			ParameterCount: h.ParameterCount,
+		}
+	case err != errNotGGUF:
+		log.Printf("[registry] unable to parse GGUF header of %s: %v", ref.Name, err)
+	}
+	return resp, nil
+}
+
+// StreamModel follows streamHandler's rules for downloads: per-model rate
+// limits, expiry, quarantine (lifted by the admin token), the range gate for
+// partial reads and the egress budget. Models missing locally aren't fetched
+// from the Hugging Face Hub, and origin-tier reads don't fill the local tier.
+func (s *grpcServer) StreamModel(req *registrypb.StreamModelRequest, stream grpc.ServerStreamingServer[registrypb.ModelChunk]) error {
+	ctx := stream.Context()
+	// With path_traversal on, names with ".." segments are used as given,
+	// as HTTP downloads take them.
+	traversal := vulns.Enabled(vulnPathTraversal) && slices.Contains(strings.Split(req.Name, "/"), "..")
+	ref, err := lookupModelRef(nil, s.modelDir, req.Name, traversal)
+	if err != nil {
+		return grpcNameError(err)
+	}
+	ref = ref.resolveLatest()
+	if !grpcModelFilter(ctx)(ref.Base()) {
+		return status.Error(codes.NotFound, "model not found")
+	}
+	name := ref.Name
+	if d := limits().model.Allow(name); !d.Allowed {
+		return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+	if err := streams.Begin(name, true); errors.Is(err, errStreamDeleting) {
+		return status.Error(codes.NotFound, "model not found")
+	} else if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer streams.End(name)
+
+	var obj storageObject
+	if tier != nil && ref.Backend == primaryBackend && ref.Version == "" {
+		var f *os.File
+		if f, _, err = tier.Open(s.modelDir, ref.File); err == nil {
+			obj, err = newLocalObject(f)
+		}
+	} else if traversal {
+		var f *os.File
+		if f, err = os.Open(ref.Path()); err == nil {
+			obj, err = newLocalObject(f)
+		}
+	} else {
+		st, key := storageFor(ref)
+		obj, err = st.Open(ctx, key)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return status.Error(codes.NotFound, "model not found")
+		}
+		return status.Error(codes.Internal, "unable to open model")
+	}
+	defer obj.Close()
+	info := obj.Info()
+
+	if age, expired := expiry.Check(name, info.ModTime()); expired {
+		return status.Errorf(codes.FailedPrecondition, "model expired: age %s exceeds %s", age.Round(time.Second), expiry.maxAge)
+	}
+	if isQuarantined(name, info) && !grpcIsAdmin(ctx) {
+		return status.Error(codes.PermissionDenied, "model is quarantined")
+	}
+
+	size := info.Size()
+	offset, length := req.Offset, req.Length
+	if length == 0 {
+		length = size - offset
+	}
+	if offset < 0 || length < 0 || offset > size || length > size-offset {
+		return status.Errorf(codes.OutOfRange, "range %d+%d is outside the model's %d bytes", req.Offset, req.Length, size)
+	}
+	if offset != 0 || length != size {
+		if !ranges.Acquire() {
+			return status.Error(codes.ResourceExhausted, "too many concurrent range requests")
+		}
+		defer ranges.Release()
+	}
+	body, err := obj.Range(offset, length)
+	if err != nil {
+		log.Printf("[registry] unable to read %s: %v", name, err)
+		return status.Error(codes.Unavailable, "unable to read model")
+	}
+	defer body.Close()
+
+	recent.Touch(name)
+	lastUse.Touch(name)
+	client, identity := grpcClient(ctx), grpcIdentity(ctx)
+	alertHoneypotGRPC(ctx, name, offset, length)
+	events.Publish(eventDownloadStarted, name, withIdentity(identity, map[string]any{"offset": offset, "length": length, "client": client}))
+	// The egress writer hands over at most egressChunk bytes per write, which
+	// keeps each message small.
+	pullStart := time.Now()
+	n, err := io.Copy(egress.Writer(ctx, &grpcChunkWriter{stream: stream, offset: offset}), body)
+	modelBytes.Add(float64(n), name)
+	if attacks != nil {
+		attacks.Downloaded(attacks.grpcEvent(ctx), name, n)
+	}
+	complete := err == nil && n == length
+	recordGRPCPull(ctx, name, offset, length, n, complete, pullStart)
+	events.Publish(eventDownloadFinished, name, withIdentity(identity, map[string]any{"bytes": n, "complete": complete, "client": client}))
+	if err != nil {
+		log.Printf("[registry] stream error: %v", err)
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Error(codes.Unavailable, fmt.Sprintf("unable to read model: %v", err))
+	}
+	return nil
+}
+
+// grpcChunkWriter sends each write as one ModelChunk.
+type grpcChunkWriter struct {
+	stream grpc.ServerStreamingServer[registrypb.ModelChunk]
+	offset int64
+}
+
+func (w *grpcChunkWriter) Write(p []byte) (int, error) {
+	if err := w.stream.Send(&registrypb.ModelChunk{Offset: w.offset, Data: p}); err != nil {
+		return 0, err
+	}
+	w.offset += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"model-registry/registrypb"
+)
+
+// chunkRecorder collects what StreamModel sends.
+type chunkRecorder struct {
+	grpc.ServerStream
+	data []byte
+}
+
+func (c *chunkRecorder) Context() context.Context { return context.Background() }
+
+func (c *chunkRecorder) Send(m *registrypb.ModelChunk) error {
+	c.data = append(c.data, m.Data...)
+	return nil
+}
+
+func TestStreamModelRejectsTraversal(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "models")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	newTestRegistryIn(t, dir)
+	writeTestModel(t, root, "secret.gguf", []byte("outside MODEL_DIR"))
+	writeTestModel(t, dir, "tiny.gguf", []byte("GGUF"))
+	s := &grpcServer{modelDir: dir}
+
+	var ok chunkRecorder
+	if err := s.StreamModel(&registrypb.StreamModelRequest{Name: "tiny.gguf"}, &ok); err != nil || string(ok.data) != "GGUF" {
+		t.Fatalf("StreamModel(tiny.gguf) = %q, %v", ok.data, err)
+	}
+	for _, name := range []string{"../secret.gguf", "../../../../etc/passwd", ".registry/api-keys.json"} {
+		var rec chunkRecorder
+		err := s.StreamModel(&registrypb.StreamModelRequest{Name: name}, &rec)
+		if status.Code(err) != codes.NotFound || len(rec.data) > 0 {
+			t.Errorf("StreamModel(%s) = %d bytes, %v; want NotFound", name, len(rec.data), err)
+		}
+	}
+}
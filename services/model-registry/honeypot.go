@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"model-registry/registrypb"
+)
+
+// Honeypots. Models named by MODEL_REGISTRY_HONEYPOTS, and the decoys of the
+// active scenario, are bait: nobody has a reason to fetch them, so every
+// download over HTTP or gRPC is logged as HONEYPOT and published as a
+// honeypot.triggered event, which webhooks get too, with everything known
+// about the caller. The alert fires when the download starts, so aborted
+// transfers and HEAD probes still count. Honeypots are listed and served
+// like any other model.
+
+// honeypotPatterns holds the names and path.Match patterns from
+// MODEL_REGISTRY_HONEYPOTS; a reload swaps it.
+var honeypotPatterns atomic.Pointer[[]string]
+
+// decoyHoneypots is the set of scenario decoys, set at boot.
+var decoyHoneypots map[string]bool
+
+// honeypotHits is labelled like modelBytes and dropped with it.
+var honeypotHits = metrics.Counter("honeypot_downloads_total", "Downloads of honeypot models by model", "model")
+
+// parseHoneypots parses MODEL_REGISTRY_HONEYPOTS, a comma separated list of
+// model names and patterns such as "internal-*.gguf".
+func parseHoneypots(spec string) ([]string, error) {
+	patterns := splitList(spec)
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+	}
+	return patterns, nil
+}
+
+// honeypots returns the patterns from MODEL_REGISTRY_HONEYPOTS.
+func honeypots() []string {
+	if p := honeypotPatterns.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// isHoneypot reports whether downloads of name raise an alert.
+func isHoneypot(name string) bool {
+	if decoyHoneypots[name] {
+		return true
+	}
+	for _, p := range honeypots() {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// alertHoneypotHTTP raises the alert for a download of name served to r, if
+// name is a honeypot.
+func alertHoneypotHTTP(r *http.Request, name string, rng byteRange) {
+	if !isHoneypot(name) {
+		return
+	}
+	data := map[string]any{
+		"protocol": "http", "method": r.Method, "client": clientIP(r), "remote_addr": r.RemoteAddr,
+		"forwarded_for": strings.Join(r.Header.Values("X-Forwarded-For"), ", "), "user_agent": r.UserAgent(),
+		"offset": rng.Start, "length": rng.Length, "request_id": requestID(r.Context()),
+	}
+	raiseHoneypot(name, data, requestPrincipals(r), requestIdentity(r), requestClaims(r), requestAPIKey(r))
+	if attacks != nil {
+		recordHoneypotAttack(attacks.requestEvent(r), name)
+	}
+}
+
+// alertHoneypotGRPC raises the alert for a gRPC download of name, if name
+// is a honeypot.
+func alertHoneypotGRPC(ctx context.Context, name string, offset, length int64) {
+	if !isHoneypot(name) {
+		return
+	}
+	data := map[string]any{
+		"protocol": "grpc", "method": registrypb.ModelRegistry_StreamModel_FullMethodName, "client": grpcClient(ctx),
+		"offset": offset, "length": length, "request_id": requestID(ctx),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		data["remote_addr"] = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		data["user_agent"] = strings.Join(md.Get("user-agent"), " ")
+		data["forwarded_for"] = strings.Join(md.Get("x-forwarded-for"), ", ")
+	}
+	raiseHoneypot(name, data, grpcPrincipals(ctx), grpcIdentity(ctx), grpcClaims(ctx), grpcAPIKey(ctx))
+	if attacks != nil {
+		recordHoneypotAttack(attacks.grpcEvent(ctx), name)
+	}
+}
+
+// recordHoneypotAttack scores a honeypot download as a successful attack.
+func recordHoneypotAttack(ev attackEvent, name string) {
+	ev.Kind, ev.Success, ev.Model = attackHoneypot, true, name
+	ev.Detail = "downloaded honeypot " + name
+	attacks.Record(ev)
+}
+
+// raiseHoneypot adds the caller's credentials to data, then logs, counts
+// and publishes the alert.
+func raiseHoneypot(name string, data map[string]any, principals []string, identity string, claims *jwtClaims, key string) {
+	if principals == nil {
+		principals = []string{}
+	}
+	data["principals"] = principals
+	if claims != nil {
+		data["subject"] = claims.Subject
+	}
+	if keyName, _, ok := apiKeys.Lookup(key); ok {
+		data["key"] = keyName
+	}
+	by := "anonymous"
+	if len(principals) > 0 {
+		by = strings.Join(principals, ",")
+	}
+	log.Printf("[registry] HONEYPOT %s downloaded over %s by %s from %s (forwarded_for=%q user_agent=%q range=%d+%d req=%s)",
+		name, data["protocol"], by, data["client"], data["forwarded_for"], data["user_agent"], data["offset"], data["length"], data["request_id"])
+	honeypotHits.Inc(name)
+	events.Publish(eventHoneypot, name, withIdentity(identity, data))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Hugging Face pull-through cache.
+//
+// MODEL_REGISTRY_HF_REPOS maps model names to files on the Hugging Face Hub.
+// A download of a mapped model that isn't in MODEL_DIR fetches the file from
+// the Hub into a hidden temp file, checks it against the SHA-256 the Hub
+// reports for LFS files, publishes it like an upload and then serves it, so
+// the registry is the only host that needs to reach the Hub.
+const (
+	defaultHubEndpoint = "https://huggingface.co"
+	defaultHubRevision = "main"
+	hubHeaderTimeout   = 30 * time.Second
+)
+
+// errHubBusy is returned when an upload of the model is in progress.
+var errHubBusy = errors.New("an upload of this model is in progress")
+
+// hub is nil unless MODEL_REGISTRY_HF_REPOS maps at least one model.
+var hub *hubMirror
+
+// hubSource is a file on the Hub.
+type hubSource struct {
+	Repo     string // owner/name
+	File     string // path inside the repo
+	Revision string
+}
+
+func (s hubSource) String() string {
+	return "hf://" + s.Repo + "/" + s.File + "@" + s.Revision
+}
+
+// hubMirror fetches mapped models from the Hub, one fetch per model at a time.
+type hubMirror struct {
+	endpoint string
+	token    string
+	repos    map[string]hubSource
+	client   *http.Client
+	fetches  *keyedMutex
+}
+
+// parseHubRepos parses "name=owner/repo/path/in/repo@revision,..." where the
+// path defaults to the model's file name and the revision to main. An entry
+// starting with "@" names a file with one mapping per line ('#' comments).
+func parseHubRepos(spec string) (map[string]hubSource, error) {
+	var items []string
+	for _, item := range splitList(spec) {
+		file, ok := strings.CutPrefix(item, "@")
+		if !ok {
+			items = append(items, item)
+			continue
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				items = append(items, line)
+			}
+		}
+	}
+	out := map[string]hubSource{}
+	for _, item := range items {
+		name, target, ok := strings.Cut(item, "=")
+		name, target = strings.TrimSpace(name), strings.TrimSpace(target)
+		if !ok || name == "" || target == "" {
+			return nil, fmt.Errorf("entry %q is not name=owner/repo[/file][@revision]", item)
+		}
+		if err := validUploadName(name); err != nil {
+			return nil, fmt.Errorf("entry %q: %v", item, err)
+		}
+		src := hubSource{Revision: defaultHubRevision}
+		if path, rev, ok := strings.Cut(target, "@"); ok {
+			target, src.Revision = path, rev
+		}
+		parts := strings.SplitN(target, "/", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" || src.Revision == "" {
+			return nil, fmt.Errorf("entry %q is not name=owner/repo[/file][@revision]", item)
+		}
+		src.Repo = parts[0] + "/" + parts[1]
+		src.File = filepath.Base(name)
+		if len(parts) == 3 && parts[2] != "" {
+			src.File = parts[2]
+		}
+		out[name] = src
+	}
+	return out, nil
+}
+
+func newHubMirror(endpoint, token string, repos map[string]hubSource) *hubMirror {
+	if len(repos) == 0 {
+		return nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = hubHeaderTimeout
+	return &hubMirror{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		token:    token,
+		repos:    repos,
+		client:   &http.Client{Transport: traceTransport(transport)},
+		fetches:  newKeyedMutex(),
+	}
+}
+
+// Source returns the Hub file mapped to name.
+func (h *hubMirror) Source(name string) (hubSource, bool) {
+	if h == nil {
+		return hubSource{}, false
+	}
+	src, ok := h.repos[name]
+	return src, ok
+}
+
+// resolveURL is the Hub download URL of src.
+func (h *hubMirror) resolveURL(src hubSource) string {
+	file := strings.Split(src.File, "/")
+	for i, p := range file {
+		file[i] = url.PathEscape(p)
+	}
+	return h.endpoint + "/" + src.Repo + "/resolve/" + url.PathEscape(src.Revision) + "/" + strings.Join(file, "/")
+}
+
+// Fetch caches the model mapped to ref.Name at ref unless another request did
+// so while this one waited. The fetch isn't tied to the client's request, so
+// a client giving up doesn't waste a half-finished download for the next one.
+func (h *hubMirror) Fetch(r *http.Request, ref modelRef) error {
+	name, dst := ref.Name, ref.Path()
+	h.fetches.Lock(name)
+	defer h.fetches.Unlock(name)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	if !writes.Begin(name) {
+		return errHubBusy
+	}
+	defer writes.End(name)
+
+	src := h.repos[name]
+	start := time.Now()
+	sum, err := h.download(context.WithoutCancel(r.Context()), src, dst)
+	if err != nil {
+		log.Printf("[registry] hub: unable to fetch %s from %s: %v", name, src, err)
+		return err
+	}
+	info, _, err := publishModel(r, ref, sum, nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("[registry] hub: cached %s from %s (%d bytes in %s)", name, src, info.Size(), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// download copies src into a temp file next to dst and renames it into
+// place once complete and, when the Hub reports one, its SHA-256 matched.
+func (h *hubMirror) download(ctx context.Context, src hubSource, dst string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.resolveURL(src), nil)
+	if err != nil {
+		return "", err
+	}
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	// LFS files redirect to a CDN; the resolve response names the content's
+	// SHA-256 in X-Linked-Etag. net/http drops the token on the cross-host hop.
+	var want string
+	client := *h.client
+	client.CheckRedirect = func(next *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if want == "" && next.Response != nil {
+			want = hubETag(next.Response.Header.Get("X-Linked-Etag"))
+		}
+		return nil
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("hub answered %s", resp.Status)
+	}
+	if want == "" {
+		want = hubETag(resp.Header.Get("X-Linked-Etag"))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".hub-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	tmp.Chmod(0o644)
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if want != "" && want != sum {
+		return "", fmt.Errorf("content hashes to %s, hub reported %s", sum, want)
+	}
+	return sum, os.Rename(tmp.Name(), dst)
+}
+
+// hubETag returns the SHA-256 in an X-Linked-Etag value, or "" if the value
+// isn't one (small files stored without LFS carry a git blob id instead).
+func hubETag(v string) string {
+	v = strings.Trim(strings.TrimPrefix(v, "W/"), `"`)
+	if blobDigestPattern.MatchString(v) {
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// JWT authentication against the crash-pay auth service. With
+// MODEL_REGISTRY_JWKS_URL set, Bearer tokens that are JWTs are verified
+// against the signing keys published there and must be issued by
+// MODEL_REGISTRY_JWT_ISSUER for one of the MODEL_REGISTRY_JWT_AUDIENCE
+// audiences. A valid token authenticates the request like an API key, its
+// claims are attached to the request context for handlers (requestClaims),
+// and its subject is logged. Tokens with a role in MODEL_REGISTRY_JWT_ADMIN_ROLES
+// pass admin checks. Only asymmetric algorithms are accepted: a JWKS has no
+// business publishing shared secrets, and pinning them rules out alg
+// confusion and unsigned ("none") tokens.
+const (
+	defaultJWTAudience     = "model-registry"
+	defaultJWKSRefresh     = time.Hour
+	jwksMinRefetch         = 30 * time.Second // bound on refetches for unknown kids
+	jwtLeeway              = 30 * time.Second // clock skew allowed on exp, nbf and iat
+	jwksMaxBytes           = 1 << 20
+	jwtMaxTokenLen         = 16 << 10
+	jwtVerifiedCacheMax    = 4096
+	jwtInvalidTokenMessage = "invalid bearer token"
+)
+
+// jwtAuth verifies bearer JWTs; nil when MODEL_REGISTRY_JWKS_URL is unset.
+var jwtAuth *jwtVerifier
+
+// jwtAdminRoles are the role claims treated as admins.
+var jwtAdminRoles map[string]bool
+
+// jwtClaims are the claims of a verified token.
+type jwtClaims struct {
+	Subject  string
+	Issuer   string
+	Audience []string
+	Expires  time.Time
+	// Raw holds every claim as decoded JSON.
+	Raw map[string]any
+}
+
+// Roles are the token's role claim (a string) and roles claim (a list).
+func (c *jwtClaims) Roles() []string {
+	var roles []string
+	if role, ok := c.Raw["role"].(string); ok && role != "" {
+		roles = append(roles, role)
+	}
+	if list, ok := c.Raw["roles"].([]any); ok {
+		for _, v := range list {
+			if role, ok := v.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+// HasRole reports whether the token carries any of roles.
+func (c *jwtClaims) HasRole(roles map[string]bool) bool {
+	if c == nil {
+		return false
+	}
+	for _, role := range c.Roles() {
+		if roles[role] {
+			return true
+		}
+	}
+	return false
+}
+
+type claimsKey struct{}
+
+// withClaims returns ctx carrying c.
+func withClaims(ctx context.Context, c *jwtClaims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, c)
+}
+
+// claimsFromContext returns the claims attached to ctx, or nil.
+func claimsFromContext(ctx context.Context) *jwtClaims {
+	c, _ := ctx.Value(claimsKey{}).(*jwtClaims)
+	return c
+}
+
+// requestClaims returns the verified claims of r's bearer token, or nil.
+// Requests that went through jwtMiddleware carry them in their context;
+// for the others (the logging middleware sees the request before the
+// router) the token is looked up in the verifier's cache.
+func requestClaims(r *http.Request) *jwtClaims {
+	if c := claimsFromContext(r.Context()); c != nil {
+		return c
+	}
+	token := bearerJWT(r.Header.Get("Authorization"))
+	if jwtAuth == nil || token == "" {
+		return nil
+	}
+	c, _ := jwtAuth.Verify(r.Context(), token)
+	return c
+}
+
+// bearerJWT returns the token of a Bearer authorization value when it's
+// shaped like a JWT, so API keys and the admin token are left alone.
+func bearerJWT(auth string) string {
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok || len(token) > jwtMaxTokenLen || strings.Count(token, ".") != 2 {
+		return ""
+	}
+	head, _, _ := strings.Cut(token, ".")
+	raw, err := base64.RawURLEncoding.DecodeString(head)
+	if err != nil {
+		return ""
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if json.Unmarshal(raw, &h) != nil || h.Alg == "" {
+		return ""
+	}
+	return token
+}
+
+// jwtMiddleware verifies bearer JWTs and attaches their claims to the
+// request. Requests with an invalid token are refused rather than treated
+// as anonymous.
+func jwtMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerJWT(r.Header.Get("Authorization"))
+		if jwtAuth == nil || token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		c, err := jwtAuth.Verify(r.Context(), token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="model-registry", error="invalid_token", error_description=%q`, err.Error()))
+			http.Error(w, jwtInvalidTokenMessage+": "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withClaims(r.Context(), c)))
+	})
+}
+
+// grpcClaims is requestClaims for gRPC calls: the token comes in the
+// authorization metadata.
+func grpcClaims(ctx context.Context) *jwtClaims {
+	if c := claimsFromContext(ctx); c != nil {
+		return c
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	v := md.Get("authorization")
+	if jwtAuth == nil || len(v) == 0 {
+		return nil
+	}
+	token := bearerJWT(v[0])
+	if token == "" {
+		return nil
+	}
+	c, _ := jwtAuth.Verify(ctx, token)
+	return c
+}
+
+// grpcVerifyJWT attaches the claims of the call's bearer JWT to ctx, or
+// fails the call when the token is invalid.
+func grpcVerifyJWT(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	v := md.Get("authorization")
+	if jwtAuth == nil || len(v) == 0 {
+		return ctx, nil
+	}
+	token := bearerJWT(v[0])
+	if token == "" {
+		return ctx, nil
+	}
+	c, err := jwtAuth.Verify(ctx, token)
+	if err != nil {
+		return ctx, status.Error(codes.Unauthenticated, jwtInvalidTokenMessage+": "+err.Error())
+	}
+	return withClaims(ctx, c), nil
+}
+
+// contextStream is a server stream with a replaced context, such as one
+// carrying claims.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context { return s.ctx }
+
+// grpcJWTUnary and grpcJWTStream apply jwtMiddleware to gRPC.
+func grpcJWTUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := grpcVerifyJWT(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcJWTStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcVerifyJWT(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// jwtVerifier checks tokens against a JWKS it fetches and refreshes. The
+// claims of verified tokens are cached until they expire, so the logging
+// middleware and admin checks don't verify a signature again.
+type jwtVerifier struct {
+	jwksURL   string
+	issuer    string
+	audiences []string
+	refresh   time.Duration
+	client    *http.Client
+
+	mu       sync.Mutex
+	keys     map[string]jwk // by kid
+	fetched  time.Time      // last successful fetch
+	attempt  time.Time      // last fetch attempt
+	verified map[[sha256.Size]byte]*jwtClaims
+}
+
+// jwk is a parsed signing key of the JWKS.
+type jwk struct {
+	alg string // the key's alg, or "" when unrestricted
+	key crypto.PublicKey
+}
+
+// newJWTVerifier fetches the JWKS once so a bad URL shows up in the
+// startup log; the auth service being down isn't fatal, keys are fetched
+// again on the first token.
+func newJWTVerifier(jwksURL, issuer string, audiences []string, refresh time.Duration) (*jwtVerifier, error) {
+	if issuer == "" {
+		return nil, errors.New("an issuer is required (MODEL_REGISTRY_JWT_ISSUER)")
+	}
+	if len(audiences) == 0 {
+		return nil, errors.New("an audience is required (MODEL_REGISTRY_JWT_AUDIENCE)")
+	}
+	v := &jwtVerifier{
+		jwksURL:   jwksURL,
+		issuer:    issuer,
+		audiences: audiences,
+		refresh:   refresh,
+		client:    &http.Client{Timeout: 10 * time.Second, Transport: traceTransport(nil)},
+		keys:      map[string]jwk{},
+		verified:  map[[sha256.Size]byte]*jwtClaims{},
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := v.fetchLocked(context.Background()); err != nil {
+		log.Printf("[registry] JWKS fetch from %s failed: %v", jwksURL, err)
+	}
+	return v, nil
+}
+
+// fetchLocked replaces the keys with the current JWKS; on failure the old
+// keys stay. The caller must hold v.mu.
+func (v *jwtVerifier) fetchLocked(ctx context.Context) error {
+	v.attempt = time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS: %s", resp.Status)
+	}
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, jwksMaxBytes)).Decode(&set); err != nil {
+		return fmt.Errorf("JWKS: %w", err)
+	}
+	keys := map[string]jwk{}
+	for _, raw := range set.Keys {
+		kid, k, err := parseJWK(raw)
+		if err != nil {
+			log.Printf("[registry] JWKS key %q skipped: %v", kid, err)
+			continue
+		}
+		keys[kid] = k
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS has no usable signing keys")
+	}
+	v.keys, v.fetched = keys, time.Now()
+	log.Printf("[registry] loaded %d JWKS signing key(s) from %s", len(keys), v.jwksURL)
+	return nil
+}
+
+// parseJWK parses one JWKS entry into a verification key.
+func parseJWK(raw json.RawMessage) (string, jwk, error) {
+	var k struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		Crv string `json:"crv"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return "", jwk{}, err
+	}
+	if k.Use != "" && k.Use != "sig" {
+		return k.Kid, jwk{}, fmt.Errorf("use %q", k.Use)
+	}
+	enc := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err1 := enc.DecodeString(k.N)
+		e, err2 := enc.DecodeString(k.E)
+		if err := errors.Join(err1, err2); err != nil || len(e) == 0 || len(e) > 4 {
+			return k.Kid, jwk{}, errors.New("malformed RSA key")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < 2048 {
+			return k.Kid, jwk{}, fmt.Errorf("RSA key of %d bits is too short", pub.N.BitLen())
+		}
+		return k.Kid, jwk{alg: k.Alg, key: pub}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return k.Kid, jwk{}, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err1 := enc.DecodeString(k.X)
+		y, err2 := enc.DecodeString(k.Y)
+		if err := errors.Join(err1, err2); err != nil {
+			return k.Kid, jwk{}, errors.New("malformed EC key")
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return k.Kid, jwk{}, errors.New("EC point is not on the curve")
+		}
+		return k.Kid, jwk{alg: k.Alg, key: pub}, nil
+	case "OKP":
+		x, err := enc.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return k.Kid, jwk{}, errors.New("only Ed25519 OKP keys are supported")
+		}
+		return k.Kid, jwk{alg: k.Alg, key: ed25519.PublicKey(x)}, nil
+	}
+	return k.Kid, jwk{}, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// key returns the key for kid, fetching the JWKS when it's stale or kid is
+// new to it. Tokens without a kid match when the JWKS has a single key.
+func (v *jwtVerifier) key(ctx context.Context, kid string) (jwk, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	lookup := func() (jwk, bool) {
+		if kid == "" && len(v.keys) == 1 {
+			for _, k := range v.keys {
+				return k, true
+			}
+		}
+		k, ok := v.keys[kid]
+		return k, ok
+	}
+	k, ok := lookup()
+	stale := time.Since(v.fetched) > v.refresh
+	if (!ok || stale) && time.Since(v.attempt) > jwksMinRefetch {
+		if err := v.fetchLocked(ctx); err != nil {
+			log.Printf("[registry] JWKS refresh failed: %v", err)
+		}
+		k, ok = lookup()
+	}
+	return k, ok
+}
+
+// Verify checks token's signature and claims and returns the claims.
+func (v *jwtVerifier) Verify(ctx context.Context, token string) (*jwtClaims, error) {
+	sum := sha256.Sum256([]byte(token))
+	v.mu.Lock()
+	if c, ok := v.verified[sum]; ok {
+		v.mu.Unlock()
+		if time.Now().After(c.Expires.Add(jwtLeeway)) {
+			return nil, errors.New("token has expired")
+		}
+		return c, nil
+	}
+	v.mu.Unlock()
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	enc := base64.RawURLEncoding
+	var header struct {
+		Alg  string   `json:"alg"`
+		Kid  string   `json:"kid"`
+		Crit []string `json:"crit"`
+	}
+	rawHeader, err := enc.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(rawHeader, &header) != nil {
+		return nil, errors.New("malformed token header")
+	}
+	if len(header.Crit) > 0 {
+		return nil, fmt.Errorf("unsupported critical header parameters %v", header.Crit)
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	k, ok := v.key(ctx, header.Kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", header.Kid)
+	}
+	if k.alg != "" && k.alg != header.Alg {
+		return nil, fmt.Errorf("signing key %q is for %s, not %s", header.Kid, k.alg, header.Alg)
+	}
+	if err := verifyJWS(header.Alg, k.key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	payload, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	c, err := v.checkClaims(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	if len(v.verified) >= jwtVerifiedCacheMax {
+		now := time.Now()
+		for s, old := range v.verified {
+			if now.After(old.Expires) {
+				delete(v.verified, s)
+			}
+		}
+		if len(v.verified) >= jwtVerifiedCacheMax {
+			clear(v.verified)
+		}
+	}
+	v.verified[sum] = c
+	v.mu.Unlock()
+	return c, nil
+}
+
+// checkClaims decodes payload and checks its issuer, audience and times.
+func (v *jwtVerifier) checkClaims(payload []byte) (*jwtClaims, error) {
+	c := &jwtClaims{}
+	if err := json.Unmarshal(payload, &c.Raw); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	c.Subject, _ = c.Raw["sub"].(string)
+	c.Issuer, _ = c.Raw["iss"].(string)
+	switch aud := c.Raw["aud"].(type) {
+	case string:
+		c.Audience = []string{aud}
+	case []any:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				c.Audience = append(c.Audience, s)
+			}
+		}
+	}
+	if c.Issuer != v.issuer {
+		return nil, fmt.Errorf("token issuer %q isn't trusted", c.Issuer)
+	}
+	if !slices.ContainsFunc(c.Audience, func(a string) bool { return slices.Contains(v.audiences, a) }) {
+		return nil, fmt.Errorf("token audience %v doesn't include %s", c.Audience, strings.Join(v.audiences, " or "))
+	}
+	now := time.Now()
+	exp, ok := numericDate(c.Raw["exp"])
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return nil, errors.New("token has expired")
+	}
+	c.Expires = exp
+	if nbf, ok := numericDate(c.Raw["nbf"]); ok && now.Add(jwtLeeway).Before(nbf) {
+		return nil, errors.New("token isn't valid yet")
+	}
+	if iat, ok := numericDate(c.Raw["iat"]); ok && now.Add(jwtLeeway).Before(iat) {
+		return nil, errors.New("token was issued in the future")
+	}
+	return c, nil
+}
+
+// numericDate converts a JWT NumericDate claim.
+func numericDate(v any) (time.Time, bool) {
+	f, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true
+}
+
+// verifyJWS checks a JWS signature made with alg by the holder of key.
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s token signed with a non-Ed25519 key", alg)
+		}
+		if !ed25519.Verify(pub, signed, sig) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	digest := digestFor(hash, signed)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s token signed with a non-RSA key", alg)
+		}
+		var err error
+		if alg[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		} else {
+			err = rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		if err != nil {
+			return errors.New("invalid token signature")
+		}
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve.Params().BitSize != map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}[alg] {
+			return fmt.Errorf("%s token signed with the wrong EC key", alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid token signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+	}
+	return nil
+}
+
+func digestFor(hash crypto.Hash, b []byte) []byte {
+	switch hash {
+	case crypto.SHA384:
+		sum := sha512.Sum384(b)
+		return sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(b)
+		return sum[:]
+	}
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
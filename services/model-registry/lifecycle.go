@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Model lifecycle states, in the order they take precedence:
+//
+//	writing      an upload of the file is still in progress
+//	expired      older than MODEL_REGISTRY_MAX_MODEL_AGE (and not exempt)
+//	quarantined  inside the quarantine period and not released
+//	verifying    an integrity run is in progress and hasn't checked it yet
+//	deprecated   marked with POST /models/{name}/deprecate
+//	available    none of the above
+//
+// A finished upload moves writing -> quarantined (or available when
+// quarantine is off); the period elapsing or a release moves it on to
+// available. Any state can become expired as the file ages. Every endpoint
+// derives the state through modelStatus so they always agree.
+const (
+	statusWriting     = "writing"
+	statusExpired     = "expired"
+	statusQuarantined = "quarantined"
+	statusVerifying   = "verifying"
+	statusDeprecated  = "deprecated"
+	statusAvailable   = "available"
+)
+
+// validStatuses is the set accepted by ?status=.
+var validStatuses = map[string]bool{
+	statusWriting: true, statusExpired: true, statusQuarantined: true,
+	statusVerifying: true, statusDeprecated: true, statusAvailable: true,
+}
+
+// writes tracks models currently being written by an upload.
+var writes = &writeSet{names: map[string]bool{}}
+
+// writeSet is the set of model names with a write in progress.
+type writeSet struct {
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+// Begin marks name as being written. It returns false if a write to name
+// is already in progress.
+func (s *writeSet) Begin(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.names[name] {
+		return false
+	}
+	s.names[name] = true
+	return true
+}
+
+func (s *writeSet) End(name string) {
+	s.mu.Lock()
+	delete(s.names, name)
+	s.mu.Unlock()
+}
+
+func (s *writeSet) Has(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.names[name]
+}
+
+// modelStatus derives the lifecycle state of a model from the upload,
+// expiry, quarantine, integrity and sidecar state.
+func modelStatus(name string, info os.FileInfo) string {
+	if writes.Has(name) {
+		return statusWriting
+	}
+	return storedStatus(name, info)
+}
+
+// storedStatus is modelStatus without the upload state: what the model is
+// once its write finishes, for the writer to report while it holds the slot.
+func storedStatus(name string, info os.FileInfo) string {
+	if _, expired := expiry.Check(name, info.ModTime()); expired {
+		return statusExpired
+	}
+	if isQuarantined(name, info) {
+		return statusQuarantined
+	}
+	if integrity.Pending(name) {
+		return statusVerifying
+	}
+	meta, err := sidecars.Get(name)
+	if err != nil {
+		log.Printf("[registry] unable to read sidecar for %s: %v", name, err)
+	}
+	if meta.DeprecatedAt != nil {
+		return statusDeprecated
+	}
+	return statusAvailable
+}
+
+// deprecateResponse is used by POST /models/{name}/deprecate
+type deprecateResponse struct {
+	Name         string    `json:"name"`
+	DeprecatedAt time.Time `json:"deprecated_at"`
+}
+
+// deprecateHandler marks a model as deprecated. It stays downloadable; the
+// state is advisory for clients choosing what to fetch.
+func deprecateHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := resolveModel(r, modelDir, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := ref.Name
+		info, err := statModel(r.Context(), ref)
+		if err != nil || info.IsDir() {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		}
+
+		now := time.Now().UTC()
+		meta, err := sidecars.Update(name, func(m *modelMeta) {
+			if m.DeprecatedAt == nil {
+				m.DeprecatedAt = &now
+			}
+		})
+		if err != nil {
+			log.Printf("[registry] unable to deprecate %s: %v", name, err)
+			http.Error(w, "unable to deprecate model", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[registry] model %s deprecated", name)
+		rescanCatalog()
+		writeJSON(w, http.StatusOK, deprecateResponse{Name: name, DeprecatedAt: *meta.DeprecatedAt})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Log formats for MODEL_REGISTRY_LOG_FORMAT. The text format is the
+// original free-form lines; the JSON one writes every line, the access log
+// included, as a JSON object through log/slog, so pipelines can parse it
+// without regexes.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// requestIDHeader carries a request's ID in both directions: a caller's ID
+// is kept, otherwise one is generated, and either way it's sent back.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern bounds the IDs accepted from callers, so they can't log
+// arbitrary text.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// logJSON reports whether lines are written as JSON.
+var logJSON bool
+
+// setupLogging switches the process to format. With JSON, the standard
+// log package is routed into slog as well, so the existing log.Printf
+// calls come out as JSON lines too.
+func setupLogging(format string) error {
+	switch format {
+	case logFormatText:
+	case logFormatJSON:
+		logJSON = true
+		slog.SetDefault(slog.New(registryHandler{slog.NewJSONHandler(os.Stderr, nil)}))
+	default:
+		return fmt.Errorf("unknown log format %q (want %s or %s)", format, logFormatText, logFormatJSON)
+	}
+	return nil
+}
+
+// registryHandler drops the "[registry] " prefix the text lines carry,
+// which is noise in a JSON field.
+type registryHandler struct {
+	slog.Handler
+}
+
+func (h registryHandler) Handle(ctx context.Context, r slog.Record) error {
+	if msg, ok := strings.CutPrefix(r.Message, "[registry] "); ok {
+		stripped := slog.NewRecord(r.Time, r.Level, msg, r.PC)
+		r.Attrs(func(a slog.Attr) bool {
+			stripped.AddAttrs(a)
+			return true
+		})
+		r = stripped
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h registryHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return registryHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h registryHandler) WithGroup(name string) slog.Handler {
+	return registryHandler{h.Handler.WithGroup(name)}
+}
+
+type requestIDKey struct{}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// withRequestID returns r with its request ID (the caller's, or a new one)
+// in its context, and sends the ID back on w.
+func withRequestID(w http.ResponseWriter, r *http.Request) (*http.Request, string) {
+	id := r.Header.Get(requestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		id = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)), id
+}
+
+// requestID is the ID of the request ctx belongs to, or "".
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// grpcRequestID is the x-request-id of a gRPC call, or a new ID.
+func grpcRequestID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(requestIDHeader); len(v) > 0 && requestIDPattern.MatchString(v[0]) {
+			return v[0]
+		}
+	}
+	return newRequestID()
+}
+
+// accessEntry is one access log line; empty fields are left out.
+type accessEntry struct {
+	RequestID string
+	Method    string // HTTP method, or "grpc"
+	Path      string // request path, or the gRPC method
+	Route     string
+	Status    int    // HTTP status
+	Code      string // gRPC status code
+	Bytes     int64
+	Duration  time.Duration
+	Client    string
+	Identity  string
+	Key       string
+	Subject   string
+	Token     string // download token
+}
+
+// logAccess writes e as a JSON line, or in the text format as before with
+// the bytes and request ID appended.
+func logAccess(e accessEntry) {
+	if logJSON {
+		attrs := []any{"request_id", e.RequestID, "method", e.Method, "path", e.Path}
+		if e.Code != "" {
+			attrs = append(attrs, "code", e.Code)
+		} else {
+			attrs = append(attrs, "status", e.Status, "bytes", e.Bytes)
+		}
+		attrs = append(attrs, "duration_ms", float64(e.Duration.Microseconds())/1000, "client", e.Client)
+		for _, kv := range [][2]string{{"route", e.Route}, {"identity", e.Identity}, {"key", e.Key}, {"sub", e.Subject}, {"token", e.Token}} {
+			if kv[1] != "" {
+				attrs = append(attrs, kv[0], kv[1])
+			}
+		}
+		slog.Info("request", attrs...)
+		return
+	}
+	var extra string
+	if e.Token != "" {
+		extra = " token=" + e.Token
+	}
+	if e.Identity != "" {
+		extra += " identity=" + e.Identity
+	}
+	if e.Key != "" {
+		extra += " key=" + e.Key
+	}
+	if e.Subject != "" {
+		extra += " sub=" + e.Subject
+	}
+	if e.Method == "grpc" {
+		log.Printf("[registry] grpc %s %s %s%s req=%s", e.Path, e.Code, e.Duration, extra, e.RequestID)
+		return
+	}
+	log.Printf("[registry] %s %s %d %s bytes=%d%s req=%s", e.Method, e.Path, e.Status, e.Duration, e.Bytes, extra, e.RequestID)
+}
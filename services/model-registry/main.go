@@ -1,21 +1,36 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 // Env keys
 const (
 	defaultModelDir = "./models"
+
+	// stateDirName holds registry-owned state (caches, sidecars) inside the
+	// model directory. It is hidden so it never shows up in listings.
+	stateDirName = ".registry"
 )
 
 // basicResponse is used by /healthz
@@ -26,41 +41,662 @@ type basicResponse struct {
 
 // listResponse is used by /models
 type listResponse struct {
-	Models []string `json:"models"`
+	Models     []string `json:"models"`
+	Total      int      `json:"total"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+	NextOffset *int     `json:"next_offset,omitempty"`
 }
 
 func main() {
-	modelDir := getenv("MODEL_DIR", defaultModelDir)
+	// Core settings from the optional config file, overridden by the environment
+	configPath = getenv("MODEL_REGISTRY_CONFIG", "")
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	configEnv = cfg.env
+
+	// Lab exercise profile: defaults for weaknesses and telemetry, plus decoys
+	if activeScenario, err = loadScenario(getenv("MODEL_REGISTRY_SCENARIO", ""), getenv("MODEL_REGISTRY_SCENARIO_FILE", "")); err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_SCENARIO: %v", err)
+	}
+	if activeScenario != nil {
+		scenarioEnv = activeScenario.env()
+	}
+
+	// Free-form text lines, or JSON lines for log pipelines
+	if err := setupLogging(getenv("MODEL_REGISTRY_LOG_FORMAT", logFormatText)); err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_LOG_FORMAT: %v", err)
+	}
+	if configPath != "" {
+		log.Printf("[registry] loaded configuration from %s", configPath)
+	}
+	if activeScenario != nil {
+		log.Printf("[registry] SCENARIO %s: %s", activeScenario.Name, activeScenario.Description)
+	}
+	modelDir := cfg.ModelDir
+
+	if err := validateModelDir(modelDir); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// Make sure the directory exists at boot; create if missing unless the
+	// operator asked us to require it (e.g. a volume that must be mounted).
+	if cfg.CreateDir {
+		log.Printf("[registry] MODEL_REGISTRY_CREATE_DIR=true: creating %s if missing", modelDir)
+		if err := os.MkdirAll(modelDir, 0o755); err != nil {
+			log.Fatalf("unable to create model directory: %v", err)
+		}
+	} else {
+		log.Printf("[registry] MODEL_REGISTRY_CREATE_DIR=false: requiring existing %s", modelDir)
+		if _, err := os.Stat(modelDir); err != nil {
+			log.Fatalf("model directory %s must already exist: %v", modelDir, err)
+		}
+	}
+
+	// Nested layouts: list subdirectories and accept slashes in model names
+	recursive = getenvBool("MODEL_REGISTRY_RECURSIVE", false)
+
+	// Extensions listed and accepted as models, e.g. gguf,safetensors,onnx
+	exts, err := parseModelExts(getenv("MODEL_EXTS", "gguf"))
+	if err != nil {
+		log.Fatalf("fatal: MODEL_EXTS: %v", err)
+	}
+	modelExtensions.Store(&exts)
+
+	// Download tracking for /stats/recent; optionally persisted across restarts
+	recent = newRecentTracker(getenvInt("MODEL_REGISTRY_RECENT_MAX", defaultRecentMax))
+	if statsFile := getenv("MODEL_REGISTRY_STATS_FILE", ""); statsFile != "" {
+		if err := recent.Load(statsFile); err != nil {
+			log.Printf("[registry] unable to load stats from %s: %v", statsFile, err)
+		}
+		go recent.persistLoop(statsFile, 30*time.Second)
+	}
+
+	// Multi-part download correlation via X-Download-Session
+	sessions = newSessionTracker(getenvDuration("MODEL_REGISTRY_SESSION_TTL", defaultSessionTTL), getenvInt("MODEL_REGISTRY_SESSION_MAX", defaultSessionMax))
+	go sessions.janitor()
+
+	// Opt-in per-download tokens tying a download's start to its outcome
+	if getenvBool("MODEL_REGISTRY_DOWNLOAD_TOKENS", false) {
+		downloadTokens = newDownloadTokenTracker(getenvDuration("MODEL_REGISTRY_DOWNLOAD_TOKEN_TTL", defaultDownloadTokenTTL))
+		go downloadTokens.janitor()
+	}
+
+	// Single-use download tokens minted via POST /models/{name}/token
+	oneTimeTokens = newOneTimeTokenStore(getenvDuration("MODEL_REGISTRY_ONE_TIME_TOKEN_TTL", defaultOneTimeTokenTTL))
+	go oneTimeTokens.janitor()
+
+	// Weighted selection for /models/select; a fixed seed makes picks reproducible
+	weights, err := parseWeights(getenv("MODEL_REGISTRY_SELECT_WEIGHTS", ""))
+	if err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_SELECT_WEIGHTS: %v", err)
+	}
+	seed := time.Now().UnixNano()
+	if v := getenv("MODEL_REGISTRY_SELECT_SEED", ""); v != "" {
+		if seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			log.Fatalf("invalid MODEL_REGISTRY_SELECT_SEED: %v", err)
+		}
+	}
+	modelSelector = newWeightedSelector(weights, seed)
+
+	// Optional retention: hide/refuse models older than MODEL_REGISTRY_MAX_MODEL_AGE
+	exempt, err := parseGlobList(getenv("MODEL_REGISTRY_AGE_EXEMPT", ""))
+	if err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_AGE_EXEMPT: %v", err)
+	}
+	expiry = newModelExpiry(getenvDuration("MODEL_REGISTRY_MAX_MODEL_AGE", 0), exempt)
+
+	// Client certificates identify internal callers; some identities may be
+	// admins without the token, or publishers
+	clientCA := cfg.TLS.ClientCA
+	mtlsEnabled = clientCA != ""
+	if adminIdentities, err = parseIdentities(cfg.Auth.AdminIdentities); err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_ADMIN_IDENTITIES: %v", err)
+	}
+	if publisherIdentities, err = parseIdentities(cfg.Auth.PublisherIdentities); err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_PUBLISHER_IDENTITIES: %v", err)
+	}
+
+	// Bearer JWTs from the crash-pay auth service, verified against its JWKS
+	if jwksURL := cfg.Auth.JWKSURL; jwksURL != "" {
+		if jwtAuth, err = newJWTVerifier(jwksURL, cfg.Auth.JWTIssuer, cfg.Auth.JWTAudience, cfg.Auth.JWKSRefresh); err != nil {
+			log.Fatalf("invalid JWT configuration: %v", err)
+		}
+		jwtAdminRoles = parseRoleNames(cfg.Auth.JWTAdminRoles)
+		jwtPublisherRoles = parseRoleNames(cfg.Auth.JWTPublisherRoles)
+	}
+
+	// Admin token for admin-only routes; unset leaves them open (lab default)
+	adminToken = cfg.Auth.AdminToken
+
+	// API keys (name:key) every request must carry once any exist
+	keyPairs, keyRoles, err := configuredAPIKeys(cfg.Auth)
+	if err != nil {
+		log.Fatalf("fatal: %v", err)
+	}
+	if apiKeys, err = newAPIKeyStore(modelDir, keyPairs, keyRoles, cfg.Auth.RequireAPIKey); err != nil {
+		log.Fatalf("invalid API keys: %v", err)
+	}
+	// Until some credential grants more than reader, every caller is admin
+	if !rolesEnforced() {
+		log.Printf("[registry] MODEL_REGISTRY_ADMIN_TOKEN unset: admin routes are unauthenticated")
+	}
+
+	// Trusted ed25519 keys; when set, uploads must carry a valid signature
+	if uploadVerifier, err = parseSigningKeys(getenv("MODEL_REGISTRY_SIGNING_KEYS", "")); err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_SIGNING_KEYS: %v", err)
+	}
+
+	// Parse and sanity-check each upload's GGUF header before storing it
+	validateUploads = getenvBool("MODEL_REGISTRY_VALIDATE_UPLOADS", true)
 
-	// Make sure the directory exists at boot; create if missing
-	if err := os.MkdirAll(modelDir, 0o755); err != nil {
-		log.Fatalf("unable to create model directory: %v", err)
+	// Whole-file hashing (digests, integrity runs) shares a small semaphore
+	if n := getenvInt("MODEL_REGISTRY_CHECKSUM_CONCURRENCY", defaultChecksumConcurrency); n > 0 {
+		checksumSlots = make(chan struct{}, n)
+	}
+	integrity = newIntegrityChecker(modelDir)
+	if enabledAlgos, err = parseChecksumAlgos(getenv("MODEL_REGISTRY_CHECKSUM_ALGOS", defaultChecksumAlgos)); err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_CHECKSUM_ALGOS: %v", err)
+	}
+
+	// Digest misses hashed inline per /manifest request; the rest fill in the background
+	manifestHashBudget = getenvInt("MODEL_REGISTRY_MANIFEST_HASH_BUDGET", defaultManifestHashBudget)
+
+	// Per-model change history behind /changes; older versions must resync
+	catalog = newCatalogTracker(getenvInt("MODEL_REGISTRY_CHANGE_LOG_SIZE", defaultChangeLogSize))
+
+	// Largest accepted POST /models body; 0 means unlimited
+	maxUploadSize = cfg.Limits.MaxUploadSize
+
+	// Mutable version tags (stable, canary, ...), persisted under .registry
+	tags = newTagStore(modelDir)
+
+	// Webhooks notified of uploads, tag changes and deletes; more are added through /webhooks
+	webhooks, err = newWebhookStore(modelDir, splitList(getenv("MODEL_REGISTRY_WEBHOOKS", "")), getenv("MODEL_REGISTRY_WEBHOOK_SECRET", ""),
+		getenvInt("MODEL_REGISTRY_WEBHOOK_ATTEMPTS", defaultWebhookAttempts), getenvDuration("MODEL_REGISTRY_WEBHOOK_BACKOFF", defaultWebhookBackoff))
+	if err != nil {
+		log.Fatalf("fatal: %v", err)
+	}
+
+	// Resumable upload sessions without a chunk for this long are removed
+	uploadSessionTTL = getenvDuration("MODEL_REGISTRY_UPLOAD_SESSION_TTL", defaultUploadSessionTTL)
+
+	// Upload bodies up to this size are buffered in memory, larger ones spool to disk
+	spoolThreshold = int64(getenvInt("MODEL_REGISTRY_UPLOAD_SPOOL_THRESHOLD", defaultSpoolThreshold))
+
+	// Per-model metadata kept under .registry
+	sidecars = newSidecarStore(modelDir)
+	pins.Load(sidecars)
+	cards = newCardStore(modelDir)
+	provenance = newProvenanceStore(modelDir)
+
+	// Content-addressed copies of uploads under .registry/blobs, served by digest
+	if getenvBool("MODEL_REGISTRY_BLOB_STORE", false) {
+		blobs = newBlobStore(modelDir)
+	}
+
+	// Opt-in quarantine of newly added models (scan-before-publish)
+	quarantinePeriod = getenvDuration("MODEL_REGISTRY_QUARANTINE_PERIOD", 0)
+	if quarantinePeriod > 0 {
+		log.Printf("[registry] quarantining new models for %s", quarantinePeriod)
+	}
+
+	// Rate limits as "rate[:burst]" in requests/sec, per IP, model and client
+	limitSet, err := newRateLimitSet(cfg.Limits)
+	if err != nil {
+		log.Fatalf("fatal: %v", err)
+	}
+	rateLimits.Store(limitSet)
+	go rateLimitJanitor()
+
+	// Cache-Control for downloads: per-model overrides win over the global default
+	cacheRules, err := parseCacheRules(getenv("MODEL_REGISTRY_CACHE_CONTROL_OVERRIDES", ""))
+	if err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_CACHE_CONTROL_OVERRIDES: %v", err)
+	}
+	cacheControl = &cachePolicy{
+		global:    getenv("MODEL_REGISTRY_CACHE_CONTROL", defaultCacheControl),
+		overrides: cacheRules,
+	}
+
+	// Optional one-shot migration of a flat layout into per-architecture dirs
+	switch mode := getenv("MODEL_REGISTRY_MIGRATE", migrateOff); mode {
+	case migrateOff:
+	case migrateDryRun, migrateApply:
+		if !recursive {
+			log.Printf("[registry] MODEL_REGISTRY_MIGRATE without MODEL_REGISTRY_RECURSIVE: migrated models will not be listed")
+		}
+		if err := migrateLayout(modelDir, getenv("MODEL_REGISTRY_MIGRATE_PATTERN", "*.gguf"), mode); err != nil {
+			log.Fatalf("layout migration failed: %v", err)
+		}
+	default:
+		log.Fatalf("invalid MODEL_REGISTRY_MIGRATE=%q (want dry-run or apply)", mode)
+	}
+
+	// Chaos mode for exercising client retries; off unless a rate is set
+	if chaos, err = parseChaos(
+		getenv("MODEL_REGISTRY_CHAOS_RATE", ""),
+		getenv("MODEL_REGISTRY_CHAOS_DELAY", ""),
+		getenv("MODEL_REGISTRY_CHAOS_ERROR_RATE", ""),
+	); err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_CHAOS_*: %v", err)
+	}
+	if chaos != nil {
+		log.Printf("[registry] CHAOS MODE: rate=%g delay=%s-%s error_rate=%g", chaos.rate, chaos.minDelay, chaos.maxDelay, chaos.errorRate)
+	}
+
+	// Lab weaknesses switched on at startup; /admin/vulns flips them later
+	vulnFlagsOn, err := parseVulns(getenv("MODEL_REGISTRY_VULNS", ""))
+	if err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_VULNS: %v", err)
+	}
+	vulns.Set(vulnFlagsOn)
+	if on := vulns.EnabledNames(); len(on) > 0 {
+		log.Printf("[registry] LAB VULNERABILITIES ON: %s", strings.Join(on, ", "))
+	}
+
+	// Bait models whose downloads raise an alert, besides scenario decoys
+	honeypotList, err := parseHoneypots(getenv("MODEL_REGISTRY_HONEYPOTS", ""))
+	if err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_HONEYPOTS: %v", err)
+	}
+	honeypotPatterns.Store(&honeypotList)
+
+	// Disk headroom /readyz requires on MODEL_DIR, as bytes or a percentage
+	if readyMinFree, err = parseMinFree(getenv("MODEL_REGISTRY_READY_MIN_FREE", "")); err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_READY_MIN_FREE: %v", err)
+	}
+
+	// Caps on concurrent downloads, node-wide and per model; 0 means unlimited
+	streams.maxTotal, streams.maxPerModel = cfg.Limits.MaxStreams, cfg.Limits.MaxModelStreams
+
+	// Separate cap on concurrent range (shard) requests; 0 means unlimited
+	if ranges, err = newRangeGate(
+		getenvInt("MODEL_REGISTRY_MAX_RANGE_CONCURRENCY", 0),
+		getenv("MODEL_REGISTRY_RANGE_OVERFLOW", rangeOverflowReject),
+	); err != nil {
+		log.Fatalf("invalid range concurrency settings: %v", err)
+	}
+
+	// Node-wide egress cap in bytes/sec shared by all downloads; 0 only meters
+	egress = newEgressLimiter(cfg.Limits.EgressLimit)
+	// Per-download cap in bytes/sec under the node-wide one; 0 is unlimited
+	streamLimit = cfg.Limits.StreamLimit
+
+	deltaBlockSize = getenvInt("MODEL_REGISTRY_DELTA_BLOCK_SIZE", defaultDeltaBlockSize)
+	if deltaBlockSize < 64 {
+		log.Fatalf("MODEL_REGISTRY_DELTA_BLOCK_SIZE must be at least 64 bytes")
+	}
+
+	// OpenTelemetry spans exported as OTLP/HTTP JSON; off without an endpoint
+	if endpoint := getenv("MODEL_REGISTRY_OTLP_ENDPOINT", getenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")); endpoint != "" {
+		ratio, err := strconv.ParseFloat(getenv("MODEL_REGISTRY_TRACE_SAMPLE_RATIO", "1"), 64)
+		if err != nil {
+			log.Fatalf("invalid MODEL_REGISTRY_TRACE_SAMPLE_RATIO: %v", err)
+		}
+		if tracing, err = newTraceExporter(endpoint, getenv("MODEL_REGISTRY_OTLP_HEADERS", getenv("OTEL_EXPORTER_OTLP_HEADERS", "")),
+			getenv("OTEL_SERVICE_NAME", "model-registry"), ratio); err != nil {
+			log.Fatalf("invalid tracing configuration: %v", err)
+		}
+		go tracing.run()
+		log.Printf("[registry] exporting traces to %s (sample ratio %g)", tracing.url, ratio)
 	}
 
 	r := mux.NewRouter()
-	
-	// Global CORS middleware that applies to all routes
-	r.Use(func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Set CORS headers for all requests
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization")
-			
-			// Handle preflight OPTIONS requests
-			if r.Method == "OPTIONS" {
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-			
-			next.ServeHTTP(w, r)
-		})
-	})
-	
+	r.Use(tracingMiddleware)
+
+	// Global CORS middleware that applies to all routes. "*" keeps the open
+	// lab behavior; a list of origins switches to reflecting safelisted headers.
+	cors = newCORSConfig(
+		getenv("MODEL_REGISTRY_CORS_ORIGINS", "*"),
+		getenv("MODEL_REGISTRY_CORS_HEADERS", defaultCORSHeaders),
+		getenvInt("MODEL_REGISTRY_CORS_MAX_AGE", defaultCORSMaxAge),
+	)
+	r.Use(corsMiddleware)
+
+	// Public mirrors: every write answers 405, whatever the credentials
+	readOnly = getenvBool("MODEL_REGISTRY_READ_ONLY", getenvBool("READ_ONLY", false))
+	if readOnly {
+		log.Printf("[registry] read-only: uploads, deletes and other writes are refused")
+	}
+	r.Use(readOnlyMiddleware)
+
+	// JSON zstd/gzip: opt-in globally, always on for Save-Data clients
+	compressJSON = getenvBool("MODEL_REGISTRY_COMPRESS_JSON", false)
+	r.Use(compressMiddleware)
+
+	// zstd for full model downloads to clients sending Accept-Encoding: zstd
+	compressModels = getenvBool("MODEL_REGISTRY_COMPRESS_MODELS", false)
+	if zstdLevel, err = parseZstdLevel(getenv("MODEL_REGISTRY_ZSTD_LEVEL", "default")); err != nil {
+		log.Fatalf("fatal: MODEL_REGISTRY_ZSTD_LEVEL: %v", err)
+	}
+
+	r.Use(chaosMiddleware)
+	r.Use(ipRateLimitMiddleware)
+	r.Use(jwtMiddleware)
+	r.Use(apiKeyMiddleware)
+	r.Use(clientRateLimitMiddleware)
+
+	// Where primary-backend models live: MODEL_DIR, or a bucket or container
+	storage = localStorage{dir: modelDir}
+	switch storageDriver = getenv("STORAGE_DRIVER", storageDriverLocal); storageDriver {
+	case storageDriverLocal:
+	case storageDriverS3:
+		region := getenv("MODEL_REGISTRY_S3_REGION", getenv("AWS_REGION", defaultS3Region))
+		b, err := newS3Bucket(getenv("MODEL_REGISTRY_S3_ENDPOINT", ""), getenv("MODEL_REGISTRY_S3_BUCKET", ""), getenv("MODEL_REGISTRY_S3_PREFIX", ""),
+			region, getenvBool("MODEL_REGISTRY_S3_PATH_STYLE", false), int64(getenvInt("MODEL_REGISTRY_S3_PART_SIZE", defaultS3PartSize)))
+		if err != nil {
+			log.Fatalf("invalid S3 storage configuration: %v", err)
+		}
+		storage = b
+		log.Printf("[registry] storing models in %s", b)
+	case storageDriverAzure:
+		c, err := newAzureContainer(getenv("MODEL_REGISTRY_AZURE_ENDPOINT", ""), getenv("MODEL_REGISTRY_AZURE_ACCOUNT", getenv("AZURE_STORAGE_ACCOUNT", "")),
+			getenv("MODEL_REGISTRY_AZURE_CONTAINER", ""), getenv("MODEL_REGISTRY_AZURE_PREFIX", ""), int64(getenvInt("MODEL_REGISTRY_AZURE_BLOCK_SIZE", defaultAzureBlockSize)))
+		if err != nil {
+			log.Fatalf("invalid Azure storage configuration: %v", err)
+		}
+		storage = c
+		log.Printf("[registry] storing models in %s", c)
+	case storageDriverGCS:
+		b, err := newGCSBucket(getenv("MODEL_REGISTRY_GCS_ENDPOINT", ""), getenv("MODEL_REGISTRY_GCS_BUCKET", ""), getenv("MODEL_REGISTRY_GCS_PREFIX", ""),
+			int64(getenvInt("MODEL_REGISTRY_GCS_CHUNK_SIZE", defaultGCSChunkSize)))
+		if err != nil {
+			log.Fatalf("invalid GCS storage configuration: %v", err)
+		}
+		storage = b
+		log.Printf("[registry] storing models in %s", b)
+	case storageDriverChunks:
+		c, err := newChunkStore(modelDir, getenvInt("MODEL_REGISTRY_CHUNK_AVG_SIZE", defaultChunkAvgSize))
+		if err != nil {
+			log.Fatalf("invalid chunk storage configuration: %v", err)
+		}
+		storage, chunkStorage = c, c
+		log.Printf("[registry] storing models as %s", c)
+		// Unreferenced chunks are collected this often, and on POST /admin/chunks/gc
+		if every := getenvDuration("MODEL_REGISTRY_CHUNK_GC_INTERVAL", defaultChunkGCInterval); every > 0 {
+			go c.janitor(every)
+		}
+	default:
+		log.Fatalf("unknown STORAGE_DRIVER %q (want %s, %s, %s, %s or %s)", storageDriver, storageDriverLocal, storageDriverS3, storageDriverAzure, storageDriverGCS, storageDriverChunks)
+	}
+	storage = traceStorage(storage, storageDriver)
+	// These keep models as local files and can't work against a bucket.
+	if remoteStorage() && (getenv("MODEL_REGISTRY_ORIGIN_DIR", "") != "" || getenv("MODEL_REGISTRY_HF_REPOS", "") != "" ||
+		getenvBool("MODEL_REGISTRY_BLOB_STORE", false) || getenvBool("MODEL_REGISTRY_OCI", false)) {
+		log.Fatalf("STORAGE_DRIVER=%s can't be combined with MODEL_REGISTRY_ORIGIN_DIR, MODEL_REGISTRY_HF_REPOS, MODEL_REGISTRY_BLOB_STORE or MODEL_REGISTRY_OCI", storageDriver)
+	}
+
+	// Optional Hugging Face Hub mirror; mapped models are fetched on a miss
+	hubRepos, err := parseHubRepos(getenv("MODEL_REGISTRY_HF_REPOS", ""))
+	if err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_HF_REPOS: %v", err)
+	}
+	hub = newHubMirror(getenv("MODEL_REGISTRY_HF_ENDPOINT", defaultHubEndpoint), getenv("MODEL_REGISTRY_HF_TOKEN", os.Getenv("HF_TOKEN")), hubRepos)
+	if hub != nil {
+		if uploadVerifier != nil {
+			log.Fatalf("MODEL_REGISTRY_HF_REPOS can't be combined with MODEL_REGISTRY_SIGNING_KEYS: Hub files carry no upload signature")
+		}
+		log.Printf("[registry] Hugging Face mirror of %d models via %s", len(hubRepos), hub.endpoint)
+	}
+
+	// Pull-through proxy of another registry for models missing here
+	if raw := getenv("MODEL_REGISTRY_UPSTREAM", ""); raw != "" {
+		if upstream, err = newUpstreamProxy(raw, getenv("MODEL_REGISTRY_UPSTREAM_TOKEN", ""), getenvDuration("MODEL_REGISTRY_UPSTREAM_TTL", defaultUpstreamTTL)); err != nil {
+			log.Fatalf("invalid MODEL_REGISTRY_UPSTREAM: %v", err)
+		}
+		log.Printf("[registry] pulling missing models through from %s (ttl=%s)", upstream.url, upstream.ttl)
+	}
+
+	// Optional slow origin tier behind MODEL_DIR; misses are cached locally
+	tier = newStorageTier(getenv("MODEL_REGISTRY_ORIGIN_DIR", ""))
+	if tier != nil {
+		log.Printf("[registry] origin tier %s, caching into %s", tier.origin, modelDir)
+	}
+
+	// HMAC key for /models cursors; random per boot unless pinned
+	cursorKey = newCursorKey(getenv("MODEL_REGISTRY_CURSOR_KEY", ""))
+
+	// Additional named filesystem backends, addressed as /models/<backend>:<name>
+	if backends, err = parseBackends(getenv("MODEL_REGISTRY_BACKENDS", ""), modelDir); err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_BACKENDS: %v", err)
+	}
+	// Bytes of models each backend may hold; uploads past them get 507
+	quotaLimits, err := parseQuotas(cfg.Limits.Quota, getenv("MODEL_REGISTRY_BACKEND_QUOTAS", ""))
+	if err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_BACKEND_QUOTAS: %v", err)
+	}
+	quotas = newQuotaTracker(modelDir, quotaLimits)
+
 	r.HandleFunc("/healthz", healthzHandler).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/readyz", readyzHandler(modelDir)).Methods(http.MethodGet, http.MethodOptions)
 	r.HandleFunc("/models", listHandler(modelDir)).Methods(http.MethodGet, http.MethodOptions)
-	r.HandleFunc("/models/{name}", streamHandler(modelDir)).Methods(http.MethodGet, http.MethodOptions)
-	
+	r.HandleFunc("/models", requirePublisher(uploadHandler(modelDir))).Methods(http.MethodPost)
+	r.HandleFunc("/uploads", requirePublisher(createUploadSessionHandler(modelDir))).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/uploads/{id}", requirePublisher(uploadSessionHandler(modelDir))).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc("/uploads/{id}", requirePublisher(patchUploadSessionHandler(modelDir))).Methods(http.MethodPatch)
+	r.HandleFunc("/uploads/{id}", requirePublisher(deleteUploadSessionHandler(modelDir))).Methods(http.MethodDelete)
+	r.HandleFunc("/uploads/{id}/finalize", requirePublisher(finalizeUploadSessionHandler(modelDir))).Methods(http.MethodPost)
+	r.HandleFunc("/models/select", selectHandler(modelDir)).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern()+"/metadata", requireModelAccess(modelDir, metadataHandler(modelDir))).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern()+"/digest", requireModelAccess(modelDir, digestHandler(modelDir))).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern()+"/release", requireAdmin(releaseHandler(modelDir))).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/admin/verify-all", requireAdmin(verifyAllHandler(modelDir))).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/admin/verify-all", requireAdmin(verifyStatusHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/models/"+namePattern()+"/deprecate", requirePublisher(requireModelOwner(modelDir, deprecateHandler(modelDir)))).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern()+"/promote", requirePublisher(requireModelOwner(modelDir, promoteHandler(modelDir)))).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern()+"/token", requireAdmin(mintTokenHandler(modelDir))).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern()+"/card", requireModelAccess(modelDir, cardHandler(modelDir))).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern()+"/card", requirePublisher(requireModelOwner(modelDir, putCardHandler(modelDir)))).Methods(http.MethodPut)
+	r.HandleFunc("/models/"+namePattern()+"/provenance", requireModelAccess(modelDir, provenanceHandler(modelDir))).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern()+"/provenance", requirePublisher(requireModelOwner(modelDir, putProvenanceHandler(modelDir)))).Methods(http.MethodPut)
+	r.HandleFunc("/models/"+namePattern()+"/provenance", requirePublisher(requireModelOwner(modelDir, deleteProvenanceHandler(modelDir)))).Methods(http.MethodDelete)
+	r.HandleFunc("/models/"+namePattern()+"/tags", requireModelAccess(modelDir, tagsHandler(modelDir))).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern()+"/tags", requirePublisher(requireModelOwner(modelDir, putTagsHandler(modelDir)))).Methods(http.MethodPut)
+	r.HandleFunc("/models/"+namePattern()+"/acl", requireModelAccess(modelDir, aclHandler(modelDir))).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern()+"/acl", requirePublisher(requireModelAccess(modelDir, putACLHandler(modelDir)))).Methods(http.MethodPut)
+	r.HandleFunc("/models/"+namePattern()+"/acl", requirePublisher(requireModelAccess(modelDir, deleteACLHandler(modelDir)))).Methods(http.MethodDelete)
+	r.HandleFunc("/models/"+namePattern()+"/retention", requireAdmin(modelRetentionHandler(modelDir))).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern()+"/retention", requireAdmin(putModelRetentionHandler(modelDir))).Methods(http.MethodPut)
+	r.HandleFunc("/models/"+namePattern()+"/retention", requireAdmin(deleteModelRetentionHandler(modelDir))).Methods(http.MethodDelete)
+	r.HandleFunc("/models/"+namePattern()+"/pin", requireAdmin(pinHandler(modelDir))).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern()+"/pin", requireAdmin(unpinHandler(modelDir))).Methods(http.MethodDelete)
+	r.HandleFunc("/pins", requireAdmin(listPinsHandler)).Methods(http.MethodGet, http.MethodOptions)
+
+	// Promotions to production wait for a second identity's approval
+	if getenvBool("MODEL_REGISTRY_PROMOTION_APPROVAL", false) {
+		if approvals, err = newApprovalStore(modelDir); err != nil {
+			log.Fatalf("unable to load approvals: %v", err)
+		}
+		r.HandleFunc("/approvals", requirePublisher(listApprovalsHandler)).Methods(http.MethodGet, http.MethodOptions)
+		r.HandleFunc("/approvals/{id}", requirePublisher(approvalHandler)).Methods(http.MethodGet, http.MethodOptions)
+		r.HandleFunc("/approvals/{id}/approve", requireAdmin(approveHandler(modelDir))).Methods(http.MethodPost, http.MethodOptions)
+		r.HandleFunc("/approvals/{id}/reject", requirePublisher(rejectHandler)).Methods(http.MethodPost, http.MethodOptions)
+		log.Printf("[registry] promotions to production need approval")
+	}
+	r.HandleFunc("/models/"+namePattern()+"/versions", requireModelAccess(modelDir, versionsHandler(modelDir))).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern()+"/versions/{version}", requireModelAccess(modelDir, versionRoute(streamHandler(modelDir)))).Methods(http.MethodGet, http.MethodHead, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern()+"/versions/{version}", requireAdmin(versionRoute(deleteHandler(modelDir)))).Methods(http.MethodDelete)
+	r.HandleFunc("/models/"+namePattern()+"/delta", requireModelAccess(modelDir, deltaHandler(modelDir))).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern()+"/chunks", requireModelAccess(modelDir, chunksHandler(modelDir))).Methods(http.MethodGet, http.MethodHead, http.MethodOptions)
+	r.HandleFunc("/models/"+namePattern(), requireAdmin(deleteHandler(modelDir))).Methods(http.MethodDelete)
+	r.HandleFunc("/models/"+namePattern(), requireModelAccess(modelDir, streamHandler(modelDir))).Methods(http.MethodGet, http.MethodHead, http.MethodOptions).Name(downloadRouteName)
+	r.HandleFunc("/manifest", manifestHandler(modelDir)).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/changes", changesHandler(modelDir)).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/admin/api-keys", requireAdmin(listAPIKeysHandler)).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/admin/api-keys", requireAdmin(createAPIKeyHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/admin/api-keys/{name}", requireAdmin(deleteAPIKeyHandler)).Methods(http.MethodDelete)
+	r.HandleFunc("/webhooks", requireAdmin(listWebhooksHandler)).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/webhooks", requireAdmin(addWebhookHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/webhooks/{id}", requireAdmin(deleteWebhookHandler)).Methods(http.MethodDelete)
+	r.HandleFunc("/webhooks/{id}/deliveries", requireAdmin(webhookDeliveriesHandler)).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/capabilities", capabilitiesHandler).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/stats", statsHandler).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/quota", quotaHandler).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/stats/metrics", requireAdmin(metricsJSONHandler)).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/metrics", requireAdmin(metricsHandler)).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/audit", requireAdmin(auditHandler)).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/attacks", requireAdmin(attacksHandler)).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/attacks", requireAdmin(resetAttacksHandler)).Methods(http.MethodDelete)
+	r.HandleFunc("/score", requireScoreboard(scoreHandler)).Methods(http.MethodGet, http.MethodOptions).Name(scoreRouteName)
+	r.HandleFunc("/flags", requireAdmin(listFlagsHandler)).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/flags/verify", requireScoreboard(verifyFlagHandler)).Methods(http.MethodPost, http.MethodOptions).Name(flagVerifyRouteName)
+	r.HandleFunc("/admin/reload", requireAdmin(reloadHandler)).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/admin/vulns", requireVulnAdmin(listVulnsHandler)).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/admin/vulns", requireVulnAdmin(setVulnsHandler)).Methods(http.MethodPut)
+	r.HandleFunc("/admin/scenario", requireVulnAdmin(scenarioHandler)).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/stats/recent", recentHandler).Methods(http.MethodGet, http.MethodOptions)
+	if getenvBool("MODEL_REGISTRY_OCI", false) {
+		if !slices.Contains(modelExts(), ".gguf") {
+			log.Fatalf("MODEL_REGISTRY_OCI needs gguf in MODEL_EXTS: repositories map to .gguf models")
+		}
+		ociEnabled = true
+		registerOCIRoutes(r, modelDir)
+		log.Printf("[registry] OCI distribution API enabled at /v2/")
+	}
+	if chunkStorage != nil {
+		r.HandleFunc("/admin/chunks", requireAdmin(chunkStatsHandler)).Methods(http.MethodGet, http.MethodOptions)
+		r.HandleFunc("/admin/chunks/gc", requireAdmin(chunkGCHandler)).Methods(http.MethodPost, http.MethodOptions)
+	}
+	if blobs != nil {
+		r.HandleFunc("/blobs/{digest}", blobHandler(modelDir)).Methods(http.MethodGet, http.MethodHead, http.MethodOptions)
+		log.Printf("[registry] blob store enabled at /blobs")
+	}
+	// Stale upload sessions, old temp files and unreferenced blobs are
+	// collected this often, and on POST /admin/gc
+	gcTempAge := getenvDuration("MODEL_REGISTRY_GC_TEMP_AGE", defaultGCTempAge)
+	if gcTempAge <= 0 {
+		log.Fatalf("MODEL_REGISTRY_GC_TEMP_AGE must be positive: younger temp files may still be written")
+	}
+	collector = newGarbageCollector(modelDir, gcTempAge, getenvBool("MODEL_REGISTRY_GC_DRY_RUN", false))
+	if every := getenvDuration("MODEL_REGISTRY_GC_INTERVAL", defaultGCInterval); every > 0 {
+		go collector.janitor(every)
+	}
+	r.HandleFunc("/admin/gc", requireAdmin(lastGCHandler)).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/admin/gc", requireAdmin(gcHandler)).Methods(http.MethodPost)
+
+	// Retention rules: keep the newest N versions, purge what nobody used for
+	// a while. Applied this often, and on POST /admin/retention
+	retentionExempt, err := parseGlobList(getenv("MODEL_REGISTRY_RETENTION_EXEMPT", ""))
+	if err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_RETENTION_EXEMPT: %v", err)
+	}
+	keepVersions := getenvInt("MODEL_REGISTRY_RETENTION_KEEP_VERSIONS", 0)
+	maxIdle := getenvDuration("MODEL_REGISTRY_RETENTION_MAX_IDLE", 0)
+	if keepVersions < 0 || maxIdle < 0 {
+		log.Fatalf("MODEL_REGISTRY_RETENTION_KEEP_VERSIONS and MODEL_REGISTRY_RETENTION_MAX_IDLE can't be negative")
+	}
+	retention = newRetentionPolicy(modelDir, keepVersions, maxIdle, retentionExempt, getenvBool("MODEL_REGISTRY_RETENTION_DRY_RUN", false))
+	lastUseFile := lastUsePath(modelDir)
+	if err := lastUse.Load(lastUseFile); err != nil {
+		log.Printf("[registry] unable to load last use from %s: %v", lastUseFile, err)
+	}
+	go lastUse.persistLoop(lastUseFile, 30*time.Second)
+	if keepVersions > 0 || maxIdle > 0 {
+		log.Printf("[registry] retention: keep_versions=%d max_idle=%s", keepVersions, maxIdle)
+	}
+	if every := getenvDuration("MODEL_REGISTRY_RETENTION_INTERVAL", defaultRetentionInterval); every > 0 {
+		go retention.janitor(every)
+	}
+	r.HandleFunc("/admin/retention", requireAdmin(retentionHandler)).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/admin/retention", requireAdmin(applyRetentionHandler)).Methods(http.MethodPost)
+
+	// Replica of another registry: new and changed models are copied from it
+	// every interval, and when its webhook calls POST /replication/notify
+	if source := getenv("MODEL_REGISTRY_REPLICATION_SOURCE", ""); source != "" {
+		replication, err = newReplicator(modelDir, source, getenv("MODEL_REGISTRY_REPLICATION_TOKEN", ""),
+			getenv("MODEL_REGISTRY_REPLICATION_SECRET", ""), getenvBool("MODEL_REGISTRY_REPLICATION_DELETE", false))
+		if err != nil {
+			log.Fatalf("invalid MODEL_REGISTRY_REPLICATION_SOURCE: %v", err)
+		}
+		go replication.loop(getenvDuration("MODEL_REGISTRY_REPLICATION_INTERVAL", defaultReplicationInterval))
+		r.HandleFunc("/admin/replication", requireAdmin(replicationStatusHandler)).Methods(http.MethodGet, http.MethodOptions)
+		r.HandleFunc("/admin/replication/sync", requireAdmin(replicationSyncHandler)).Methods(http.MethodPost, http.MethodOptions)
+		r.HandleFunc("/replication/notify", replicationNotifyHandler).Methods(http.MethodPost)
+		log.Printf("[registry] replicating from %s (delete=%t)", replication.source, replication.prune)
+	}
+
+	// Models dropped into an S3 prefix are imported into a backend
+	if bucket := getenv("MODEL_REGISTRY_S3_SYNC_BUCKET", ""); bucket != "" {
+		b, err := newS3Bucket(getenv("MODEL_REGISTRY_S3_SYNC_ENDPOINT", getenv("MODEL_REGISTRY_S3_ENDPOINT", "")), bucket, getenv("MODEL_REGISTRY_S3_SYNC_PREFIX", ""),
+			getenv("MODEL_REGISTRY_S3_SYNC_REGION", getenv("MODEL_REGISTRY_S3_REGION", getenv("AWS_REGION", defaultS3Region))),
+			getenvBool("MODEL_REGISTRY_S3_SYNC_PATH_STYLE", getenvBool("MODEL_REGISTRY_S3_PATH_STYLE", false)), defaultS3PartSize)
+		if err != nil {
+			log.Fatalf("invalid S3 sync configuration: %v", err)
+		}
+		backend := getenv("MODEL_REGISTRY_S3_SYNC_BACKEND", primaryBackend)
+		if storageDriver == storageDriverS3 && backend == primaryBackend && bucket == getenv("MODEL_REGISTRY_S3_BUCKET", "") && b.prefix == objectPrefix(getenv("MODEL_REGISTRY_S3_PREFIX", "")) {
+			log.Fatalf("MODEL_REGISTRY_S3_SYNC_BUCKET and _PREFIX name the bucket models are stored in")
+		}
+		if s3Syncer, err = newS3Sync(b, backend, modelDir); err != nil {
+			log.Fatalf("invalid S3 sync configuration: %v", err)
+		}
+		if every := getenvDuration("MODEL_REGISTRY_S3_SYNC_INTERVAL", defaultS3SyncInterval); every > 0 {
+			go s3Syncer.janitor(every)
+		}
+		r.HandleFunc("/admin/s3-sync", requireAdmin(s3SyncStatusHandler)).Methods(http.MethodGet, http.MethodOptions)
+		r.HandleFunc("/admin/s3-sync", requireAdmin(s3SyncHandler)).Methods(http.MethodPost)
+		log.Printf("[registry] importing models from %s into backend %s", b, backend)
+	}
+	if getenvBool("MODEL_REGISTRY_EVENTS", false) {
+		events = newEventBroker(getenvInt("MODEL_REGISTRY_EVENTS_BUFFER", defaultEventBuffer))
+		r.HandleFunc("/events", requireAdmin(eventsHandler)).Methods(http.MethodGet, http.MethodOptions)
+		log.Printf("[registry] event stream enabled at /events")
+		// Catalog changes are noticed by rescanning, right after uploads and
+		// the like and at least this often for expiry and quarantine periods
+		if every := getenvDuration("MODEL_REGISTRY_EVENTS_SCAN_INTERVAL", defaultCatalogScanInterval); every > 0 {
+			catalogScans = make(chan struct{}, 1)
+			go watchCatalog(modelDir, every)
+		}
+	}
+
+	registerGauges(modelDir)
+
+	// Append-only record of every model pull, queried with GET /audit
+	if getenvBool("MODEL_REGISTRY_AUDIT", true) {
+		if audit, err = newAuditLog(modelDir); err != nil {
+			log.Fatalf("unable to open the audit log: %v", err)
+		}
+	}
+
+	// Attack events scored per team for the lab scoreboard, which reads
+	// GET /score with its own token
+	scoreboardToken = getenv("MODEL_REGISTRY_SCOREBOARD_TOKEN", "")
+	if getenvBool("MODEL_REGISTRY_ATTACKS", false) {
+		ac := attackConfig{
+			authFailures: getenvInt("MODEL_REGISTRY_ATTACK_AUTH_FAILURES", defaultAttackAuthFailures),
+			authWindow:   getenvDuration("MODEL_REGISTRY_ATTACK_AUTH_WINDOW", defaultAttackAuthWindow),
+			volume:       int64(getenvInt("MODEL_REGISTRY_ATTACK_VOLUME", defaultAttackVolume)),
+			volumeWindow: getenvDuration("MODEL_REGISTRY_ATTACK_VOLUME_WINDOW", defaultAttackVolumeWindow),
+			teamHeader:   getenv("MODEL_REGISTRY_ATTACK_TEAM_HEADER", ""),
+		}
+		if ac.authFailures < 1 || ac.authWindow <= 0 || ac.volumeWindow <= 0 {
+			log.Fatalf("invalid MODEL_REGISTRY_ATTACK_*: failures must be at least 1 and windows positive")
+		}
+		if attacks, err = newAttackLog(modelDir, ac); err != nil {
+			log.Fatalf("unable to open the attack log: %v", err)
+		}
+		log.Printf("[registry] attack telemetry on, scores at /score")
+	}
+
+	// Decoy models of the scenario, planted if missing and watched on pull
+	if activeScenario != nil {
+		if err := plantDecoys(activeScenario, modelDir); err != nil {
+			log.Fatalf("unable to plant scenario decoys: %v", err)
+		}
+	}
+
+	// CTF flags, one per team and challenge, planted into templated models
+	if file := getenv("MODEL_REGISTRY_FLAGS_FILE", ""); file != "" {
+		if ctfFlags, err = loadFlags(file, getenv("MODEL_REGISTRY_FLAG_SECRET", ""), getenv("MODEL_REGISTRY_FLAG_TEAMS", "")); err != nil {
+			log.Fatalf("invalid MODEL_REGISTRY_FLAGS_FILE: %v", err)
+		}
+		if err := ctfFlags.plant(modelDir); err != nil {
+			log.Fatalf("unable to plant CTF flags: %v", err)
+		}
+	}
+
 	// Catch-all OPTIONS handler for CORS preflight
 	r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "OPTIONS" {
@@ -70,15 +706,125 @@ func main() {
 		}
 	}).Methods(http.MethodOptions)
 
-	// Wrap with simple logging middleware
-	logged := loggingMiddleware(r)
+	// Wrap with simple logging middleware; per-route verbosity is keyed by the
+	// mux path template, e.g. MODEL_REGISTRY_LOG_ROUTES="/healthz=off,/stats=errors"
+	routeLevels, err := parseRouteLogLevels(getenv("MODEL_REGISTRY_LOG_ROUTES", ""))
+	if err != nil {
+		log.Fatalf("invalid MODEL_REGISTRY_LOG_ROUTES: %v", err)
+	}
+	// Downloads for the path_traversal lab flag go to a router that leaves
+	// ".." in paths alone, with the main one's authentication
+	tr := mux.NewRouter().SkipClean(true)
+	tr.Use(tracingMiddleware, corsMiddleware, jwtMiddleware, apiKeyMiddleware)
+	tr.HandleFunc("/models/{name:.+}", streamHandler(modelDir)).Methods(http.MethodGet, http.MethodHead).Name(downloadRouteName)
+	logged := traversalMiddleware(loggingMiddleware(r, routeLevels), loggingMiddleware(tr, routeLevels))
+
+	// Operator banner (maintenance, deprecations) sent on every response
+	if notice = sanitizeNotice(getenv("MODEL_REGISTRY_BANNER", "")); notice != "" {
+		log.Printf("[registry] banner: %s", notice)
+	}
 
-	port := getenv("MODEL_REGISTRY_INTERNAL_PORT", getenv("PORT", "8050"))
+	port := cfg.Port
 	addr := fmt.Sprintf("0.0.0.0:%s", port)
-	log.Printf("[registry] listening on %s, serving dir=%s", addr, modelDir)
-	if err := http.ListenAndServe(addr, logged); err != nil {
+	// No read or write timeout: uploads and downloads of big models take as
+	// long as they take. Headers must arrive promptly and idle connections go.
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           noticeMiddleware(logged),
+		ReadHeaderTimeout: getenvDuration("MODEL_REGISTRY_READ_HEADER_TIMEOUT", defaultReadHeaderTimeout),
+		IdleTimeout:       getenvDuration("MODEL_REGISTRY_IDLE_TIMEOUT", defaultIdleTimeout),
+	}
+	// Some load balancers expect connections to be recycled per request
+	keepAlive := getenvBool("MODEL_REGISTRY_KEEPALIVE", true)
+	srv.SetKeepAlivesEnabled(keepAlive)
+	// Long-lived SSE streams would otherwise hold Shutdown until its timeout
+	srv.RegisterOnShutdown(events.Close)
+	log.Printf("[registry] keep-alives enabled=%t idle_timeout=%s read_header_timeout=%s", keepAlive, srv.IdleTimeout, srv.ReadHeaderTimeout)
+
+	// TLS on the main port when a cert is configured (or self-signed for
+	// labs), optionally with a plaintext listener that only redirects to it
+	// (and answers /healthz).
+	certFile, keyFile := cfg.TLS.CertFile, cfg.TLS.KeyFile
+	if cfg.TLS.SelfSigned {
+		hosts := selfSignedHosts(cfg.TLS.Hosts)
+		if certFile, keyFile, err = selfSignedCert(modelDir, hosts); err != nil {
+			log.Fatalf("fatal: unable to create a self-signed certificate: %v", err)
+		}
+	}
+	tlsEnabled = certFile != ""
+	if mtlsEnabled {
+		if srv.TLSConfig, err = clientTLSConfig(clientCA, cfg.TLS.ClientAuth); err != nil {
+			log.Fatalf("invalid client certificate configuration: %v", err)
+		}
+		log.Printf("[registry] verifying client certificates against %s", clientCA)
+	}
+	servers := []*http.Server{srv}
+	if redirectPort := cfg.TLS.RedirectPort; redirectPort != "" {
+		servers = append(servers, &http.Server{
+			Addr:              fmt.Sprintf("0.0.0.0:%s", redirectPort),
+			Handler:           noticeMiddleware(loggingMiddleware(redirectRouter(port), routeLevels)),
+			ReadHeaderTimeout: srv.ReadHeaderTimeout,
+			IdleTimeout:       srv.IdleTimeout,
+		})
+	}
+
+	// Optional gRPC API on its own port, with the main port's certificate
+	var grpcSrv *grpc.Server
+	if grpcPort := cfg.GRPCPort; grpcPort != "" {
+		var creds credentials.TransportCredentials
+		if certFile != "" {
+			if creds, err = grpcCredentials(certFile, keyFile, srv.TLSConfig); err != nil {
+				log.Fatalf("invalid TLS configuration for gRPC: %v", err)
+			}
+		}
+		grpcSrv = newGRPCServer(modelDir, creds)
+		grpcEnabled = true
+		go serveGRPC(grpcSrv, fmt.Sprintf("0.0.0.0:%s", grpcPort))
+	}
+
+	// On SIGTERM/SIGINT stop reusing connections so clients reconnect to a
+	// healthy instance, then let in-flight requests finish on every listener
+	// for up to the grace period (keep it below the orchestrator's own).
+	shutdownDelay := getenvDuration("MODEL_REGISTRY_SHUTDOWN_DELAY", 0)
+	shutdownGrace := getenvDuration("MODEL_REGISTRY_SHUTDOWN_GRACE", defaultShutdownGrace)
+	// SIGHUP rereads the configuration and applies what can change live
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			reload("SIGHUP")
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		<-sig
+		shutdown(servers, grpcSrv, shutdownDelay, shutdownGrace)
+	}()
+
+	for _, s := range servers[1:] {
+		go func(s *http.Server) {
+			log.Printf("[registry] redirecting http://%s to https on port %s", s.Addr, port)
+			if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("fatal: %v", err)
+			}
+		}(s)
+	}
+
+	if certFile != "" {
+		log.Printf("[registry] listening with TLS on %s, serving dir=%s", addr, modelDir)
+		err = srv.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		log.Printf("[registry] listening on %s, serving dir=%s", addr, modelDir)
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("fatal: %v", err)
 	}
+	<-done
 }
 
 // healthzHandler returns basic liveness info.
@@ -90,36 +836,239 @@ func healthzHandler(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, resp)
 }
 
-// listHandler enumerates all files directly under modelDir.
+// listHandler enumerates the models under modelDir that pass the query's
+// filters, flat and paged or grouped by directory with ?group=dir.
 func listHandler(modelDir string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		files, err := os.ReadDir(modelDir)
+		group := r.URL.Query().Get("group")
+		if group != "" && group != "dir" {
+			http.Error(w, "group must be dir", http.StatusBadRequest)
+			return
+		}
+
+		status := r.URL.Query().Get("status")
+		if status != "" && !validStatuses[status] {
+			http.Error(w, "unknown status "+strconv.Quote(status), http.StatusBadRequest)
+			return
+		}
+		stage := r.URL.Query().Get("stage")
+		if stage != "" && !slices.Contains(stageOrder, stage) {
+			http.Error(w, "unknown stage "+strconv.Quote(stage), http.StatusBadRequest)
+			return
+		}
+
+		page, err := parseListPage(r.URL.Query())
 		if err != nil {
-			http.Error(w, "unable to list models", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if group != "" && page.Active() {
+			http.Error(w, "pagination is not supported with group", http.StatusBadRequest)
 			return
 		}
 
-		var names []string
+		scope, err := listBackends(r, modelDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var files []modelFile
+		for _, backend := range scope {
+			found, err := backendStorage(backend, modelDir).List(r.Context())
+			if err != nil {
+				log.Printf("[registry] unable to list backend %s: %v", backend, err)
+				http.Error(w, "unable to list models", http.StatusInternalServerError)
+				return
+			}
+			for _, f := range found {
+				f.Name = qualifiedName(backend, f.Name)
+				files = append(files, f)
+			}
+			if backend == primaryBackend && tier != nil {
+				files = append(files, tier.Uncached(found)...)
+			}
+		}
+
+		// Without ?status= expired and quarantined models are hidden; with it
+		// exactly the models in that lifecycle state are listed.
+		prefix := r.URL.Query().Get("prefix")
+		glob := r.URL.Query().Get("glob")
+		if _, err := path.Match(glob, ""); err != nil {
+			http.Error(w, "invalid glob "+strconv.Quote(glob), http.StatusBadRequest)
+			return
+		}
+		quant := r.URL.Query().Get("quant")
+		format := r.URL.Query().Get("format")
+		allowed := requestModelFilter(r)
+		var visible []modelFile
 		for _, f := range files {
-			// only show files ending in .gguf to keep list concise
-			if !f.IsDir() && filepath.Ext(f.Name()) == ".gguf" {
-				names = append(names, f.Name())
+			if !allowed(f.Name) {
+				continue
+			}
+			st := modelStatus(f.Key(), f.Info)
+			if status != "" && st != status {
+				continue
+			}
+			if status == "" && (st == statusExpired || st == statusQuarantined) {
+				continue
+			}
+			if stage != "" && stageOf(f.Key()) != stage {
+				continue
+			}
+			if quant != "" && !quantMatches(parseQuant(f.Name), quant) {
+				continue
 			}
+			if format != "" && modelFormat(f.Name) != format {
+				continue
+			}
+			if !strings.HasPrefix(f.Name, prefix) {
+				continue
+			}
+			if ok, _ := path.Match(glob, f.Name); glob != "" && !ok {
+				continue
+			}
+			visible = append(visible, f)
 		}
-		writeJSON(w, http.StatusOK, listResponse{Models: names})
+
+		total := len(visible)
+		if group == "dir" {
+			writeJSONConditional(w, r, "models", groupedListResponse{Groups: groupByDir(visible), Total: total})
+			return
+		}
+		var nextCursor string
+		var nextOffset *int
+		if page.Active() {
+			visible, nextCursor, nextOffset = page.apply(visible)
+		}
+		if detail, _ := strconv.ParseBool(r.URL.Query().Get("detail")); detail {
+			entries := []modelEntry{}
+			for _, f := range visible {
+				e := modelEntry{
+					Name:     f.Name,
+					Size:     f.Info.Size(),
+					Modified: f.Info.ModTime().UTC(),
+					Format:   modelFormat(f.Name),
+					Quant:    parseQuant(f.Name),
+					Status:   modelStatus(f.Key(), f.Info),
+					Version:  f.Version,
+				}
+				// Header fields come from the GGUF cache; the file type only
+				// stands in for a quant the name doesn't carry.
+				if h, err := readGGUFHeader(f.Path, f.Info); err == nil {
+					e.Architecture, e.ContextLength, e.ParameterCount = h.Architecture, h.ContextLength, h.ParameterCount
+					if e.Quant == "" {
+						e.Quant = h.Quantization
+					}
+				}
+				meta, err := sidecars.Get(f.Key())
+				if err == nil {
+					e.Summary = meta.CardSummary
+				}
+				e.Stage = modelStage(meta)
+				entries = append(entries, e)
+			}
+			writeJSONConditional(w, r, "models", detailedListResponse{Models: entries, Total: total, NextCursor: nextCursor, NextOffset: nextOffset})
+			return
+		}
+		var names []string
+		for _, f := range visible {
+			names = append(names, f.Name)
+		}
+		writeJSONConditional(w, r, "models", listResponse{Models: names, Total: total, NextCursor: nextCursor, NextOffset: nextOffset})
 	}
 }
 
-// streamHandler streams the raw file back to caller.
-// It performs NO signature validation or ACL checks (intentional weakness, LLM05/10).
+// streamHandler streams the raw file back to caller. Private models are
+// checked against their ACL by requireModelAccess on the route.
+// It performs NO signature validation (intentional weakness, LLM05/10).
 func streamHandler(modelDir string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		name := mux.Vars(r)["name"]
+		ref, err := resolveModel(r, modelDir, mux.Vars(r)["name"])
+		if errors.As(err, new(invalidNameError)) {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := ref.Name
+		// HEAD answers with the headers a GET would send, without the body
+		// or any of a download's side effects.
+		head := r.Method == http.MethodHead
+
+		if !head {
+			modelLimit := limits().model
+			if d := modelLimit.Allow(name); !d.Allowed {
+				writeRateLimited(w, modelLimit, d)
+				return
+			}
+		}
+
+		sessionID := r.Header.Get(sessionHeader)
+		if sessionID != "" && !validSessionID(sessionID) {
+			http.Error(w, "invalid "+sessionHeader, http.StatusBadRequest)
+			return
+		}
+
+		// Models missing here come from MODEL_REGISTRY_UPSTREAM, and copies
+		// of its models are revalidated once their TTL is up.
+		if upstream != nil && !head {
+			if err := upstream.Ensure(r, ref); err == errUpstreamBusy {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			} else if err != nil {
+				http.Error(w, "unable to fetch model from the upstream registry", http.StatusBadGateway)
+				return
+			}
+		}
+
+		// A delete in progress wins; the file is about to disappear.
+		if err := streams.Begin(name, !head); errors.Is(err, errStreamDeleting) {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeStreamsFull(w, err)
+			return
+		}
+		defer streams.End(name)
 
 		// This is deliberate for the vulnerable lab.
-		absPath := filepath.Join(modelDir, name)
+		absPath := ref.Path()
 
-		f, err := os.Open(absPath)
+		st, key := storageFor(ref)
+		var obj storageObject
+		var fromOrigin bool
+		if tier != nil && ref.Backend == primaryBackend && ref.Version == "" {
+			// The origin tier pairs two local directories.
+			var f *os.File
+			if f, fromOrigin, err = tier.Open(modelDir, ref.File); err == nil {
+				obj, err = newLocalObject(f)
+			}
+			if fromOrigin && err == nil {
+				absPath = f.Name()
+			}
+		} else if traversalRequest(r) {
+			// The store keeps names inside MODEL_DIR; the lab goes wherever
+			// the name leads.
+			var f *os.File
+			if f, err = os.Open(absPath); err == nil {
+				obj, err = newLocalObject(f)
+			}
+		} else {
+			obj, err = st.Open(r.Context(), key)
+		}
+		// A model mapped to the Hugging Face Hub is fetched on its first download.
+		if _, mapped := hub.Source(name); mapped && !head && os.IsNotExist(err) && ref.Backend == primaryBackend && ref.Version == "" {
+			if err = hub.Fetch(r, ref); err == nil {
+				obj, err = st.Open(r.Context(), key)
+			} else if err == errHubBusy {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			} else {
+				http.Error(w, "unable to fetch model from the Hugging Face Hub", http.StatusBadGateway)
+				return
+			}
+		}
 		if err != nil {
 			if os.IsNotExist(err) {
 				http.Error(w, "model not found", http.StatusNotFound)
@@ -128,33 +1077,322 @@ func streamHandler(modelDir string) http.HandlerFunc {
 			http.Error(w, "unable to open model", http.StatusInternalServerError)
 			return
 		}
-		defer f.Close()
+		defer obj.Close()
+		info := obj.Info()
+
+		if age, expired := expiry.Check(name, info.ModTime()); expired {
+			w.Header().Set("X-Model-Age", strconv.FormatInt(int64(age.Seconds()), 10))
+			http.Error(w, fmt.Sprintf("model expired: age %s exceeds %s", age.Round(time.Second), expiry.maxAge), http.StatusGone)
+			return
+		}
+
+		// A one-time token is checked here and, like the admin token, also
+		// unlocks quarantined models. It is only consumed once the body is
+		// about to stream.
+		granted := false
+		if r.URL.Query().Has("token") {
+			if !checkOneTimeToken(w, r, name) {
+				return
+			}
+			granted = true
+		}
+
+		if isQuarantined(name, info) && !isAdmin(r) && !granted {
+			http.Error(w, "model is quarantined", http.StatusForbidden)
+			return
+		}
+		if checkNotModified(w, r, fileETag(info)) {
+			return
+		}
+
+		// Full file unless the client asked for a shard (?shard=i/n) or a
+		// byte range (Range: bytes=a-b), e.g. to resume an interrupted download.
+		size := info.Size()
+		rng := byteRange{Start: 0, Length: size}
+		partial := false
+		w.Header().Set("Accept-Ranges", "bytes")
+		spec, rangeHeader := r.URL.Query().Get("shard"), r.Header.Get("Range")
+		if spec != "" && rangeHeader != "" {
+			http.Error(w, "shard and Range can't be combined", http.StatusBadRequest)
+			return
+		}
+		var want byteRange
+		var what string
+		switch {
+		case spec != "":
+			idx, count, shard, err := parseShard(spec, size)
+			if err == errEmptyRange {
+				writeRangeNotSatisfiable(w, size)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("X-Shard-Index", strconv.Itoa(idx))
+			w.Header().Set("X-Shard-Count", strconv.Itoa(count))
+			want, what = shard, fmt.Sprintf("shard %d/%d", idx, count)
+		case rangeHeader != "" && ifRangeMatches(r, fileETag(info)):
+			// Malformed or multi-range headers are ignored: full file.
+			br, err := parseRange(rangeHeader, size)
+			if err == errEmptyRange {
+				writeRangeNotSatisfiable(w, size)
+				return
+			} else if err == nil {
+				want, what = br, "range "+rangeHeader
+			}
+		}
+		if what != "" {
+			// Range requests get their own concurrency cap; over it the
+			// policy either refuses or falls back to one full stream.
+			if head || ranges.Acquire() {
+				if !head {
+					defer ranges.Release()
+				}
+				rng, partial = want, true
+			} else if ranges.policy == rangeOverflowFull {
+				w.Header().Del("X-Shard-Index")
+				w.Header().Del("X-Shard-Count")
+				log.Printf("[registry] range limit %d reached: serving %s in full instead of %s", ranges.max, name, what)
+			} else {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "too many concurrent range requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		// Full downloads may go out zstd-compressed; ranges and shards address
+		// bytes of the file itself, so they never are.
+		var encoding string
+		if compressModels {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if !partial {
+				encoding = negotiateEncoding(r, []string{encodingZstd})
+			}
+		}
+
+		var src io.Reader
+		if !head {
+			body, err := obj.Range(rng.Start, rng.Length)
+			if err != nil {
+				log.Printf("[registry] unable to read %s: %v", name, err)
+				http.Error(w, "unable to read model", http.StatusBadGateway)
+				return
+			}
+			defer body.Close()
+			src = body
+			if granted && !redeemOneTimeToken(w, r, name) {
+				return
+			}
+		}
+
+		var token string
+		if !head {
+			recent.Touch(name)
+			lastUse.Touch(name)
+			if sessionID != "" {
+				sessions.Begin(sessionID, name, size)
+			}
+			token = downloadTokens.Issue(name)
+			if token != "" {
+				w.Header().Set(downloadTokenHeader, token)
+			}
+		}
 
 		// Best-effort Content-Type; default to octet-stream
+		if tier != nil && ref.Backend == primaryBackend {
+			if fromOrigin {
+				w.Header().Set(tierHeader, "origin")
+			} else {
+				w.Header().Set(tierHeader, "local")
+			}
+		}
+		if ref.Version != "" {
+			w.Header().Set(versionHeader, ref.Version)
+		}
 		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filepath.Base(absPath)))
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, path.Base(ref.File)))
+		if cc := cacheControl.For(name); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+		// For full downloads the SHA-256 is computed while streaming and sent
+		// as a trailer to clients that advertise "TE: trailers" (trailers need
+		// chunked encoding, so Content-Length is dropped for them). Everyone
+		// else keeps Content-Length and gets the digest as a plain header when
+		// it is already cached.
+		var hasher hash.Hash
+		if encoding != "" {
+			// The encoded size isn't known up front, and a strong validator
+			// no longer applies to the encoded bytes.
+			w.Header().Set("Content-Encoding", encoding)
+			w.Header().Set("ETag", "W/"+fileETag(info))
+		}
+		if !head && !partial && acceptsTrailers(r) {
+			hasher = sha256.New()
+			w.Header().Set("Trailer", checksumTrailer)
+		} else {
+			if encoding == "" {
+				w.Header().Set("Content-Length", strconv.FormatInt(rng.Length, 10))
+			}
+			if !partial {
+				if sum, ok := digests.Cached(absPath, info); ok {
+					w.Header().Set(checksumTrailer, sum)
+				}
+			}
+		}
+		if partial {
+			w.Header().Set("Content-Range", rng.contentRange(size))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		alertHoneypotHTTP(r, name, rng)
+		if head {
+			return
+		}
+
+		events.Publish(eventDownloadStarted, name, withIdentity(requestIdentity(r), map[string]any{"offset": rng.Start, "length": rng.Length, "client": clientIP(r), "token": token}))
 
-		if _, err := io.Copy(w, f); err != nil {
+		pullStart := time.Now()
+		var dst io.Writer = egress.Writer(r.Context(), w)
+		var zw *zstdWriter
+		if encoding == encodingZstd {
+			zw = newZstdWriter(dst)
+			dst = zw
+		}
+		if hasher != nil {
+			dst = io.MultiWriter(dst, hasher)
+		}
+		var fill *tierFill
+		if fromOrigin && !partial {
+			if fill = tier.Fill(modelDir, ref.File); fill != nil {
+				src = fill.Tee(src)
+			}
+		}
+		n, err := io.Copy(dst, src)
+		modelBytes.Add(float64(n), name)
+		if sp := spanFromContext(r.Context()); sp != nil {
+			sp.SetAttr("model.name", name)
+			sp.SetAttr("model.bytes", n)
+		}
+		if zw != nil {
+			if cerr := zw.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if fill != nil {
+			fill.Finish(err == nil && n == size)
+		}
+		if err != nil {
 			// If client cancels, just log
 			log.Printf("[registry] stream error: %v", err)
 		}
+		complete := err == nil && n == rng.Length
+		events.Publish(eventDownloadFinished, name, withIdentity(requestIdentity(r), map[string]any{"bytes": n, "complete": complete, "client": clientIP(r), "token": token}))
+		recordHTTPPull(r, "http", name, "", rng, n, complete, pullStart)
+		if elapsed, ok := downloadTokens.Finish(token); ok {
+			log.Printf("[registry] download %s: model=%s bytes=%d/%d complete=%t duration=%s", token, name, n, rng.Length, complete, elapsed.Round(time.Millisecond))
+		}
+		if hasher != nil && err == nil && n == size {
+			sum := hex.EncodeToString(hasher.Sum(nil))
+			w.Header().Set(checksumTrailer, sum)
+			digests.Put(absPath, info, sum)
+		}
+		if sessionID != "" {
+			if s, ok := sessions.Add(sessionID, rng.Start, n); ok {
+				log.Printf("[registry] download session %s: model=%s parts=%d bytes=%d covered=%d/%d complete=%t",
+					s.ID, s.Model, s.Parts, s.Bytes, s.Covered, s.Size, s.CompletedAt != nil)
+			}
+		}
 	}
 }
 
-// loggingMiddleware logs basic request/response information.
-func loggingMiddleware(next http.Handler) http.Handler {
+// Access log verbosity levels for MODEL_REGISTRY_LOG_ROUTES.
+const (
+	logLevelFull   = "full"   // every request (default)
+	logLevelErrors = "errors" // only responses with status >= 400
+	logLevelOff    = "off"    // never
+)
+
+// parseRouteLogLevels parses "template=level,..." into a lookup map.
+func parseRouteLogLevels(spec string) (map[string]string, error) {
+	levels := map[string]string{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		tpl, level, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q is not route=level", item)
+		}
+		switch level {
+		case logLevelFull, logLevelErrors, logLevelOff:
+		default:
+			return nil, fmt.Errorf("unknown log level %q for %s", level, tpl)
+		}
+		levels[tpl] = level
+	}
+	return levels, nil
+}
+
+// loggingMiddleware logs basic request/response information and records the
+// request metrics. The request is matched against router to find its route
+// template, which labels the metrics and selects the verbosity from levels;
+// unlisted routes are always logged. Every request gets a request ID here.
+func loggingMiddleware(router *mux.Router, levels map[string]string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		r, id := withRequestID(w, r)
 		ww := &wrappedWriter{ResponseWriter: w, status: http.StatusOK}
-		next.ServeHTTP(ww, r)
-		log.Printf("[registry] %s %s %d %s", r.Method, r.URL.Path, ww.status, time.Since(start))
+		router.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if tpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		httpRequests.Inc(route, metricMethod(r.Method), strconv.Itoa(ww.status))
+		httpDuration.Observe(time.Since(start).Seconds(), route)
+		attacks.Observe(r, match.Route, ww.status, ww.bytes)
+
+		level := logLevelFull
+		if l, ok := levels[route]; ok {
+			level = l
+		}
+		if level == logLevelOff || (level == logLevelErrors && ww.status < 400) {
+			return
+		}
+		e := accessEntry{
+			RequestID: id,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Route:     route,
+			Status:    ww.status,
+			Bytes:     ww.bytes,
+			Duration:  time.Since(start),
+			Client:    clientIP(r),
+			Identity:  requestIdentity(r),
+			Key:       apiKeyName(r),
+			Token:     ww.Header().Get(downloadTokenHeader),
+		}
+		if c := requestClaims(r); c != nil {
+			e.Subject = c.Subject
+		}
+		logAccess(e)
 	})
 }
 
-// wrappedWriter captures response status for logging.
+// wrappedWriter captures response status and size for logging.
 type wrappedWriter struct {
 	http.ResponseWriter
 	status int
+	bytes  int64
+}
+
+func (w *wrappedWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
 }
 
 func (w *wrappedWriter) WriteHeader(code int) {
@@ -162,6 +1400,18 @@ func (w *wrappedWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
+// Flush lets streaming handlers (SSE) flush through the logging wrapper.
+func (w *wrappedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *wrappedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // writeJSON is a helper to marshal and write JSON responses.
 func writeJSON(w http.ResponseWriter, code int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -173,8 +1423,50 @@ func writeJSON(w http.ResponseWriter, code int, v interface{}) {
 
 // getenv returns the value or a fallback if empty.
 func getenv(k, fallback string) string {
-	if v := os.Getenv(k); v != "" {
+	if v := lookupEnv(k); v != "" {
 		return v
 	}
 	return fallback
-}
\ No newline at end of file
+}
+
+// getenvInt returns the integer value of k or fallback if empty or invalid.
+func getenvInt(k string, fallback int) int {
+	v := lookupEnv(k)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("[registry] invalid %s=%q, using %d", k, v, fallback)
+		return fallback
+	}
+	return n
+}
+
+// getenvDuration returns the duration value of k (e.g. "30s") or fallback if empty or invalid.
+func getenvDuration(k string, fallback time.Duration) time.Duration {
+	v := lookupEnv(k)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("[registry] invalid %s=%q, using %s", k, v, fallback)
+		return fallback
+	}
+	return d
+}
+
+// getenvBool returns the boolean value of k (1/0, true/false, ...) or fallback if empty or invalid.
+func getenvBool(k string, fallback bool) bool {
+	v := lookupEnv(k)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("[registry] invalid %s=%q, using %t", k, v, fallback)
+		return fallback
+	}
+	return b
+}
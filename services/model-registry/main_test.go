@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestRegistry points the registry's stores at a fresh MODEL_DIR and
+// returns it.
+func newTestRegistry(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	newTestRegistryIn(t, dir)
+	return dir
+}
+
+// newTestRegistryIn is newTestRegistry with dir as MODEL_DIR.
+func newTestRegistryIn(t *testing.T, dir string) {
+	t.Helper()
+	storage = localStorage{dir: dir}
+	sidecars = newSidecarStore(dir)
+	recent = newRecentTracker(defaultRecentMax)
+	sessions = newSessionTracker(defaultSessionTTL, defaultSessionMax)
+	expiry = newModelExpiry(0, nil)
+	cacheControl = &cachePolicy{}
+}
+
+// writeTestModel stores content as the model name in dir.
+func writeTestModel(t *testing.T, dir, name string, content []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamChecksumTrailer(t *testing.T) {
+	dir := newTestRegistry(t)
+	content := []byte("GGUF model bytes for the trailer test")
+	writeTestModel(t, dir, "tiny.gguf", content)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/models/{name}", streamHandler(dir)).Methods(http.MethodGet)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/models/tiny.gguf", nil)
+	req.Header.Set("TE", "trailers")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if resp.ContentLength != -1 {
+		t.Errorf("ContentLength = %d, want -1 (chunked)", resp.ContentLength)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != string(content) {
+		t.Fatalf("body = %q, want %q", body, content)
+	}
+
+	sum := sha256.Sum256(content)
+	if got, want := resp.Trailer.Get(checksumTrailer), hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("trailer %s = %q, want %q", checksumTrailer, got, want)
+	}
+}
+
+func TestStreamHidesRegistryState(t *testing.T) {
+	dir := newTestRegistry(t)
+	recursive = true
+	t.Cleanup(func() { recursive = false })
+	writeTestModel(t, dir, "tiny.gguf", []byte("GGUF"))
+	if err := os.MkdirAll(filepath.Join(dir, stateDirName), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestModel(t, dir, stateDirName+"/api-keys.json", []byte(`{"keys":[]}`))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/models/"+namePattern(), requireModelAccess(dir, streamHandler(dir))).Methods(http.MethodGet)
+	for path, want := range map[string]int{
+		"/models/tiny.gguf":                  http.StatusOK,
+		"/models/.registry/api-keys.json":    http.StatusNotFound,
+		"/models/sub/.hidden.gguf":           http.StatusNotFound,
+		"/models/" + stateDirName + "/x.txt": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("GET %s: status = %d, want %d", path, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// manifestContentType is newline-delimited JSON, one model per line.
+const manifestContentType = "application/x-ndjson"
+
+// manifestPartialHeader is set when some entries lack requested digests.
+const manifestPartialHeader = "X-Manifest-Partial"
+
+// defaultManifestHashBudget is how many uncached models one /manifest request
+// hashes before answering.
+const defaultManifestHashBudget = 4
+
+// manifestHashBudget is configured by MODEL_REGISTRY_MANIFEST_HASH_BUDGET.
+var manifestHashBudget = defaultManifestHashBudget
+
+// manifestWarming is set while a background pass fills digests a manifest
+// request had to leave out.
+var manifestWarming atomic.Bool
+
+// manifestEntry is one line of /manifest. The fields mean the same as in
+// /models/{name}/metadata.
+type manifestEntry struct {
+	Name     string            `json:"name"`
+	Version  string            `json:"version,omitempty"` // newest version of a versioned model
+	Size     int64             `json:"size"`
+	Modified time.Time         `json:"modified"`
+	Status   string            `json:"status"`
+	Digests  map[string]string `json:"digests,omitempty"`
+	Partial  bool              `json:"partial,omitempty"` // some requested digests aren't known yet
+}
+
+// manifestItem is an entry plus what is needed to hash it. Origin-tier
+// models not yet cached are read from the origin, not the primary store.
+type manifestItem struct {
+	entry  manifestEntry
+	ref    modelRef
+	info   os.FileInfo
+	origin bool
+}
+
+// digests returns the digests of the item for algos.
+func (it manifestItem) digests(ctx context.Context, algos []string) (map[string]string, error) {
+	if it.origin {
+		return digests.Digests(it.ref.Path(), it.info, algos)
+	}
+	return digests.ModelDigests(ctx, it.ref, it.info, algos)
+}
+
+// scanCatalog lists every model a default /models?backend=all listing would
+// show (expired and quarantined ones are left out), ordered by backend and
+// then name.
+func scanCatalog(modelDir string) ([]manifestItem, error) {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var items []manifestItem
+	add := func(backend, dir string, files []modelFile, origin bool) {
+		for _, f := range files {
+			ref := fileRef(backend, dir, f)
+			st := modelStatus(ref.Name, f.Info)
+			if st == statusExpired || st == statusQuarantined {
+				continue
+			}
+			items = append(items, manifestItem{
+				entry: manifestEntry{
+					Name:     qualifiedName(backend, f.Name),
+					Version:  f.Version,
+					Size:     f.Info.Size(),
+					Modified: f.Info.ModTime().UTC(),
+					Status:   st,
+				},
+				ref:    ref,
+				info:   f.Info,
+				origin: origin,
+			})
+		}
+	}
+	for _, backend := range names {
+		dir := backendDir(backend, modelDir)
+		found, err := backendStorage(backend, modelDir).List(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", backend, err)
+		}
+		add(backend, dir, found, false)
+		if backend == primaryBackend && tier != nil {
+			add(backend, tier.origin, tier.Uncached(found), true)
+		}
+	}
+	return items, nil
+}
+
+// catalogRecords is what the catalog version is derived from.
+func catalogRecords(items []manifestItem) map[string]catalogRecord {
+	records := make(map[string]catalogRecord, len(items))
+	for _, it := range items {
+		records[it.entry.Name] = catalogRecord{Size: it.entry.Size, Modified: it.entry.Modified, Status: it.entry.Status}
+	}
+	return records
+}
+
+// manifestHandler streams the whole catalog as ndjson for mirroring tools.
+// ?algo= picks the digests to include (default sha256). Cached digests are
+// always included; up to manifestHashBudget misses are hashed inline and the
+// rest are left out, marked partial and filled in the background so a later
+// request is complete. Only complete manifests carry an ETag, derived from
+// the catalog version and the algorithms.
+func manifestHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		spec := r.URL.Query().Get("algo")
+		if spec == "" {
+			spec = algoSHA256
+		}
+		algos, err := requestedAlgos(spec)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		items, err := scanCatalog(modelDir)
+		if err != nil {
+			log.Printf("[registry] unable to build manifest: %v", err)
+			http.Error(w, "unable to list models", http.StatusInternalServerError)
+			return
+		}
+
+		version := catalogVersionString(catalog.Observe(catalogRecords(items)))
+		// The version covers the whole catalog; private models are then
+		// left out for callers who can't see them.
+		allowed := requestModelFilter(r)
+		items = slices.DeleteFunc(items, func(it manifestItem) bool { return !allowed(it.entry.Name) })
+
+		budget := manifestHashBudget
+		var deferred []manifestItem
+		for i := range items {
+			it := &items[i]
+			sums, complete := digests.Peek(it.ref.Path(), it.info, algos)
+			if !complete && budget > 0 {
+				budget--
+				if full, err := it.digests(r.Context(), algos); err != nil {
+					log.Printf("[registry] manifest: unable to hash %s: %v", it.entry.Name, err)
+				} else {
+					sums, complete = full, true
+				}
+			}
+			if len(sums) > 0 {
+				it.entry.Digests = sums
+			}
+			if !complete {
+				it.entry.Partial = true
+				deferred = append(deferred, *it)
+			}
+		}
+
+		w.Header().Set(catalogVersionHeader, version)
+		if len(deferred) > 0 {
+			w.Header().Set(manifestPartialHeader, "true")
+			warmManifestDigests(deferred, algos)
+		} else if checkNotModified(w, r, fmt.Sprintf(`W/"manifest-%s-%s"`, version, strings.Join(algos, "+"))) {
+			return
+		}
+
+		w.Header().Set("Content-Type", manifestContentType)
+		w.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(w)
+		for _, it := range items {
+			if err := enc.Encode(it.entry); err != nil {
+				return // client went away
+			}
+		}
+	}
+}
+
+// warmManifestDigests hashes items in the background, one pass at a time.
+// Each file still waits for a checksum slot, so this competes fairly with
+// other hashing rather than adding to it.
+func warmManifestDigests(items []manifestItem, algos []string) {
+	if !manifestWarming.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer manifestWarming.Store(false)
+		log.Printf("[registry] manifest: hashing %d models in the background", len(items))
+		for _, it := range items {
+			if _, err := it.digests(context.Background(), algos); err != nil {
+				log.Printf("[registry] manifest: unable to hash %s: %v", it.entry.Name, err)
+			}
+		}
+	}()
+}
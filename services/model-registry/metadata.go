@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// metadataResponse is used by /models/{name}/metadata
+type metadataResponse struct {
+	Name        string             `json:"name"`
+	Version     string             `json:"version,omitempty"`
+	Size        int64              `json:"size"`
+	Modified    time.Time          `json:"modified"`
+	Format      string             `json:"format"`
+	Status      string             `json:"status"`
+	Stage       string             `json:"stage"`
+	Quarantine  *quarantineStatus  `json:"quarantine,omitempty"`
+	Provenance  *provenanceSummary `json:"provenance,omitempty"`
+	Sha256      string             `json:"sha256"`
+	Digests     map[string]string  `json:"digests,omitempty"`
+	GGUF        *ggufHeader        `json:"gguf,omitempty"`
+	Safetensors *safetensorsHeader `json:"safetensors,omitempty"`
+}
+
+// metadataHandler describes a model without transferring it: size, mtime,
+// lifecycle state, its SHA-256 and the GGUF header (version, tensor count and
+// metadata keys) when the file has one. ?algo= lists further digests to
+// include (e.g. sha256,sha512); all digests, and the parsed header, are
+// computed in one pass and cached.
+func metadataHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := resolveModel(r, modelDir, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := ref.Name
+		algos, err := requestedAlgos(r.URL.Query().Get("algo"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		info, err := statModel(r.Context(), ref)
+		if err != nil || info.IsDir() {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		}
+
+		meta, _ := sidecars.Get(name)
+		resp := metadataResponse{
+			Name:       name,
+			Version:    ref.Version,
+			Size:       info.Size(),
+			Modified:   info.ModTime().UTC(),
+			Format:     modelFormat(ref.File),
+			Status:     modelStatus(name, info),
+			Stage:      modelStage(meta),
+			Quarantine: quarantineState(name, info),
+			Provenance: meta.Provenance,
+		}
+		all := algos
+		if !slices.Contains(algos, algoSHA256) {
+			all = append([]string{algoSHA256}, algos...)
+		}
+		sums, err := digests.ModelDigests(r.Context(), ref, info, all)
+		if err != nil {
+			log.Printf("[registry] unable to hash %s: %v", name, err)
+			http.Error(w, "unable to hash model", http.StatusInternalServerError)
+			return
+		}
+		resp.Sha256 = sums[algoSHA256]
+		if len(algos) > 0 {
+			resp.Digests = make(map[string]string, len(algos))
+			for _, algo := range algos {
+				resp.Digests[algo] = sums[algo]
+			}
+		}
+
+		switch resp.Format {
+		case "gguf":
+			switch h, err := readModelGGUFHeader(r.Context(), ref, info); {
+			case err == nil:
+				resp.GGUF = h
+			case err != errNotGGUF:
+				log.Printf("[registry] unable to parse GGUF header of %s: %v", name, err)
+			}
+		case "safetensors":
+			if obj, err := openModel(r.Context(), ref); err == nil {
+				switch h, err := readSafetensorsHeader(objectReader(obj), obj.Info().Size()); {
+				case err == nil:
+					resp.Safetensors = h
+				case err != errNotSafetensors:
+					log.Printf("[registry] unable to parse safetensors header of %s: %v", name, err)
+				}
+				obj.Close()
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A small in-process metric registry. Every exported view (the Prometheus
+// text one at /metrics and the JSON one at /stats/metrics) renders from it,
+// so they can't disagree. Label values must come from bounded sets such as
+// route templates, status codes and the catalog's model names, never from
+// client addresses, tokens or names taken unchecked from requests.
+
+// metricsRegistry holds all metrics in registration order.
+type metricsRegistry struct {
+	mu         sync.Mutex
+	counters   []*counterVec
+	histograms []*histogramVec
+	gauges     []*gaugeFunc
+}
+
+var metrics = &metricsRegistry{}
+
+// counterVec is a monotonically increasing value per label combination.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // keyed by joined label values
+}
+
+// histogramVec tracks observations in fixed buckets per label combination.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // upper bounds, ascending
+
+	mu     sync.Mutex
+	series map[string]*histogramData
+}
+
+type histogramData struct {
+	counts []uint64 // cumulative is derived at render time
+	sum    float64
+	count  uint64
+}
+
+// gaugeFunc is sampled when metrics are rendered.
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+const labelSep = "\xff"
+
+func (m *metricsRegistry) Counter(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	m.mu.Lock()
+	m.counters = append(m.counters, c)
+	m.mu.Unlock()
+	return c
+}
+
+func (m *metricsRegistry) Histogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramData{}}
+	m.mu.Lock()
+	m.histograms = append(m.histograms, h)
+	m.mu.Unlock()
+	return h
+}
+
+func (m *metricsRegistry) Gauge(name, help string, fn func() float64) {
+	m.mu.Lock()
+	m.gauges = append(m.gauges, &gaugeFunc{name: name, help: help, fn: fn})
+	m.mu.Unlock()
+}
+
+// Add increases the counter for the given label values by v.
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSep)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// Delete drops the series for the given label values, for label values
+// that no longer exist (such as a deleted model).
+func (c *counterVec) Delete(labelValues ...string) {
+	key := strings.Join(labelValues, labelSep)
+	c.mu.Lock()
+	delete(c.values, key)
+	c.mu.Unlock()
+}
+
+// Inc increases the counter for the given label values by one.
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Observe records v for the given label values.
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSep)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d, ok := h.series[key]
+	if !ok {
+		d = &histogramData{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = d
+	}
+	for i, ub := range h.buckets {
+		if v <= ub {
+			d.counts[i]++
+			break
+		}
+	}
+	d.sum += v
+	d.count++
+}
+
+// metricSample is one labelled value in the JSON view.
+type metricSample struct {
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// histogramSample summarizes one labelled histogram in the JSON view.
+// Buckets are cumulative counts keyed by upper bound, as in Prometheus.
+type histogramSample struct {
+	Labels  map[string]string `json:"labels,omitempty"`
+	Count   uint64            `json:"count"`
+	Sum     float64           `json:"sum"`
+	Buckets map[string]uint64 `json:"buckets"`
+}
+
+// metricsSnapshot is used by /stats/metrics
+type metricsSnapshot struct {
+	Counters   map[string][]metricSample    `json:"counters"`
+	Gauges     map[string]float64           `json:"gauges"`
+	Histograms map[string][]histogramSample `json:"histograms"`
+}
+
+func labelMap(names []string, key string) map[string]string {
+	if len(names) == 0 {
+		return nil
+	}
+	values := strings.Split(key, labelSep)
+	out := make(map[string]string, len(names))
+	for i, n := range names {
+		if i < len(values) {
+			out[n] = values[i]
+		}
+	}
+	return out
+}
+
+// Snapshot renders every metric's current value.
+func (m *metricsRegistry) Snapshot() metricsSnapshot {
+	m.mu.Lock()
+	counters := append([]*counterVec{}, m.counters...)
+	hists := append([]*histogramVec{}, m.histograms...)
+	gauges := append([]*gaugeFunc{}, m.gauges...)
+	m.mu.Unlock()
+
+	snap := metricsSnapshot{
+		Counters:   map[string][]metricSample{},
+		Gauges:     map[string]float64{},
+		Histograms: map[string][]histogramSample{},
+	}
+	for _, c := range counters {
+		c.mu.Lock()
+		samples := []metricSample{}
+		for key, v := range c.values {
+			samples = append(samples, metricSample{Labels: labelMap(c.labels, key), Value: v})
+		}
+		c.mu.Unlock()
+		sort.Slice(samples, func(i, j int) bool { return sampleKey(samples[i].Labels) < sampleKey(samples[j].Labels) })
+		snap.Counters[c.name] = samples
+	}
+	for _, g := range gauges {
+		snap.Gauges[g.name] = g.fn()
+	}
+	for _, h := range hists {
+		h.mu.Lock()
+		samples := []histogramSample{}
+		for key, d := range h.series {
+			hs := histogramSample{Labels: labelMap(h.labels, key), Count: d.count, Sum: d.sum, Buckets: map[string]uint64{}}
+			var cum uint64
+			for i, ub := range h.buckets {
+				cum += d.counts[i]
+				hs.Buckets[strconv.FormatFloat(ub, 'g', -1, 64)] = cum
+			}
+			hs.Buckets["+Inf"] = d.count
+			samples = append(samples, hs)
+		}
+		h.mu.Unlock()
+		sort.Slice(samples, func(i, j int) bool { return sampleKey(samples[i].Labels) < sampleKey(samples[j].Labels) })
+		snap.Histograms[h.name] = samples
+	}
+	return snap
+}
+
+// sampleKey orders samples deterministically by their labels.
+func sampleKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + "=" + labels[k] + ",")
+	}
+	return b.String()
+}
+
+// Registry metrics. Route labels are mux path templates, so cardinality is
+// bounded by the number of routes.
+var (
+	httpRequests = metrics.Counter("http_requests_total", "HTTP requests by route, method and status", "route", "method", "status")
+	httpDuration = metrics.Histogram("http_request_duration_seconds", "HTTP request latency by route",
+		[]float64{0.005, 0.025, 0.1, 0.5, 1, 5, 30, 120}, "route")
+	digestLookups = metrics.Counter("digest_cache_lookups_total", "Digest cache lookups by result", "result")
+	// modelBytes is labelled with names of models that were found, and a
+	// model's series is dropped when it's deleted.
+	modelBytes = metrics.Counter("model_bytes_served_total", "Model bytes sent by model", "model")
+)
+
+// metricMethod folds unusual HTTP methods into one label value.
+func metricMethod(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return m
+	}
+	return "OTHER"
+}
+
+// registerGauges exposes state owned by other components. It runs once at
+// boot, after they are configured.
+func registerGauges(modelDir string) {
+	metrics.Gauge("models", "Models in the primary backend", func() float64 {
+		found, err := storage.List(context.Background())
+		if err != nil {
+			return 0
+		}
+		return float64(len(found))
+	})
+	metrics.Gauge("model_bytes", "Size of the models in the primary backend", func() float64 {
+		found, err := storage.List(context.Background())
+		if err != nil {
+			return 0
+		}
+		var sum int64
+		for _, f := range found {
+			sum += f.Info.Size()
+		}
+		return float64(sum)
+	})
+	metrics.Gauge("disk_bytes_total", "Size of the filesystem holding the model directory", func() float64 {
+		total, _, err := diskUsage(modelDir)
+		if err != nil {
+			return 0
+		}
+		return float64(total)
+	})
+	metrics.Gauge("disk_bytes_free", "Free space on the filesystem holding the model directory", func() float64 {
+		_, free, err := diskUsage(modelDir)
+		if err != nil {
+			return 0
+		}
+		return float64(free)
+	})
+	metrics.Gauge("egress_bytes_total", "Model and delta bytes sent", func() float64 { return float64(egress.Stats().BytesTotal) })
+	metrics.Gauge("egress_bytes_per_second", "Average egress rate over the last 5s", func() float64 { return float64(egress.Stats().CurrentBytesPerSec) })
+	metrics.Gauge("streams_active", "Model downloads in flight", func() float64 { return float64(streams.Stats().Active) })
+	metrics.Gauge("streams_rejected_total", "Model downloads refused over the stream caps", func() float64 { return float64(streams.Stats().Rejected) })
+	metrics.Gauge("range_requests_active", "Range requests in flight", func() float64 { return float64(ranges.Stats().Active) })
+	metrics.Gauge("range_requests_rejected_total", "Range requests refused over the cap", func() float64 { return float64(ranges.Stats().Rejected) })
+	metrics.Gauge("range_requests_downgraded_total", "Range requests served in full over the cap", func() float64 { return float64(ranges.Stats().Downgraded) })
+	metrics.Gauge("tier_hits_total", "Downloads served from the local tier", func() float64 { return float64(tier.Stats().Hits) })
+	metrics.Gauge("tier_misses_total", "Downloads served from the origin tier", func() float64 { return float64(tier.Stats().Misses) })
+	metrics.Gauge("integrity_failures_total", "Models that failed integrity verification", func() float64 { return float64(integrity.Stats().FailsTotal) })
+	metrics.Gauge("download_sessions_active", "Open X-Download-Session sessions", func() float64 { return float64(sessions.Stats().Active) })
+	if replication != nil {
+		metrics.Gauge("replication_lag_seconds", "Time since the last complete replication pass", func() float64 { return replication.Lag().Seconds() })
+	}
+}
+
+// promNamespace prefixes every metric name in the Prometheus view.
+const promNamespace = "model_registry_"
+
+// promLabels renders names and the joined values in key as {a="x",b="y"},
+// plus an extra pair when extra is set.
+func promLabels(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		values := strings.Split(key, labelSep)
+		for i, n := range names {
+			if i < len(values) {
+				pairs = append(pairs, n+"="+strconv.Quote(values[i]))
+			}
+		}
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+"="+strconv.Quote(extra[1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func promFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WritePrometheus renders every metric in the Prometheus text exposition
+// format, series sorted by labels.
+func (m *metricsRegistry) WritePrometheus(w io.Writer) {
+	m.mu.Lock()
+	counters := append([]*counterVec{}, m.counters...)
+	hists := append([]*histogramVec{}, m.histograms...)
+	gauges := append([]*gaugeFunc{}, m.gauges...)
+	m.mu.Unlock()
+
+	for _, c := range counters {
+		name := promNamespace + c.name
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, c.help, name)
+		c.mu.Lock()
+		keys := make([]string, 0, len(c.values))
+		for key := range c.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s %s\n", name, promLabels(c.labels, key), promFloat(c.values[key]))
+		}
+		c.mu.Unlock()
+	}
+	for _, g := range gauges {
+		name := promNamespace + g.name
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, g.help, name, name, promFloat(g.fn()))
+	}
+	for _, h := range hists {
+		name := promNamespace + h.name
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, h.help, name)
+		h.mu.Lock()
+		keys := make([]string, 0, len(h.series))
+		for key := range h.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			d := h.series[key]
+			var cum uint64
+			for i, ub := range h.buckets {
+				cum += d.counts[i]
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, promLabels(h.labels, key, "le", promFloat(ub)), cum)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, promLabels(h.labels, key, "le", "+Inf"), d.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, promLabels(h.labels, key), promFloat(d.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, promLabels(h.labels, key), d.count)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// metricsHandler serves the registry for Prometheus scrapes.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WritePrometheus(w)
+}
+
+// metricsJSONHandler serves the registry as JSON for non-Prometheus consumers.
+func metricsJSONHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, metrics.Snapshot())
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Migration modes for MODEL_REGISTRY_MIGRATE.
+const (
+	migrateOff    = ""
+	migrateDryRun = "dry-run"
+	migrateApply  = "apply"
+)
+
+// migrateLayout moves flat top-level model files matching pattern into
+// per-architecture subdirectories (llama-2-7b.Q4_K_M.gguf -> llama/...). In
+// dry-run mode it only logs what it would do.
+//
+// It is idempotent: only files directly in modelDir are considered, so moved
+// files are never revisited, and a file whose destination already exists is
+// skipped. Moves are plain renames within the model volume, hence atomic.
+func migrateLayout(modelDir, pattern, mode string) error {
+	entries, err := os.ReadDir(modelDir)
+	if err != nil {
+		return err
+	}
+
+	var moved, skipped int
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !isModelFile(name) {
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, name); !ok {
+			continue
+		}
+		arch := architectureFromName(name)
+		if arch == "" {
+			log.Printf("[registry] migrate: skip %s: no architecture in name", name)
+			skipped++
+			continue
+		}
+
+		src := filepath.Join(modelDir, name)
+		dst := filepath.Join(modelDir, arch, name)
+		if _, err := os.Lstat(dst); err == nil {
+			log.Printf("[registry] migrate: skip %s: %s already exists", name, dst)
+			skipped++
+			continue
+		}
+
+		if mode == migrateDryRun {
+			log.Printf("[registry] migrate (dry-run): would move %s -> %s", src, dst)
+			moved++
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return fmt.Errorf("create %s: %w", filepath.Dir(dst), err)
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return fmt.Errorf("move %s: %w", name, err)
+		}
+		// Keep registry sidecar metadata, the card and provenance attached to the model's new name.
+		newName := arch + "/" + name
+		if _, err := os.Stat(sidecars.path(name)); err == nil {
+			if err := os.MkdirAll(filepath.Dir(sidecars.path(newName)), 0o755); err == nil {
+				if err := os.Rename(sidecars.path(name), sidecars.path(newName)); err != nil {
+					log.Printf("[registry] migrate: unable to move sidecar of %s: %v", name, err)
+				}
+			}
+		}
+		if _, err := os.Stat(cards.path(name)); err == nil {
+			if err := os.MkdirAll(filepath.Dir(cards.path(newName)), 0o755); err == nil {
+				if err := os.Rename(cards.path(name), cards.path(newName)); err != nil {
+					log.Printf("[registry] migrate: unable to move card of %s: %v", name, err)
+				}
+			}
+		}
+		if _, err := os.Stat(provenance.path(name)); err == nil {
+			if err := os.MkdirAll(filepath.Dir(provenance.path(newName)), 0o755); err == nil {
+				if err := os.Rename(provenance.path(name), provenance.path(newName)); err != nil {
+					log.Printf("[registry] migrate: unable to move provenance of %s: %v", name, err)
+				}
+			}
+		}
+		log.Printf("[registry] migrate: moved %s -> %s", src, dst)
+		moved++
+	}
+
+	verb := "moved"
+	if mode == migrateDryRun {
+		verb = "would move"
+	}
+	log.Printf("[registry] migrate: %s %d file(s), skipped %d", verb, moved, skipped)
+	return nil
+}
+
+// architectureFromName derives the model family from the leading token of a
+// file name, e.g. "Llama-2-7b.Q4_K_M.gguf" -> "llama". It returns "" when the
+// name has no separator to split on.
+func architectureFromName(name string) string {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	i := strings.IndexAny(base, "-_.")
+	if i <= 0 {
+		return ""
+	}
+	arch := strings.ToLower(base[:i])
+	for _, c := range arch {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			return ""
+		}
+	}
+	return arch
+}
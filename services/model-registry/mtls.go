@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// Mutual TLS for internal callers. With MODEL_REGISTRY_TLS_CLIENT_CA the
+// HTTPS and gRPC listeners ask for client certificates and verify them
+// against that CA bundle. A verified certificate's subject CN (or its first
+// DNS name when the CN is empty) is the caller's identity: it's logged with
+// each request, added to the events the caller causes, and identities in
+// MODEL_REGISTRY_ADMIN_IDENTITIES pass admin checks without the admin token.
+
+// MODEL_REGISTRY_TLS_CLIENT_AUTH values.
+const (
+	clientAuthRequire  = "require"  // handshakes without a valid cert fail
+	clientAuthOptional = "optional" // a cert is verified if sent; callers without one are anonymous
+)
+
+var (
+	// mtlsEnabled reports whether client certificates are verified.
+	mtlsEnabled bool
+	// adminIdentities are the certificate identities treated as admins.
+	adminIdentities map[string]bool
+)
+
+// clientTLSConfig is the server TLS config verifying client certificates
+// against the PEM bundle in caFile.
+func clientTLSConfig(caFile, mode string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates in %s", caFile)
+	}
+	cfg := &tls.Config{ClientCAs: pool, MinVersion: tls.VersionTLS12}
+	switch mode {
+	case clientAuthRequire:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case clientAuthOptional:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown client auth mode %q (want %s or %s)", mode, clientAuthRequire, clientAuthOptional)
+	}
+	return cfg, nil
+}
+
+// grpcCredentials are the gRPC listener's TLS credentials: the main port's
+// certificate, verifying client certificates like base when it's set.
+func grpcCredentials(certFile, keyFile string, base *tls.Config) (credentials.TransportCredentials, error) {
+	if base == nil {
+		return credentials.NewServerTLSFromFile(certFile, keyFile)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := base.Clone()
+	cfg.Certificates = []tls.Certificate{cert}
+	return credentials.NewTLS(cfg), nil
+}
+
+// certIdentity maps a verified client certificate to an identity.
+func certIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+// requestIdentity is the identity of r's client certificate, or "".
+func requestIdentity(r *http.Request) string {
+	return certIdentity(r.TLS)
+}
+
+// grpcIdentity is requestIdentity for gRPC calls.
+func grpcIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ""
+	}
+	return certIdentity(&info.State)
+}
+
+// withIdentity adds the caller's identity to event data when there is one.
+func withIdentity(identity string, data map[string]any) map[string]any {
+	if identity != "" {
+		data["identity"] = identity
+	}
+	return data
+}
+
+// parseIdentities parses a list of certificate identities, such as
+// MODEL_REGISTRY_ADMIN_IDENTITIES.
+func parseIdentities(spec string) (map[string]bool, error) {
+	ids := map[string]bool{}
+	for _, id := range splitList(spec) {
+		ids[id] = true
+	}
+	if len(ids) > 0 && !mtlsEnabled {
+		return nil, errors.New("identities need client certificates (MODEL_REGISTRY_TLS_CLIENT_CA)")
+	}
+	return ids, nil
+}
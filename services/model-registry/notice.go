@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// noticeHeader carries the operator banner on every response.
+	noticeHeader = "X-Registry-Notice"
+
+	maxNoticeLen = 512
+)
+
+// notice is the sanitized MODEL_REGISTRY_BANNER; empty disables it.
+var notice string
+
+// sanitizeNotice makes an operator supplied banner safe to send as a header
+// value: control and non-ASCII characters become spaces, runs of whitespace
+// collapse, and the result is capped at maxNoticeLen bytes.
+func sanitizeNotice(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if c < 0x20 || c > 0x7e {
+			c = ' '
+		}
+		b.WriteRune(c)
+	}
+	out := strings.Join(strings.Fields(b.String()), " ")
+	if len(out) > maxNoticeLen {
+		out = strings.TrimSpace(out[:maxNoticeLen])
+	}
+	return out
+}
+
+// noticeMiddleware adds the banner to every response, including ones the
+// router doesn't match.
+func noticeMiddleware(next http.Handler) http.Handler {
+	if notice == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(noticeHeader, notice)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,776 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// OCI Distribution API.
+//
+// /v2/ exposes the models of the primary backend as OCI artifacts so ORAS,
+// containerd and friends can pull and push them. Repository "llama" is model
+// "llama.gguf" (nested repositories need recursive mode). Tag "latest" is
+// what a plain name resolves to; any other tag is a version label or a
+// registry tag. Each model is an artifact manifest with an empty config and
+// the model file as its only layer, and the layer blob is the model itself.
+// Pushed manifests are kept in the sidecar and served back verbatim while the
+// model is unchanged; other models get a manifest generated from the file.
+const (
+	ociDigestHeader       = "Docker-Content-Digest"
+	ociManifestType       = "application/vnd.oci.image.manifest.v1+json"
+	ociDockerManifestType = "application/vnd.docker.distribution.manifest.v2+json"
+	ociEmptyType          = "application/vnd.oci.empty.v1+json"
+	ociArtifactType       = "application/vnd.crash-pay.model.v1"
+	ociLayerType          = "application/vnd.crash-pay.model.gguf"
+	ociTitleAnnotation    = "org.opencontainers.image.title"
+	ociCreatedAnnotation  = "org.opencontainers.image.created"
+	ociVersionAnnotation  = "org.opencontainers.image.version"
+	ociLatestTag          = "latest"
+	ociMaxManifestSize    = 4 << 20
+	ociUploadTTL          = time.Hour
+)
+
+// ociEnabled is set when MODEL_REGISTRY_OCI mounts the API.
+var ociEnabled bool
+
+var (
+	// ociRepoPattern is the distribution spec's repository name grammar.
+	ociRepoPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	ociTagPattern  = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+	ociUploadID    = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	// ociEmptyConfig is the config blob of every generated manifest.
+	ociEmptyConfig = []byte("{}")
+	ociEmptyDigest = sha256Hex(ociEmptyConfig)
+)
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// ociDescriptor points at a blob.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is an OCI image manifest (or the identical Docker schema 2 one).
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// modelLayer returns the layer holding the model: the only layer, or the one
+// titled as a .gguf file.
+func (m ociManifest) modelLayer() (ociDescriptor, error) {
+	if len(m.Layers) == 1 {
+		return m.Layers[0], nil
+	}
+	var found []ociDescriptor
+	for _, l := range m.Layers {
+		if t := l.Annotations[ociTitleAnnotation]; isModelFile(t) && modelFormat(t) == "gguf" {
+			found = append(found, l)
+		}
+	}
+	if len(found) != 1 {
+		return ociDescriptor{}, errors.New("manifest must have one layer, or exactly one layer titled *.gguf")
+	}
+	return found[0], nil
+}
+
+// ociError is one entry of an OCI error response.
+type ociError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ociErrorResponse struct {
+	Errors []ociError `json:"errors"`
+}
+
+type ociTagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+type ociCatalog struct {
+	Repositories []string `json:"repositories"`
+}
+
+func writeOCIError(w http.ResponseWriter, code int, errCode, msg string) {
+	writeJSON(w, code, ociErrorResponse{Errors: []ociError{{Code: errCode, Message: msg}}})
+}
+
+// registerOCIRoutes mounts the /v2/ API on r.
+func registerOCIRoutes(r *mux.Router, modelDir string) {
+	const repo = "/v2/{name:.+}"
+	r.HandleFunc("/v2/", ociBaseHandler).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc("/v2/_catalog", ociCatalogHandler(modelDir)).Methods(http.MethodGet)
+	r.HandleFunc(repo+"/tags/list", ociTagsHandler(modelDir)).Methods(http.MethodGet)
+	r.HandleFunc(repo+"/manifests/{reference}", ociManifestHandler(modelDir)).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc(repo+"/manifests/{reference}", ociRequirePublisher(ociPutManifestHandler(modelDir))).Methods(http.MethodPut)
+	r.HandleFunc(repo+"/blobs/uploads/", ociRequirePublisher(ociStartUploadHandler(modelDir))).Methods(http.MethodPost)
+	r.HandleFunc(repo+"/blobs/uploads/{id}", ociRequirePublisher(ociUploadHandler(modelDir))).Methods(http.MethodGet, http.MethodPatch, http.MethodPut, http.MethodDelete)
+	r.HandleFunc(repo+"/blobs/{digest}", ociBlobHandler(modelDir)).Methods(http.MethodGet, http.MethodHead)
+}
+
+// ociRequirePublisher is requirePublisher with the challenge OCI clients
+// expect; they send the admin token or an API key as the password of Basic
+// credentials.
+func ociRequirePublisher(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch got := requestRole(r); {
+		case got == roleNone:
+			w.Header().Set("WWW-Authenticate", `Basic realm="model-registry"`)
+			writeOCIError(w, http.StatusUnauthorized, "UNAUTHORIZED", "publisher credentials required")
+		case got < rolePublisher:
+			writeOCIError(w, http.StatusForbidden, "DENIED", "publisher role required")
+		default:
+			next(w, r)
+		}
+	}
+}
+
+func ociBaseHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// ociModelName maps a repository to its model name.
+func ociModelName(repo string) (string, error) {
+	if !ociRepoPattern.MatchString(repo) || (strings.Contains(repo, "/") && !recursive) {
+		return "", fmt.Errorf("invalid repository name %q", repo)
+	}
+	return repo + ".gguf", nil
+}
+
+// ociRepoName is the repository a model name is published as, if any.
+func ociRepoName(model string) (string, bool) {
+	repo, ok := strings.CutSuffix(model, ".gguf")
+	return repo, ok && ociRepoPattern.MatchString(repo)
+}
+
+// ociRepoRefs returns the refs of every stored revision of a repository's
+// model: the plain file, or each version.
+func ociRepoRefs(r *http.Request, modelDir, repo string) ([]modelRef, error) {
+	name, err := ociModelName(repo)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := parseModelRef(r, modelDir, name)
+	if err != nil {
+		return nil, err
+	}
+	if !requestModelFilter(r)(ref.Base()) {
+		return nil, nil // private to others
+	}
+	if info, err := statModel(r.Context(), ref); err == nil && !info.IsDir() {
+		return []modelRef{ref}, nil
+	}
+	versions, _ := listVersions(ref.Dir, ref.File)
+	var out []modelRef
+	for _, v := range versions {
+		if vr, err := ref.withVersion(v.Version); err == nil {
+			out = append(out, vr)
+		}
+	}
+	return out, nil
+}
+
+// ociManifestFor returns the manifest of the model at ref: the pushed one if
+// it still describes the file, else a generated one.
+func ociManifestFor(ctx context.Context, ref modelRef, info os.FileInfo) ([]byte, string, error) {
+	sum, err := digests.ModelSHA256(ctx, ref, info)
+	if err != nil {
+		return nil, "", err
+	}
+	if meta, err := sidecars.Get(ref.Name); err == nil && len(meta.OCIManifest) > 0 {
+		var m ociManifest
+		if json.Unmarshal(meta.OCIManifest, &m) == nil {
+			if l, err := m.modelLayer(); err == nil && l.Digest == blobDigestPrefix+sum {
+				mt := m.MediaType
+				if mt == "" {
+					mt = ociManifestType
+				}
+				return meta.OCIManifest, mt, nil
+			}
+		}
+	}
+	m := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		ArtifactType:  ociArtifactType,
+		Config:        ociDescriptor{MediaType: ociEmptyType, Digest: blobDigestPrefix + ociEmptyDigest, Size: int64(len(ociEmptyConfig))},
+		Layers: []ociDescriptor{{
+			MediaType:   ociLayerType,
+			Digest:      blobDigestPrefix + sum,
+			Size:        info.Size(),
+			Annotations: map[string]string{ociTitleAnnotation: path.Base(ref.File)},
+		}},
+		Annotations: map[string]string{ociCreatedAnnotation: info.ModTime().UTC().Format(time.RFC3339)},
+	}
+	if ref.Version != "" {
+		m.Annotations[ociVersionAnnotation] = ref.Version
+	}
+	b, err := json.Marshal(m)
+	return b, ociManifestType, err
+}
+
+// ociServable reports why the model at ref may not be pulled, like the
+// download route: expired models are gone, quarantined ones need the admin
+// token.
+func ociServable(w http.ResponseWriter, r *http.Request, ref modelRef, info os.FileInfo) bool {
+	if _, expired := expiry.Check(ref.Name, info.ModTime()); expired {
+		writeOCIError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "model expired")
+		return false
+	}
+	if isQuarantined(ref.Name, info) && !isAdmin(r) {
+		writeOCIError(w, http.StatusForbidden, "DENIED", "model is quarantined")
+		return false
+	}
+	return true
+}
+
+// ociManifestHandler serves the manifest for a tag or manifest digest.
+func ociManifestHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repo, reference := vars["name"], vars["reference"]
+		refs, err := ociRepoRefs(r, modelDir, repo)
+		if err != nil {
+			writeOCIError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+			return
+		}
+		if len(refs) == 0 {
+			writeOCIError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository not found")
+			return
+		}
+		if !strings.HasPrefix(reference, blobDigestPrefix) {
+			name := refs[0].Base()
+			if reference != ociLatestTag {
+				name += versionSep + reference
+			}
+			ref, err := resolveModel(r, modelDir, name)
+			if err != nil {
+				writeOCIError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "unknown tag "+strconv.Quote(reference))
+				return
+			}
+			refs = []modelRef{ref}
+		}
+		for _, ref := range refs {
+			info, err := statModel(r.Context(), ref)
+			if err != nil || info.IsDir() {
+				continue
+			}
+			body, mediaType, err := ociManifestFor(r.Context(), ref, info)
+			if err != nil {
+				log.Printf("[registry] oci: unable to build manifest of %s: %v", ref.Name, err)
+				writeOCIError(w, http.StatusInternalServerError, "UNKNOWN", "unable to build manifest")
+				return
+			}
+			digest := blobDigestPrefix + sha256Hex(body)
+			if strings.HasPrefix(reference, blobDigestPrefix) && digest != reference {
+				continue
+			}
+			if !ociServable(w, r, ref, info) {
+				return
+			}
+			w.Header().Set(ociDigestHeader, digest)
+			if checkNotModified(w, r, `"`+digest+`"`) {
+				return
+			}
+			w.Header().Set("Content-Type", mediaType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			if ref.Version != "" {
+				w.Header().Set(versionHeader, ref.Version)
+			}
+			w.WriteHeader(http.StatusOK)
+			if r.Method != http.MethodHead {
+				w.Write(body)
+			}
+			return
+		}
+		writeOCIError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest not found")
+	}
+}
+
+// ociStagingDir holds pushed blobs until a manifest publishes them, and
+// config blobs for good.
+func ociStagingDir(modelDir string) string {
+	return filepath.Join(modelDir, stateDirName, "oci", "blobs")
+}
+
+func ociUploadsDir(modelDir string) string {
+	return filepath.Join(modelDir, stateDirName, "oci", "uploads")
+}
+
+// ociFindBlob locates the content with digest sum for repo: one of the
+// repo's models or a pushed blob. Quarantined or expired models only count
+// for callers allowed to pull them.
+func ociFindBlob(r *http.Request, modelDir, repo, sum string) (string, bool) {
+	refs, _ := ociRepoRefs(r, modelDir, repo)
+	for _, ref := range refs {
+		info, err := statModel(r.Context(), ref)
+		if err != nil {
+			continue
+		}
+		got, ok := digests.Cached(ref.Path(), info)
+		if !ok {
+			if got, err = digests.ModelSHA256(r.Context(), ref, info); err != nil {
+				continue
+			}
+		}
+		if got != sum {
+			continue
+		}
+		if _, expired := expiry.Check(ref.Name, info.ModTime()); expired || (isQuarantined(ref.Name, info) && !isAdmin(r)) {
+			return "", false
+		}
+		return ref.Path(), true
+	}
+	p := filepath.Join(ociStagingDir(modelDir), sum)
+	if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+		return p, true
+	}
+	return "", false
+}
+
+// ociBlobHandler serves a blob of a repository.
+func ociBlobHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		sum, err := parseBlobDigest(vars["digest"])
+		if err != nil || !strings.HasPrefix(vars["digest"], blobDigestPrefix) {
+			writeOCIError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest must be sha256:<hex>")
+			return
+		}
+		if _, err := ociModelName(vars["name"]); err != nil {
+			writeOCIError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+			return
+		}
+		if sum == ociEmptyDigest {
+			w.Header().Set(ociDigestHeader, blobDigestPrefix+sum)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", strconv.Itoa(len(ociEmptyConfig)))
+			w.WriteHeader(http.StatusOK)
+			if r.Method != http.MethodHead {
+				w.Write(ociEmptyConfig)
+			}
+			return
+		}
+		p, ok := ociFindBlob(r, modelDir, vars["name"], sum)
+		if !ok {
+			writeOCIError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob not found")
+			return
+		}
+		serveBlob(w, r, p, sum)
+	}
+}
+
+// ociTagsHandler lists "latest", the versions and the registry tags of a
+// repository, sorted, paged with ?n= and ?last=.
+func ociTagsHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		repo := mux.Vars(r)["name"]
+		refs, err := ociRepoRefs(r, modelDir, repo)
+		if err != nil {
+			writeOCIError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+			return
+		}
+		if len(refs) == 0 {
+			writeOCIError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository not found")
+			return
+		}
+		list := []string{ociLatestTag}
+		for _, ref := range refs {
+			if ref.Version != "" {
+				list = append(list, ref.Version)
+			}
+		}
+		for tag := range tags.Get(refs[0].Base()) {
+			if tag != ociLatestTag {
+				list = append(list, tag)
+			}
+		}
+		sort.Strings(list)
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		writeJSON(w, http.StatusOK, ociTagList{Name: repo, Tags: ociPage(w, r, list)})
+	}
+}
+
+// ociCatalogHandler lists the repositories, i.e. the models of the primary
+// backend whose names are valid repository names.
+func ociCatalogHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		found, err := scanModels(modelDir)
+		if err != nil {
+			writeOCIError(w, http.StatusInternalServerError, "UNKNOWN", "unable to list models")
+			return
+		}
+		repos := []string{}
+		allowed := requestModelFilter(r)
+		for _, f := range found {
+			if repo, ok := ociRepoName(f.Name); ok && allowed(f.Name) {
+				repos = append(repos, repo)
+			}
+		}
+		sort.Strings(repos)
+		writeJSON(w, http.StatusOK, ociCatalog{Repositories: ociPage(w, r, repos)})
+	}
+}
+
+// ociPage applies ?last= and ?n= to a sorted list, linking the next page.
+func ociPage(w http.ResponseWriter, r *http.Request, list []string) []string {
+	q := r.URL.Query()
+	if last := q.Get("last"); last != "" {
+		i := sort.SearchStrings(list, last)
+		if i < len(list) && list[i] == last {
+			i++
+		}
+		list = list[i:]
+	}
+	if n, err := strconv.Atoi(q.Get("n")); err == nil && n >= 0 && n < len(list) {
+		list = list[:n]
+		if n > 0 {
+			q.Set("last", list[n-1])
+			w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, q.Encode()))
+		}
+	}
+	return list
+}
+
+// ociStartUploadHandler opens a blob upload session. With ?digest= the body
+// is the whole blob (monolithic upload) and the upload completes at once.
+func ociStartUploadHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		repo := mux.Vars(r)["name"]
+		if _, err := ociModelName(repo); err != nil {
+			writeOCIError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+			return
+		}
+		dir := ociUploadsDir(modelDir)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			writeOCIError(w, http.StatusInternalServerError, "UNKNOWN", "unable to start upload")
+			return
+		}
+		ociSweepUploads(dir)
+		var raw [16]byte
+		if _, err := rand.Read(raw[:]); err != nil {
+			writeOCIError(w, http.StatusInternalServerError, "UNKNOWN", "unable to start upload")
+			return
+		}
+		id := hex.EncodeToString(raw[:])
+		if err := os.WriteFile(filepath.Join(dir, id), nil, 0o644); err != nil {
+			writeOCIError(w, http.StatusInternalServerError, "UNKNOWN", "unable to start upload")
+			return
+		}
+		if r.URL.Query().Get("digest") != "" {
+			r = mux.SetURLVars(r, map[string]string{"name": repo, "id": id})
+			r.Method = http.MethodPut
+			ociUploadHandler(modelDir)(w, r)
+			return
+		}
+		w.Header().Set("Docker-Upload-UUID", id)
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+		w.Header().Set("Range", "0-0")
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// ociSweepUploads removes sessions idle for longer than ociUploadTTL.
+func ociSweepUploads(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-ociUploadTTL)
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+}
+
+// ociUploadHandler drives an upload session: PATCH appends a chunk, PUT
+// appends the final one and completes the upload against ?digest=, GET
+// reports progress and DELETE cancels.
+func ociUploadHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repo, id := vars["name"], vars["id"]
+		p := filepath.Join(ociUploadsDir(modelDir), id)
+		info, err := os.Stat(p)
+		if !ociUploadID.MatchString(id) || err != nil {
+			writeOCIError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload not found")
+			return
+		}
+		location := "/v2/" + repo + "/blobs/uploads/" + id
+		progress := func(size int64) {
+			w.Header().Set("Docker-Upload-UUID", id)
+			w.Header().Set("Location", location)
+			w.Header().Set("Range", fmt.Sprintf("0-%d", max(size-1, 0)))
+			w.Header().Set("Content-Length", "0")
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			progress(info.Size())
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case http.MethodDelete:
+			os.Remove(p)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// Chunks must arrive in order.
+		if cr := r.Header.Get("Content-Range"); cr != "" {
+			start, _, _ := strings.Cut(strings.TrimPrefix(cr, "bytes="), "-")
+			if n, err := strconv.ParseInt(start, 10, 64); err != nil || n != info.Size() {
+				progress(info.Size())
+				writeOCIError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", "chunk out of order")
+				return
+			}
+		}
+		size, err := ociAppend(w, r, p, info.Size())
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				os.Remove(p)
+				writeOCIError(w, http.StatusRequestEntityTooLarge, "SIZE_INVALID", "upload exceeds "+strconv.FormatInt(maxUploadSize, 10)+" bytes")
+				return
+			}
+			log.Printf("[registry] oci: upload %s: %v", id, err)
+			writeOCIError(w, http.StatusInternalServerError, "BLOB_UPLOAD_INVALID", "unable to store chunk")
+			return
+		}
+		if r.Method == http.MethodPatch {
+			progress(size)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		digest := r.URL.Query().Get("digest")
+		want, err := parseBlobDigest(digest)
+		if err != nil || !strings.HasPrefix(digest, blobDigestPrefix) {
+			writeOCIError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest must be sha256:<hex>")
+			return
+		}
+		got, err := ociFileDigest(p)
+		if err != nil || got != want {
+			os.Remove(p)
+			writeOCIError(w, http.StatusBadRequest, "DIGEST_INVALID", "content does not match "+digest)
+			return
+		}
+		staging := ociStagingDir(modelDir)
+		if err := os.MkdirAll(staging, 0o755); err != nil {
+			writeOCIError(w, http.StatusInternalServerError, "UNKNOWN", "unable to store blob")
+			return
+		}
+		if err := os.Rename(p, filepath.Join(staging, want)); err != nil {
+			writeOCIError(w, http.StatusInternalServerError, "UNKNOWN", "unable to store blob")
+			return
+		}
+		log.Printf("[registry] oci: received blob %s for %s (%d bytes)", digest, repo, size)
+		w.Header().Set(ociDigestHeader, digest)
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/"+digest)
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// ociAppend appends the request body to the session file at p, which holds
+// size bytes, and returns its new size. maxUploadSize caps the whole blob.
+func ociAppend(w http.ResponseWriter, r *http.Request, p string, size int64) (int64, error) {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return size, err
+	}
+	defer f.Close()
+	body := io.Reader(r.Body)
+	if maxUploadSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, maxUploadSize-size)
+	}
+	n, err := io.Copy(f, body)
+	return size + n, err
+}
+
+// ociFileDigest hashes a finished upload, under the shared checksum limit.
+func ociFileDigest(p string) (string, error) {
+	checksumSlots <- struct{}{}
+	defer func() { <-checksumSlots }()
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ociPutManifestHandler publishes a pushed manifest: its model layer becomes
+// the model behind the tag ("latest" for the plain model, any other tag a
+// version), going through the same quarantine, digest and event path as
+// POST /models. When signed uploads are enforced pushes are refused, as the
+// OCI API has no way to carry the detached signature.
+func ociPutManifestHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		repo, reference := vars["name"], vars["reference"]
+		if uploadVerifier != nil {
+			writeOCIError(w, http.StatusForbidden, "DENIED", "signed uploads are required; use POST /models")
+			return
+		}
+		name, err := ociModelName(repo)
+		if err != nil {
+			writeOCIError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+			return
+		}
+		if !ociTagPattern.MatchString(reference) {
+			writeOCIError(w, http.StatusBadRequest, "TAG_INVALID", "manifests are pushed by tag")
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, ociMaxManifestSize))
+		if err != nil {
+			writeOCIError(w, http.StatusBadRequest, "MANIFEST_INVALID", "unable to read manifest")
+			return
+		}
+		var m ociManifest
+		if err := json.Unmarshal(body, &m); err != nil || m.SchemaVersion != 2 {
+			writeOCIError(w, http.StatusBadRequest, "MANIFEST_INVALID", "body must be an image manifest (schemaVersion 2)")
+			return
+		}
+		if mt := r.Header.Get("Content-Type"); mt != ociManifestType && mt != ociDockerManifestType {
+			writeOCIError(w, http.StatusBadRequest, "MANIFEST_INVALID", "unsupported manifest type "+strconv.Quote(mt))
+			return
+		}
+		layer, err := m.modelLayer()
+		if err != nil {
+			writeOCIError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		sum, err := parseBlobDigest(layer.Digest)
+		if err != nil {
+			writeOCIError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+			return
+		}
+		if csum, err := parseBlobDigest(m.Config.Digest); err != nil || (csum != ociEmptyDigest && !ociHasBlob(r, modelDir, repo, csum)) {
+			writeOCIError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "config blob "+m.Config.Digest+" not uploaded")
+			return
+		}
+		src, ok := ociFindBlob(r, modelDir, repo, sum)
+		if !ok {
+			writeOCIError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "layer blob "+layer.Digest+" not uploaded")
+			return
+		}
+
+		ref, err := parseModelRef(r, modelDir, name)
+		if err == nil {
+			err = validUploadName(ref.File)
+		}
+		if err == nil && reference != ociLatestTag {
+			ref, err = ref.withVersion(reference)
+		}
+		if err != nil {
+			writeOCIError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+			return
+		}
+		if err := uploadConflict(ref); err != nil {
+			writeOCIError(w, http.StatusConflict, "DENIED", err.Error())
+			return
+		}
+		if code, err := claimPrivate(r, ref, false); err != nil {
+			writeOCIError(w, code, "DENIED", err.Error())
+			return
+		}
+		name = ref.Name
+		if !writes.Begin(name) {
+			writeOCIError(w, http.StatusConflict, "DENIED", "an upload of this model is already in progress")
+			return
+		}
+		defer writes.End(name)
+
+		dst := ref.Path()
+		staged := filepath.Join(ociStagingDir(modelDir), sum)
+		if info, err := os.Stat(src); err == nil {
+			release, err := quotas.Reserve(r.Context(), ref, info.Size())
+			if err != nil {
+				status := http.StatusInternalServerError
+				if _, ok := err.(*quotaError); ok {
+					status = http.StatusInsufficientStorage
+				}
+				log.Printf("[registry] oci: %s refused: %v", name, err)
+				writeOCIError(w, status, "DENIED", err.Error())
+				return
+			}
+			defer release()
+		}
+		if src != dst {
+			tmp := filepath.Join(filepath.Dir(dst), ".oci-"+filepath.Base(dst))
+			os.Remove(tmp)
+			err := os.MkdirAll(filepath.Dir(dst), 0o755)
+			if err == nil {
+				err = os.Link(src, tmp)
+			}
+			if err == nil {
+				err = os.Rename(tmp, dst)
+			}
+			if err != nil {
+				os.Remove(tmp)
+				log.Printf("[registry] oci: unable to publish %s: %v", name, err)
+				writeOCIError(w, http.StatusInternalServerError, "UNKNOWN", "unable to store model")
+				return
+			}
+			if src == staged {
+				os.Remove(staged)
+			}
+		}
+		if _, _, err := publishModel(r, ref, sum, nil); err != nil {
+			writeOCIError(w, http.StatusInternalServerError, "UNKNOWN", "unable to stat model")
+			return
+		}
+		if _, err := sidecars.Update(name, func(meta *modelMeta) { meta.OCIManifest = body }); err != nil {
+			log.Printf("[registry] oci: %s published but its manifest wasn't saved: %v", name, err)
+		}
+		digest := blobDigestPrefix + sha256Hex(body)
+		w.Header().Set(ociDigestHeader, digest)
+		w.Header().Set("Location", "/v2/"+repo+"/manifests/"+digest)
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// ociHasBlob reports whether a blob a manifest refers to is available.
+func ociHasBlob(r *http.Request, modelDir, repo, sum string) bool {
+	_, ok := ociFindBlob(r, modelDir, repo, sum)
+	return ok
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultOneTimeTokenTTL = 15 * time.Minute
+
+var (
+	errTokenUnknown = errors.New("invalid download token")
+	errTokenUsed    = errors.New("download token already used")
+	errTokenExpired = errors.New("download token expired")
+)
+
+// oneTimeTokens backs single-use download links minted by admins.
+var oneTimeTokens = newOneTimeTokenStore(defaultOneTimeTokenTTL)
+
+// oneTimeToken is a single-use grant to download one model.
+type oneTimeToken struct {
+	Model     string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// oneTimeTokenStore is a time-expiring map of minted tokens. Used and expired
+// tokens are kept for one more ttl so reuse is answered with 410 rather than
+// looking like a forged token.
+type oneTimeTokenStore struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	tokens map[string]*oneTimeToken
+}
+
+// mintTokenResponse is used by POST /models/{name}/token
+type mintTokenResponse struct {
+	Token     string    `json:"token"`
+	Model     string    `json:"model"`
+	ExpiresAt time.Time `json:"expires_at"`
+	URL       string    `json:"url"`
+}
+
+func newOneTimeTokenStore(ttl time.Duration) *oneTimeTokenStore {
+	if ttl <= 0 {
+		ttl = defaultOneTimeTokenTTL
+	}
+	return &oneTimeTokenStore{ttl: ttl, tokens: make(map[string]*oneTimeToken)}
+}
+
+// Mint issues a token for model valid for the store's ttl.
+func (s *oneTimeTokenStore) Mint(model string) (string, time.Time, error) {
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", time.Time{}, err
+	}
+	tok := hex.EncodeToString(raw[:])
+	expires := time.Now().Add(s.ttl).UTC()
+
+	s.mu.Lock()
+	s.tokens[tok] = &oneTimeToken{Model: model, ExpiresAt: expires}
+	s.mu.Unlock()
+	return tok, expires, nil
+}
+
+// Redeem consumes tok for model. Only the first successful call returns nil.
+func (s *oneTimeTokenStore) Redeem(tok, model string) error {
+	return s.use(tok, model, true)
+}
+
+// Check reports what Redeem would without consuming tok.
+func (s *oneTimeTokenStore) Check(tok, model string) error {
+	return s.use(tok, model, false)
+}
+
+func (s *oneTimeTokenStore) use(tok, model string, consume bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[tok]
+	if !ok || t.Model != model {
+		return errTokenUnknown
+	}
+	if t.UsedAt != nil {
+		return errTokenUsed
+	}
+	now := time.Now()
+	if now.After(t.ExpiresAt) {
+		return errTokenExpired
+	}
+	if consume {
+		t.UsedAt = &now
+	}
+	return nil
+}
+
+// expire forgets tokens a full ttl after they expired.
+func (s *oneTimeTokenStore) expire() {
+	cutoff := time.Now().Add(-s.ttl)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tok, t := range s.tokens {
+		if t.ExpiresAt.Before(cutoff) {
+			delete(s.tokens, tok)
+		}
+	}
+}
+
+// janitor periodically drops old tokens.
+func (s *oneTimeTokenStore) janitor() {
+	for range time.Tick(s.ttl / 2) {
+		s.expire()
+	}
+}
+
+// checkOneTimeToken checks ?token= on a download without consuming it. It
+// reports whether the request carried a valid token; otherwise it writes the
+// error response (410 for used or expired tokens, 403 for unknown ones) and
+// returns false.
+func checkOneTimeToken(w http.ResponseWriter, r *http.Request, model string) bool {
+	return tokenUsable(w, oneTimeTokens.Check(r.URL.Query().Get("token"), model))
+}
+
+// redeemOneTimeToken consumes ?token= once the download is about to stream,
+// so a request answered 304 or 429 leaves the token for a retry. It answers
+// like checkOneTimeToken if another download took the token in between.
+func redeemOneTimeToken(w http.ResponseWriter, r *http.Request, model string) bool {
+	if !tokenUsable(w, oneTimeTokens.Redeem(r.URL.Query().Get("token"), model)) {
+		return false
+	}
+	log.Printf("[registry] one-time token redeemed for %s", model)
+	return true
+}
+
+// tokenUsable writes the response for a failed token check or redemption.
+func tokenUsable(w http.ResponseWriter, err error) bool {
+	switch err {
+	case nil:
+		return true
+	case errTokenUsed, errTokenExpired:
+		http.Error(w, err.Error(), http.StatusGone)
+	default:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	}
+	return false
+}
+
+// mintTokenHandler issues a single-use download token for {name}.
+func mintTokenHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := resolveModel(r, modelDir, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		info, err := statModel(r.Context(), ref)
+		if err != nil || info.IsDir() {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		}
+		tok, expires, err := oneTimeTokens.Mint(ref.Name)
+		if err != nil {
+			http.Error(w, "unable to mint token", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[registry] one-time token minted for %s, expires %s", ref.Name, expires.Format(time.RFC3339))
+		writeJSON(w, http.StatusCreated, mintTokenResponse{
+			Token:     tok,
+			Model:     ref.Name,
+			ExpiresAt: expires,
+			URL:       "/models/" + url.PathEscape(ref.Name) + "?token=" + tok,
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestOneTimeTokenSurvivesBodylessAnswers(t *testing.T) {
+	dir := newTestRegistry(t)
+	writeTestModel(t, dir, "tiny.gguf", []byte("GGUF one-time token test"))
+	info, err := os.Stat(filepath.Join(dir, "tiny.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oneTimeTokens = newOneTimeTokenStore(defaultOneTimeTokenTTL)
+	tok, _, err := oneTimeTokens.Mint("tiny.gguf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := newRangeGate(1, rangeOverflowReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full.active.Store(1)
+	saved := ranges
+	ranges = full
+	t.Cleanup(func() { ranges = saved })
+
+	r := mux.NewRouter()
+	r.HandleFunc("/models/{name}", streamHandler(dir)).Methods(http.MethodGet)
+	get := func(header, value string) int {
+		req := httptest.NewRequest(http.MethodGet, "/models/tiny.gguf?token="+tok, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, tc := range []struct {
+		what          string
+		header, value string
+		want          int
+	}{
+		{"conditional GET", "If-None-Match", fileETag(info), http.StatusNotModified},
+		{"range over the limit", "Range", "bytes=0-3", http.StatusTooManyRequests},
+		{"download", "", "", http.StatusOK},
+		{"second download", "", "", http.StatusGone},
+	} {
+		if got := get(tc.header, tc.value); got != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.what, got, tc.want)
+		}
+	}
+}
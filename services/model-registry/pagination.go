@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// cursorKey signs list cursors so clients can't forge positions. It is random
+// per process unless MODEL_REGISTRY_CURSOR_KEY pins it (needed for cursors to
+// survive restarts or work across replicas).
+var cursorKey []byte
+
+func newCursorKey(secret string) []byte {
+	if secret != "" {
+		return []byte(secret)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// listPage is the pagination requested by a /models query. Offset mode is
+// used for ?limit=/?offset=, cursor mode whenever ?cursor is present (empty
+// for the first page).
+type listPage struct {
+	cursorMode bool
+	after      string // cursor mode: last name of the previous page
+	offset     int
+	limit      int // 0 means unlimited (no pagination requested)
+}
+
+// parseListPage reads limit/offset/cursor from q.
+func parseListPage(q url.Values) (listPage, error) {
+	var p listPage
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return p, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		p.limit = n
+	}
+	if _, ok := q["cursor"]; ok {
+		if q.Get("offset") != "" {
+			return p, errors.New("offset and cursor cannot be combined")
+		}
+		p.cursorMode = true
+		if p.limit == 0 {
+			p.limit = defaultPageLimit
+		}
+		if raw := q.Get("cursor"); raw != "" {
+			after, err := decodeCursor(raw)
+			if err != nil {
+				return p, err
+			}
+			p.after = after
+		}
+		return p, nil
+	}
+	if raw := q.Get("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return p, errors.New("offset must be a non-negative integer")
+		}
+		p.offset = n
+		if p.limit == 0 {
+			p.limit = defaultPageLimit
+		}
+	}
+	return p, nil
+}
+
+// Active reports whether any pagination was requested.
+func (p listPage) Active() bool {
+	return p.limit > 0
+}
+
+// apply sorts models by name and cuts out the requested page. It returns the
+// cursor or offset for the next page; both are empty/nil on the last page.
+func (p listPage) apply(models []modelFile) ([]modelFile, string, *int) {
+	sort.Slice(models, func(i, j int) bool { return models[i].Name < models[j].Name })
+	if p.cursorMode {
+		start := sort.Search(len(models), func(i int) bool { return models[i].Name > p.after })
+		models = models[start:]
+		if len(models) <= p.limit {
+			return models, "", nil
+		}
+		models = models[:p.limit]
+		return models, encodeCursor(models[len(models)-1].Name), nil
+	}
+
+	if p.offset >= len(models) {
+		return []modelFile{}, "", nil
+	}
+	models = models[p.offset:]
+	if len(models) <= p.limit {
+		return models, "", nil
+	}
+	next := p.offset + p.limit
+	return models[:p.limit], "", &next
+}
+
+// encodeCursor returns an opaque token for "after name". Clients must treat
+// it as opaque; its layout (base64 name, '.', truncated HMAC) may change.
+func encodeCursor(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name)) + "." + cursorMAC(name)
+}
+
+func decodeCursor(cursor string) (string, error) {
+	rawName, mac, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return "", errInvalidCursor
+	}
+	b, err := base64.RawURLEncoding.DecodeString(rawName)
+	if err != nil {
+		return "", errInvalidCursor
+	}
+	name := string(b)
+	if !hmac.Equal([]byte(mac), []byte(cursorMAC(name))) {
+		return "", errInvalidCursor
+	}
+	return name, nil
+}
+
+func cursorMAC(name string) string {
+	m := hmac.New(sha256.New, cursorKey)
+	m.Write([]byte(name))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil)[:16])
+}
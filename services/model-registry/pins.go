@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Pinning. POST /models/{name}/pin marks a model as one the registry must
+// never reclaim on its own: retention skips it, MODEL_REGISTRY_MAX_MODEL_AGE
+// doesn't expire it and DELETE refuses it with 409 until it is unpinned. A
+// pin on name@version covers that version; one on the plain name of a
+// versioned model covers every version. Pins are kept in the sidecar, so
+// they survive restarts and re-uploads, and mirrored in memory because
+// expiry checks run on every listing.
+
+// modelPin is a pin, as stored in the sidecar.
+type modelPin struct {
+	At     time.Time `json:"at"`
+	By     string    `json:"by,omitempty"` // principals of the admin who pinned
+	Reason string    `json:"reason,omitempty"`
+}
+
+// pinSet is the set of pinned names.
+type pinSet struct {
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+var pins = &pinSet{names: map[string]bool{}}
+
+// Load fills the set from the sidecars under s.
+func (p *pinSet) Load(s *sidecarStore) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		var m modelMeta
+		if json.Unmarshal(data, &m) != nil || m.Pin == nil {
+			return nil
+		}
+		if rel, err := filepath.Rel(s.dir, path); err == nil {
+			p.names[strings.TrimSuffix(filepath.ToSlash(rel), ".json")] = true
+		}
+		return nil
+	})
+}
+
+func (p *pinSet) Set(name string, pinned bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pinned {
+		p.names[name] = true
+	} else {
+		delete(p.names, name)
+	}
+}
+
+// Covers reports whether name, or the model it is a version of, is pinned.
+func (p *pinSet) Covers(name string) bool {
+	base, _, _ := strings.Cut(name, versionSep)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.names[name] || p.names[base]
+}
+
+// pinResponse is used by /models/{name}/pin and /pins
+type pinResponse struct {
+	Name string `json:"name"`
+	modelPin
+}
+
+// pinTarget resolves {name} for the pin routes without picking a version,
+// answering itself for models that don't exist.
+func pinTarget(w http.ResponseWriter, r *http.Request, modelDir string) (modelRef, bool) {
+	ref, err := parseModelRef(r, modelDir, mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ref, false
+	}
+	if _, err := statModel(r.Context(), ref.resolveLatest()); err != nil {
+		http.Error(w, "model not found", http.StatusNotFound)
+		return ref, false
+	}
+	return ref, true
+}
+
+// pinHandler pins {name}. The optional body is {"reason": "..."}; pinning a
+// pinned model keeps the first pin.
+func pinHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, ok := pinTarget(w, r, modelDir)
+		if !ok {
+			return
+		}
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, `body must be empty or a JSON object like {"reason": "production"}`, http.StatusBadRequest)
+			return
+		}
+		pin := modelPin{At: time.Now().UTC(), By: strings.Join(requestPrincipals(r), ","), Reason: req.Reason}
+		meta, err := sidecars.Update(ref.Name, func(m *modelMeta) {
+			if m.Pin == nil {
+				m.Pin = &pin
+			}
+		})
+		if err != nil {
+			log.Printf("[registry] unable to pin %s: %v", ref.Name, err)
+			http.Error(w, "unable to pin model", http.StatusInternalServerError)
+			return
+		}
+		pins.Set(ref.Name, true)
+		log.Printf("[registry] pinned %s (by=%q reason=%q)", ref.Name, meta.Pin.By, meta.Pin.Reason)
+		rescanCatalog() // an expired model is listed again
+		writeJSON(w, http.StatusOK, pinResponse{Name: ref.Name, modelPin: *meta.Pin})
+	}
+}
+
+// unpinHandler removes the pin of {name}.
+func unpinHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, ok := pinTarget(w, r, modelDir)
+		if !ok {
+			return
+		}
+		if _, err := sidecars.Update(ref.Name, func(m *modelMeta) { m.Pin = nil }); err != nil {
+			log.Printf("[registry] unable to unpin %s: %v", ref.Name, err)
+			http.Error(w, "unable to unpin model", http.StatusInternalServerError)
+			return
+		}
+		pins.Set(ref.Name, false)
+		log.Printf("[registry] unpinned %s", ref.Name)
+		rescanCatalog()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// listPinsHandler serves GET /pins: every pin, by name.
+func listPinsHandler(w http.ResponseWriter, r *http.Request) {
+	pins.mu.Lock()
+	names := make([]string, 0, len(pins.names))
+	for name := range pins.names {
+		names = append(names, name)
+	}
+	pins.mu.Unlock()
+	sort.Strings(names)
+	out := []pinResponse{}
+	for _, name := range names {
+		if meta, err := sidecars.Get(name); err == nil && meta.Pin != nil {
+			out = append(out, pinResponse{Name: name, modelPin: *meta.Pin})
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"pins": out})
+}
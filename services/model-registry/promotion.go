@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Promotion. Apart from its status, every model is at a stage of the release
+// workflow, kept in its sidecar:
+//
+//	uploaded    where every upload, import and copy starts
+//	staging     being evaluated
+//	production  cleared for serving
+//	retired     no longer to be served; still stored and downloadable
+//
+// POST /models/{name}/promote moves a model forward, one stage or straight to
+// the one named in the body; stages never move back, so new contents go
+// through a new upload (or version), which starts over at uploaded. Listings
+// take ?stage= so an inference gateway can load only production models.
+const (
+	stageUploaded   = "uploaded"
+	stageStaging    = "staging"
+	stageProduction = "production"
+	stageRetired    = "retired"
+)
+
+// stageOrder is the workflow, first stage first.
+var stageOrder = []string{stageUploaded, stageStaging, stageProduction, stageRetired}
+
+// promotionsTotal counts promotions by the stage moved to.
+var promotionsTotal = metrics.Counter("model_promotions_total", "Models promoted by target stage", "stage")
+
+// stagePromotion is one move between stages, as the sidecar records it.
+type stagePromotion struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	At     time.Time `json:"at"`
+	By     string    `json:"by,omitempty"` // principals of the caller
+	Reason string    `json:"reason,omitempty"`
+	// ApprovedBy and Approval name the second identity that approved the
+	// move, and the approval, when one was required.
+	ApprovedBy string `json:"approved_by,omitempty"`
+	Approval   string `json:"approval,omitempty"`
+}
+
+// modelStage is the stage the sidecar m puts its model at.
+func modelStage(m modelMeta) string {
+	if m.Stage == "" {
+		return stageUploaded
+	}
+	return m.Stage
+}
+
+// stageOf is modelStage for the model registry state is kept under key; an
+// unreadable sidecar counts as uploaded.
+func stageOf(key string) string {
+	m, _ := sidecars.Get(key)
+	return modelStage(m)
+}
+
+// nextStage is the stage after s, or "" for the last one.
+func nextStage(s string) string {
+	if i := slices.Index(stageOrder, s); i >= 0 && i+1 < len(stageOrder) {
+		return stageOrder[i+1]
+	}
+	return ""
+}
+
+// promoteResponse is used by /models/{name}/promote
+type promoteResponse struct {
+	Name       string           `json:"name"`
+	Stage      string           `json:"stage"`
+	Promotions []stagePromotion `json:"promotions"`
+}
+
+// promoteHandler moves {name} (the latest version of a versioned model, or
+// name@version) to a later stage. The optional body is {"stage": "...",
+// "reason": "..."}; without a stage the model moves to the next one. Moving
+// back, or to the stage it is at, is a conflict.
+func promoteHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := resolveModel(r, modelDir, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := ref.Name
+		if info, err := statModel(r.Context(), ref); err != nil || info.IsDir() {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		}
+		var req struct {
+			Stage  string `json:"stage"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, `body must be empty or a JSON object like {"stage": "production", "reason": "passed evaluation"}`, http.StatusBadRequest)
+			return
+		}
+		if req.Stage != "" && !slices.Contains(stageOrder, req.Stage) {
+			http.Error(w, "unknown stage "+strconv.Quote(req.Stage)+" (want "+strings.Join(stageOrder, ", ")+")", http.StatusBadRequest)
+			return
+		}
+
+		promotion := stagePromotion{At: time.Now().UTC(), By: strings.Join(requestPrincipals(r), ","), Reason: req.Reason}
+		// Moves to production wait for a second identity when approvals are on.
+		if approvals != nil {
+			meta, err := sidecars.Get(name)
+			if err != nil {
+				log.Printf("[registry] unable to promote %s: %v", name, err)
+				http.Error(w, "unable to promote model", http.StatusInternalServerError)
+				return
+			}
+			if to, conflict := promotionTarget(modelStage(meta), req.Stage); conflict == "" && to == stageProduction {
+				requestApproval(w, r, name, meta, to, req.Reason)
+				return
+			}
+		}
+		meta, conflict, err := promoteModel(name, req.Stage, &promotion, approvals != nil)
+		if err != nil {
+			log.Printf("[registry] unable to promote %s: %v", name, err)
+			http.Error(w, "unable to promote model", http.StatusInternalServerError)
+			return
+		}
+		if conflict != "" {
+			http.Error(w, conflict, http.StatusConflict)
+			return
+		}
+		promoted(r, name, promotion)
+		writeJSON(w, http.StatusOK, promoteResponse{Name: name, Stage: meta.Stage, Promotions: meta.Promotions})
+	}
+}
+
+// promotionTarget is the stage a promotion of a model at from to the
+// requested stage to ("" for the next one) ends at, or why it can't happen.
+func promotionTarget(from, to string) (string, string) {
+	if to == "" {
+		to = nextStage(from)
+	}
+	switch {
+	case to == "":
+		return "", "model is " + from + "; there is no later stage"
+	case slices.Index(stageOrder, to) <= slices.Index(stageOrder, from):
+		return "", "model is " + from + "; promotions only move forward"
+	}
+	return to, ""
+}
+
+// promoteModel moves name to the stage to ("" for the next one), filling in
+// and recording p. Unless approved, a move to production is refused when
+// approvals are on, in case the model moved on since the caller looked. A
+// non-empty conflict says why the model stayed put.
+func promoteModel(name, to string, p *stagePromotion, gated bool) (meta modelMeta, conflict string, err error) {
+	meta, err = sidecars.Update(name, func(m *modelMeta) {
+		from := modelStage(*m)
+		var target string
+		if target, conflict = promotionTarget(from, to); conflict != "" {
+			return
+		}
+		if gated && target == stageProduction {
+			conflict = "model is " + from + "; promotions to production need an approval"
+			return
+		}
+		p.From, p.To = from, target
+		m.Stage = target
+		m.Promotions = append(m.Promotions, *p)
+	})
+	return meta, conflict, err
+}
+
+// promoted reports a promotion of name by r's caller.
+func promoted(r *http.Request, name string, p stagePromotion) {
+	promotionsTotal.Inc(p.To)
+	log.Printf("[registry] promoted %s from %s to %s (by=%q approved_by=%q reason=%q)", name, p.From, p.To, p.By, p.ApprovedBy, p.Reason)
+	events.Publish(eventModelPromoted, name, withIdentity(requestIdentity(r), map[string]any{"from": p.From, "stage": p.To, "reason": p.Reason, "client": clientIP(r)}))
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Provenance. PUT /models/{name}/provenance attaches an SLSA-style
+// provenance document to a model version: an in-toto statement, or a DSSE
+// envelope carrying one, saying who built (trained) the model, from which
+// inputs (datasets, base models, the pipeline at a digest) and how. The
+// statement must name the model's SHA-256 among its subjects, so a document
+// can't be attached to content it doesn't describe. Documents are stored
+// as sent under MODEL_DIR/.registry/provenance/<name>.json and served back
+// verbatim; the sidecar keeps a summary for metadata. Envelope signatures
+// are kept for clients to verify, not checked here.
+const (
+	maxProvenanceSize = 1 << 20
+
+	inTotoMediaType = "application/vnd.in-toto+json"
+	dsseMediaType   = "application/vnd.dsse.envelope.v1+json"
+)
+
+// provenance holds the provenance documents.
+var provenance = &cardStore{}
+
+func newProvenanceStore(modelDir string) *cardStore {
+	return &cardStore{dir: filepath.Join(modelDir, stateDirName, "provenance"), ext: ".json"}
+}
+
+// inTotoStatement is the part of an in-toto statement the registry reads.
+type inTotoStatement struct {
+	Type    string `json:"_type"`
+	Subject []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+// dsseEnvelope is a DSSE envelope; the payload is a base64 in-toto statement.
+type dsseEnvelope struct {
+	PayloadType string            `json:"payloadType"`
+	Payload     string            `json:"payload"`
+	Signatures  []json.RawMessage `json:"signatures"`
+}
+
+// slsaPredicate is the part of an SLSA provenance predicate the summary
+// comes from, in the v1 and v0.2 layouts.
+type slsaPredicate struct {
+	BuildDefinition struct {
+		BuildType            string               `json:"buildType"`
+		ResolvedDependencies []provenanceMaterial `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+	} `json:"runDetails"`
+
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	BuildType string               `json:"buildType"`
+	Materials []provenanceMaterial `json:"materials"`
+}
+
+// provenanceMaterial is an input of the build: a dataset, base model or
+// pipeline definition.
+type provenanceMaterial struct {
+	URI    string            `json:"uri,omitempty"`
+	Name   string            `json:"name,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// provenanceSummary describes the attached document, in the sidecar.
+type provenanceSummary struct {
+	MediaType     string               `json:"media_type"`
+	PredicateType string               `json:"predicate_type"`
+	Builder       string               `json:"builder,omitempty"`
+	BuildType     string               `json:"build_type,omitempty"`
+	Materials     []provenanceMaterial `json:"materials,omitempty"`
+	Signatures    int                  `json:"signatures"` // envelope signatures, unverified
+	AttachedAt    time.Time            `json:"attached_at"`
+	AttachedBy    string               `json:"attached_by,omitempty"` // principals
+}
+
+// parseProvenance reads doc as an in-toto statement or a DSSE envelope of
+// one and checks it describes content with SHA-256 sum.
+func parseProvenance(doc []byte, sum string) (provenanceSummary, error) {
+	var s provenanceSummary
+	var env dsseEnvelope
+	if err := json.Unmarshal(doc, &env); err != nil {
+		return s, errors.New("provenance must be a JSON in-toto statement or DSSE envelope")
+	}
+	statement := doc
+	s.MediaType = inTotoMediaType
+	if env.PayloadType != "" {
+		if env.PayloadType != inTotoMediaType {
+			return s, errors.New("envelope payloadType must be " + inTotoMediaType)
+		}
+		payload, err := base64.StdEncoding.DecodeString(env.Payload)
+		if err != nil {
+			return s, errors.New("envelope payload is not base64")
+		}
+		statement, s.MediaType, s.Signatures = payload, dsseMediaType, len(env.Signatures)
+	}
+
+	var st inTotoStatement
+	if err := json.Unmarshal(statement, &st); err != nil || !strings.HasPrefix(st.Type, "https://in-toto.io/Statement/") {
+		return s, errors.New("provenance must be an in-toto statement (_type https://in-toto.io/Statement/...)")
+	}
+	if st.PredicateType == "" {
+		return s, errors.New("statement has no predicateType")
+	}
+	described := false
+	for _, sub := range st.Subject {
+		described = described || strings.EqualFold(sub.Digest["sha256"], sum)
+	}
+	if !described {
+		return s, errors.New("no subject of the statement has the model's sha256 " + sum)
+	}
+	s.PredicateType = st.PredicateType
+
+	var p slsaPredicate
+	if len(st.Predicate) > 0 && json.Unmarshal(st.Predicate, &p) == nil {
+		s.Builder, s.BuildType, s.Materials = p.RunDetails.Builder.ID, p.BuildDefinition.BuildType, p.BuildDefinition.ResolvedDependencies
+		if s.Builder == "" {
+			s.Builder = p.Builder.ID
+		}
+		if s.BuildType == "" {
+			s.BuildType = p.BuildType
+		}
+		if len(s.Materials) == 0 {
+			s.Materials = p.Materials
+		}
+	}
+	return s, nil
+}
+
+// provenanceResponse is used by PUT /models/{name}/provenance
+type provenanceResponse struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+	provenanceSummary
+}
+
+// provenanceHandler returns the provenance document of {name} as attached.
+func provenanceHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := resolveModel(r, modelDir, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// A new upload under the name drops the summary, and with it the
+		// document about the old content.
+		meta, err := sidecars.Get(ref.Name)
+		if err == nil && meta.Provenance == nil {
+			http.Error(w, "model has no provenance", http.StatusNotFound)
+			return
+		}
+		var doc []byte
+		if err == nil {
+			doc, err = provenance.Get(ref.Name)
+		}
+		if err != nil {
+			if os.IsNotExist(err) {
+				http.Error(w, "model has no provenance", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "unable to read provenance", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", meta.Provenance.MediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(doc)))
+		w.Write(doc)
+	}
+}
+
+// putProvenanceHandler attaches the document in the body to {name},
+// replacing any earlier one. Like cards, provenance is per version, so a
+// plain name must not resolve to a versioned model.
+func putProvenanceHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := parseModelRef(r, modelDir, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if latest := ref.resolveLatest(); latest.Version != "" && ref.Version == "" {
+			http.Error(w, errVersionedModel.Error(), http.StatusBadRequest)
+			return
+		}
+		name := ref.Name
+		info, err := statModel(r.Context(), ref)
+		if err != nil || info.IsDir() {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		}
+		doc, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxProvenanceSize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "provenance exceeds "+strconv.Itoa(maxProvenanceSize)+" bytes", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "unable to read provenance", http.StatusBadRequest)
+			return
+		}
+
+		meta, err := sidecars.Get(name)
+		if err != nil {
+			log.Printf("[registry] unable to read sidecar of %s: %v", name, err)
+			http.Error(w, "unable to store provenance", http.StatusInternalServerError)
+			return
+		}
+		sum := meta.Sha256
+		if sum == "" {
+			sums, err := digests.ModelDigests(r.Context(), ref, info, []string{algoSHA256})
+			if err != nil {
+				log.Printf("[registry] unable to hash %s: %v", name, err)
+				http.Error(w, "unable to hash model", http.StatusInternalServerError)
+				return
+			}
+			sum = sums[algoSHA256]
+		}
+		summary, err := parseProvenance(doc, sum)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		summary.AttachedAt, summary.AttachedBy = time.Now().UTC(), strings.Join(requestPrincipals(r), ",")
+
+		if err := provenance.Put(name, doc); err != nil {
+			log.Printf("[registry] unable to store provenance of %s: %v", name, err)
+			http.Error(w, "unable to store provenance", http.StatusInternalServerError)
+			return
+		}
+		if _, err := sidecars.Update(name, func(m *modelMeta) { m.Provenance = &summary }); err != nil {
+			log.Printf("[registry] provenance of %s stored but not its summary: %v", name, err)
+			http.Error(w, "unable to store provenance", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[registry] stored provenance of %s (%d bytes, %s, builder=%q)", name, len(doc), summary.PredicateType, summary.Builder)
+		writeJSON(w, http.StatusOK, provenanceResponse{Name: name, Size: len(doc), provenanceSummary: summary})
+	}
+}
+
+// deleteProvenanceHandler removes the provenance of {name}.
+func deleteProvenanceHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := resolveModel(r, modelDir, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := ref.Name
+		if info, err := statModel(r.Context(), ref); err != nil || info.IsDir() {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		}
+		if _, err := sidecars.Update(name, func(m *modelMeta) { m.Provenance = nil }); err != nil {
+			log.Printf("[registry] unable to remove provenance of %s: %v", name, err)
+			http.Error(w, "unable to remove provenance", http.StatusInternalServerError)
+			return
+		}
+		if err := provenance.Delete(name); err != nil {
+			log.Printf("[registry] unable to remove provenance of %s: %v", name, err)
+			http.Error(w, "unable to remove provenance", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[registry] removed provenance of %s", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
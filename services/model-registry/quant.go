@@ -0,0 +1,75 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// quantPattern matches the common llama.cpp quantization tokens when they
+// appear as a separate component of a file name, e.g. "mistral-7b.Q4_K_M.gguf"
+// or "phi-2-iq3_xxs.gguf". Longer alternatives come first so Q4_K_M is not
+// cut short at Q4_K.
+var quantPattern = regexp.MustCompile(`(?i)(?:^|[.\-_])(` +
+	`IQ[1-4]_(?:XXS|XS|NL|S|M)|` +
+	`Q[2-6]_K_(?:XL|S|M|L)|` +
+	`Q[2-8]_K|` +
+	`Q[4-8]_[01]|` +
+	`TQ[12]_0|` +
+	`BF16|FP16|F16|FP32|F32` +
+	`)(?:$|[.\-_])`)
+
+// modelEntry is one model in a ?detail=1 listing.
+type modelEntry struct {
+	Name           string    `json:"name"`
+	Size           int64     `json:"size"`
+	Modified       time.Time `json:"modified"`
+	Format         string    `json:"format"`
+	Quant          string    `json:"quant,omitempty"`
+	Status         string    `json:"status"`
+	Stage          string    `json:"stage"`
+	Version        string    `json:"version,omitempty"`
+	Architecture   string    `json:"architecture,omitempty"`
+	ContextLength  uint64    `json:"context_length,omitempty"`
+	ParameterCount uint64    `json:"parameter_count,omitempty"`
+	Summary        string    `json:"summary,omitempty"`
+}
+
+// detailedListResponse is used by /models?detail=1
+type detailedListResponse struct {
+	Models     []modelEntry `json:"models"`
+	Total      int          `json:"total"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+	NextOffset *int         `json:"next_offset,omitempty"`
+}
+
+// parseQuant returns the upper-cased quantization token in a model's file
+// name, or "" if none is recognized. FP16/FP32 are normalized to F16/F32.
+// Only the file name is consulted; GGUF headers are not read here.
+func parseQuant(name string) string {
+	base := strings.TrimSuffix(path.Base(name), path.Ext(name))
+	m := quantPattern.FindStringSubmatch(base)
+	if m == nil {
+		return ""
+	}
+	q := strings.ToUpper(m[1])
+	switch q {
+	case "FP16":
+		return "F16"
+	case "FP32":
+		return "F32"
+	}
+	return q
+}
+
+// quantMatches reports whether a detected quant satisfies a ?quant= filter.
+// The filter matches exactly or as a "_"-delimited prefix, so Q4 selects
+// Q4_0 and Q4_K_M while Q4_K selects only the K variants.
+func quantMatches(quant, want string) bool {
+	if quant == "" {
+		return false
+	}
+	want = strings.ToUpper(want)
+	return quant == want || strings.HasPrefix(quant, want+"_")
+}
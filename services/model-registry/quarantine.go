@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// quarantinePeriod keeps newly added models out of listings until it has
+// elapsed or the model is explicitly released. Zero disables quarantine.
+var quarantinePeriod time.Duration
+
+// quarantineStatus is reported in model metadata.
+type quarantineStatus struct {
+	Quarantined bool       `json:"quarantined"`
+	Since       time.Time  `json:"since"`
+	Until       time.Time  `json:"until"`
+	ReleasedAt  *time.Time `json:"released_at,omitempty"`
+}
+
+// releaseResponse is used by POST /models/{name}/release
+type releaseResponse struct {
+	Name       string    `json:"name"`
+	ReleasedAt time.Time `json:"released_at"`
+}
+
+// quarantineState derives the quarantine status of a model from its sidecar,
+// falling back to the file mtime as the time it arrived. It returns nil when
+// quarantine is disabled.
+func quarantineState(name string, info os.FileInfo) *quarantineStatus {
+	if quarantinePeriod <= 0 {
+		return nil
+	}
+	meta, err := sidecars.Get(name)
+	if err != nil {
+		log.Printf("[registry] unable to read sidecar for %s: %v", name, err)
+	}
+
+	since := info.ModTime().UTC()
+	if meta.QuarantinedAt != nil {
+		since = *meta.QuarantinedAt
+	}
+	st := &quarantineStatus{Since: since, Until: since.Add(quarantinePeriod), ReleasedAt: meta.ReleasedAt}
+	st.Quarantined = meta.ReleasedAt == nil && time.Now().Before(st.Until)
+	return st
+}
+
+// isQuarantined is a convenience wrapper for handlers that only need the flag.
+func isQuarantined(name string, info os.FileInfo) bool {
+	st := quarantineState(name, info)
+	return st != nil && st.Quarantined
+}
+
+// releaseHandler ends quarantine for a model ahead of the grace period.
+func releaseHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := resolveModel(r, modelDir, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := ref.Name
+		info, err := statModel(r.Context(), ref)
+		if err != nil || info.IsDir() {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		}
+
+		now := time.Now().UTC()
+		meta, err := sidecars.Update(name, func(m *modelMeta) {
+			if m.ReleasedAt == nil {
+				m.ReleasedAt = &now
+			}
+		})
+		if err != nil {
+			log.Printf("[registry] unable to release %s: %v", name, err)
+			http.Error(w, "unable to release model", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[registry] model %s released from quarantine", name)
+		rescanCatalog()
+		writeJSON(w, http.StatusOK, releaseResponse{Name: name, ReleasedAt: *meta.ReleasedAt})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Disk quotas. MODEL_REGISTRY_QUOTA caps the bytes of models stored in
+// MODEL_DIR, and MODEL_REGISTRY_BACKEND_QUOTAS caps each extra backend, the
+// registry's namespaces. Usage counts every model file, all versions
+// included; registry state and temp files don't count. An upload that would
+// take its backend over the quota is refused with 507 Insufficient Storage,
+// up front when its size is announced and again before it is stored, since
+// uploads in progress hold their size until they finish. Replacing a model
+// only needs room for the difference. Caches filled on a download (the
+// origin tier, the Hugging Face mirror) aren't refused but count.
+
+// quotaRejected counts refused uploads by backend.
+var quotaRejected = metrics.Counter("quota_rejected_uploads_total", "Uploads refused by the disk quota by backend", "backend")
+
+// quotaTracker holds the quotas and the bytes uploads in progress hold.
+type quotaTracker struct {
+	modelDir string
+	limits   map[string]int64 // backend -> bytes; missing means unlimited
+
+	mu       sync.Mutex
+	reserved map[string]int64
+}
+
+// quotas is the quota tracker, always set; without quotas it allows
+// everything.
+var quotas = newQuotaTracker("", nil)
+
+func newQuotaTracker(modelDir string, limits map[string]int64) *quotaTracker {
+	if limits == nil {
+		limits = map[string]int64{}
+	}
+	return &quotaTracker{modelDir: modelDir, limits: limits, reserved: map[string]int64{}}
+}
+
+// parseQuotas combines MODEL_REGISTRY_QUOTA, for the primary backend, with
+// "name=bytes,name=bytes" for the others.
+func parseQuotas(primary int64, spec string) (map[string]int64, error) {
+	limits := map[string]int64{}
+	if primary < 0 {
+		return nil, fmt.Errorf("MODEL_REGISTRY_QUOTA can't be negative")
+	}
+	if primary > 0 {
+		limits[primaryBackend] = primary
+	}
+	for _, item := range splitList(spec) {
+		name, raw, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("entry %q is not backend=bytes", item)
+		}
+		if _, known := backends[name]; !known {
+			return nil, errUnknownBackend(name)
+		}
+		if n > 0 {
+			limits[name] = n
+		}
+	}
+	return limits, nil
+}
+
+// quotaError is an upload the quota has no room for.
+type quotaError struct {
+	backend           string
+	size, used, limit int64
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("upload of %d bytes exceeds the quota of backend %s: %d of %d bytes in use", e.size, e.backend, e.used, e.limit)
+}
+
+// Reserve holds size bytes on ref's backend for an upload that replaces
+// whatever is stored at ref, or fails with a *quotaError. release gives the
+// bytes back; call it once the model is stored or the upload failed.
+func (q *quotaTracker) Reserve(ctx context.Context, ref modelRef, size int64) (release func(), err error) {
+	limit := q.limits[ref.Backend]
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	used, _, err := backendUsage(ctx, ref.Backend, q.modelDir)
+	if err != nil {
+		return nil, err
+	}
+	used += q.reserved[ref.Backend]
+	need := size
+	if info, err := statModel(ctx, ref); err == nil {
+		need -= info.Size()
+	}
+	if used+need > limit {
+		quotaRejected.Inc(ref.Backend)
+		return nil, &quotaError{backend: ref.Backend, size: size, used: used, limit: limit}
+	}
+	q.reserved[ref.Backend] += size
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			q.reserved[ref.Backend] -= size
+			q.mu.Unlock()
+		})
+	}, nil
+}
+
+// Check reports whether an upload of size bytes to ref would fit now.
+func (q *quotaTracker) Check(ctx context.Context, ref modelRef, size int64) error {
+	release, err := q.Reserve(ctx, ref, size)
+	if err != nil {
+		return err
+	}
+	release()
+	return nil
+}
+
+// writeQuotaError answers a failed Reserve or Check: 507 for the quota,
+// 500 when usage couldn't be counted.
+func writeQuotaError(w http.ResponseWriter, ref modelRef, err error) {
+	if qe, ok := err.(*quotaError); ok {
+		log.Printf("[registry] upload %s refused: %v", ref.Name, qe)
+		http.Error(w, qe.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	log.Printf("[registry] upload %s: unable to check the quota: %v", ref.Name, err)
+	http.Error(w, "unable to check the quota", http.StatusInternalServerError)
+}
+
+// backendUsage sums the models stored on backend, every version counted.
+func backendUsage(ctx context.Context, backend, modelDir string) (bytes int64, models int, err error) {
+	dir := backendDir(backend, modelDir)
+	found, err := backendStorage(backend, modelDir).List(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, f := range found {
+		if f.Version == "" {
+			bytes += f.Info.Size()
+			models++
+			continue
+		}
+		versions, err := listVersions(dir, f.Name)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, v := range versions {
+			bytes += v.Info.Size()
+			models++
+		}
+	}
+	return bytes, models, nil
+}
+
+// quotaUsage is one backend in /quota.
+type quotaUsage struct {
+	Backend   string   `json:"backend"`
+	Models    int      `json:"models"` // versions count one each
+	Used      int64    `json:"used_bytes"`
+	Reserved  int64    `json:"reserved_bytes"` // held by uploads in progress
+	Quota     int64    `json:"quota_bytes"`    // 0 = unlimited
+	Available *int64   `json:"available_bytes,omitempty"`
+	Percent   *float64 `json:"used_percent,omitempty"`
+}
+
+// quotaHandler serves GET /quota: usage and quota of every backend.
+func quotaHandler(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := []quotaUsage{}
+	for _, backend := range names {
+		used, models, err := backendUsage(r.Context(), backend, quotas.modelDir)
+		if err != nil {
+			log.Printf("[registry] unable to count usage of backend %s: %v", backend, err)
+			http.Error(w, "unable to count usage", http.StatusInternalServerError)
+			return
+		}
+		quotas.mu.Lock()
+		u := quotaUsage{Backend: backend, Models: models, Used: used, Reserved: quotas.reserved[backend], Quota: quotas.limits[backend]}
+		quotas.mu.Unlock()
+		if u.Quota > 0 {
+			avail := max(u.Quota-u.Used-u.Reserved, 0)
+			pct := float64(u.Used*10000/u.Quota) / 100
+			u.Available, u.Percent = &avail, &pct
+		}
+		out = append(out, u)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"backends": out})
+}
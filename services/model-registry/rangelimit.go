@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Range overflow policies for MODEL_REGISTRY_RANGE_OVERFLOW.
+const (
+	rangeOverflowReject = "reject" // answer 429
+	rangeOverflowFull   = "full"   // ignore the range and stream the whole file
+)
+
+// rangeGate caps how many partial (shard) downloads run at once, independent
+// of full downloads. A max of zero means no limit; the counters are kept
+// either way so /stats can report them.
+type rangeGate struct {
+	max    int64
+	policy string
+
+	active     atomic.Int64
+	rejected   atomic.Int64
+	downgraded atomic.Int64
+	version    atomic.Uint64 // bumped on every change, used for /stats ETags
+}
+
+// rangeStats is the range section of the /stats response.
+type rangeStats struct {
+	Active     int64  `json:"active"`
+	Limit      int64  `json:"limit"`
+	Policy     string `json:"policy"`
+	Rejected   int64  `json:"rejected_total"`
+	Downgraded int64  `json:"downgraded_total"`
+}
+
+var ranges = &rangeGate{policy: rangeOverflowReject}
+
+func newRangeGate(max int, policy string) (*rangeGate, error) {
+	if max < 0 {
+		return nil, fmt.Errorf("limit must not be negative")
+	}
+	switch policy {
+	case rangeOverflowReject, rangeOverflowFull:
+	default:
+		return nil, fmt.Errorf("policy %q is not %s or %s", policy, rangeOverflowReject, rangeOverflowFull)
+	}
+	return &rangeGate{max: int64(max), policy: policy}, nil
+}
+
+// Acquire claims a slot for one range request. When it returns false the
+// caller applies the overflow policy (and must not call Release).
+func (g *rangeGate) Acquire() bool {
+	defer g.version.Add(1)
+	for {
+		cur := g.active.Load()
+		if g.max > 0 && cur >= g.max {
+			if g.policy == rangeOverflowFull {
+				g.downgraded.Add(1)
+			} else {
+				g.rejected.Add(1)
+			}
+			return false
+		}
+		if g.active.CompareAndSwap(cur, cur+1) {
+			return true
+		}
+	}
+}
+
+// Release frees a slot claimed by Acquire.
+func (g *rangeGate) Release() {
+	g.active.Add(-1)
+	g.version.Add(1)
+}
+
+// Stats returns a snapshot of the counters.
+func (g *rangeGate) Stats() rangeStats {
+	return rangeStats{
+		Active:     g.active.Load(),
+		Limit:      g.max,
+		Policy:     g.policy,
+		Rejected:   g.rejected.Load(),
+		Downgraded: g.downgraded.Load(),
+	}
+}
+
+// Version changes whenever the counters do.
+func (g *rangeGate) Version() uint64 {
+	return g.version.Load()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxShardCount = 1024
+
+var errEmptyRange = fmt.Errorf("requested range is empty")
+
+// byteRange is a single requested slice of a model file.
+type byteRange struct {
+	Start  int64
+	Length int64
+}
+
+// contentRange formats the Content-Range header value for r within size.
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+// parseShard parses a "?shard=i/n" spec (1-based index) and returns the byte
+// range of that shard within a file of the given size.
+//
+// The file is cut into n shards of ceil(size/n) bytes each; the last shard
+// holds whatever remains and may be shorter. If the shards run out before
+// index i (tiny files split many ways) the shard is empty and an error is
+// returned so the client gets 416.
+func parseShard(spec string, size int64) (idx, count int, rng byteRange, err error) {
+	rawIdx, rawCount, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, rng, fmt.Errorf("shard must be i/n")
+	}
+	idx, err1 := strconv.Atoi(rawIdx)
+	count, err2 := strconv.Atoi(rawCount)
+	if err1 != nil || err2 != nil || count < 1 || count > maxShardCount || idx < 1 || idx > count {
+		return 0, 0, rng, fmt.Errorf("shard must be i/n with 1 <= i <= n <= %d", maxShardCount)
+	}
+
+	shardSize := (size + int64(count) - 1) / int64(count)
+	start := int64(idx-1) * shardSize
+	if start >= size {
+		return idx, count, rng, errEmptyRange
+	}
+	length := shardSize
+	if start+length > size {
+		length = size - start
+	}
+	return idx, count, byteRange{Start: start, Length: length}, nil
+}
+
+// parseRange parses a Range header holding a single byte range ("bytes=a-b",
+// "bytes=a-" or the suffix form "bytes=-n") against a file of size bytes. The
+// end is clamped to the file. A range starting past the end yields
+// errEmptyRange (416); other errors, including multiple ranges, mean the
+// header should be ignored.
+func parseRange(header string, size int64) (byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return byteRange{}, fmt.Errorf("unsupported range unit")
+	}
+	if strings.Contains(spec, ",") {
+		return byteRange{}, fmt.Errorf("multiple ranges are not supported")
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return byteRange{}, fmt.Errorf("malformed range %q", spec)
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return byteRange{}, fmt.Errorf("malformed range %q", spec)
+		}
+		if n == 0 || size == 0 {
+			return byteRange{}, errEmptyRange
+		}
+		if n > size {
+			n = size
+		}
+		return byteRange{Start: size - n, Length: n}, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, fmt.Errorf("malformed range %q", spec)
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return byteRange{}, fmt.Errorf("malformed range %q", spec)
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return byteRange{}, errEmptyRange
+	}
+	return byteRange{Start: start, Length: end - start + 1}, nil
+}
+
+// writeRangeNotSatisfiable responds 416 with the file size advertised.
+func writeRangeNotSatisfiable(w http.ResponseWriter, size int64) {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	http.Error(w, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// tokenBucket refills at rate tokens/sec up to burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limitDecision is the outcome of a rate limit check plus the bucket state
+// needed to fill RateLimit-* headers.
+type limitDecision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next token, when denied
+}
+
+// rateLimiter keeps one token bucket per key (client IP, model name, ...).
+// A nil *rateLimiter allows everything.
+type rateLimiter struct {
+	name  string
+	spec  string // as configured
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// rateLimitSet is the limiters in force; each is nil when not configured.
+type rateLimitSet struct {
+	ip    *rateLimiter
+	model *rateLimiter
+	// client limits each caller, keyed by its first principal (API key,
+	// token subject or certificate) or, for anonymous callers, its IP.
+	client *rateLimiter
+	// overrides replace client for individual principals.
+	overrides map[string]*rateLimiter
+}
+
+// rateLimits holds the current set; a reload swaps it whole.
+var rateLimits atomic.Pointer[rateLimitSet]
+
+// limits returns the current limiters.
+func limits() *rateLimitSet {
+	if s := rateLimits.Load(); s != nil {
+		return s
+	}
+	return &rateLimitSet{}
+}
+
+// newRateLimitSet parses the configured limits.
+func newRateLimitSet(c configLimits) (*rateLimitSet, error) {
+	s := &rateLimitSet{}
+	var err error
+	if s.ip, err = parseRateLimit("per-ip", c.RateLimitIP); err != nil {
+		return nil, fmt.Errorf("invalid MODEL_REGISTRY_RATE_LIMIT_IP: %v", err)
+	}
+	if s.model, err = parseRateLimit("per-model", c.RateLimitModel); err != nil {
+		return nil, fmt.Errorf("invalid MODEL_REGISTRY_RATE_LIMIT_MODEL: %v", err)
+	}
+	if s.client, err = parseRateLimit("per-client", c.RateLimitClient); err != nil {
+		return nil, fmt.Errorf("invalid MODEL_REGISTRY_RATE_LIMIT_CLIENT: %v", err)
+	}
+	// Per-client overrides as "principal=rate[:burst]", e.g. key:scraper=1:5
+	if s.overrides, err = parseRateOverrides(c.RateLimitOverrides); err != nil {
+		return nil, fmt.Errorf("invalid MODEL_REGISTRY_RATE_LIMIT_OVERRIDES: %v", err)
+	}
+	return s, nil
+}
+
+// clientLimited reports whether any per-client limit is set.
+func (s *rateLimitSet) clientLimited() bool {
+	return s.client != nil || len(s.overrides) > 0
+}
+
+// all returns the configured limiters.
+func (s *rateLimitSet) all() []*rateLimiter {
+	var out []*rateLimiter
+	for _, l := range append([]*rateLimiter{s.ip, s.model, s.client}, slices.Collect(maps.Values(s.overrides))...) {
+		if l != nil {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// keep takes over the limiters of old whose spec didn't change, so a
+// reload doesn't refill every bucket, and reports whether any limit
+// changed.
+func (s *rateLimitSet) keep(old *rateLimitSet) (changed bool) {
+	same := func(l, o *rateLimiter) *rateLimiter {
+		if l != nil && o != nil && l.spec == o.spec {
+			return o
+		}
+		changed = changed || l != nil || o != nil
+		return l
+	}
+	s.ip, s.model, s.client = same(s.ip, old.ip), same(s.model, old.model), same(s.client, old.client)
+	for p, l := range s.overrides {
+		s.overrides[p] = same(l, old.overrides[p])
+	}
+	for p := range old.overrides {
+		if _, ok := s.overrides[p]; !ok {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// parseRateLimit parses "rate[:burst]" (requests/sec, burst defaults to rate)
+// into a limiter. An empty spec returns nil.
+func parseRateLimit(name, spec string) (*rateLimiter, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	rawRate, rawBurst, hasBurst := strings.Cut(spec, ":")
+	rate, err := strconv.ParseFloat(rawRate, 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("rate must be a positive number, got %q", rawRate)
+	}
+	burst := math.Max(1, math.Ceil(rate))
+	if hasBurst {
+		if burst, err = strconv.ParseFloat(rawBurst, 64); err != nil || burst < 1 {
+			return nil, fmt.Errorf("burst must be >= 1, got %q", rawBurst)
+		}
+	}
+	return &rateLimiter{name: name, spec: spec, rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}, nil
+}
+
+// Allow takes one token from key's bucket.
+func (l *rateLimiter) Allow(key string) limitDecision {
+	if l == nil {
+		return limitDecision{Allowed: true}
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	d := limitDecision{Limit: int(l.burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = secondsDuration((1 - b.tokens) / l.rate)
+	}
+	d.Remaining = int(math.Floor(b.tokens))
+	d.Reset = secondsDuration((l.burst - b.tokens) / l.rate)
+	return d
+}
+
+// prune drops buckets that have refilled completely; they carry no state.
+func (l *rateLimiter) prune() {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// rateLimitJanitor prunes the current limiters every minute.
+func rateLimitJanitor() {
+	for range time.Tick(time.Minute) {
+		for _, l := range limits().all() {
+			l.prune()
+		}
+	}
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// ceilSeconds rounds d up to whole seconds, as the headers require.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// writeRateLimited responds 429 with the draft RateLimit-* headers and
+// Retry-After derived from the bucket state. Every limiter goes through here
+// so throttled responses look the same regardless of which limit tripped.
+func writeRateLimited(w http.ResponseWriter, l *rateLimiter, d limitDecision) {
+	retry := ceilSeconds(d.RetryAfter)
+	if retry < 1 {
+		retry = 1
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", d.Limit, ceilSeconds(secondsDuration(float64(d.Limit)/l.rate))))
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	http.Error(w, fmt.Sprintf("rate limit exceeded (%s)", l.name), http.StatusTooManyRequests)
+}
+
+// clientIP returns the remote IP of r without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ipRateLimitMiddleware applies the per-IP limiter to every routed request
+// except preflights and liveness probes.
+func ipRateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l := limits().ip; l != nil && r.Method != http.MethodOptions && !isProbe(r) {
+			if d := l.Allow(clientIP(r)); !d.Allowed {
+				writeRateLimited(w, l, d)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseRateOverrides parses MODEL_REGISTRY_RATE_LIMIT_OVERRIDES:
+// principal=rate[:burst] pairs, one limiter per principal.
+func parseRateOverrides(spec string) (map[string]*rateLimiter, error) {
+	overrides := map[string]*rateLimiter{}
+	for _, pair := range splitList(spec) {
+		principal, limit, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q (want principal=rate[:burst])", pair)
+		}
+		if err := validatePrincipal(principal); err != nil {
+			return nil, err
+		}
+		l, err := parseRateLimit("per-client", limit)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", principal, err)
+		}
+		if l == nil {
+			return nil, fmt.Errorf("%s: missing rate", principal)
+		}
+		overrides[principal] = l
+	}
+	return overrides, nil
+}
+
+// allowClient takes a token for the caller with principals, connecting from
+// ip, from its override or from the client limiter of s. The limiter is
+// returned for writeRateLimited.
+func (s *rateLimitSet) allowClient(principals []string, ip string) (*rateLimiter, limitDecision) {
+	key := "ip:" + ip
+	if len(principals) > 0 {
+		key = principals[0]
+	}
+	l := s.client
+	if o, ok := s.overrides[key]; ok {
+		l = o
+	}
+	return l, l.Allow(key)
+}
+
+// clientRateLimitMiddleware applies the per-client limits. It runs after
+// authentication so callers are keyed by their credentials rather than by
+// an IP they may share with others.
+func clientRateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s := limits(); s.clientLimited() && r.Method != http.MethodOptions && !isProbe(r) {
+			if l, d := s.allowClient(requestPrincipals(r), clientIP(r)); !d.Allowed {
+				writeRateLimited(w, l, d)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// grpcAllowClient is clientRateLimitMiddleware's check for gRPC calls.
+func grpcAllowClient(ctx context.Context) error {
+	s := limits()
+	if !s.clientLimited() {
+		return nil
+	}
+	var ip string
+	if p, ok := peer.FromContext(ctx); ok {
+		ip = p.Addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+	}
+	if l, d := s.allowClient(grpcPrincipals(ctx), ip); !d.Allowed {
+		return status.Errorf(codes.ResourceExhausted, "rate limit exceeded (%s), retry in %ds", l.name, max(1, ceilSeconds(d.RetryAfter)))
+	}
+	return nil
+}
+
+// grpcRateLimitUnary and grpcRateLimitStream apply the per-client limits to
+// gRPC.
+func grpcRateLimitUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := grpcAllowClient(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcRateLimitStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := grpcAllowClient(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestWriteRateLimited(t *testing.T) {
+	l, err := parseRateLimit("per-model", "1:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Allow("m")
+	l.Allow("m")
+	d := l.Allow("m")
+	if d.Allowed {
+		t.Fatal("third request within the burst of 2 was allowed")
+	}
+
+	w := httptest.NewRecorder()
+	writeRateLimited(w, l, d)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+	for header, want := range map[string]string{
+		"RateLimit-Limit":     "2",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "2",
+		"Retry-After":         "1",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestModelRateLimitSkipsHead(t *testing.T) {
+	dir := newTestRegistry(t)
+	writeTestModel(t, dir, "tiny.gguf", []byte("GGUF"))
+	l, err := parseRateLimit("per-model", "0.001:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := rateLimits.Swap(&rateLimitSet{model: l})
+	t.Cleanup(func() { rateLimits.Store(prev) })
+
+	r := mux.NewRouter()
+	r.HandleFunc("/models/{name}", streamHandler(dir)).Methods(http.MethodGet, http.MethodHead)
+	for i, tc := range []struct {
+		method string
+		want   int
+	}{
+		{http.MethodHead, http.StatusOK},
+		{http.MethodHead, http.StatusOK},
+		{http.MethodGet, http.StatusOK},
+		{http.MethodHead, http.StatusOK},
+		{http.MethodGet, http.StatusTooManyRequests},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tc.method, "/models/tiny.gguf", nil))
+		if w.Code != tc.want {
+			t.Errorf("request %d (%s): status = %d, want %d", i, tc.method, w.Code, tc.want)
+		}
+	}
+}
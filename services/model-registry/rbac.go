@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Role-based access control. Every credential maps to one of three roles:
+// readers list and pull models, publishers also upload and tag them, and
+// admins also delete them and change the registry's configuration (keys,
+// webhooks, quarantine, maintenance). The admin token and admin identities
+// or token roles are admin; API keys carry the role they were created with
+// (reader by default); certificates and tokens matching the publisher lists
+// are publishers; any other authenticated caller, and anonymous callers when
+// authentication isn't required, are readers. Routes are wrapped with the
+// role they need. Until some credential grants more than reader, roles
+// aren't enforced and every caller is admin (the lab default).
+
+// role is a caller's access level; higher roles include the lower ones.
+type role int
+
+const (
+	roleNone role = iota
+	roleReader
+	rolePublisher
+	roleAdmin
+)
+
+var roleNames = map[role]string{roleReader: "reader", rolePublisher: "publisher", roleAdmin: "admin"}
+
+func (ro role) String() string {
+	if name, ok := roleNames[ro]; ok {
+		return name
+	}
+	return "none"
+}
+
+// parseRole parses a role name; "" is reader.
+func parseRole(s string) (role, error) {
+	if s == "" {
+		return roleReader, nil
+	}
+	for ro, name := range roleNames {
+		if name == s {
+			return ro, nil
+		}
+	}
+	return roleNone, fmt.Errorf("unknown role %q (want reader, publisher or admin)", s)
+}
+
+func (ro role) MarshalText() ([]byte, error) { return []byte(ro.String()), nil }
+
+func (ro *role) UnmarshalText(b []byte) (err error) {
+	*ro, err = parseRole(string(b))
+	return err
+}
+
+var (
+	// publisherIdentities are the certificate identities treated as publishers.
+	publisherIdentities map[string]bool
+	// jwtPublisherRoles are the role claims treated as publishers.
+	jwtPublisherRoles map[string]bool
+)
+
+// rolesEnforced reports whether any credential grants more than reader.
+func rolesEnforced() bool {
+	return adminToken != "" || len(adminIdentities) > 0 || len(publisherIdentities) > 0 ||
+		len(jwtAdminRoles) > 0 || len(jwtPublisherRoles) > 0 || apiKeys.Grants(rolePublisher)
+}
+
+// credentialRole is the role granted by a certificate identity, verified
+// token claims and an API key, any of which may be missing.
+func credentialRole(identity string, claims *jwtClaims, key string) role {
+	best := roleNone
+	if identity != "" {
+		best = roleReader
+		if publisherIdentities[identity] {
+			best = rolePublisher
+		}
+		if adminIdentities[identity] {
+			return roleAdmin
+		}
+	}
+	if claims != nil {
+		best = max(best, roleReader)
+		if claims.HasRole(jwtPublisherRoles) {
+			best = max(best, rolePublisher)
+		}
+		if claims.HasRole(jwtAdminRoles) {
+			return roleAdmin
+		}
+	}
+	if _, ro, ok := apiKeys.Lookup(key); ok {
+		best = max(best, ro)
+	}
+	return best
+}
+
+// requestRole is the role of r's caller.
+func requestRole(r *http.Request) role {
+	if !rolesEnforced() {
+		return roleAdmin
+	}
+	if adminTokenMatches(requestAdminToken(r)) {
+		return roleAdmin
+	}
+	ro := credentialRole(requestIdentity(r), requestClaims(r), requestAPIKey(r))
+	if ro == roleNone && !authRequired() {
+		ro = roleReader
+	}
+	return ro
+}
+
+// grpcRole is requestRole for gRPC calls.
+func grpcRole(ctx context.Context) role {
+	if !rolesEnforced() {
+		return roleAdmin
+	}
+	if adminTokenMatches(grpcAdminToken(ctx)) {
+		return roleAdmin
+	}
+	ro := credentialRole(grpcIdentity(ctx), grpcClaims(ctx), grpcAPIKey(ctx))
+	if ro == roleNone && !authRequired() {
+		ro = roleReader
+	}
+	return ro
+}
+
+// requireRole rejects callers below want: 401 when they have no role at
+// all, 403 when theirs is too low.
+func requireRole(want role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		switch got := requestRole(r); {
+		case got == roleNone:
+			http.Error(w, want.String()+" credentials required", http.StatusUnauthorized)
+		case got < want:
+			http.Error(w, fmt.Sprintf("%s role required (caller is %s)", want, got), http.StatusForbidden)
+		default:
+			next(w, r)
+		}
+	}
+}
+
+// requirePublisher guards routes that add or retag models.
+func requirePublisher(next http.HandlerFunc) http.HandlerFunc {
+	return requireRole(rolePublisher, next)
+}
+
+// parseRoleNames parses a comma separated list of names into a set.
+func parseRoleNames(spec string) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range splitList(spec) {
+		names[name] = true
+	}
+	return names
+}
+
+// parseKeyRoles parses MODEL_REGISTRY_API_KEY_ROLES: name=role pairs.
+func parseKeyRoles(spec string) (map[string]role, error) {
+	roles := map[string]role{}
+	for _, pair := range splitList(spec) {
+		name, r, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q (want name=role)", pair)
+		}
+		ro, err := parseRole(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		roles[name] = ro
+	}
+	return roles, nil
+}
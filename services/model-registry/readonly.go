@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Read-only mode. With MODEL_REGISTRY_READ_ONLY (or READ_ONLY) set, every
+// route that would change the registry answers 405 before authentication is
+// looked at, so a public mirror can't be written to even with a leaked admin
+// token. Models still arrive through replication and the caches filled on a
+// download (the origin tier, the Hugging Face mirror), and background jobs
+// such as retention and garbage collection keep running as configured.
+
+// readOnly is set by MODEL_REGISTRY_READ_ONLY.
+var readOnly bool
+
+// readOnlyAllowed are routes taking a mutating method that change nothing
+// stored: flag checks, and notifications that start a replication pass.
+var readOnlyAllowed = map[string]bool{
+	"/flags/verify":       true,
+	"/replication/notify": true,
+}
+
+// mutatingMethod reports whether m is a method routes use for writes.
+func mutatingMethod(m string) bool {
+	switch m {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// readOnlyMiddleware refuses writes in read-only mode. OCI clients get the
+// distribution API's error body.
+func readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !readOnly || !mutatingMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil && readOnlyAllowed[tmpl] {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		if strings.HasPrefix(r.URL.Path, "/v2/") {
+			writeOCIError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "registry is read-only")
+			return
+		}
+		http.Error(w, "registry is read-only", http.StatusMethodNotAllowed)
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Readiness. /healthz only says the process is up; /readyz also checks what
+// serving needs and answers 503 when any check fails, so an orchestrator can
+// stop routing to an instance whose disk filled up or whose bucket went away
+// without restarting it. Checks that don't apply (no bucket, no origin, no
+// JWKS) are left out.
+
+// readyCheckTimeout bounds each check that talks to another system.
+const readyCheckTimeout = 2 * time.Second
+
+// readyProbeName is statted to check that a remote store answers; it
+// doesn't have to exist.
+const readyProbeName = ".readyz-probe"
+
+// minFreeSpace is the disk headroom /readyz requires on MODEL_DIR's
+// filesystem, in bytes or as a percentage of its size.
+type minFreeSpace struct {
+	bytes   uint64
+	percent float64
+}
+
+var readyMinFree minFreeSpace
+
+// parseMinFree parses "<bytes>" or "<percent>%".
+func parseMinFree(spec string) (minFreeSpace, error) {
+	if spec == "" {
+		return minFreeSpace{}, nil
+	}
+	if p, ok := strings.CutSuffix(spec, "%"); ok {
+		pct, err := strconv.ParseFloat(p, 64)
+		if err != nil || pct < 0 || pct >= 100 {
+			return minFreeSpace{}, fmt.Errorf("percentage must be between 0 and 100, got %q", spec)
+		}
+		return minFreeSpace{percent: pct}, nil
+	}
+	n, err := strconv.ParseUint(spec, 10, 64)
+	if err != nil {
+		return minFreeSpace{}, fmt.Errorf("want bytes or a percentage, got %q", spec)
+	}
+	return minFreeSpace{bytes: n}, nil
+}
+
+func (m minFreeSpace) String() string {
+	if m.percent > 0 {
+		return strconv.FormatFloat(m.percent, 'g', -1, 64) + "%"
+	}
+	return strconv.FormatUint(m.bytes, 10) + " bytes"
+}
+
+// readyCheck is the result of one check.
+type readyCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// readyResponse is used by /readyz
+type readyResponse struct {
+	Status string                `json:"status"` // ready or not_ready
+	Time   string                `json:"time"`
+	Checks map[string]readyCheck `json:"checks"`
+}
+
+func checkResult(detail string, err error) readyCheck {
+	if err != nil {
+		return readyCheck{Detail: err.Error()}
+	}
+	return readyCheck{OK: true, Detail: detail}
+}
+
+// checkModelDir checks that dir can be listed.
+func checkModelDir(dir string) readyCheck {
+	f, err := os.Open(dir)
+	if err == nil {
+		_, err = f.Readdirnames(1)
+		f.Close()
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	return checkResult(dir+" is readable", err)
+}
+
+// checkDisk checks the free space on dir's filesystem against readyMinFree.
+func checkDisk(dir string) readyCheck {
+	total, free, err := diskUsage(dir)
+	if err != nil {
+		return checkResult("", err)
+	}
+	detail := fmt.Sprintf("%d of %d bytes free", free, total)
+	low := free < readyMinFree.bytes
+	if readyMinFree.percent > 0 && total > 0 {
+		low = float64(free)*100/float64(total) < readyMinFree.percent
+	}
+	if low {
+		return readyCheck{Detail: detail + ", below the minimum of " + readyMinFree.String()}
+	}
+	return readyCheck{OK: true, Detail: detail}
+}
+
+// checkStorage checks that the primary store answers.
+func checkStorage(ctx context.Context) readyCheck {
+	ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+	defer cancel()
+	_, err := storage.Stat(ctx, readyProbeName)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return checkResult(storageDriver+" storage answers", err)
+}
+
+// checkJWKS checks that signing keys were fetched, without fetching them.
+func checkJWKS(v *jwtVerifier) readyCheck {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.keys) == 0 {
+		return readyCheck{Detail: "no signing keys fetched from " + v.jwksURL}
+	}
+	return readyCheck{OK: true, Detail: fmt.Sprintf("%d signing keys, fetched %s", len(v.keys), v.fetched.UTC().Format(time.RFC3339))}
+}
+
+// readyzHandler runs every check and answers 200 when all pass, 503
+// otherwise. A draining instance is never ready.
+func readyzHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := map[string]readyCheck{
+			"model_dir": checkModelDir(modelDir),
+			"disk":      checkDisk(modelDir),
+		}
+		if remoteStorage() {
+			checks["storage"] = checkStorage(r.Context())
+		}
+		if tier != nil {
+			checks["origin"] = checkModelDir(tier.origin)
+		}
+		if jwtAuth != nil {
+			checks["jwks"] = checkJWKS(jwtAuth)
+		}
+		checks["shutdown"] = readyCheck{OK: true, Detail: "serving"}
+		if draining.Load() {
+			checks["shutdown"] = readyCheck{Detail: "draining for shutdown"}
+		}
+
+		resp := readyResponse{Status: "ready", Time: time.Now().UTC().Format(time.RFC3339), Checks: checks}
+		code := http.StatusOK
+		for _, c := range checks {
+			if !c.OK {
+				resp.Status, code = "not_ready", http.StatusServiceUnavailable
+			}
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, code, resp)
+	}
+}
+
+// isProbe reports whether r is a liveness or readiness probe, which skip
+// authentication, rate limits and chaos.
+func isProbe(r *http.Request) bool {
+	return r.URL.Path == "/healthz" || r.URL.Path == "/readyz"
+}
@@ -0,0 +1,5 @@
+// Package registrypb holds the registry's gRPC API, generated from
+// registry.proto.
+package registrypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative registry.proto
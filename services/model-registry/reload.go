@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reloading. On SIGHUP or POST /admin/reload the config file (and the API
+// keys file) is read again and the settings that don't need the listeners
+// rebuilt are applied: rate limits, model extensions, honeypots, configured
+// webhooks and configured API keys. Everything is parsed before anything changes, so
+// a broken file leaves the running settings alone, and active downloads
+// and connections carry on. Other settings keep their startup values until
+// a restart. Variables in the process environment don't change, so they
+// keep winning over the file.
+
+// configPath is the file named by MODEL_REGISTRY_CONFIG at startup.
+var configPath string
+
+// reloadMu serializes reloads.
+var reloadMu sync.Mutex
+
+// Settings groups a reload reports as changed.
+const (
+	reloadRateLimits = "rate_limits"
+	reloadModelExts  = "model_exts"
+	reloadHoneypots  = "honeypots"
+	reloadWebhooks   = "webhooks"
+	reloadAPIKeys    = "api_keys"
+)
+
+// reloadResponse is the body of POST /admin/reload.
+type reloadResponse struct {
+	Changed []string `json:"changed"`
+	Time    string   `json:"time"`
+}
+
+// reloadConfig rereads the configuration and applies what can change live,
+// returning the groups that changed.
+func reloadConfig() ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	limitSet, err := newRateLimitSet(cfg.Limits)
+	if err != nil {
+		return nil, err
+	}
+	exts, err := parseModelExts(cfg.getenv("MODEL_EXTS", "gguf"))
+	if err != nil {
+		return nil, err
+	}
+	honeypotList, err := parseHoneypots(cfg.getenv("MODEL_REGISTRY_HONEYPOTS", ""))
+	if err != nil {
+		return nil, err
+	}
+	keyPairs, keyRoles, err := configuredAPIKeys(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+	hookURLs := splitList(cfg.getenv("MODEL_REGISTRY_WEBHOOKS", ""))
+	for _, u := range hookURLs {
+		if err := validWebhookURL(u); err != nil {
+			return nil, err
+		}
+	}
+
+	// The stores check what they're given before changing anything, and
+	// the rest can't fail, so an error here still leaves everything as
+	// it was.
+	changed := []string{}
+	keysChanged, err := apiKeys.Reconfigure(keyPairs, keyRoles, cfg.Auth.RequireAPIKey)
+	if err != nil {
+		return nil, err
+	}
+	if keysChanged {
+		changed = append(changed, reloadAPIKeys)
+	}
+	if hooksChanged, _ := webhooks.Reconfigure(hookURLs, cfg.getenv("MODEL_REGISTRY_WEBHOOK_SECRET", "")); hooksChanged {
+		changed = append(changed, reloadWebhooks)
+	}
+	if limitSet.keep(limits()) {
+		changed = append(changed, reloadRateLimits)
+	}
+	rateLimits.Store(limitSet)
+	if !slices.Equal(exts, modelExts()) {
+		modelExtensions.Store(&exts)
+		changed = append(changed, reloadModelExts)
+	}
+	if !slices.Equal(honeypotList, honeypots()) {
+		honeypotPatterns.Store(&honeypotList)
+		changed = append(changed, reloadHoneypots)
+	}
+	return changed, nil
+}
+
+// reload runs reloadConfig for trigger and logs the outcome.
+func reload(trigger string) ([]string, error) {
+	changed, err := reloadConfig()
+	if err != nil {
+		log.Printf("[registry] %s: configuration not reloaded: %v", trigger, err)
+		return nil, err
+	}
+	if len(changed) == 0 {
+		log.Printf("[registry] %s: configuration reloaded, nothing changed", trigger)
+	} else {
+		log.Printf("[registry] %s: configuration reloaded, changed %s", trigger, strings.Join(changed, ", "))
+	}
+	return changed, nil
+}
+
+// reloadHandler serves POST /admin/reload.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	changed, err := reload("POST /admin/reload")
+	if err != nil {
+		http.Error(w, "invalid configuration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, reloadResponse{Changed: changed, Time: time.Now().UTC().Format(time.RFC3339)})
+}
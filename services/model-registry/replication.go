@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replication. A registry started with MODEL_REGISTRY_REPLICATION_SOURCE
+// keeps a copy of another registry's models, for a DR site or a second
+// region. Every MODEL_REGISTRY_REPLICATION_INTERVAL it asks the source's
+// /changes what happened since the last pass and, when anything did, reads
+// its /manifest and copies the models that are new or changed. The source
+// can also push: one of its webhooks pointed at POST /replication/notify
+// starts a pass right away. A copy is checked against the SHA-256 the
+// source's manifest reports and then published like an upload (quota,
+// quarantine, blob store, events). Only model files are replicated; tags,
+// ACLs, pins and cards belong to each registry.
+
+const (
+	defaultReplicationInterval = time.Minute
+	replicationHeaderTimeout   = 30 * time.Second
+)
+
+var (
+	replicationCopied = metrics.Counter("replication_copied_models_total", "Models copied from the replication source by backend", "backend")
+	replicationBytes  = metrics.Counter("replication_copied_bytes_total", "Bytes copied from the replication source by backend", "backend")
+	replicationErrors = metrics.Counter("replication_errors_total", "Failed replication steps by reason", "reason")
+)
+
+// errReplicaBusy is returned when an upload of the model is in progress here.
+var errReplicaBusy = errors.New("an upload of this model is in progress")
+
+// replicaState is what a replica remembers between passes, kept in
+// .registry/replication.json.
+type replicaState struct {
+	Source  string            `json:"source"`
+	Version string            `json:"version,omitempty"` // source catalog version last brought in fully
+	Models  map[string]string `json:"models"`            // name -> SHA-256 of the copies made here
+}
+
+// replicationIssue is a model a pass couldn't bring in line.
+type replicationIssue struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// replicationResult is one pass, used by /admin/replication.
+type replicationResult struct {
+	Time     time.Time          `json:"time"`
+	Duration string             `json:"duration"`
+	Full     bool               `json:"full"`              // read the whole manifest
+	Version  string             `json:"version,omitempty"` // source catalog version seen
+	Copied   []string           `json:"copied"`
+	Bytes    int64              `json:"bytes"`
+	Removed  []string           `json:"removed"`
+	Pending  []string           `json:"pending,omitempty"` // the source hasn't hashed them yet
+	Skipped  []replicationIssue `json:"skipped,omitempty"` // left alone until an admin steps in
+	Errors   []replicationIssue `json:"errors,omitempty"`  // retried on the next pass
+	Error    string             `json:"error,omitempty"`   // the source couldn't be read
+}
+
+// complete reports whether the pass brought everything the source lists.
+func (res *replicationResult) complete() bool {
+	return res.Error == "" && len(res.Errors) == 0 && len(res.Pending) == 0
+}
+
+// replicator copies models from the source, one pass at a time.
+type replicator struct {
+	source    string // base URL, without a trailing slash
+	token     string
+	secret    string // checks X-Registry-Signature on /replication/notify
+	modelDir  string
+	prune     bool // MODEL_REGISTRY_REPLICATION_DELETE
+	statePath string
+	client    *http.Client
+	kick      chan struct{}
+	started   time.Time
+
+	run    sync.Mutex
+	mu     sync.Mutex
+	state  replicaState
+	last   *replicationResult
+	synced time.Time // end of the last complete pass
+}
+
+// replication is the replicator, or nil when this registry isn't a replica.
+var replication *replicator
+
+func newReplicator(modelDir, source, token, secret string, prune bool) (*replicator, error) {
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an http or https URL", source)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = replicationHeaderTimeout
+	p := &replicator{
+		source:    strings.TrimSuffix(source, "/"),
+		token:     token,
+		secret:    secret,
+		modelDir:  modelDir,
+		prune:     prune,
+		statePath: filepath.Join(modelDir, stateDirName, "replication.json"),
+		client:    &http.Client{Transport: traceTransport(transport)},
+		kick:      make(chan struct{}, 1),
+		started:   time.Now(),
+	}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// load reads the saved state. State saved for another source is dropped:
+// the copies stay, but they are no longer the replica's to update or remove.
+func (p *replicator) load() error {
+	p.state = replicaState{Source: p.source, Models: map[string]string{}}
+	data, err := os.ReadFile(p.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st replicaState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("%s: %w", p.statePath, err)
+	}
+	if st.Source != p.source {
+		log.Printf("[registry] replication source changed from %s: starting over", st.Source)
+		return nil
+	}
+	if st.Models == nil {
+		st.Models = map[string]string{}
+	}
+	p.state = st
+	return nil
+}
+
+func (p *replicator) save() error {
+	p.mu.Lock()
+	data, err := json.Marshal(p.state)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.statePath), 0o755); err != nil {
+		return err
+	}
+	tmp := p.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.statePath)
+}
+
+// Notify asks for a pass as soon as the current one, if any, is done.
+func (p *replicator) Notify() {
+	select {
+	case p.kick <- struct{}{}:
+	default:
+	}
+}
+
+// loop runs a full pass at once, since models may have changed here while
+// the replica was down, then a pass every interval and on Notify.
+func (p *replicator) loop(every time.Duration) {
+	var tick <-chan time.Time
+	if every > 0 {
+		tick = time.NewTicker(every).C
+	}
+	p.Sync(context.Background(), true)
+	for {
+		select {
+		case <-tick:
+		case <-p.kick:
+		}
+		p.Sync(context.Background(), false)
+	}
+}
+
+// Sync brings the replica in line with the source. Without full, the
+// manifest is only read when /changes reports something since the last
+// complete pass.
+func (p *replicator) Sync(ctx context.Context, full bool) *replicationResult {
+	p.run.Lock()
+	defer p.run.Unlock()
+	start := time.Now()
+	res := &replicationResult{Time: start.UTC(), Copied: []string{}, Removed: []string{}}
+	if err := p.sync(ctx, full, res); err != nil {
+		res.Error = err.Error()
+		replicationErrors.Inc("source")
+		log.Printf("[registry] replication: unable to read %s: %v", p.source, err)
+	}
+	res.Duration = time.Since(start).Round(time.Millisecond).String()
+	if err := p.save(); err != nil {
+		log.Printf("[registry] replication: unable to save state: %v", err)
+	}
+
+	p.mu.Lock()
+	p.last = res
+	if res.complete() {
+		p.synced = time.Now()
+	}
+	p.mu.Unlock()
+	if len(res.Copied)+len(res.Removed) > 0 {
+		log.Printf("[registry] replication: copied %d models (%d bytes), removed %d", len(res.Copied), res.Bytes, len(res.Removed))
+	}
+	return res
+}
+
+func (p *replicator) sync(ctx context.Context, full bool, res *replicationResult) error {
+	p.mu.Lock()
+	since := p.state.Version
+	p.mu.Unlock()
+	if since != "" && !full {
+		var ch changesResponse
+		if err := p.getJSON(ctx, "/changes?since="+url.QueryEscape(since), &ch); err != nil {
+			return err
+		}
+		if !ch.Resync && len(ch.Changes) == 0 {
+			res.Version = ch.Version
+			p.setVersion(ch.Version)
+			return nil
+		}
+	}
+
+	res.Full = true
+	entries, version, err := p.manifest(ctx)
+	if err != nil {
+		return err
+	}
+	res.Version = version
+	listed := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		listed[e.Name] = true
+		p.replicate(ctx, e, res)
+	}
+	p.removeGone(ctx, listed, res)
+	if res.complete() {
+		p.setVersion(version)
+	}
+	return nil
+}
+
+// replicate copies the model of one manifest entry unless the replica has
+// it already. Versioned models are listed by their newest version, which is
+// the one copied.
+func (p *replicator) replicate(ctx context.Context, e manifestEntry, res *replicationResult) {
+	name := e.Name
+	if e.Version != "" {
+		name += versionSep + e.Version
+	}
+	want := e.Digests[algoSHA256]
+	if want == "" {
+		res.Pending = append(res.Pending, name)
+		return
+	}
+	ref, err := parseModelRef(nil, p.modelDir, name)
+	if err != nil {
+		res.Skipped = append(res.Skipped, replicationIssue{Name: name, Reason: err.Error()})
+		return
+	}
+
+	p.mu.Lock()
+	copied := p.state.Models[name]
+	p.mu.Unlock()
+	if _, err := statModel(ctx, ref); err == nil {
+		var local string
+		if meta, err := sidecars.Get(ref.Name); err == nil {
+			local = meta.Sha256
+		}
+		switch {
+		case local == want:
+			p.track(name, want) // an identical model uploaded here counts as a copy
+			return
+		case copied == "" || copied != local:
+			res.Skipped = append(res.Skipped, replicationIssue{Name: name, Reason: "differs from a model uploaded to this registry"})
+			return
+		}
+	}
+
+	size, err := p.copy(ctx, ref, name, e.Size, want)
+	if err != nil {
+		log.Printf("[registry] replication: unable to copy %s: %v", name, err)
+		res.Errors = append(res.Errors, replicationIssue{Name: name, Reason: err.Error()})
+		return
+	}
+	p.track(name, want)
+	res.Copied = append(res.Copied, name)
+	res.Bytes += size
+	replicationCopied.Inc(ref.Backend)
+	replicationBytes.Add(float64(size), ref.Backend)
+}
+
+// copy downloads name from the source and publishes it at ref once its
+// SHA-256 is want.
+func (p *replicator) copy(ctx context.Context, ref modelRef, name string, size int64, want string) (int64, error) {
+	if !writes.Begin(ref.Name) {
+		replicationErrors.Inc("busy")
+		return 0, errReplicaBusy
+	}
+	defer writes.End(ref.Name)
+	release, err := quotas.Reserve(ctx, ref, size)
+	if err != nil {
+		replicationErrors.Inc("quota")
+		return 0, err
+	}
+	defer release()
+
+	path := modelURLPath(name)
+	resp, err := p.get(ctx, path)
+	if err != nil {
+		replicationErrors.Inc("fetch")
+		return 0, err
+	}
+	defer resp.Body.Close()
+	dst := ref.Path()
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		replicationErrors.Inc("store")
+		return 0, err
+	}
+	body, err := spoolBody(resp.Body, spoolThreshold, filepath.Dir(dst), nil)
+	if err != nil {
+		replicationErrors.Inc("fetch")
+		return 0, err
+	}
+	if body.Sha256 != want {
+		body.Discard()
+		replicationErrors.Inc("digest")
+		return 0, fmt.Errorf("content hashes to %s, source reported %s", body.Sha256, want)
+	}
+	st, key := storageFor(ref)
+	if err := st.Put(ctx, key, body); err != nil {
+		replicationErrors.Inc("store")
+		return 0, err
+	}
+	// publishModel describes the request an upload came in on; a copy is
+	// described as the request to the source, so events name it as the
+	// client.
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.source+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.RemoteAddr = req.URL.Host
+	if _, _, err := publishModel(req, ref, body.Sha256, nil); err != nil {
+		replicationErrors.Inc("store")
+		return 0, err
+	}
+	return body.Size, nil
+}
+
+// removeGone forgets copies deleted here and, with
+// MODEL_REGISTRY_REPLICATION_DELETE, deletes the copies of models the source
+// no longer lists. Older versions of a model the source still lists are
+// kept.
+func (p *replicator) removeGone(ctx context.Context, listed map[string]bool, res *replicationResult) {
+	p.mu.Lock()
+	names := make([]string, 0, len(p.state.Models))
+	for name := range p.state.Models {
+		names = append(names, name)
+	}
+	p.mu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		ref, err := parseModelRef(nil, p.modelDir, name)
+		if err != nil {
+			p.untrack(name)
+			continue
+		}
+		info, err := statModel(ctx, ref)
+		if err != nil {
+			p.untrack(name)
+			continue
+		}
+		if base, _, _ := strings.Cut(name, versionSep); listed[base] || !p.prune {
+			continue
+		}
+		resp, err := deleteModel(ctx, ref, info, "", map[string]any{"reason": "replication"})
+		switch {
+		case err != nil:
+			replicationErrors.Inc("delete")
+			res.Errors = append(res.Errors, replicationIssue{Name: name, Reason: err.Error()})
+		case !resp.Deleted:
+			res.Skipped = append(res.Skipped, replicationIssue{Name: name, Reason: resp.Reason})
+		default:
+			p.untrack(name)
+			res.Removed = append(res.Removed, name)
+		}
+	}
+}
+
+func (p *replicator) track(name, sum string) {
+	p.mu.Lock()
+	p.state.Models[name] = sum
+	p.mu.Unlock()
+}
+
+func (p *replicator) untrack(name string) {
+	p.mu.Lock()
+	delete(p.state.Models, name)
+	p.mu.Unlock()
+}
+
+func (p *replicator) setVersion(v string) {
+	p.mu.Lock()
+	p.state.Version = v
+	p.mu.Unlock()
+}
+
+// get requests path from the source, failing on anything but 200.
+func (p *replicator) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.source+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: source answered %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (p *replicator) getJSON(ctx context.Context, path string, v any) error {
+	resp, err := p.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// manifest reads the source's /manifest and the catalog version it belongs
+// to.
+func (p *replicator) manifest(ctx context.Context) ([]manifestEntry, string, error) {
+	resp, err := p.get(ctx, "/manifest?algo="+algoSHA256)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var entries []manifestEntry
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e manifestEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", fmt.Errorf("manifest: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, resp.Header.Get(catalogVersionHeader), nil
+}
+
+// modelURLPath is the download path of name, escaped segment by segment.
+func modelURLPath(name string) string {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return "/models/" + strings.Join(parts, "/")
+}
+
+// Lag is the time since the last complete pass, or since boot before the
+// first one.
+func (p *replicator) Lag() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.synced.IsZero() {
+		return time.Since(p.started)
+	}
+	return time.Since(p.synced)
+}
+
+// replicationStatus is GET /admin/replication.
+type replicationStatus struct {
+	Source   string             `json:"source"`
+	Version  string             `json:"version,omitempty"` // source catalog version last brought in fully
+	Models   int                `json:"models"`            // copies made here
+	Delete   bool               `json:"delete"`
+	LastSync *time.Time         `json:"last_sync,omitempty"` // end of the last complete pass
+	Lag      string             `json:"lag"`
+	Last     *replicationResult `json:"last,omitempty"`
+}
+
+// replicationStatusHandler serves GET /admin/replication.
+func replicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	p := replication
+	p.mu.Lock()
+	st := replicationStatus{Source: p.source, Version: p.state.Version, Models: len(p.state.Models), Delete: p.prune, Last: p.last}
+	if !p.synced.IsZero() {
+		t := p.synced.UTC()
+		st.LastSync = &t
+	}
+	p.mu.Unlock()
+	st.Lag = p.Lag().Round(time.Second).String()
+	writeJSON(w, http.StatusOK, st)
+}
+
+// replicationSyncHandler serves POST /admin/replication/sync: a pass now,
+// answered with its result. ?full=true reads the whole manifest even when
+// /changes has nothing new, to pick up models deleted or fixed here.
+func replicationSyncHandler(w http.ResponseWriter, r *http.Request) {
+	var full bool
+	if v := r.URL.Query().Get("full"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "full must be true or false", http.StatusBadRequest)
+			return
+		}
+		full = b
+	}
+	writeJSON(w, http.StatusOK, replication.Sync(r.Context(), full))
+}
+
+// replicationNotifyHandler serves POST /replication/notify, the target of a
+// webhook on the source: it starts a pass in the background and answers 202.
+// The delivery must carry a valid X-Registry-Signature for
+// MODEL_REGISTRY_REPLICATION_SECRET, or the caller must be an admin.
+func replicationNotifyHandler(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !isAdmin(r) && !validWebhookSignature(replication.secret, payload, r.Header.Get(webhookSignatureHeader)) {
+		http.Error(w, "admin credentials or a valid "+webhookSignatureHeader+" required", http.StatusUnauthorized)
+		return
+	}
+	replication.Notify()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// validWebhookSignature checks sig, as a webhook delivery signs payload.
+func validWebhookSignature(secret string, payload []byte, sig string) bool {
+	if secret == "" || !strings.HasPrefix(sig, "sha256=") {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(sig, "sha256="))
+	if err != nil {
+		return false
+	}
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write(payload)
+	return hmac.Equal(got, m.Sum(nil))
+}
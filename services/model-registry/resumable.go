@@ -0,0 +1,436 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads.
+//
+// POST /uploads opens a session for a model of Upload-Length bytes, PATCH
+// /uploads/{id} appends chunks at Upload-Offset, and POST
+// /uploads/{id}/finalize publishes the model like POST /models would. The
+// headers follow the tus 1.0 core protocol, so a client that loses its
+// connection asks HEAD /uploads/{id} for the offset and carries on from
+// there. Sessions are files under .registry/uploads and survive restarts.
+const (
+	tusVersion              = "1.0.0"
+	tusChunkType            = "application/offset+octet-stream"
+	defaultUploadSessionTTL = 24 * time.Hour
+)
+
+var uploadSessionID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// uploadSessionTTL is how long a session may sit without a chunk before it
+// is removed.
+var uploadSessionTTL = defaultUploadSessionTTL
+
+// uploadSessionsBusy holds the sessions a request is writing to or
+// finalizing; chunks must not interleave.
+var uploadSessionsBusy = &writeSet{names: map[string]bool{}}
+
+// uploadSession is the persisted state of a resumable upload. The offset is
+// the size of the data file, so bytes written before a crash or a dropped
+// connection count.
+type uploadSession struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"` // qualified, with any @version
+	Length    int64     `json:"length"`
+	Overwrite bool      `json:"overwrite,omitempty"`
+	Part      string    `json:"part"` // data file, on the target backend's filesystem
+	Created   time.Time `json:"created"`
+}
+
+// uploadSessionResponse is used by /uploads
+type uploadSessionResponse struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Offset  int64     `json:"offset"`
+	Length  int64     `json:"length"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+func uploadSessionsDir(modelDir string) string {
+	return filepath.Join(modelDir, stateDirName, "uploads")
+}
+
+// loadUploadSession reads session id along with its current offset and the
+// time of its last chunk.
+func loadUploadSession(modelDir, id string) (*uploadSession, int64, time.Time, error) {
+	if !uploadSessionID.MatchString(id) {
+		return nil, 0, time.Time{}, os.ErrNotExist
+	}
+	b, err := os.ReadFile(filepath.Join(uploadSessionsDir(modelDir), id+".json"))
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	var s uploadSession
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	info, err := os.Stat(s.Part)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	return &s, info.Size(), info.ModTime(), nil
+}
+
+// link is where finalizing links the data for Storage to consume.
+func (s *uploadSession) link() string {
+	return strings.TrimSuffix(s.Part, ".part") + ".finalize"
+}
+
+// remove deletes the session and its data.
+func (s *uploadSession) remove(modelDir string) {
+	os.Remove(s.Part)
+	os.Remove(s.link())
+	os.Remove(filepath.Join(uploadSessionsDir(modelDir), s.ID+".json"))
+}
+
+// sweepUploadSessions removes sessions idle for longer than uploadSessionTTL,
+// and data files whose session is gone, returning what it removed. With
+// dryRun it only reports them.
+func sweepUploadSessions(modelDir string, dryRun bool) []gcItem {
+	dir := uploadSessionsDir(modelDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var swept []gcItem
+	sweep := func(p string) {
+		info, err := os.Stat(p)
+		if err != nil {
+			return
+		}
+		if !dryRun {
+			if err := os.Remove(p); err != nil {
+				return
+			}
+		}
+		swept = append(swept, gcItem{Kind: gcUploadSession, Path: p, Bytes: info.Size()})
+	}
+	cutoff := time.Now().Add(-uploadSessionTTL)
+	sessions := map[string]bool{}
+	for _, e := range entries {
+		if id, ok := strings.CutSuffix(e.Name(), ".json"); ok {
+			sessions[id] = true
+		}
+	}
+	for _, e := range entries {
+		name := e.Name()
+		id, ok := strings.CutSuffix(name, ".json")
+		if !ok {
+			// A data file left by a session that was removed half way
+			id = strings.TrimSuffix(strings.TrimSuffix(name, ".part"), ".finalize")
+			if id != name && !sessions[id] && !uploadSessionsBusy.Has(id) {
+				if info, err := e.Info(); err == nil && info.ModTime().Before(cutoff) {
+					sweep(filepath.Join(dir, name))
+				}
+			}
+			continue
+		}
+		if uploadSessionsBusy.Has(id) {
+			continue
+		}
+		s, _, last, err := loadUploadSession(modelDir, id)
+		if err != nil {
+			if info, err := e.Info(); err == nil && info.ModTime().Before(cutoff) {
+				sweep(filepath.Join(dir, name))
+			}
+			continue
+		}
+		if last.Before(cutoff) {
+			if !dryRun {
+				log.Printf("[registry] upload session %s for %s expired", id, s.Name)
+			}
+			sweep(s.Part)
+			sweep(s.link())
+			sweep(filepath.Join(dir, name))
+		}
+	}
+	return swept
+}
+
+// uploadMetadata decodes a tus Upload-Metadata header ("key base64,...").
+func uploadMetadata(h string) map[string]string {
+	out := map[string]string{}
+	for _, pair := range splitList(h) {
+		key, val, _ := strings.Cut(pair, " ")
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(val))
+		if err == nil {
+			out[key] = string(b)
+		}
+	}
+	return out
+}
+
+// writeUploadSession sets the tus headers for s at offset and, except for
+// HEAD, writes it as JSON.
+func writeUploadSession(w http.ResponseWriter, r *http.Request, status int, s *uploadSession, offset int64, last time.Time) {
+	expires := last.Add(uploadSessionTTL).UTC()
+	h := w.Header()
+	h.Set("Tus-Resumable", tusVersion)
+	h.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	h.Set("Upload-Length", strconv.FormatInt(s.Length, 10))
+	h.Set("Upload-Expires", expires.Format(http.TimeFormat))
+	h.Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, status, uploadSessionResponse{
+		ID:      s.ID,
+		Name:    s.Name,
+		Offset:  offset,
+		Length:  s.Length,
+		Created: s.Created,
+		Expires: expires,
+	})
+}
+
+// createUploadSessionHandler opens a session. The model is named by ?name=
+// (or the filename in Upload-Metadata), with the ?version= and ?overwrite=
+// of POST /models, and its size is the Upload-Length header.
+func createUploadSessionHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length <= 0 {
+			http.Error(w, "Upload-Length must be the model size in bytes", http.StatusBadRequest)
+			return
+		}
+		if maxUploadSize > 0 && length > maxUploadSize {
+			http.Error(w, "upload exceeds "+strconv.FormatInt(maxUploadSize, 10)+" bytes", http.StatusRequestEntityTooLarge)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = filepath.Base(uploadMetadata(r.Header.Get("Upload-Metadata"))["filename"])
+		}
+		overwrite, _ := strconv.ParseBool(r.URL.Query().Get("overwrite"))
+		private, _ := strconv.ParseBool(r.URL.Query().Get("private"))
+		ref, code, err := uploadTarget(r, modelDir, name, r.URL.Query().Get("version"), overwrite, private)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		if err := quotas.Check(r.Context(), ref, length); err != nil {
+			writeQuotaError(w, ref, err)
+			return
+		}
+
+		sweepUploadSessions(modelDir, false)
+		var raw [16]byte
+		if _, err := rand.Read(raw[:]); err != nil {
+			http.Error(w, "unable to start upload", http.StatusInternalServerError)
+			return
+		}
+		s := &uploadSession{
+			ID:        hex.EncodeToString(raw[:]),
+			Name:      ref.Name,
+			Length:    length,
+			Overwrite: overwrite,
+			Created:   time.Now().UTC(),
+		}
+		s.Part = filepath.Join(uploadSessionsDir(ref.Dir), s.ID+".part")
+		b, _ := json.MarshalIndent(s, "", "  ")
+		err = os.MkdirAll(uploadSessionsDir(ref.Dir), 0o755)
+		if err == nil {
+			err = os.MkdirAll(uploadSessionsDir(modelDir), 0o755)
+		}
+		if err == nil {
+			err = os.WriteFile(s.Part, nil, 0o644)
+		}
+		if err == nil {
+			err = os.WriteFile(filepath.Join(uploadSessionsDir(modelDir), s.ID+".json"), b, 0o644)
+		}
+		if err != nil {
+			s.remove(modelDir)
+			log.Printf("[registry] unable to start upload of %s: %v", ref.Name, err)
+			http.Error(w, "unable to start upload", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[registry] upload session %s started for %s (%d bytes)", s.ID, s.Name, s.Length)
+		w.Header().Set("Location", "/uploads/"+s.ID)
+		writeUploadSession(w, r, http.StatusCreated, s, 0, time.Now())
+	}
+}
+
+// uploadSessionHandler reports a session's progress; HEAD is the tus way of
+// asking where to resume.
+func uploadSessionHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, offset, last, err := loadUploadSession(modelDir, mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "upload not found", http.StatusNotFound)
+			return
+		}
+		writeUploadSession(w, r, http.StatusOK, s, offset, last)
+	}
+}
+
+// patchUploadSessionHandler appends the body at Upload-Offset, which must be
+// the session's current offset. Whatever arrives before a dropped
+// connection is kept.
+func patchUploadSessionHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !uploadSessionsBusy.Begin(id) {
+			http.Error(w, "another request is writing to this upload", http.StatusConflict)
+			return
+		}
+		defer uploadSessionsBusy.End(id)
+		s, offset, last, err := loadUploadSession(modelDir, id)
+		if err != nil {
+			http.Error(w, "upload not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if ct := r.Header.Get("Content-Type"); ct != tusChunkType {
+			http.Error(w, "Content-Type must be "+tusChunkType, http.StatusUnsupportedMediaType)
+			return
+		}
+		if got, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64); err != nil || got != offset {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			http.Error(w, fmt.Sprintf("Upload-Offset must be %d", offset), http.StatusConflict)
+			return
+		}
+		remaining := s.Length - offset
+		if r.ContentLength > remaining {
+			http.Error(w, fmt.Sprintf("chunk runs past Upload-Length (%d bytes left)", remaining), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		f, err := os.OpenFile(s.Part, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			log.Printf("[registry] upload session %s: %v", id, err)
+			http.Error(w, "unable to store chunk", http.StatusInternalServerError)
+			return
+		}
+		n, err := f.ReadFrom(http.MaxBytesReader(w, r.Body, remaining))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		offset += n
+		if err != nil {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, fmt.Sprintf("chunk runs past Upload-Length (%d bytes left)", remaining), http.StatusRequestEntityTooLarge)
+				return
+			}
+			log.Printf("[registry] upload session %s: chunk interrupted at %d: %v", id, offset, err)
+			http.Error(w, "unable to store chunk", http.StatusInternalServerError)
+			return
+		}
+		last = time.Now()
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Expires", last.Add(uploadSessionTTL).UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// finalizeUploadSessionHandler publishes a complete session through the
+// same checks and storage path as POST /models, signature header included.
+// When that fails for a reason the client can fix (a bad signature, a
+// conflict) the session is kept for another try.
+func finalizeUploadSessionHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !uploadSessionsBusy.Begin(id) {
+			http.Error(w, "another request is writing to this upload", http.StatusConflict)
+			return
+		}
+		defer uploadSessionsBusy.End(id)
+		s, offset, _, err := loadUploadSession(modelDir, id)
+		if err != nil {
+			http.Error(w, "upload not found", http.StatusNotFound)
+			return
+		}
+		if offset != s.Length {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			http.Error(w, fmt.Sprintf("upload is incomplete: %d of %d bytes", offset, s.Length), http.StatusConflict)
+			return
+		}
+		// The session name is already qualified; a backend header on this
+		// request must not move it.
+		r.Header.Del(backendHeader)
+		ref, code, err := uploadTarget(r, modelDir, s.Name, "", s.Overwrite, false)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		name := ref.Name
+		if !writes.Begin(name) {
+			http.Error(w, "an upload of this model is already in progress", http.StatusConflict)
+			return
+		}
+		defer writes.End(name)
+
+		// Storage consumes the body, so it gets a second link to the data and
+		// the session only goes once the model is stored.
+		data, link := s.Part, s.link()
+		os.Remove(link)
+		if os.Link(s.Part, link) == nil {
+			data = link
+		}
+		f, err := os.Open(data)
+		if err != nil {
+			log.Printf("[registry] upload session %s: %v", id, err)
+			http.Error(w, "unable to read upload", http.StatusInternalServerError)
+			return
+		}
+		var sigHash hash.Hash
+		if uploadVerifier != nil {
+			sigHash = uploadVerifier.NewHash()
+		}
+		checksumSlots <- struct{}{}
+		body, err := spoolFile(f, sigHash)
+		<-checksumSlots
+		if err != nil {
+			log.Printf("[registry] upload session %s: %v", id, err)
+			http.Error(w, "unable to read upload", http.StatusInternalServerError)
+			return
+		}
+		if storeUpload(w, r, ref, body) || data == s.Part {
+			s.remove(modelDir)
+			log.Printf("[registry] upload session %s finished", id)
+		}
+	}
+}
+
+// deleteUploadSessionHandler abandons a session (tus termination).
+func deleteUploadSessionHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !uploadSessionsBusy.Begin(id) {
+			http.Error(w, "another request is writing to this upload", http.StatusConflict)
+			return
+		}
+		defer uploadSessionsBusy.End(id)
+		s, _, _, err := loadUploadSession(modelDir, id)
+		if err != nil {
+			http.Error(w, "upload not found", http.StatusNotFound)
+			return
+		}
+		s.remove(modelDir)
+		log.Printf("[registry] upload session %s for %s abandoned", id, s.Name)
+		w.Header().Set("Tus-Resumable", tusVersion)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retention policies. Two rules purge models for good:
+//
+//	keep_versions  a versioned model keeps only its N newest versions
+//	max_idle       a model nobody uploaded or downloaded for this long goes
+//
+// MODEL_REGISTRY_RETENTION_KEEP_VERSIONS and MODEL_REGISTRY_RETENTION_MAX_IDLE
+// set them for every model; PUT /models/{name}/retention overrides them for
+// one, or exempts it. The scheduler applies them every
+// MODEL_REGISTRY_RETENTION_INTERVAL, and GET /admin/retention reports what a
+// run would purge right now. Pinned models are left out. Purging goes
+// through the same path as DELETE, so models in use and tagged versions are
+// skipped, not forced.
+
+const (
+	defaultRetentionInterval = time.Hour
+	lastUseFileName          = "last-use.json"
+)
+
+// retentionPurged counts purged models by rule.
+var retentionPurged = metrics.Counter("retention_purged_total", "Models purged by retention policies by rule", "rule")
+
+// Retention rules.
+const (
+	ruleKeepVersions = "keep_versions"
+	ruleMaxIdle      = "max_idle"
+)
+
+// retentionOverride is the per-model policy, kept in the sidecar of the
+// base name. Unset fields fall back to the global rules; zero turns a rule
+// off for the model.
+type retentionOverride struct {
+	KeepVersions *int    `json:"keep_versions,omitempty"`
+	MaxIdle      *string `json:"max_idle,omitempty"` // Go duration, e.g. "720h"
+	Exempt       bool    `json:"exempt,omitempty"`
+}
+
+func (o *retentionOverride) validate() error {
+	if o.KeepVersions != nil && *o.KeepVersions < 0 {
+		return fmt.Errorf("keep_versions must be 0 (keep all) or more")
+	}
+	if o.MaxIdle != nil {
+		if d, err := time.ParseDuration(*o.MaxIdle); err != nil || d < 0 {
+			return fmt.Errorf("max_idle must be a duration such as 720h, or 0 for never")
+		}
+	}
+	return nil
+}
+
+// retentionRules is the effective policy of a model.
+type retentionRules struct {
+	KeepVersions int           // 0 keeps every version
+	MaxIdle      time.Duration // 0 never purges idle models
+	Exempt       bool
+}
+
+// retentionRulesView is retentionRules in responses.
+type retentionRulesView struct {
+	KeepVersions int    `json:"keep_versions"`
+	MaxIdle      string `json:"max_idle"`
+	Exempt       bool   `json:"exempt"`
+}
+
+func (r retentionRules) view() retentionRulesView {
+	return retentionRulesView{KeepVersions: r.KeepVersions, MaxIdle: r.MaxIdle.String(), Exempt: r.Exempt}
+}
+
+// retentionPolicy holds the global rules and runs one purge at a time.
+type retentionPolicy struct {
+	modelDir string
+	rules    retentionRules // global; Exempt is unused
+	exempt   []string       // MODEL_REGISTRY_RETENTION_EXEMPT globs
+	dryRun   bool           // MODEL_REGISTRY_RETENTION_DRY_RUN, for scheduled runs
+
+	run  sync.Mutex
+	mu   sync.Mutex
+	last *retentionReport
+}
+
+// retention is the retention policy, always set; without rules it purges
+// nothing.
+var retention *retentionPolicy
+
+func newRetentionPolicy(modelDir string, keepVersions int, maxIdle time.Duration, exempt []string, dryRun bool) *retentionPolicy {
+	return &retentionPolicy{
+		modelDir: modelDir,
+		rules:    retentionRules{KeepVersions: keepVersions, MaxIdle: maxIdle},
+		exempt:   exempt,
+		dryRun:   dryRun,
+	}
+}
+
+// Rules returns the effective policy of the model base.
+func (p *retentionPolicy) Rules(base string) (retentionRules, *retentionOverride) {
+	rules := p.rules
+	rules.Exempt = matchAny(p.exempt, base) || isHoneypot(base)
+	meta, _ := sidecars.Get(base)
+	o := meta.Retention
+	if o != nil {
+		if o.KeepVersions != nil {
+			rules.KeepVersions = *o.KeepVersions
+		}
+		if o.MaxIdle != nil {
+			rules.MaxIdle, _ = time.ParseDuration(*o.MaxIdle)
+		}
+		rules.Exempt = rules.Exempt || o.Exempt
+	}
+	return rules, o
+}
+
+// retentionItem is a model a rule selected.
+type retentionItem struct {
+	Name     string     `json:"name"`
+	Size     int64      `json:"size"`
+	Rule     string     `json:"rule"`
+	Reason   string     `json:"reason"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// retentionReport is one run, used by /admin/retention.
+type retentionReport struct {
+	Time     time.Time       `json:"time"`
+	DryRun   bool            `json:"dry_run"`
+	Duration string          `json:"duration"`
+	Purged   []retentionItem `json:"purged"` // or would be, on a dry run
+	Bytes    int64           `json:"bytes"`
+	Skipped  []retentionItem `json:"skipped"` // selected but in use, tagged or failing
+	Errors   []string        `json:"errors,omitempty"`
+}
+
+// Plan reports what a run would purge now. Tagged versions are reported as
+// skipped; models in use at the time of the run will be too.
+func (p *retentionPolicy) Plan(ctx context.Context) *retentionReport {
+	start := time.Now()
+	rep := &retentionReport{Time: start.UTC(), DryRun: true, Purged: []retentionItem{}, Skipped: []retentionItem{}}
+	candidates, errs := p.candidates(ctx, start)
+	rep.Errors = errs
+	for _, c := range candidates {
+		if t := tags.TagsOf(c.ref.Base(), c.ref.Version); c.ref.Version != "" && len(t) > 0 {
+			c.item.Reason = "version is tagged " + strings.Join(t, ", ")
+			rep.Skipped = append(rep.Skipped, c.item)
+			continue
+		}
+		rep.Purged = append(rep.Purged, c.item)
+		rep.Bytes += c.item.Size
+	}
+	rep.Duration = time.Since(start).Round(time.Millisecond).String()
+	return rep
+}
+
+// Apply purges what the rules select, or with dryRun only reports it, and
+// keeps the report as the last run.
+func (p *retentionPolicy) Apply(ctx context.Context, dryRun bool) *retentionReport {
+	p.run.Lock()
+	defer p.run.Unlock()
+	if dryRun {
+		rep := p.Plan(ctx)
+		p.mu.Lock()
+		p.last = rep
+		p.mu.Unlock()
+		return rep
+	}
+	start := time.Now()
+	rep := &retentionReport{Time: start.UTC(), Purged: []retentionItem{}, Skipped: []retentionItem{}}
+	candidates, errs := p.candidates(ctx, start)
+	rep.Errors = errs
+	for _, c := range candidates {
+		resp, err := deleteModel(ctx, c.ref, c.info, "", map[string]any{"reason": "retention", "rule": c.item.Rule})
+		switch {
+		case err != nil:
+			log.Printf("[registry] retention: unable to purge %s: %v", c.ref.Name, err)
+			c.item.Reason = err.Error()
+			rep.Skipped = append(rep.Skipped, c.item)
+		case !resp.Deleted:
+			c.item.Reason = resp.Reason
+			rep.Skipped = append(rep.Skipped, c.item)
+		default:
+			log.Printf("[registry] retention: purged %s (%s: %s)", c.ref.Name, c.item.Rule, c.item.Reason)
+			retentionPurged.Inc(c.item.Rule)
+			rep.Purged = append(rep.Purged, c.item)
+			rep.Bytes += c.item.Size
+		}
+	}
+	rep.Duration = time.Since(start).Round(time.Millisecond).String()
+
+	p.mu.Lock()
+	p.last = rep
+	p.mu.Unlock()
+	return rep
+}
+
+// Last returns the latest report, or nil before the first run.
+func (p *retentionPolicy) Last() *retentionReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.last
+}
+
+// janitor applies the policy every interval.
+func (p *retentionPolicy) janitor(every time.Duration) {
+	for range time.Tick(every) {
+		p.Apply(context.Background(), p.dryRun)
+	}
+}
+
+// retentionCandidate is a model to purge.
+type retentionCandidate struct {
+	ref  modelRef
+	info os.FileInfo
+	item retentionItem
+}
+
+// candidates walks every backend and returns the models the rules select,
+// oldest versions first.
+func (p *retentionPolicy) candidates(ctx context.Context, now time.Time) ([]retentionCandidate, []string) {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out []retentionCandidate
+	var errs []string
+	for _, backend := range names {
+		dir := backendDir(backend, p.modelDir)
+		found, err := backendStorage(backend, p.modelDir).List(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("backend %s: %v", backend, err))
+			continue
+		}
+		for _, f := range found {
+			ref := fileRef(backend, dir, f)
+			rules, _ := p.Rules(ref.Base())
+			if rules.Exempt {
+				continue
+			}
+			if f.Version == "" {
+				if pins.Covers(ref.Name) {
+					continue
+				}
+				if c, ok := idleCandidate(ref, f.Info, rules, now); ok {
+					out = append(out, c)
+				}
+				continue
+			}
+			base := modelRef{Backend: ref.Backend, Dir: ref.Dir, File: ref.File, Name: ref.Base()}
+			versions, err := listVersions(dir, f.Name)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", ref.Base(), err))
+				continue
+			}
+			keep := len(versions)
+			if rules.KeepVersions > 0 && rules.KeepVersions < keep {
+				keep = rules.KeepVersions
+			}
+			for i, v := range versions {
+				vref, _ := base.withVersion(v.Version)
+				if pins.Covers(vref.Name) {
+					continue
+				}
+				if i < len(versions)-keep {
+					out = append(out, retentionCandidate{ref: vref, info: v.Info, item: retentionItem{
+						Name: vref.Name, Size: v.Info.Size(), Rule: ruleKeepVersions,
+						Reason: fmt.Sprintf("older than the %d newest versions", keep),
+					}})
+				} else if c, ok := idleCandidate(vref, v.Info, rules, now); ok {
+					out = append(out, c)
+				}
+			}
+		}
+	}
+	return out, errs
+}
+
+// idleCandidate selects ref if its max_idle has passed since it was last
+// uploaded or downloaded.
+func idleCandidate(ref modelRef, info os.FileInfo, rules retentionRules, now time.Time) (retentionCandidate, bool) {
+	if rules.MaxIdle <= 0 {
+		return retentionCandidate{}, false
+	}
+	used := lastUse.LastUsed(ref.Name, info.ModTime())
+	if now.Sub(used) <= rules.MaxIdle {
+		return retentionCandidate{}, false
+	}
+	u := used.UTC()
+	return retentionCandidate{ref: ref, info: info, item: retentionItem{
+		Name: ref.Name, Size: info.Size(), Rule: ruleMaxIdle, LastUsed: &u,
+		Reason: fmt.Sprintf("unused for %s (max %s)", now.Sub(used).Round(time.Minute), rules.MaxIdle),
+	}}, true
+}
+
+// useTracker remembers when each model was last downloaded, for max_idle.
+// Unlike /stats/recent it forgets nothing but deleted models, and it is
+// always persisted, to .registry/last-use.json. Models it has never seen
+// count as used when tracking started, so turning max_idle on doesn't purge
+// everything downloaded before.
+type useTracker struct {
+	mu    sync.Mutex
+	since time.Time
+	used  map[string]time.Time
+	dirty bool
+}
+
+// useFile is the layout of last-use.json.
+type useFile struct {
+	Since time.Time            `json:"since"`
+	Used  map[string]time.Time `json:"used"`
+}
+
+// lastUsePath is where lastUse is persisted.
+func lastUsePath(modelDir string) string {
+	return filepath.Join(modelDir, stateDirName, lastUseFileName)
+}
+
+// lastUse is the download tracker for retention.
+var lastUse = &useTracker{since: time.Now().UTC(), used: map[string]time.Time{}}
+
+// Touch records a download of name.
+func (t *useTracker) Touch(name string) {
+	t.mu.Lock()
+	t.used[name] = time.Now().UTC()
+	t.dirty = true
+	t.mu.Unlock()
+}
+
+// Forget drops a deleted model.
+func (t *useTracker) Forget(name string) {
+	t.mu.Lock()
+	if _, ok := t.used[name]; ok {
+		delete(t.used, name)
+		t.dirty = true
+	}
+	t.mu.Unlock()
+}
+
+// LastUsed is the latest of name's last download, modTime and the start of
+// tracking.
+func (t *useTracker) LastUsed(name string, modTime time.Time) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last := t.since
+	if u := t.used[name]; u.After(last) {
+		last = u
+	}
+	if modTime.After(last) {
+		last = modTime
+	}
+	return last
+}
+
+// Load seeds the tracker from a file written by Save. A missing file is not
+// an error; tracking then starts now.
+func (t *useTracker) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			t.mu.Lock()
+			t.dirty = true // record when tracking started
+			t.mu.Unlock()
+			return nil
+		}
+		return err
+	}
+	var f useFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.since = f.Since
+	for name, at := range f.Used {
+		t.used[name] = at
+	}
+	return nil
+}
+
+// Save writes the tracker to path if anything changed since the last save.
+func (t *useTracker) Save(path string) error {
+	t.mu.Lock()
+	if !t.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+	f := useFile{Since: t.since, Used: make(map[string]time.Time, len(t.used))}
+	for name, at := range t.used {
+		f.Used[name] = at
+	}
+	t.dirty = false
+	t.mu.Unlock()
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// persistLoop periodically flushes the tracker to path.
+func (t *useTracker) persistLoop(path string, every time.Duration) {
+	for range time.Tick(every) {
+		if err := t.Save(path); err != nil {
+			log.Printf("[registry] unable to persist last use: %v", err)
+		}
+	}
+}
+
+// retentionStatus is GET /admin/retention.
+type retentionStatus struct {
+	Rules  retentionRulesView `json:"rules"`
+	Exempt []string           `json:"exempt"`
+	Plan   *retentionReport   `json:"plan"`
+	Last   *retentionReport   `json:"last,omitempty"`
+}
+
+// retentionHandler serves GET /admin/retention: the global rules, what a run
+// would purge now and the last run.
+func retentionHandler(w http.ResponseWriter, r *http.Request) {
+	exempt := retention.exempt
+	if exempt == nil {
+		exempt = []string{}
+	}
+	plan := retention.Plan(r.Context())
+	writeJSON(w, http.StatusOK, retentionStatus{Rules: retention.rules.view(), Exempt: exempt, Plan: plan, Last: retention.Last()})
+}
+
+// applyRetentionHandler serves POST /admin/retention: purge now.
+// ?dry_run=true only reports; without it MODEL_REGISTRY_RETENTION_DRY_RUN
+// decides.
+func applyRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	dryRun := retention.dryRun
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "dry_run must be true or false", http.StatusBadRequest)
+			return
+		}
+		dryRun = b
+	}
+	writeJSON(w, http.StatusOK, retention.Apply(r.Context(), dryRun))
+}
+
+// modelRetentionResponse is used by /models/{name}/retention
+type modelRetentionResponse struct {
+	Name      string             `json:"name"`
+	Effective retentionRulesView `json:"effective"`
+	Override  *retentionOverride `json:"override"`
+}
+
+// modelRetentionHandler returns the effective policy of {name} and its
+// override, if any.
+func modelRetentionHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, ok := aclTarget(w, r, modelDir)
+		if !ok {
+			return
+		}
+		base := ref.Base()
+		rules, o := retention.Rules(base)
+		writeJSON(w, http.StatusOK, modelRetentionResponse{Name: base, Effective: rules.view(), Override: o})
+	}
+}
+
+// putModelRetentionHandler replaces the override of {name}.
+func putModelRetentionHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, ok := aclTarget(w, r, modelDir)
+		if !ok {
+			return
+		}
+		var o retentionOverride
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&o); err != nil {
+			http.Error(w, `body must be a JSON object like {"keep_versions": 3, "max_idle": "720h", "exempt": false}`, http.StatusBadRequest)
+			return
+		}
+		if err := o.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		base := ref.Base()
+		if _, err := sidecars.Update(base, func(m *modelMeta) { m.Retention = &o }); err != nil {
+			log.Printf("[registry] unable to write retention of %s: %v", base, err)
+			http.Error(w, "unable to save retention policy", http.StatusInternalServerError)
+			return
+		}
+		rules, _ := retention.Rules(base)
+		log.Printf("[registry] retention of %s: keep_versions=%d max_idle=%s exempt=%t", base, rules.KeepVersions, rules.MaxIdle, rules.Exempt)
+		writeJSON(w, http.StatusOK, modelRetentionResponse{Name: base, Effective: rules.view(), Override: &o})
+	}
+}
+
+// deleteModelRetentionHandler puts {name} back on the global rules.
+func deleteModelRetentionHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, ok := aclTarget(w, r, modelDir)
+		if !ok {
+			return
+		}
+		base := ref.Base()
+		if _, err := sidecars.Update(base, func(m *modelMeta) { m.Retention = nil }); err != nil {
+			log.Printf("[registry] unable to write retention of %s: %v", base, err)
+			http.Error(w, "unable to save retention policy", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 storage driver.
+//
+// With STORAGE_DRIVER=s3 the models of the primary backend live in an
+// S3-compatible bucket instead of MODEL_DIR, which only keeps the registry's
+// own state (sidecars, cards, tags). Uploads larger than a part are sent as
+// multipart uploads. Requests are signed with AWS Signature Version 4.
+const (
+	defaultS3Region   = "us-east-1"
+	defaultS3PartSize = 64 << 20
+	minS3PartSize     = 5 << 20 // S3's smallest part, except for the last
+	maxS3Parts        = 10000
+
+	s3EmptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// s3Bucket is a Storage talking to one bucket over the S3 REST API.
+type s3Bucket struct {
+	endpoint     *url.URL
+	name         string
+	prefix       string // key prefix models live under, "" or ending in "/"
+	region       string
+	pathStyle    bool
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	partSize     int64
+	client       *http.Client
+}
+
+func newS3Bucket(endpoint, name, prefix, region string, pathStyle bool, partSize int64) (*s3Bucket, error) {
+	if name == "" {
+		return nil, errors.New("MODEL_REGISTRY_S3_BUCKET is required")
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("endpoint %q is not an http(s) URL", endpoint)
+	}
+	if partSize < minS3PartSize {
+		return nil, fmt.Errorf("part size %d is below the S3 minimum of %d", partSize, minS3PartSize)
+	}
+	return &s3Bucket{
+		endpoint:     u,
+		name:         name,
+		prefix:       objectPrefix(prefix),
+		region:       region,
+		pathStyle:    pathStyle,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		partSize:     partSize,
+		client:       &http.Client{Transport: traceTransport(nil)},
+	}, nil
+}
+
+// String names the bucket and prefix for logs.
+func (b *s3Bucket) String() string {
+	return "s3://" + b.name + "/" + b.prefix
+}
+
+// readS3Error turns a failed response into a storageError; 404s on an
+// object become fs.ErrNotExist so callers can keep using os.IsNotExist.
+func readS3Error(resp *http.Response, key string) error {
+	e := &storageError{Driver: storageDriverS3, Status: resp.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(body, e)
+	if resp.StatusCode == http.StatusNotFound && (e.Code == "" || e.Code == "NoSuchKey") {
+		return &fs.PathError{Op: storageDriverS3, Path: key, Err: fs.ErrNotExist}
+	}
+	return e
+}
+
+// url returns the URL of key (without the prefix) with the given query; an
+// empty key addresses the bucket itself.
+func (b *s3Bucket) url(key string, query url.Values) *url.URL {
+	u := *b.endpoint
+	p := "/"
+	if key != "" {
+		p += b.prefix + key
+	}
+	if b.pathStyle {
+		p = "/" + b.name + p
+	} else {
+		u.Host = b.name + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(b.endpoint.Path, "/") + p
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// do signs and sends a request for key.
+func (b *s3Bucket) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "", body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = b.url(key, query)
+	req.Host = req.URL.Host
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	signS3(req, payloadHash, b.region, b.accessKey, b.secretKey, b.sessionToken, time.Now())
+	return b.client.Do(req)
+}
+
+func (b *s3Bucket) Stat(ctx context.Context, key string) (os.FileInfo, error) {
+	return b.stat(ctx, key)
+}
+
+func (b *s3Bucket) stat(ctx context.Context, key string) (*objectInfo, error) {
+	resp, err := b.do(ctx, http.MethodHead, key, nil, nil, nil, 0, s3EmptyPayload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readS3Error(resp, key)
+	}
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &objectInfo{key: key, size: resp.ContentLength, modTime: mtime, etag: resp.Header.Get("ETag")}, nil
+}
+
+// Open looks key up; the object's reads only succeed while its ETag is
+// unchanged, so a download never mixes two uploads.
+func (b *s3Bucket) Open(ctx context.Context, key string) (storageObject, error) {
+	info, err := b.stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{b: b, ctx: ctx, info: info}, nil
+}
+
+// s3Object is an object looked up by Open. It keeps the caller's context,
+// which bounds its reads.
+type s3Object struct {
+	b    *s3Bucket
+	ctx  context.Context
+	info *objectInfo
+}
+
+func (o *s3Object) Info() os.FileInfo { return o.info }
+
+// Range fetches length bytes from offset with one ranged GET.
+func (o *s3Object) Range(offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	if o.info.etag != "" {
+		header.Set("If-Match", o.info.etag)
+	}
+	resp, err := o.b.do(o.ctx, http.MethodGet, o.info.key, nil, header, nil, 0, s3EmptyPayload)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent && (resp.StatusCode != http.StatusOK || offset != 0) {
+		defer resp.Body.Close()
+		return nil, readS3Error(resp, o.info.key)
+	}
+	return resp.Body, nil
+}
+
+func (o *s3Object) Close() error { return nil }
+
+// Put sends the body in one request up to the part size, as a multipart
+// upload beyond it.
+func (b *s3Bucket) Put(ctx context.Context, key string, body *spooledBody) error {
+	defer body.Discard()
+	src, size := body.ReaderAt(), body.Size
+	if size <= b.partSize {
+		resp, err := b.do(ctx, http.MethodPut, key, nil, nil, io.NewSectionReader(src, 0, size), size, s3UnsignedPayload)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return readS3Error(resp, key)
+		}
+		return nil
+	}
+	return b.putMultipart(ctx, key, src, size)
+}
+
+// s3InitiateResult is the body of a CreateMultipartUpload response.
+type s3InitiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+// s3CompletedPart is one part of a CompleteMultipartUpload request.
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// s3CompleteRequest is the body of a CompleteMultipartUpload request.
+type s3CompleteRequest struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+// putMultipart uploads src in parts of at least the configured part size
+// (larger when the object wouldn't fit in maxS3Parts), aborting the upload
+// on any failure so the bucket doesn't keep orphaned parts.
+func (b *s3Bucket) putMultipart(ctx context.Context, key string, src io.ReaderAt, size int64) (err error) {
+	partSize := max(b.partSize, (size+maxS3Parts-1)/maxS3Parts)
+	resp, err := b.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, 0, s3EmptyPayload)
+	if err != nil {
+		return err
+	}
+	var init s3InitiateResult
+	if resp.StatusCode != http.StatusOK {
+		err = readS3Error(resp, key)
+	} else if err = xml.NewDecoder(resp.Body).Decode(&init); err == nil && init.UploadID == "" {
+		err = errors.New("s3: multipart upload started without an upload id")
+	}
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			// A fresh context: the upload's own may be what was canceled.
+			if resp, abortErr := b.do(context.Background(), http.MethodDelete, key, url.Values{"uploadId": {init.UploadID}}, nil, nil, 0, s3EmptyPayload); abortErr == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	var done s3CompleteRequest
+	for off, n := int64(0), 1; off < size; off, n = off+partSize, n+1 {
+		length := min(partSize, size-off)
+		query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {init.UploadID}}
+		resp, err := b.do(ctx, http.MethodPut, key, query, nil, io.NewSectionReader(src, off, length), length, s3UnsignedPayload)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return readS3Error(resp, key)
+		}
+		done.Parts = append(done.Parts, s3CompletedPart{PartNumber: n, ETag: resp.Header.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(done)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	resp, err = b.do(ctx, http.MethodPost, key, url.Values{"uploadId": {init.UploadID}}, nil, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(sum[:]))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readS3Error(resp, key)
+	}
+	// CompleteMultipartUpload can fail after the 200 has been sent.
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(reply, []byte("<Error>")) {
+		e := &storageError{Driver: storageDriverS3, Status: resp.StatusCode}
+		xml.Unmarshal(reply, e)
+		return e
+	}
+	return nil
+}
+
+// Delete removes key. Deleting a missing key is not an error in S3.
+func (b *s3Bucket) Delete(ctx context.Context, key string) error {
+	resp, err := b.do(ctx, http.MethodDelete, key, nil, nil, nil, 0, s3EmptyPayload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return readS3Error(resp, key)
+	}
+	return nil
+}
+
+// s3ListResult is the body of a ListObjectsV2 response.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+		ETag         string    `xml:"ETag"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns the models in the bucket like scanModels does for a
+// directory: .gguf objects under the prefix, including those under
+// "subdirectories" in recursive mode, skipping hidden path segments, sorted by
+// name.
+func (b *s3Bucket) List(ctx context.Context) ([]modelFile, error) {
+	var out []modelFile
+	query := url.Values{"list-type": {"2"}}
+	if b.prefix != "" {
+		query.Set("prefix", b.prefix)
+	}
+	if !recursive {
+		query.Set("delimiter", "/")
+	}
+	for {
+		resp, err := b.do(ctx, http.MethodGet, "", query, nil, nil, 0, s3EmptyPayload)
+		if err != nil {
+			return nil, err
+		}
+		var page s3ListResult
+		if resp.StatusCode != http.StatusOK {
+			err = readS3Error(resp, "")
+		} else {
+			err = xml.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			name, ok := objectModelName(obj.Key, b.prefix)
+			if !ok {
+				continue
+			}
+			out = append(out, modelFile{Name: name, Info: &objectInfo{key: name, size: obj.Size, modTime: obj.LastModified, etag: obj.ETag}})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// signS3 adds AWS Signature Version 4 headers to req. The host, any Range,
+// If-Match or Content-Type and all x-amz-* headers are signed; payloadHash is the
+// hex SHA-256 of the body or UNSIGNED-PAYLOAD.
+func signS3(req *http.Request, payloadHash, region, accessKey, secretKey, sessionToken string, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	headers := map[string]string{"host": req.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "range" || k == "if-match" || k == "content-type" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{day, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signed+", Signature="+sig)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// s3CanonicalQuery encodes query the way Signature Version 4 requires:
+// sorted by key, every component percent-encoded except unreserved
+// characters. It is also what gets sent, so both sides agree.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), query[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything except unreserved characters, and
+// slashes too when slash is set.
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !slash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
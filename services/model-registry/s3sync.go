@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3 sync. With MODEL_REGISTRY_S3_SYNC_BUCKET set, the registry watches a
+// bucket prefix that a training pipeline drops models into and imports new
+// and changed objects every MODEL_REGISTRY_S3_SYNC_INTERVAL, and on POST
+// /admin/s3-sync. Imports are published like uploads into
+// MODEL_REGISTRY_S3_SYNC_BACKEND, so they land in MODEL_DIR, the storage
+// driver, the blob store or the chunk store as configured. An object is
+// imported again when its ETag changes; objects that disappear are left
+// alone here.
+
+const defaultS3SyncInterval = 5 * time.Minute
+
+var (
+	s3SyncObjects = metrics.Counter("s3_sync_objects_total", "Objects handled by the S3 sync by result", "result")
+	s3SyncBytes   = metrics.Counter("s3_sync_imported_bytes_total", "Bytes imported by the S3 sync by backend", "backend")
+)
+
+// s3MD5ETag matches the ETag of an object uploaded in one part without
+// SSE-KMS, which is the MD5 of its content.
+var s3MD5ETag = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// s3SyncState is what the sync remembers between passes, kept in
+// .registry/s3-sync.json: the ETag each imported model was imported at.
+type s3SyncState struct {
+	Source  string            `json:"source"`
+	Objects map[string]string `json:"objects"`
+}
+
+// s3SyncResult is one pass, used by /admin/s3-sync.
+type s3SyncResult struct {
+	Time     time.Time         `json:"time"`
+	Duration string            `json:"duration"`
+	Objects  int               `json:"objects"` // listed under the prefix
+	Imported []string          `json:"imported"`
+	Updated  []string          `json:"updated"`
+	Bytes    int64             `json:"bytes"`
+	Skipped  map[string]string `json:"skipped,omitempty"` // name -> why it was left alone
+	Errors   map[string]string `json:"errors,omitempty"`  // name -> error, retried next pass
+	Error    string            `json:"error,omitempty"`   // the bucket couldn't be listed
+}
+
+// s3Sync imports a bucket prefix into a backend, one pass at a time.
+type s3Sync struct {
+	bucket    *s3Bucket
+	backend   string
+	modelDir  string
+	statePath string
+
+	run   sync.Mutex
+	mu    sync.Mutex
+	state s3SyncState
+	last  *s3SyncResult
+}
+
+// s3Syncer is nil unless MODEL_REGISTRY_S3_SYNC_BUCKET is set.
+var s3Syncer *s3Sync
+
+func newS3Sync(bucket *s3Bucket, backend, modelDir string) (*s3Sync, error) {
+	if _, ok := backends[backend]; !ok {
+		return nil, errUnknownBackend(backend)
+	}
+	s := &s3Sync{
+		bucket:    bucket,
+		backend:   backend,
+		modelDir:  modelDir,
+		statePath: filepath.Join(modelDir, stateDirName, "s3-sync.json"),
+		state:     s3SyncState{Source: bucket.String(), Objects: map[string]string{}},
+	}
+	data, err := os.ReadFile(s.statePath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st s3SyncState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.statePath, err)
+	}
+	if st.Source == s.state.Source && st.Objects != nil {
+		s.state = st
+	}
+	return s, nil
+}
+
+func (s *s3Sync) save() error {
+	s.mu.Lock()
+	data, err := json.Marshal(s.state)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.statePath), 0o755); err != nil {
+		return err
+	}
+	tmp := s.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.statePath)
+}
+
+// Sync imports what changed in the bucket since the last pass.
+func (s *s3Sync) Sync(ctx context.Context) *s3SyncResult {
+	s.run.Lock()
+	defer s.run.Unlock()
+	start := time.Now()
+	res := &s3SyncResult{Time: start.UTC(), Imported: []string{}, Updated: []string{}, Skipped: map[string]string{}, Errors: map[string]string{}}
+	found, err := s.bucket.List(ctx)
+	if err != nil {
+		res.Error = err.Error()
+		log.Printf("[registry] s3 sync: unable to list %s: %v", s.bucket, err)
+	}
+	res.Objects = len(found)
+	for _, f := range found {
+		s.object(ctx, f, res)
+	}
+	res.Duration = time.Since(start).Round(time.Millisecond).String()
+	if err := s.save(); err != nil {
+		log.Printf("[registry] s3 sync: unable to save state: %v", err)
+	}
+
+	s.mu.Lock()
+	s.last = res
+	s.mu.Unlock()
+	if n := len(res.Imported) + len(res.Updated); n > 0 {
+		log.Printf("[registry] s3 sync: imported %d new and %d changed models (%d bytes) from %s", len(res.Imported), len(res.Updated), res.Bytes, s.bucket)
+	}
+	return res
+}
+
+// object imports one listed object unless it is unchanged since its import.
+func (s *s3Sync) object(ctx context.Context, f modelFile, res *s3SyncResult) {
+	etag := f.Info.(*objectInfo).etag
+	s.mu.Lock()
+	imported, known := s.state.Objects[f.Name]
+	s.mu.Unlock()
+	if known && imported == etag {
+		return
+	}
+	name := qualifiedName(s.backend, f.Name)
+	ref, err := parseModelRef(nil, s.modelDir, name)
+	if err != nil {
+		res.Skipped[name] = err.Error()
+		s3SyncObjects.Inc("skipped")
+		return
+	}
+	if _, err := statModel(ctx, ref); err == nil && !known {
+		res.Skipped[name] = "a model uploaded to this registry has the name"
+		s3SyncObjects.Inc("skipped")
+		return
+	}
+
+	if err := s.importObject(ctx, ref, f.Name, f.Info.Size()); err != nil {
+		log.Printf("[registry] s3 sync: unable to import %s: %v", f.Name, err)
+		res.Errors[name] = err.Error()
+		s3SyncObjects.Inc("failed")
+		return
+	}
+	s.mu.Lock()
+	s.state.Objects[f.Name] = etag
+	s.mu.Unlock()
+	if known {
+		res.Updated = append(res.Updated, name)
+		s3SyncObjects.Inc("updated")
+	} else {
+		res.Imported = append(res.Imported, name)
+		s3SyncObjects.Inc("imported")
+	}
+	res.Bytes += f.Info.Size()
+	s3SyncBytes.Add(float64(f.Info.Size()), ref.Backend)
+}
+
+// importObject downloads key and publishes it at ref. Objects with an MD5
+// ETag are checked against it; the read fails if the object is replaced
+// halfway.
+func (s *s3Sync) importObject(ctx context.Context, ref modelRef, key string, size int64) error {
+	if !writes.Begin(ref.Name) {
+		return errors.New("an upload of this model is in progress")
+	}
+	defer writes.End(ref.Name)
+	release, err := quotas.Reserve(ctx, ref, size)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	obj, err := s.bucket.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	src, err := obj.Range(0, obj.Info().Size())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst := ref.Path()
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	body, err := spoolBody(src, spoolThreshold, filepath.Dir(dst), md5.New())
+	if err != nil {
+		return err
+	}
+	etag := strings.Trim(obj.Info().(*objectInfo).etag, `"`)
+	if sum := hex.EncodeToString(body.Extra); s3MD5ETag.MatchString(etag) && sum != etag {
+		body.Discard()
+		return fmt.Errorf("content has MD5 %s, object ETag is %s", sum, etag)
+	}
+	st, dstKey := storageFor(ref)
+	if err := st.Put(ctx, dstKey, body); err != nil {
+		return err
+	}
+	// publishModel describes the request an upload came in on; an import is
+	// described as the request to the bucket.
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.bucket.url(key, nil).String(), nil)
+	if err != nil {
+		return err
+	}
+	req.RemoteAddr = req.URL.Host
+	_, _, err = publishModel(req, ref, body.Sha256, nil)
+	return err
+}
+
+// janitor syncs right away, then every interval.
+func (s *s3Sync) janitor(every time.Duration) {
+	s.Sync(context.Background())
+	for range time.Tick(every) {
+		s.Sync(context.Background())
+	}
+}
+
+// s3SyncStatus is GET /admin/s3-sync.
+type s3SyncStatus struct {
+	Source   string        `json:"source"`
+	Backend  string        `json:"backend"`
+	Imported int           `json:"imported"` // models imported and tracked
+	Last     *s3SyncResult `json:"last,omitempty"`
+}
+
+// s3SyncStatusHandler serves GET /admin/s3-sync.
+func s3SyncStatusHandler(w http.ResponseWriter, r *http.Request) {
+	s := s3Syncer
+	s.mu.Lock()
+	st := s3SyncStatus{Source: s.state.Source, Backend: s.backend, Imported: len(s.state.Objects), Last: s.last}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, st)
+}
+
+// s3SyncHandler serves POST /admin/s3-sync: a pass now.
+func s3SyncHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s3Syncer.Sync(r.Context()))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// selectResponse is used by /models/select
+type selectResponse struct {
+	Model string `json:"model"`
+}
+
+// weightedSelector picks a model from a pool according to configured weights.
+// Models without a configured weight get weight 1, so an empty config means a
+// uniform choice.
+type weightedSelector struct {
+	mu      sync.Mutex
+	rng     *rand.Rand
+	weights map[string]float64
+}
+
+// modelSelector serves /models/select.
+var modelSelector = newWeightedSelector(nil, time.Now().UnixNano())
+
+func newWeightedSelector(weights map[string]float64, seed int64) *weightedSelector {
+	if weights == nil {
+		weights = map[string]float64{}
+	}
+	return &weightedSelector{rng: rand.New(rand.NewSource(seed)), weights: weights}
+}
+
+// parseWeights parses "a.gguf=3,b.gguf=1" into a weight map.
+func parseWeights(spec string) (map[string]float64, error) {
+	weights := map[string]float64{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, raw, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("weight entry %q is not name=weight", item)
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("weight for %q must be a non-negative number", name)
+		}
+		weights[strings.TrimSpace(name)] = w
+	}
+	return weights, nil
+}
+
+func (s *weightedSelector) weight(name string) float64 {
+	if w, ok := s.weights[name]; ok {
+		return w
+	}
+	return 1
+}
+
+// Pick returns one member of pool chosen proportionally to its weight. It
+// returns false if every member has zero weight.
+func (s *weightedSelector) Pick(pool []string) (string, bool) {
+	var total float64
+	for _, name := range pool {
+		total += s.weight(name)
+	}
+	if total <= 0 {
+		return "", false
+	}
+
+	s.mu.Lock()
+	target := s.rng.Float64() * total
+	s.mu.Unlock()
+
+	for _, name := range pool {
+		target -= s.weight(name)
+		if target < 0 {
+			return name, true
+		}
+	}
+	// Floating point rounding; fall back to the last weighted member.
+	for i := len(pool) - 1; i >= 0; i-- {
+		if s.weight(pool[i]) > 0 {
+			return pool[i], true
+		}
+	}
+	return "", false
+}
+
+// selectHandler picks one model from ?pool=a,b,c by weight. With ?redirect=1
+// the client is sent straight to the chosen model's download URL.
+func selectHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw := r.URL.Query().Get("pool")
+		if raw == "" {
+			http.Error(w, "pool is required", http.StatusBadRequest)
+			return
+		}
+
+		// Members are held to what listHandler shows the caller: a model
+		// hidden from them, expired or quarantined is reported as missing.
+		var pool []string
+		seen := map[string]bool{}
+		allowed := requestModelFilter(r)
+		for _, name := range strings.Split(raw, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			missing := fmt.Sprintf("pool member %q not found", name)
+			ref, err := resolveModel(r, modelDir, name)
+			if errors.As(err, new(invalidNameError)) || (err == nil && !allowed(ref.Base())) {
+				http.Error(w, missing, http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			info, err := statModel(r.Context(), ref)
+			if err != nil || info.IsDir() {
+				http.Error(w, missing, http.StatusBadRequest)
+				return
+			}
+			if st := modelStatus(ref.Name, info); st == statusExpired || st == statusQuarantined {
+				http.Error(w, missing, http.StatusBadRequest)
+				return
+			}
+			pool = append(pool, name)
+		}
+		if len(pool) == 0 {
+			http.Error(w, "pool is required", http.StatusBadRequest)
+			return
+		}
+
+		chosen, ok := modelSelector.Pick(pool)
+		if !ok {
+			http.Error(w, "every pool member has zero weight", http.StatusBadRequest)
+			return
+		}
+
+		if redirect, _ := strconv.ParseBool(r.URL.Query().Get("redirect")); redirect {
+			http.Redirect(w, r, "/models/"+url.PathEscape(chosen), http.StatusFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, selectResponse{Model: chosen})
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// sessionHeader lets a client correlate several (Range) requests that
+	// together make up one logical download.
+	sessionHeader = "X-Download-Session"
+
+	defaultSessionTTL   = 10 * time.Minute
+	defaultSessionMax   = 10000
+	maxSessionIDLen     = 128
+	maxCompletedHistory = 100
+)
+
+// sessions aggregates multi-part downloads keyed by X-Download-Session.
+var sessions = newSessionTracker(defaultSessionTTL, defaultSessionMax)
+
+// byteSpan is a half-open interval [Start, End) of a model file.
+type byteSpan struct {
+	Start, End int64
+}
+
+// downloadSession is the aggregated state of one correlated download.
+type downloadSession struct {
+	ID          string     `json:"id"`
+	Model       string     `json:"model"`
+	Size        int64      `json:"size"`
+	Parts       int        `json:"parts"`
+	Bytes       int64      `json:"bytes"`
+	Covered     int64      `json:"covered"`
+	Started     time.Time  `json:"started"`
+	LastSeen    time.Time  `json:"last_seen"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+
+	spans []byteSpan // merged, sorted ranges delivered so far
+}
+
+// sessionStats is the session section of the /stats response.
+type sessionStats struct {
+	Active          int               `json:"active"`
+	CompletedTotal  int64             `json:"completed_total"`
+	AbandonedTotal  int64             `json:"abandoned_total"`
+	RecentCompleted []downloadSession `json:"recent_completed"`
+}
+
+// sessionTracker is a time-expiring map of in-progress download sessions plus
+// a bounded history of the ones that completed. Session IDs come from
+// clients, so at most max sessions are tracked; past that the least recently
+// seen one is dropped as abandoned.
+type sessionTracker struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	max       int
+	order     *list.List // front = most recently seen; values are *downloadSession
+	active    map[string]*list.Element
+	completed []downloadSession // oldest first, bounded to maxCompletedHistory
+	doneTotal int64
+	abandoned int64
+	version   uint64 // bumped on every change, used for /stats ETags
+}
+
+func newSessionTracker(ttl time.Duration, max int) *sessionTracker {
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	if max <= 0 {
+		max = defaultSessionMax
+	}
+	return &sessionTracker{ttl: ttl, max: max, order: list.New(), active: make(map[string]*list.Element)}
+}
+
+// validSessionID rejects empty, oversized or non-printable session IDs so they
+// are safe to log and return.
+func validSessionID(id string) bool {
+	if id == "" || len(id) > maxSessionIDLen {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// Begin registers a new part of session id for model (of the given size).
+func (t *sessionTracker) Begin(id, model string, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now().UTC()
+	el, ok := t.active[id]
+	if !ok {
+		el = t.order.PushFront(&downloadSession{ID: id, Model: model, Size: size, Started: now})
+		t.active[id] = el
+		if t.order.Len() > t.max {
+			t.abandon(t.order.Back().Value.(*downloadSession), "evicted")
+		}
+	}
+	s := el.Value.(*downloadSession)
+	if s.Model != model || s.Size != size {
+		// A session ID reused for a different file starts over.
+		*s = downloadSession{ID: id, Model: model, Size: size, Started: now}
+	}
+	t.order.MoveToFront(el)
+	s.Parts++
+	s.LastSeen = now
+	t.version++
+}
+
+// abandon drops the active session s, logging why. Callers hold t.mu.
+func (t *sessionTracker) abandon(s *downloadSession, why string) {
+	log.Printf("[registry] download session %s %s: model=%s parts=%d bytes=%d covered=%d/%d",
+		s.ID, why, s.Model, s.Parts, s.Bytes, s.Covered, s.Size)
+	t.order.Remove(t.active[s.ID])
+	delete(t.active, s.ID)
+	t.abandoned++
+	t.version++
+}
+
+// Add records that n bytes starting at offset were delivered for session id.
+// It returns a snapshot of the session after the update.
+func (t *sessionTracker) Add(id string, offset, n int64) (downloadSession, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	el, ok := t.active[id]
+	if !ok {
+		return downloadSession{}, false
+	}
+	s := el.Value.(*downloadSession)
+	t.order.MoveToFront(el)
+	now := time.Now().UTC()
+	t.version++
+	s.LastSeen = now
+	s.Bytes += n
+	if n > 0 {
+		s.spans = mergeSpan(s.spans, byteSpan{Start: offset, End: offset + n})
+		s.Covered = 0
+		for _, sp := range s.spans {
+			s.Covered += sp.End - sp.Start
+		}
+	}
+
+	if s.Covered >= s.Size {
+		s.CompletedAt = &now
+		t.order.Remove(el)
+		delete(t.active, id)
+		t.doneTotal++
+		t.completed = append(t.completed, *s)
+		if len(t.completed) > maxCompletedHistory {
+			t.completed = t.completed[len(t.completed)-maxCompletedHistory:]
+		}
+	}
+	return *s, true
+}
+
+// Stats returns a snapshot for /stats.
+func (t *sessionTracker) Stats() sessionStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	recentDone := make([]downloadSession, len(t.completed))
+	// newest first
+	for i, s := range t.completed {
+		recentDone[len(t.completed)-1-i] = s
+	}
+	return sessionStats{
+		Active:          len(t.active),
+		CompletedTotal:  t.doneTotal,
+		AbandonedTotal:  t.abandoned,
+		RecentCompleted: recentDone,
+	}
+}
+
+// Version changes whenever the tracked state does.
+func (t *sessionTracker) Version() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.version
+}
+
+// expire drops sessions that have not seen traffic within the TTL.
+func (t *sessionTracker) expire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// The least recently seen sessions are at the back.
+	cutoff := time.Now().Add(-t.ttl)
+	for el := t.order.Back(); el != nil; el = t.order.Back() {
+		s := el.Value.(*downloadSession)
+		if !s.LastSeen.Before(cutoff) {
+			break
+		}
+		t.abandon(s, "abandoned")
+	}
+}
+
+// janitor periodically expires stale sessions.
+func (t *sessionTracker) janitor() {
+	for range time.Tick(t.ttl / 2) {
+		t.expire()
+	}
+}
+
+// mergeSpan inserts sp into the sorted, non-overlapping spans and coalesces
+// any that now touch or overlap.
+func mergeSpan(spans []byteSpan, sp byteSpan) []byteSpan {
+	spans = append(spans, sp)
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start < spans[j].Start })
+
+	merged := spans[:1]
+	for _, cur := range spans[1:] {
+		last := &merged[len(merged)-1]
+		if cur.Start <= last.End {
+			if cur.End > last.End {
+				last.End = cur.End
+			}
+			continue
+		}
+		merged = append(merged, cur)
+	}
+	return merged
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSessionTrackerEvictsLeastRecentlySeen(t *testing.T) {
+	tr := newSessionTracker(time.Hour, 3)
+	for i := range 3 {
+		tr.Begin(fmt.Sprintf("s%d", i), "m.gguf", 100)
+	}
+	tr.Add("s0", 0, 10) // s1 is now the least recently seen
+	tr.Begin("s3", "m.gguf", 100)
+
+	st := tr.Stats()
+	if st.Active != 3 || st.AbandonedTotal != 1 {
+		t.Fatalf("active=%d abandoned=%d, want 3 and 1", st.Active, st.AbandonedTotal)
+	}
+	if _, ok := tr.Add("s1", 0, 10); ok {
+		t.Error("s1 is still tracked; it should have been evicted")
+	}
+	for _, id := range []string{"s0", "s2", "s3"} {
+		if _, ok := tr.Add(id, 10, 10); !ok {
+			t.Errorf("%s was evicted", id)
+		}
+	}
+}
+
+func TestSessionTrackerExpires(t *testing.T) {
+	tr := newSessionTracker(time.Minute, 10)
+	tr.Begin("old", "m.gguf", 100)
+	tr.Begin("new", "m.gguf", 100)
+	tr.order.Back().Value.(*downloadSession).LastSeen = time.Now().Add(-2 * time.Minute)
+
+	tr.expire()
+	if _, ok := tr.Add("old", 0, 10); ok {
+		t.Error("the idle session survived expire")
+	}
+	if _, ok := tr.Add("new", 0, 10); !ok {
+		t.Error("the live session was expired")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Graceful shutdown. On SIGTERM/SIGINT the registry reports itself as
+// draining, optionally waits for load balancers to stop sending it traffic,
+// then stops accepting connections and gives in-flight requests (multi-GB
+// downloads included) up to the grace period to finish before closing what's
+// left.
+
+const (
+	defaultShutdownGrace     = 30 * time.Second
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+)
+
+// draining is set once shutdown has begun.
+var draining atomic.Bool
+
+// shutdown drains servers and grpcSrv (which may be nil): it fails readiness
+// and disables keep-alives at once, so clients move elsewhere during delay,
+// then stops every listener and waits up to grace for requests to finish,
+// then closes the connections still open.
+func shutdown(servers []*http.Server, grpcSrv *grpc.Server, delay, grace time.Duration) {
+	draining.Store(true)
+	for _, s := range servers {
+		s.SetKeepAlivesEnabled(false)
+	}
+	log.Printf("[registry] shutting down: %d downloads in flight, grace period %s", streams.Stats().Active, grace)
+	if delay > 0 {
+		log.Printf("[registry] waiting %s before closing listeners", delay)
+		time.Sleep(delay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Printf("[registry] shutdown %s: %v; closing %d downloads still running", s.Addr, err, streams.Stats().Active)
+				s.Close()
+			}
+		}(s)
+	}
+	if grpcSrv != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stopGRPC(ctx, grpcSrv)
+		}()
+	}
+	wg.Wait()
+	tracing.Close()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// modelMeta is registry-owned metadata stored next to a model as a sidecar
+// file under MODEL_DIR/.registry/meta/<name>.json.
+type modelMeta struct {
+	// QuarantinedAt is when the model entered quarantine (upload/import time).
+	// When unset the file's mtime is used.
+	QuarantinedAt *time.Time `json:"quarantined_at,omitempty"`
+	// ReleasedAt is set by POST /models/{name}/release to end quarantine early.
+	ReleasedAt *time.Time `json:"released_at,omitempty"`
+	// Signature is the verified detached signature supplied at upload time.
+	Signature *signatureRecord `json:"signature,omitempty"`
+	// DeprecatedAt is set by POST /models/{name}/deprecate.
+	DeprecatedAt *time.Time `json:"deprecated_at,omitempty"`
+	// Sha256 is the recorded digest integrity checks compare the file against.
+	Sha256 string `json:"sha256,omitempty"`
+	// CardSummary is the opening paragraph of the model card, for listings.
+	CardSummary string `json:"card_summary,omitempty"`
+	// OCIManifest is the manifest the model was pushed with over /v2/.
+	OCIManifest []byte `json:"oci_manifest,omitempty"`
+	// ACL makes the model private to the principals it lists; kept on the
+	// base name of versioned models.
+	ACL *modelACL `json:"acl,omitempty"`
+	// Retention overrides the retention rules; kept on the base name too.
+	Retention *retentionOverride `json:"retention,omitempty"`
+	// Pin protects the model from retention, expiry and deletion.
+	Pin *modelPin `json:"pin,omitempty"`
+	// Upstream marks a copy pulled through from MODEL_REGISTRY_UPSTREAM.
+	Upstream *upstreamRecord `json:"upstream,omitempty"`
+	// Stage is the promotion stage, set by POST /models/{name}/promote;
+	// unset means uploaded. Promotions are the moves that led there.
+	Stage      string           `json:"stage,omitempty"`
+	Promotions []stagePromotion `json:"promotions,omitempty"`
+	// Provenance summarizes the document PUT /models/{name}/provenance
+	// attached.
+	Provenance *provenanceSummary `json:"provenance,omitempty"`
+}
+
+// sidecarStore reads and writes modelMeta files. Writes are serialized so
+// concurrent updates to the same model don't interleave.
+type sidecarStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+var sidecars = &sidecarStore{}
+
+func newSidecarStore(modelDir string) *sidecarStore {
+	return &sidecarStore{dir: filepath.Join(modelDir, stateDirName, "meta")}
+}
+
+func (s *sidecarStore) path(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+// Get returns the sidecar for name; a missing sidecar yields zero metadata.
+func (s *sidecarStore) Get(name string) (modelMeta, error) {
+	var m modelMeta
+	data, err := os.ReadFile(s.path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// Update applies fn to the current sidecar of name and writes it back atomically.
+func (s *sidecarStore) Update(name string, fn func(*modelMeta)) (modelMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, err := s.Get(name)
+	if err != nil {
+		return m, err
+	}
+	fn(&m)
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return m, err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path(name)), 0o755); err != nil {
+		return m, err
+	}
+	tmp := s.path(name) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return m, err
+	}
+	return m, os.Rename(tmp, s.path(name))
+}
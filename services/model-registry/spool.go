@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// defaultSpoolThreshold is the largest upload body kept in memory.
+const defaultSpoolThreshold = 8 << 20
+
+// spoolThreshold is configured by MODEL_REGISTRY_UPLOAD_SPOOL_THRESHOLD. Up to
+// this many bytes per in-flight upload are held in RAM, so peak memory is
+// roughly threshold x concurrent uploads; 0 always spools to disk.
+var spoolThreshold int64 = defaultSpoolThreshold
+
+// spooledBody is an upload read to completion either into memory or into a
+// temp file. Digests cover every byte regardless of where it ended up.
+type spooledBody struct {
+	mem    *bytes.Buffer // set when the body fit under the threshold
+	file   *os.File      // set once the body outgrew it
+	Size   int64
+	Sha256 string
+	Extra  []byte // sum of the optional extra hash passed to spoolBody
+}
+
+// spoolBody reads src, switching from memory to a temp file in dir as soon as
+// more than threshold bytes arrive. extra, if non-nil, is fed the same bytes
+// (e.g. the SHA-512 used by signature verification).
+func spoolBody(src io.Reader, threshold int64, dir string, extra hash.Hash) (*spooledBody, error) {
+	h256 := sha256.New()
+	hashes := io.Writer(h256)
+	if extra != nil {
+		hashes = io.MultiWriter(h256, extra)
+	}
+	body := &spooledBody{mem: &bytes.Buffer{}}
+	in := io.TeeReader(src, hashes)
+
+	// One byte past the threshold tells us whether the body fits.
+	n, err := io.CopyN(body.mem, in, threshold+1)
+	body.Size = n
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err == nil {
+		f, err := os.CreateTemp(dir, ".upload-*")
+		if err != nil {
+			return nil, err
+		}
+		body.file = f
+		if _, err := body.mem.WriteTo(f); err != nil {
+			body.Discard()
+			return nil, err
+		}
+		body.mem = nil
+		rest, err := io.Copy(f, in)
+		body.Size += rest
+		if err != nil {
+			body.Discard()
+			return nil, err
+		}
+	}
+
+	body.Sha256 = hex.EncodeToString(h256.Sum(nil))
+	if extra != nil {
+		body.Extra = extra.Sum(nil)
+	}
+	return body, nil
+}
+
+// spoolFile takes over an upload already written to f (a resumable upload's
+// data), hashing it as spoolBody would. Commit or Discard then close and
+// remove f.
+func spoolFile(f *os.File, extra hash.Hash) (*spooledBody, error) {
+	h256 := sha256.New()
+	hashes := io.Writer(h256)
+	if extra != nil {
+		hashes = io.MultiWriter(h256, extra)
+	}
+	body := &spooledBody{file: f}
+	n, err := io.Copy(hashes, io.NewSectionReader(f, 0, 1<<62))
+	if err != nil {
+		body.Discard()
+		return nil, err
+	}
+	body.Size = n
+	body.Sha256 = hex.EncodeToString(h256.Sum(nil))
+	if extra != nil {
+		body.Extra = extra.Sum(nil)
+	}
+	return body, nil
+}
+
+// InMemory reports whether the body stayed under the threshold.
+func (b *spooledBody) InMemory() bool {
+	return b.file == nil
+}
+
+// ReaderAt gives access to the body wherever it is held.
+func (b *spooledBody) ReaderAt() io.ReaderAt {
+	if b.file != nil {
+		return b.file
+	}
+	return bytes.NewReader(b.mem.Bytes())
+}
+
+// Commit writes the body to dst atomically: in-memory bodies go through a
+// temp file next to dst, spooled ones are renamed (dir must be on the same
+// filesystem as dst).
+func (b *spooledBody) Commit(dst string) error {
+	if b.file == nil {
+		f, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+		if err != nil {
+			return err
+		}
+		if _, err := b.mem.WriteTo(f); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		b.file = f
+	}
+	if err := b.file.Close(); err != nil {
+		b.Discard()
+		return err
+	}
+	if err := os.Chmod(b.file.Name(), 0o644); err != nil {
+		b.Discard()
+		return err
+	}
+	if err := os.Rename(b.file.Name(), dst); err != nil {
+		b.Discard()
+		return err
+	}
+	b.file = nil
+	return nil
+}
+
+// Discard drops the body and removes any temp file.
+func (b *spooledBody) Discard() {
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+		b.file = nil
+	}
+	b.mem = nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRecentMax   = 100
+	defaultRecentLimit = 10
+)
+
+// bootID distinguishes ETags across restarts, when in-memory versions reset.
+var bootID = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// recent tracks the most recently downloaded models for /stats/recent.
+var recent = newRecentTracker(defaultRecentMax)
+
+// recentEntry is one row of the /stats/recent response.
+type recentEntry struct {
+	Name       string    `json:"name"`
+	LastAccess time.Time `json:"last_access"`
+	Count      int64     `json:"count"`
+}
+
+// recentResponse is used by /stats/recent
+type recentResponse struct {
+	Models []recentEntry `json:"models"`
+}
+
+// statsResponse is used by /stats
+type statsResponse struct {
+	Sessions  sessionStats   `json:"sessions"`
+	Streams   streamStats    `json:"streams"`
+	Ranges    rangeStats     `json:"ranges"`
+	Integrity integrityStats `json:"integrity"`
+	Tier      tierStats      `json:"tier"`
+	Egress    egressStats    `json:"egress"`
+}
+
+// recentTracker keeps the most recently downloaded models in LRU order,
+// bounded to max entries. The least recently touched model is evicted first.
+type recentTracker struct {
+	mu    sync.Mutex
+	max   int
+	order *list.List // front = most recent; values are *recentEntry
+	items map[string]*list.Element
+	dirty bool
+}
+
+func newRecentTracker(max int) *recentTracker {
+	if max <= 0 {
+		max = defaultRecentMax
+	}
+	return &recentTracker{
+		max:   max,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Touch records a download of name.
+func (t *recentTracker) Touch(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now().UTC()
+	if el, ok := t.items[name]; ok {
+		e := el.Value.(*recentEntry)
+		e.LastAccess = now
+		e.Count++
+		t.order.MoveToFront(el)
+	} else {
+		t.items[name] = t.order.PushFront(&recentEntry{Name: name, LastAccess: now, Count: 1})
+		if t.order.Len() > t.max {
+			oldest := t.order.Back()
+			t.order.Remove(oldest)
+			delete(t.items, oldest.Value.(*recentEntry).Name)
+		}
+	}
+	t.dirty = true
+}
+
+// Recent returns up to n entries, most recent first.
+func (t *recentTracker) Recent(n int) []recentEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make([]recentEntry, 0, n)
+	for el := t.order.Front(); el != nil && len(out) < n; el = el.Next() {
+		out = append(out, *el.Value.(*recentEntry))
+	}
+	return out
+}
+
+// Load seeds the tracker from a file written by Save. A missing file is not an error.
+func (t *recentTracker) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var entries []recentEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Entries are stored most recent first; push to the back to keep that order.
+	for _, e := range entries {
+		if _, ok := t.items[e.Name]; ok || t.order.Len() >= t.max {
+			continue
+		}
+		e := e
+		t.items[e.Name] = t.order.PushBack(&e)
+	}
+	return nil
+}
+
+// Save writes the tracker to path if anything changed since the last save.
+func (t *recentTracker) Save(path string) error {
+	t.mu.Lock()
+	if !t.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+	entries := make([]recentEntry, 0, t.order.Len())
+	for el := t.order.Front(); el != nil; el = el.Next() {
+		entries = append(entries, *el.Value.(*recentEntry))
+	}
+	t.dirty = false
+	t.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// persistLoop periodically flushes the tracker to path.
+func (t *recentTracker) persistLoop(path string, every time.Duration) {
+	for range time.Tick(every) {
+		if err := t.Save(path); err != nil {
+			log.Printf("[registry] unable to persist stats: %v", err)
+		}
+	}
+}
+
+// recentHandler returns the most recently downloaded models.
+// The number of entries is taken from ?n= and capped at the tracker size.
+func recentHandler(w http.ResponseWriter, r *http.Request) {
+	n := defaultRecentLimit
+	if v := r.URL.Query().Get("n"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 {
+			http.Error(w, "n must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+	if n > recent.max {
+		n = recent.max
+	}
+	writeJSON(w, http.StatusOK, recentResponse{Models: recent.Recent(n)})
+}
+
+// statsHandler reports aggregated download statistics. The ETag is derived
+// from the tracker version so unchanged stats answer 304 without building
+// the response.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	eg := egress.Stats()
+	etag := fmt.Sprintf(`W/"stats-%s-%d-%d-%d-%d-%d-%d-%d"`, bootID, sessions.Version(), streams.Version(), ranges.Version(),
+		integrity.Version(), tier.Version(), eg.BytesTotal, eg.CurrentBytesPerSec)
+	if checkNotModified(w, r, etag) {
+		return
+	}
+	writeJSON(w, http.StatusOK, statsResponse{
+		Sessions:  sessions.Stats(),
+		Streams:   streams.Stats(),
+		Ranges:    ranges.Stats(),
+		Integrity: integrity.Stats(),
+		Tier:      tier.Stats(),
+		Egress:    eg,
+	})
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage is where model files live. Names are slash separated and relative
+// to the store's root, as in modelRef.File. The registry's own state
+// (sidecars, cards, tags, versions) stays in MODEL_DIR whatever the store.
+type Storage interface {
+	// List returns the models in the store, sorted by name.
+	List(ctx context.Context) ([]modelFile, error)
+	// Stat returns the size and mtime of name; missing models satisfy
+	// os.IsNotExist.
+	Stat(ctx context.Context, name string) (os.FileInfo, error)
+	// Open returns a handle on name whose reads all see the same content.
+	Open(ctx context.Context, name string) (storageObject, error)
+	// Put stores body as name, consuming it whether or not it succeeds.
+	Put(ctx context.Context, name string, body *spooledBody) error
+	// Delete removes name.
+	Delete(ctx context.Context, name string) error
+}
+
+// storageObject is an opened model.
+type storageObject interface {
+	Info() os.FileInfo
+	// Range returns length bytes starting at offset.
+	Range(offset, length int64) (io.ReadCloser, error)
+	Close() error
+}
+
+// Storage drivers selectable with STORAGE_DRIVER.
+const (
+	storageDriverLocal  = "local"
+	storageDriverS3     = "s3"
+	storageDriverAzure  = "azure"
+	storageDriverGCS    = "gcs"
+	storageDriverChunks = "chunks"
+)
+
+// errRemoteVersions is returned for versioned uploads to a remote store;
+// versions are kept as local files.
+var errRemoteVersions = errors.New("versions need STORAGE_DRIVER=" + storageDriverLocal)
+
+// storage holds the primary backend's models: MODEL_DIR unless
+// STORAGE_DRIVER selects another driver, named by storageDriver.
+var (
+	storage       Storage = localStorage{}
+	storageDriver         = storageDriverLocal
+)
+
+// backendStorage returns the store of a named backend.
+func backendStorage(backend, modelDir string) Storage {
+	if backend == primaryBackend {
+		return storage
+	}
+	return traceStorage(localStorage{dir: backendDir(backend, modelDir)}, storageDriverLocal)
+}
+
+// storageFor returns the store holding the model at ref and its name there.
+// Other backends and versions are always local files.
+func storageFor(ref modelRef) (Storage, string) {
+	if ref.Backend == primaryBackend && ref.Version == "" {
+		return storage, ref.File
+	}
+	rel, err := filepath.Rel(ref.Dir, ref.Path())
+	if err != nil {
+		rel = ref.File
+	}
+	return traceStorage(localStorage{dir: ref.Dir}, storageDriverLocal), filepath.ToSlash(rel)
+}
+
+// remoteStorage reports whether primary models live somewhere other than
+// local files, which features reading models from disk can't work with.
+func remoteStorage() bool {
+	st := storage
+	if t, ok := st.(tracedStorage); ok {
+		st = t.Storage
+	}
+	_, local := st.(localStorage)
+	return !local
+}
+
+// statModel returns the file info of the model at ref.
+func statModel(ctx context.Context, ref modelRef) (os.FileInfo, error) {
+	st, name := storageFor(ref)
+	return st.Stat(ctx, name)
+}
+
+// openModel opens the model at ref in its store.
+func openModel(ctx context.Context, ref modelRef) (storageObject, error) {
+	st, name := storageFor(ref)
+	return st.Open(ctx, name)
+}
+
+// openModelContent returns a reader of the first n bytes of the model at
+// ref, or of all of it when that is shorter.
+func openModelContent(ctx context.Context, ref modelRef, n int64) (io.ReadCloser, error) {
+	obj, err := openModel(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := obj.Range(0, min(n, obj.Info().Size()))
+	if err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return objectContent{ReadCloser: rc, obj: obj}, nil
+}
+
+// objectContent is a range of an opened model; closing it closes both.
+type objectContent struct {
+	io.ReadCloser
+	obj storageObject
+}
+
+func (c objectContent) Close() error {
+	c.ReadCloser.Close()
+	return c.obj.Close()
+}
+
+// objectReader returns a ReaderAt for obj: the file itself for local
+// models, else one range request per read.
+func objectReader(obj storageObject) io.ReaderAt {
+	if o, ok := obj.(*localObject); ok {
+		return o.f
+	}
+	return objectReaderAt{obj}
+}
+
+// objectReaderAt reads an opened model at arbitrary offsets.
+type objectReaderAt struct {
+	obj storageObject
+}
+
+func (r objectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	size := r.obj.Info().Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	n := min(int64(len(p)), size-off)
+	rc, err := r.obj.Range(off, n)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	got, err := io.ReadFull(rc, p[:n])
+	if err == nil && int64(got) < int64(len(p)) {
+		err = io.EOF
+	}
+	return got, err
+}
+
+// removeModel deletes the model at ref.
+func removeModel(ctx context.Context, ref modelRef) error {
+	st, name := storageFor(ref)
+	return st.Delete(ctx, name)
+}
+
+// storageError is an error response from a remote store.
+type storageError struct {
+	Driver  string `xml:"-"`
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *storageError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%s: %d %s", e.Driver, e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("%s: %d %s: %s", e.Driver, e.Status, e.Code, e.Message)
+}
+
+// objectInfo describes a remote object as an os.FileInfo so listing and
+// status code can treat it like a file. etag is whatever the store uses to
+// tell revisions apart.
+type objectInfo struct {
+	key     string
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+func (o *objectInfo) Name() string       { return path.Base(o.key) }
+func (o *objectInfo) Size() int64        { return o.size }
+func (o *objectInfo) Mode() fs.FileMode  { return 0o444 }
+func (o *objectInfo) ModTime() time.Time { return o.modTime }
+func (o *objectInfo) IsDir() bool        { return false }
+func (o *objectInfo) Sys() any           { return nil }
+
+// objectPrefix normalizes a key prefix to "" or a path ending in "/".
+func objectPrefix(prefix string) string {
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// objectModelName maps a listed object key to a model name: the key without
+// prefix, if it names a model file and no segment is hidden, as scanModels
+// skips hidden entries.
+func objectModelName(key, prefix string) (string, bool) {
+	name, ok := strings.CutPrefix(key, prefix)
+	if !ok || !isModelFile(path.Base(name)) {
+		return "", false
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if strings.HasPrefix(seg, ".") {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// localStorage keeps models as files under dir.
+type localStorage struct {
+	dir string
+}
+
+// path is where name is kept. Names that would lead out of dir don't exist
+// in the store.
+func (s localStorage) path(op, name string) (string, error) {
+	p := filepath.Join(s.dir, filepath.FromSlash(name))
+	if rel, err := filepath.Rel(s.dir, p); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return p, nil
+}
+
+func (s localStorage) List(ctx context.Context) ([]modelFile, error) {
+	return scanModels(s.dir)
+}
+
+func (s localStorage) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	p, err := s.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (s localStorage) Open(ctx context.Context, name string) (storageObject, error) {
+	p, err := s.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return newLocalObject(f)
+}
+
+// Put renames a spooled body into place, so it must have been spooled on
+// the same filesystem.
+func (s localStorage) Put(ctx context.Context, name string, body *spooledBody) error {
+	p, err := s.path("put", name)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(p), 0o755)
+	}
+	if err != nil {
+		body.Discard()
+		return err
+	}
+	return body.Commit(p)
+}
+
+func (s localStorage) Delete(ctx context.Context, name string) error {
+	p, err := s.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// localObject is an open model file; holding the descriptor keeps serving
+// the same content even if the name is replaced meanwhile.
+type localObject struct {
+	f    *os.File
+	info os.FileInfo
+}
+
+func newLocalObject(f *os.File) (*localObject, error) {
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &localObject{f: f, info: info}, nil
+}
+
+func (o *localObject) Info() os.FileInfo { return o.info }
+
+func (o *localObject) Range(offset, length int64) (io.ReadCloser, error) {
+	return io.NopCloser(io.NewSectionReader(o.f, offset, length)), nil
+}
+
+func (o *localObject) Close() error { return o.f.Close() }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStorageStaysInDir(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "models")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestModel(t, root, "secret.gguf", []byte("outside"))
+	st := localStorage{dir: dir}
+
+	for _, name := range []string{"../secret.gguf", "a/../../secret.gguf", ".."} {
+		if _, err := st.Stat(context.Background(), name); !os.IsNotExist(err) {
+			t.Errorf("Stat(%s) = %v, want not exist", name, err)
+		}
+		if obj, err := st.Open(context.Background(), name); !os.IsNotExist(err) {
+			if obj != nil {
+				obj.Close()
+			}
+			t.Errorf("Open(%s) = %v, want not exist", name, err)
+		}
+		if err := st.Delete(context.Background(), name); !os.IsNotExist(err) {
+			t.Errorf("Delete(%s) = %v, want not exist", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "secret.gguf")); err != nil {
+		t.Fatalf("file outside the store was touched: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// latestTag, when set, overrides "newest version" for plain model names.
+const latestTag = "latest"
+
+// tags maps mutable labels (stable, canary, prod, ...) to versions.
+var tags = &tagStore{tags: map[string]map[string]string{}}
+
+// tagStore is the in-memory tag table, written through to
+// MODEL_DIR/.registry/tags.json on every change.
+type tagStore struct {
+	mu   sync.Mutex
+	path string
+	tags map[string]map[string]string // model -> tag -> version
+}
+
+// tagsResponse is used by /models/{name}/tags
+type tagsResponse struct {
+	Name string            `json:"name"`
+	Tags map[string]string `json:"tags"`
+}
+
+// newTagStore loads the persisted table, if any.
+func newTagStore(modelDir string) *tagStore {
+	s := &tagStore{path: filepath.Join(modelDir, stateDirName, "tags.json"), tags: map[string]map[string]string{}}
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[registry] unable to read %s: %v", s.path, err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(b, &s.tags); err != nil {
+		log.Printf("[registry] ignoring corrupt %s: %v", s.path, err)
+		s.tags = map[string]map[string]string{}
+	}
+	return s
+}
+
+// Lookup returns the version tag points at for model.
+func (s *tagStore) Lookup(model, tag string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.tags[model][tag]
+	return v, ok
+}
+
+// Get returns a copy of model's tags.
+func (s *tagStore) Get(model string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]string, len(s.tags[model]))
+	for t, v := range s.tags[model] {
+		out[t] = v
+	}
+	return out
+}
+
+// TagsOf returns the tags pointing at version of model, sorted.
+func (s *tagStore) TagsOf(model, version string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []string
+	for t, v := range s.tags[model] {
+		if v == version {
+			out = append(out, t)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Set replaces model's tags and persists the table.
+func (s *tagStore) Set(model string, set map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, had := s.tags[model]
+	if len(set) == 0 {
+		delete(s.tags, model)
+	} else {
+		s.tags[model] = set
+	}
+	if err := s.save(); err != nil {
+		if had {
+			s.tags[model] = prev
+		} else {
+			delete(s.tags, model)
+		}
+		return err
+	}
+	return nil
+}
+
+// save writes the table atomically; the caller must hold s.mu.
+func (s *tagStore) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(s.tags, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// tagsHandler returns the tags of {name}.
+func tagsHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := parseModelRef(r, modelDir, mux.Vars(r)["name"])
+		if err != nil || ref.Version != "" {
+			http.Error(w, "name must be a model without a version", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, tagsResponse{Name: ref.Name, Tags: tags.Get(ref.Name)})
+	}
+}
+
+// putTagsHandler replaces the tags of {name} with the JSON object in the body,
+// e.g. {"stable": "1.2", "canary": "1.3"}; {} removes them all. Every tag
+// must point at a stored version and must not itself be a version label.
+func putTagsHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := parseModelRef(r, modelDir, mux.Vars(r)["name"])
+		if err != nil || ref.Version != "" {
+			http.Error(w, "name must be a model without a version", http.StatusBadRequest)
+			return
+		}
+		var set map[string]string
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&set); err != nil {
+			http.Error(w, "body must be a JSON object of tag to version", http.StatusBadRequest)
+			return
+		}
+		versions, err := listVersions(ref.Dir, ref.File)
+		if err != nil {
+			http.Error(w, "unable to list versions", http.StatusInternalServerError)
+			return
+		}
+		stored := make(map[string]bool, len(versions))
+		for _, v := range versions {
+			stored[v.Version] = true
+		}
+		for tag, version := range set {
+			if err := validVersion(tag); err != nil {
+				http.Error(w, fmt.Sprintf("invalid tag %q", tag), http.StatusBadRequest)
+				return
+			}
+			if stored[tag] {
+				http.Error(w, fmt.Sprintf("tag %q is also a version of this model", tag), http.StatusBadRequest)
+				return
+			}
+			if !stored[version] {
+				http.Error(w, fmt.Sprintf("tag %q: version %q not found", tag, version), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		if err := tags.Set(ref.Name, set); err != nil {
+			log.Printf("[registry] unable to save tags for %s: %v", ref.Name, err)
+			http.Error(w, "unable to save tags", http.StatusInternalServerError)
+			return
+		}
+		pairs := make([]string, 0, len(set))
+		for tag, version := range set {
+			pairs = append(pairs, tag+"="+version)
+		}
+		sort.Strings(pairs)
+		log.Printf("[registry] tags for %s: %s", ref.Name, strings.Join(pairs, ","))
+		events.Publish(eventModelTagged, ref.Name, withIdentity(requestIdentity(r), map[string]any{"tags": set, "client": clientIP(r)}))
+		writeJSON(w, http.StatusOK, tagsResponse{Name: ref.Name, Tags: tags.Get(ref.Name)})
+	}
+}
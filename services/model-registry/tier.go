@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// tierHeader tells clients which tier served a download.
+const tierHeader = "X-Storage-Tier"
+
+// Tiered storage.
+//
+// With MODEL_REGISTRY_ORIGIN_DIR set, MODEL_DIR acts as a fast cache in front
+// of a slow origin directory. A primary-backend model missing locally is
+// streamed from the origin and, for full downloads, teed into a hidden temp
+// file next to its final location in MODEL_DIR. The file is promoted with a
+// rename once the whole model was copied and discarded otherwise, so a
+// partial transfer never appears as a cached model.
+type storageTier struct {
+	origin string
+	fills  *keyedMutex // one fill per model at a time
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	filled    atomic.Int64
+	discarded atomic.Int64
+	version   atomic.Uint64 // bumped on every change, used for /stats ETags
+}
+
+// tierStats is the tier section of the /stats response.
+type tierStats struct {
+	Enabled   bool  `json:"enabled"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Filled    int64 `json:"filled"`
+	Discarded int64 `json:"discarded"`
+}
+
+// tier is nil when no origin is configured.
+var tier *storageTier
+
+func newStorageTier(origin string) *storageTier {
+	if origin == "" {
+		return nil
+	}
+	return &storageTier{origin: origin, fills: newKeyedMutex()}
+}
+
+// Open opens file (relative to the model dir) locally, falling back to the
+// origin. fromOrigin reports which tier the file came from.
+func (t *storageTier) Open(modelDir, file string) (f *os.File, fromOrigin bool, err error) {
+	f, err = os.Open(filepath.Join(modelDir, file))
+	if t == nil || !os.IsNotExist(err) {
+		if t != nil && err == nil {
+			t.hits.Add(1)
+			t.version.Add(1)
+		}
+		return f, false, err
+	}
+	f, err = os.Open(filepath.Join(t.origin, file))
+	if err == nil {
+		t.misses.Add(1)
+		t.version.Add(1)
+	}
+	return f, err == nil, err
+}
+
+// Uncached returns origin models that are not in the local listing.
+func (t *storageTier) Uncached(local []modelFile) []modelFile {
+	found, err := scanModels(t.origin)
+	if err != nil {
+		log.Printf("[registry] tier: unable to list origin %s: %v", t.origin, err)
+		return nil
+	}
+	have := make(map[string]bool, len(local))
+	for _, m := range local {
+		have[m.Name] = true
+	}
+	var out []modelFile
+	for _, m := range found {
+		if !have[m.Name] && m.Version == "" { // versions aren't tiered
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// tierFill is an in-progress copy of an origin model into the local tier.
+type tierFill struct {
+	t    *storageTier
+	file string
+	dst  string
+	tmp  *os.File
+	err  error
+}
+
+// Fill starts caching file into modelDir, or returns nil if another request
+// is already caching it or the temp file can't be created.
+func (t *storageTier) Fill(modelDir, file string) *tierFill {
+	if !t.fills.TryLock(file) {
+		return nil
+	}
+	dst := filepath.Join(modelDir, file)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		t.fills.Unlock(file)
+		log.Printf("[registry] tier: unable to cache %s: %v", file, err)
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tier-*")
+	if err != nil {
+		t.fills.Unlock(file)
+		log.Printf("[registry] tier: unable to cache %s: %v", file, err)
+		return nil
+	}
+	tmp.Chmod(0o644) // CreateTemp uses 0600; cached models should match the origin's usual mode
+	return &tierFill{t: t, file: file, dst: dst, tmp: tmp}
+}
+
+// Write never fails so a broken cache write can't interrupt the client; the
+// first error is remembered and the fill is discarded at the end.
+func (c *tierFill) Write(p []byte) (int, error) {
+	if c.err == nil {
+		_, c.err = c.tmp.Write(p)
+	}
+	return len(p), nil
+}
+
+// Tee returns src wrapped so every byte read is also written to the fill.
+func (c *tierFill) Tee(src io.Reader) io.Reader {
+	return io.TeeReader(src, c)
+}
+
+// Finish promotes the cached copy if complete, otherwise removes it.
+func (c *tierFill) Finish(complete bool) {
+	defer c.t.fills.Unlock(c.file)
+	defer c.t.version.Add(1)
+	closeErr := c.tmp.Close()
+	if complete && c.err == nil && closeErr == nil {
+		err := os.Rename(c.tmp.Name(), c.dst)
+		if err == nil {
+			c.t.filled.Add(1)
+			log.Printf("[registry] tier: cached %s locally", c.file)
+			return
+		}
+		c.err = err
+	}
+	os.Remove(c.tmp.Name())
+	c.t.discarded.Add(1)
+	if c.err != nil {
+		log.Printf("[registry] tier: discarded cache fill of %s: %v", c.file, c.err)
+	} else {
+		log.Printf("[registry] tier: discarded partial cache fill of %s", c.file)
+	}
+}
+
+// Stats returns a snapshot of the tier counters.
+func (t *storageTier) Stats() tierStats {
+	if t == nil {
+		return tierStats{}
+	}
+	return tierStats{
+		Enabled:   true,
+		Hits:      t.hits.Load(),
+		Misses:    t.misses.Load(),
+		Filled:    t.filled.Load(),
+		Discarded: t.discarded.Load(),
+	}
+}
+
+// Version changes whenever the counters do.
+func (t *storageTier) Version() uint64 {
+	if t == nil {
+		return 0
+	}
+	return t.version.Load()
+}
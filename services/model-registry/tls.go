@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Self-signed certificates for lab deployments: with
+// MODEL_REGISTRY_TLS_SELF_SIGNED the registry mints its own, kept under
+// .registry/tls so clients that pinned it keep working across restarts. A
+// certificate is reused until it's within selfSignedRenewal of expiring or
+// stops covering the configured hosts.
+const (
+	selfSignedValidity = 365 * 24 * time.Hour
+	selfSignedRenewal  = 30 * 24 * time.Hour
+)
+
+// tlsEnabled reports whether the main listener serves HTTPS.
+var tlsEnabled bool
+
+// redirectRouter is the plaintext listener used while migrating to TLS. It
+// answers /healthz so probes keep working and sends everything else to the
+// same path on the HTTPS port with a 301; it never serves model bytes.
+func redirectRouter(httpsPort string) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/healthz", healthzHandler).Methods(http.MethodGet)
+	r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	return r
+}
+
+// selfSignedHosts are the names a self-signed certificate covers: this
+// host's name, localhost and the loopback addresses, plus extra.
+func selfSignedHosts(extra []string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		hosts = append(hosts, name)
+	}
+	return append(hosts, extra...)
+}
+
+// selfSignedCert returns the cert and key files of a self-signed
+// certificate for hosts under modelDir, minting a new one unless the stored
+// one is still good.
+func selfSignedCert(modelDir string, hosts []string) (string, string, error) {
+	dir := filepath.Join(modelDir, stateDirName, "tls")
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if cert, err := loadSelfSigned(certFile, keyFile); err == nil && certCovers(cert, hosts) {
+		log.Printf("[registry] using self-signed certificate %s (expires %s)", certFingerprint(cert), cert.NotAfter.Format(time.DateOnly))
+		return certFile, keyFile, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "model-registry", Organization: []string{"crash-pay model registry (self-signed)"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true, // so clients can trust it directly as a root
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return "", "", err
+	}
+	cert, _ := x509.ParseCertificate(der)
+	log.Printf("[registry] generated self-signed certificate %s for %v in %s", certFingerprint(cert), hosts, dir)
+	return certFile, keyFile, nil
+}
+
+// loadSelfSigned parses a stored certificate, failing when it or its key is
+// missing or it expires within selfSignedRenewal.
+func loadSelfSigned(certFile, keyFile string) (*x509.Certificate, error) {
+	if _, err := os.Stat(keyFile); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if time.Until(cert.NotAfter) < selfSignedRenewal {
+		return nil, errors.New("certificate expires soon")
+	}
+	return cert, nil
+}
+
+// certCovers reports whether cert is valid for every host.
+func certCovers(cert *x509.Certificate, hosts []string) bool {
+	for _, h := range hosts {
+		if cert.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// certFingerprint is the SHA-256 of the certificate, for pinning.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
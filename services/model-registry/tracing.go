@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mrand "math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// OpenTelemetry tracing, without the SDK. With an OTLP endpoint configured,
+// HTTP routes, gRPC calls, storage operations and requests to buckets, the
+// origin hub and the JWKS are recorded as spans and exported in batches as
+// OTLP/HTTP JSON. W3C traceparent (and tracestate) headers are honoured on
+// the way in and sent on the way out, so a download the LLM gateway makes
+// for a user request shows up in that request's trace. Without an endpoint
+// none of this runs.
+
+// Span kinds, as numbered by OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+
+	// traceBatchSize and traceBatchInterval bound how long a span waits to
+	// be exported; traceQueueSize spans may wait at once before new ones
+	// are dropped.
+	traceBatchSize     = 256
+	traceBatchInterval = 5 * time.Second
+	traceQueueSize     = 4096
+)
+
+// tracing exports spans; nil when tracing is off.
+var tracing *traceExporter
+
+// spanContext identifies a span across process boundaries.
+type spanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+	State   string // tracestate, passed through untouched
+}
+
+// parseTraceparent parses a W3C traceparent header. Versions above 00 are
+// read as far as 00 defines them.
+func parseTraceparent(h string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || sc.TraceID == [16]byte{} {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || sc.SpanID == [8]byte{} {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// traceparent formats sc as a traceparent header.
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// span is one timed operation. A nil *span ignores every call, so code can
+// annotate the current span whether or not tracing is on.
+type span struct {
+	sc     spanContext
+	parent [8]byte
+	remote bool // a parent from another process, never exported
+	name   string
+	kind   int
+	start  time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  map[string]any
+	errMsg string
+}
+
+type spanKey struct{}
+
+// spanFromContext is the span ctx belongs to, or nil.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// withRemoteParent makes sc, received from a caller, the parent of spans
+// started from the returned context.
+func withRemoteParent(ctx context.Context, sc spanContext) context.Context {
+	return context.WithValue(ctx, spanKey{}, &span{sc: sc, remote: true})
+}
+
+// startSpan starts a span named name as a child of ctx's span, or of a new
+// trace sampled at the configured ratio.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if tracing == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]any{}}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.sc.TraceID, s.sc.Sampled, s.sc.State = parent.sc.TraceID, parent.sc.Sampled, parent.sc.State
+		s.parent = parent.sc.SpanID
+	} else {
+		rand.Read(s.sc.TraceID[:])
+		s.sc.Sampled = mrand.Float64() < tracing.ratio
+	}
+	rand.Read(s.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttr records an attribute; values are strings, bools, ints or floats.
+func (s *span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed.
+func (s *span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = msg
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export when it's sampled.
+func (s *span) End() {
+	if s == nil || s.remote {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.sc.Sampled {
+		tracing.enqueue(s)
+	}
+}
+
+// traceExporter batches finished spans and posts them to an OTLP/HTTP
+// endpoint.
+type traceExporter struct {
+	url     string
+	headers map[string]string
+	service string
+	ratio   float64
+	client  *http.Client
+
+	queue   chan *span
+	dropped atomic.Int64
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// newTraceExporter exports to the OTLP base URL endpoint (spans go to
+// /v1/traces under it), sending headers, a comma separated list of
+// key=value pairs, with every batch.
+func newTraceExporter(endpoint, headers, service string, ratio float64) (*traceExporter, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("endpoint %q must be an http or https URL", endpoint)
+	}
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("sample ratio must be between 0 and 1, got %g", ratio)
+	}
+	e := &traceExporter{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers: map[string]string{},
+		service: service,
+		ratio:   ratio,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan *span, traceQueueSize),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	for _, pair := range splitList(headers) {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid header %q (want key=value)", pair)
+		}
+		e.headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return e, nil
+}
+
+func (e *traceExporter) enqueue(s *span) {
+	select {
+	case e.queue <- s:
+	default:
+		if e.dropped.Add(1) == 1 {
+			log.Printf("[registry] tracing: export queue full, dropping spans")
+		}
+	}
+}
+
+// run exports a batch once it's full or traceBatchInterval has passed, until
+// Close.
+func (e *traceExporter) run() {
+	defer close(e.stopped)
+	tick := time.NewTicker(traceBatchInterval)
+	defer tick.Stop()
+	var batch []*span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			log.Printf("[registry] tracing: unable to export %d spans: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		case <-e.stop:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close exports the spans still queued.
+func (e *traceExporter) Close() {
+	if e == nil {
+		return
+	}
+	close(e.stop)
+	<-e.stopped
+}
+
+// OTLP/JSON payload. IDs are hex and timestamps decimal strings, as the
+// OTLP JSON encoding asks.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string      `json:"traceId"`
+		SpanID            string      `json:"spanId"`
+		ParentSpanID      string      `json:"parentSpanId,omitempty"`
+		TraceState        string      `json:"traceState,omitempty"`
+		Name              string      `json:"name"`
+		Kind              int         `json:"kind"`
+		StartTimeUnixNano string      `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+		Attributes        []otlpAttr  `json:"attributes,omitempty"`
+		Status            *otlpStatus `json:"status,omitempty"`
+	}
+	otlpAttr struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"` // 2 = error
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func otlpValue(v any) map[string]any {
+	switch v := v.(type) {
+	case string:
+		return map[string]any{"stringValue": v}
+	case bool:
+		return map[string]any{"boolValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]any{"doubleValue": v}
+	}
+	return map[string]any{"stringValue": fmt.Sprint(v)}
+}
+
+func (s *span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+		TraceState:        s.sc.State,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	for k, v := range s.attrs {
+		out.Attributes = append(out.Attributes, otlpAttr{Key: k, Value: otlpValue(v)})
+	}
+	if s.errMsg != "" {
+		out.Status = &otlpStatus{Code: 2, Message: s.errMsg}
+	}
+	return out
+}
+
+func (e *traceExporter) export(batch []*span) error {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = s.otlp()
+	}
+	host, _ := os.Hostname()
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttr{
+			{Key: "service.name", Value: otlpValue(e.service)},
+			{Key: "host.name", Value: otlpValue(host)},
+		}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "model-registry"}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// tracingMiddleware records a server span per routed request, continuing
+// the caller's trace when it sends traceparent.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tracing == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := "unmatched"
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tpl, err := cur.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		ctx := r.Context()
+		if sc, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+			sc.State = r.Header.Get(tracestateHeader)
+			ctx = withRemoteParent(ctx, sc)
+		}
+		ctx, sp := startSpan(ctx, r.Method+" "+route, spanKindServer)
+		sp.SetAttr("http.request.method", r.Method)
+		sp.SetAttr("http.route", route)
+		sp.SetAttr("url.path", r.URL.Path)
+		sp.SetAttr("client.address", clientIP(r))
+		if id := requestID(ctx); id != "" {
+			sp.SetAttr("request.id", id)
+		}
+		ww := &wrappedWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(ww, r.WithContext(ctx))
+		sp.SetAttr("http.response.status_code", ww.status)
+		if ww.status >= 500 {
+			sp.SetError(http.StatusText(ww.status))
+		}
+		sp.End()
+	})
+}
+
+// tracingTransport records a client span per outgoing request and sends
+// traceparent with it.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+// traceTransport wraps base (http.DefaultTransport when nil). It passes
+// requests straight through while tracing is off.
+func traceTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return tracingTransport{base: base}
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if tracing == nil {
+		return t.base.RoundTrip(req)
+	}
+	_, sp := startSpan(req.Context(), req.Method, spanKindClient)
+	sp.SetAttr("http.request.method", req.Method)
+	sp.SetAttr("server.address", req.URL.Hostname())
+	sp.SetAttr("url.path", req.URL.Path) // the query may hold signatures
+	req = req.Clone(req.Context())
+	req.Header.Set(traceparentHeader, sp.sc.traceparent())
+	if sp.sc.State != "" {
+		req.Header.Set(tracestateHeader, sp.sc.State)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		sp.SetError(err.Error())
+	} else {
+		sp.SetAttr("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= 500 {
+			sp.SetError(resp.Status)
+		}
+	}
+	sp.End()
+	return resp, err
+}
+
+// tracedStorage records a span per storage operation.
+type tracedStorage struct {
+	Storage
+	driver string
+}
+
+// traceStorage wraps s while tracing is on.
+func traceStorage(s Storage, driver string) Storage {
+	if tracing == nil {
+		return s
+	}
+	return tracedStorage{Storage: s, driver: driver}
+}
+
+// storageSpan starts the span of operation op on name ("" for List).
+func (t tracedStorage) storageSpan(ctx context.Context, op, name string) (context.Context, *span) {
+	ctx, sp := startSpan(ctx, "storage."+op, spanKindInternal)
+	sp.SetAttr("storage.driver", t.driver)
+	if name != "" {
+		sp.SetAttr("model.file", name)
+	}
+	return ctx, sp
+}
+
+// endStorageSpan ends sp, treating missing models as an answer rather than
+// a failure.
+func endStorageSpan(sp *span, err error) {
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		sp.SetError(err.Error())
+	}
+	sp.End()
+}
+
+func (t tracedStorage) List(ctx context.Context) ([]modelFile, error) {
+	ctx, sp := t.storageSpan(ctx, "List", "")
+	found, err := t.Storage.List(ctx)
+	sp.SetAttr("storage.models", len(found))
+	endStorageSpan(sp, err)
+	return found, err
+}
+
+func (t tracedStorage) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	ctx, sp := t.storageSpan(ctx, "Stat", name)
+	info, err := t.Storage.Stat(ctx, name)
+	endStorageSpan(sp, err)
+	return info, err
+}
+
+func (t tracedStorage) Open(ctx context.Context, name string) (storageObject, error) {
+	ctx, sp := t.storageSpan(ctx, "Open", name)
+	obj, err := t.Storage.Open(ctx, name)
+	endStorageSpan(sp, err)
+	return obj, err
+}
+
+func (t tracedStorage) Put(ctx context.Context, name string, body *spooledBody) error {
+	ctx, sp := t.storageSpan(ctx, "Put", name)
+	err := t.Storage.Put(ctx, name, body)
+	endStorageSpan(sp, err)
+	return err
+}
+
+func (t tracedStorage) Delete(ctx context.Context, name string) error {
+	ctx, sp := t.storageSpan(ctx, "Delete", name)
+	err := t.Storage.Delete(ctx, name)
+	endStorageSpan(sp, err)
+	return err
+}
+
+// grpcTraceContext starts the server span of a gRPC call, continuing the
+// caller's trace when its metadata carries traceparent.
+func grpcTraceContext(ctx context.Context, method string) (context.Context, *span) {
+	if tracing == nil {
+		return ctx, nil
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(traceparentHeader); len(v) > 0 {
+			if sc, ok := parseTraceparent(v[0]); ok {
+				if st := md.Get(tracestateHeader); len(st) > 0 {
+					sc.State = st[0]
+				}
+				ctx = withRemoteParent(ctx, sc)
+			}
+		}
+	}
+	ctx, sp := startSpan(ctx, method, spanKindServer)
+	sp.SetAttr("rpc.system", "grpc")
+	sp.SetAttr("rpc.method", method)
+	return ctx, sp
+}
+
+func endGRPCSpan(sp *span, err error) {
+	sp.SetAttr("rpc.grpc.status_code", int(status.Code(err)))
+	if err != nil {
+		sp.SetError(err.Error())
+	}
+	sp.End()
+}
+
+// grpcTraceUnary and grpcTraceStream apply tracingMiddleware to gRPC.
+func grpcTraceUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, sp := grpcTraceContext(ctx, info.FullMethod)
+	resp, err := handler(ctx, req)
+	endGRPCSpan(sp, err)
+	return resp, err
+}
+
+func grpcTraceStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, sp := grpcTraceContext(ss.Context(), info.FullMethod)
+	err := handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	endGRPCSpan(sp, err)
+	return err
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxUploadSize caps a single upload body in bytes; 0 means unlimited.
+var maxUploadSize int64
+
+// uploadResponse is used by POST /models
+type uploadResponse struct {
+	Name         string `json:"name"`
+	Version      string `json:"version,omitempty"`
+	Size         int64  `json:"size"`
+	Sha256       string `json:"sha256"`
+	Status       string `json:"status"`
+	Deduplicated bool   `json:"deduplicated,omitempty"` // the blob store already held this content
+}
+
+// validUploadName checks a client supplied model name (without any backend
+// prefix or version): a model file name, or in recursive mode a clean relative path
+// with no hidden or ".." segments.
+func validUploadName(name string) error {
+	if name == "" {
+		return errors.New("a model name is required (?name= or the multipart filename)")
+	}
+	if strings.Contains(name, `\`) || path.IsAbs(name) || path.Clean(name) != name {
+		return fmt.Errorf("invalid model name %q", name)
+	}
+	if strings.Contains(name, "/") && !recursive {
+		return fmt.Errorf("model name %q must not contain a directory", name)
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if seg == ".." || strings.HasPrefix(seg, ".") {
+			return fmt.Errorf("invalid model name %q", name)
+		}
+	}
+	if !isModelFile(path.Base(name)) {
+		exts := modelExts()
+		if len(exts) == 1 {
+			return fmt.Errorf("model %q must be a %s file", name, exts[0])
+		}
+		return fmt.Errorf("model %q must end in one of %s", name, strings.Join(exts, ", "))
+	}
+	return nil
+}
+
+// uploadSource returns the model bytes and the name they were sent under.
+// Multipart bodies use the first file part (preferring a field named
+// "file"); anything else is taken as the raw model. ?name= overrides the
+// multipart filename.
+func uploadSource(r *http.Request) (io.Reader, string, error) {
+	name := r.URL.Query().Get("name")
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.Body, name, nil
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, "", errors.New("multipart body has no file part")
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if part.FileName() == "" && part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+		if name == "" {
+			name = filepath.Base(part.FileName())
+		}
+		return part, name, nil
+	}
+}
+
+// uploadConflict reports why ref can't be stored. A plain file would shadow
+// versions of the same name, so a model is either one or the other; likewise
+// a version would shadow a tag.
+func uploadConflict(ref modelRef) error {
+	if ref.Version != "" {
+		if _, ok := tags.Lookup(ref.Base(), ref.Version); ok {
+			return errors.New("version label is in use as a tag")
+		}
+		if _, err := os.Stat(filepath.Join(ref.Dir, ref.File)); err == nil {
+			return errors.New("an unversioned model of this name exists")
+		}
+	} else if versions, _ := listVersions(ref.Dir, ref.File); len(versions) > 0 {
+		return errVersionedModel
+	}
+	return nil
+}
+
+// publishModel writes the sidecar, blob store link and upload event for a
+// model just stored at ref, and reports whether the blob store held it.
+func publishModel(r *http.Request, ref modelRef, sum string, sig *signatureRecord) (os.FileInfo, bool, error) {
+	name, dst := ref.Name, ref.Path()
+	now := time.Now().UTC()
+	var prevSum string
+	if _, err := sidecars.Update(name, func(m *modelMeta) {
+		prevSum = m.Sha256
+		*m = modelMeta{QuarantinedAt: &now, Signature: sig, Sha256: sum, CardSummary: m.CardSummary, ACL: m.ACL, Retention: m.Retention, Pin: m.Pin}
+	}); err != nil {
+		log.Printf("[registry] upload %s: unable to write sidecar: %v", name, err)
+	}
+	var dedup bool
+	if blobs != nil {
+		var err error
+		if dedup, err = blobs.Link(dst, sum); err != nil {
+			log.Printf("[registry] upload %s: unable to add to blob store: %v", name, err)
+		}
+		if prevSum != sum {
+			blobs.Release(prevSum)
+		}
+	}
+	info, err := statModel(r.Context(), ref)
+	if err != nil {
+		return nil, false, err
+	}
+	digests.Put(dst, info, sum)
+	log.Printf("[registry] uploaded %s: %d bytes sha256=%s signed=%t deduplicated=%t", name, info.Size(), sum, sig != nil, dedup)
+	events.Publish(eventModelUploaded, name, withIdentity(requestIdentity(r), map[string]any{"size": info.Size(), "sha256": sum, "client": clientIP(r)}))
+	rescanCatalog()
+	return info, dedup, nil
+}
+
+// uploadHandler publishes a model. The body is streamed through spoolBody
+// (memory up to the spool threshold, then a temp file next to the target)
+// while its SHA-256, and the SHA-512 for signature checks, are computed. The
+// model only appears under its name once complete: it is handed to the
+// model's Storage (which, for local files, renames it into place) and its
+// sidecar records the digest, the verified signature and the time it entered
+// quarantine. Existing models are only replaced with ?overwrite=1.
+// ?version= (or a name@version) stores a new version of a versioned model.
+func uploadHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if maxUploadSize > 0 {
+			if r.ContentLength > maxUploadSize {
+				http.Error(w, "upload exceeds "+strconv.FormatInt(maxUploadSize, 10)+" bytes", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		}
+
+		src, name, err := uploadSource(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		overwrite, _ := strconv.ParseBool(r.URL.Query().Get("overwrite"))
+		private, _ := strconv.ParseBool(r.URL.Query().Get("private"))
+		ref, code, err := uploadTarget(r, modelDir, name, r.URL.Query().Get("version"), overwrite, private)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		name = ref.Name
+		dst := ref.Path()
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") && r.ContentLength > 0 {
+			if err := quotas.Check(r.Context(), ref, r.ContentLength); err != nil {
+				writeQuotaError(w, ref, err)
+				return
+			}
+		}
+
+		if !writes.Begin(name) {
+			http.Error(w, "an upload of this model is already in progress", http.StatusConflict)
+			return
+		}
+		defer writes.End(name)
+
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			log.Printf("[registry] upload %s: %v", name, err)
+			http.Error(w, "unable to store model", http.StatusInternalServerError)
+			return
+		}
+		var sigHash hash.Hash
+		if uploadVerifier != nil {
+			sigHash = uploadVerifier.NewHash()
+		}
+		body, err := spoolBody(src, spoolThreshold, filepath.Dir(dst), sigHash)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "upload exceeds "+strconv.FormatInt(maxUploadSize, 10)+" bytes", http.StatusRequestEntityTooLarge)
+				return
+			}
+			log.Printf("[registry] upload %s: %v", name, err)
+			http.Error(w, "unable to read upload", http.StatusBadRequest)
+			return
+		}
+		if body.Size == 0 {
+			body.Discard()
+			http.Error(w, "upload is empty", http.StatusBadRequest)
+			return
+		}
+
+		storeUpload(w, r, ref, body)
+	}
+}
+
+// uploadTarget resolves and checks the model an upload of name (and the
+// optional version) would create, returning the status to answer with when
+// it can't. A private upload makes the model private to the caller.
+func uploadTarget(r *http.Request, modelDir, name, version string, overwrite, private bool) (modelRef, int, error) {
+	ref, err := parseModelRef(r, modelDir, name)
+	if err != nil {
+		return ref, http.StatusBadRequest, err
+	}
+	if err := validUploadName(ref.File); err != nil {
+		return ref, http.StatusBadRequest, err
+	}
+	if version != "" {
+		if ref.Version != "" {
+			return ref, http.StatusBadRequest, errors.New("version given twice")
+		}
+		if ref, err = ref.withVersion(version); err != nil {
+			return ref, http.StatusBadRequest, err
+		}
+	}
+	if remoteStorage() && ref.Backend == primaryBackend && ref.Version != "" {
+		return ref, http.StatusBadRequest, errRemoteVersions
+	}
+	if err := uploadConflict(ref); err != nil {
+		return ref, http.StatusConflict, err
+	}
+	if _, err := statModel(r.Context(), ref); err == nil {
+		if !overwrite {
+			return ref, http.StatusConflict, errors.New("model already exists (use ?overwrite=1 to replace it)")
+		}
+		// Replacing a model discards it, which is an admin's call.
+		if !isAdmin(r) {
+			return ref, http.StatusForbidden, errors.New("admin role required to overwrite a model")
+		}
+	}
+	if code, err := claimPrivate(r, ref, private); err != nil {
+		return ref, code, err
+	}
+	return ref, 0, nil
+}
+
+// storeUpload validates a complete upload, stores and publishes it at ref
+// and reports whether it was stored. The caller holds writes for ref.Name.
+func storeUpload(w http.ResponseWriter, r *http.Request, ref modelRef, body *spooledBody) bool {
+	name := ref.Name
+	if validateUploads {
+		if err := checkModelFormat(ref.File, body); err != nil {
+			body.Discard()
+			log.Printf("[registry] upload %s rejected: %v", name, err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return false
+		}
+	}
+	var sig *signatureRecord
+	if uploadVerifier != nil {
+		rec, err := uploadVerifier.Verify(r.Header.Get(signatureHeader), body.Extra)
+		if err != nil {
+			body.Discard()
+			log.Printf("[registry] upload %s rejected: %v", name, err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return false
+		}
+		sig = &rec
+	}
+
+	release, err := quotas.Reserve(r.Context(), ref, body.Size)
+	if err != nil {
+		body.Discard()
+		writeQuotaError(w, ref, err)
+		return false
+	}
+	defer release()
+
+	st, key := storageFor(ref)
+	if err := st.Put(r.Context(), key, body); err != nil {
+		log.Printf("[registry] upload %s: %v", name, err)
+		http.Error(w, "unable to store model", http.StatusInternalServerError)
+		return false
+	}
+	info, dedup, err := publishModel(r, ref, body.Sha256, sig)
+	if err != nil {
+		http.Error(w, "unable to stat model", http.StatusInternalServerError)
+		return true
+	}
+	writeJSON(w, http.StatusCreated, uploadResponse{
+		Name:         name,
+		Version:      ref.Version,
+		Size:         body.Size,
+		Sha256:       body.Sha256,
+		Status:       storedStatus(name, info), // the write slot is still held
+		Deduplicated: dedup,
+	})
+	return true
+}
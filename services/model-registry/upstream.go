@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Pull-through proxy. With MODEL_REGISTRY_UPSTREAM set, a download of a model
+// this registry doesn't have is fetched from that registry, stored like an
+// upload and served; later downloads are served from the copy. Once a copy
+// is MODEL_REGISTRY_UPSTREAM_TTL old, the next download revalidates it with a
+// conditional GET on the upstream ETag: 304 keeps it, a new body replaces it
+// and 404 evicts it. While the upstream can't be reached, copies are served
+// stale and tried again after another TTL.
+
+const (
+	defaultUpstreamTTL    = 10 * time.Minute
+	upstreamHeaderTimeout = 30 * time.Second
+)
+
+// upstreamResults counts upstream requests by what came of them.
+var upstreamResults = metrics.Counter("upstream_requests_total", "Pull-through requests to the upstream registry by result", "result")
+
+// errUpstreamBusy is returned when an upload of the model is in progress.
+var errUpstreamBusy = errors.New("an upload of this model is in progress")
+
+// upstreamRecord marks a model as a copy of the upstream's, in the sidecar.
+type upstreamRecord struct {
+	ETag    string    `json:"etag"`
+	Checked time.Time `json:"checked"` // last fetch or revalidation
+}
+
+// upstreamProxy fetches models missing here from the upstream registry.
+type upstreamProxy struct {
+	url     string // base URL, without a trailing slash
+	token   string
+	ttl     time.Duration // 0 never revalidates
+	client  *http.Client
+	fetches *keyedMutex // one fetch per model at a time
+}
+
+// upstream is nil when no upstream is configured.
+var upstream *upstreamProxy
+
+func newUpstreamProxy(rawURL, token string, ttl time.Duration) (*upstreamProxy, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an http or https URL", rawURL)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = upstreamHeaderTimeout
+	return &upstreamProxy{
+		url:     strings.TrimSuffix(rawURL, "/"),
+		token:   token,
+		ttl:     ttl,
+		client:  &http.Client{Transport: traceTransport(transport)},
+		fetches: newKeyedMutex(),
+	}, nil
+}
+
+// Ensure fetches ref from the upstream when it is missing here, or
+// revalidates the copy once its TTL is up, so the download that follows
+// finds what the upstream has. Models the origin tier or the Hugging Face
+// mirror serve are left to them. An error means ref is missing and couldn't
+// be fetched; a copy that can't be revalidated is served stale.
+func (u *upstreamProxy) Ensure(r *http.Request, ref modelRef) error {
+	ctx := r.Context()
+	if _, _, fetch := u.due(ctx, ref); !fetch {
+		return nil
+	}
+	u.fetches.Lock(ref.Name)
+	defer u.fetches.Unlock(ref.Name)
+	// Another download may have done it while this one waited.
+	info, etag, fetch := u.due(ctx, ref)
+	if !fetch {
+		return nil
+	}
+
+	// The fetch isn't tied to the client's request, so a client giving up
+	// doesn't waste a half-finished download for the next one.
+	resp, err := u.get(context.WithoutCancel(ctx), ref.Name, etag)
+	if err != nil {
+		upstreamResults.Inc("error")
+		if info != nil {
+			log.Printf("[registry] upstream: unable to revalidate %s, serving the cached copy: %v", ref.Name, err)
+			upstreamResults.Inc("stale")
+			u.checked(ref)
+			return nil
+		}
+		log.Printf("[registry] upstream: unable to fetch %s: %v", ref.Name, err)
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && info != nil:
+		upstreamResults.Inc("not_modified")
+		u.checked(ref)
+		return nil
+	case resp.StatusCode == http.StatusNotFound && info == nil:
+		upstreamResults.Inc("missing")
+		return nil // answered as a model that doesn't exist
+	case resp.StatusCode == http.StatusNotFound:
+		u.evict(ctx, ref, info)
+		return nil
+	}
+
+	start := time.Now()
+	size, err := u.store(r, ref, resp)
+	if err != nil {
+		switch {
+		case err == errUpstreamBusy && info != nil:
+			return nil // the upload replaces the copy anyway
+		case err == errUpstreamBusy:
+			return err
+		}
+		upstreamResults.Inc("error")
+		if info != nil {
+			log.Printf("[registry] upstream: unable to refresh %s, serving the cached copy: %v", ref.Name, err)
+			return nil
+		}
+		log.Printf("[registry] upstream: unable to fetch %s: %v", ref.Name, err)
+		return err
+	}
+	result := "fetched"
+	if info != nil {
+		result = "refreshed"
+	}
+	upstreamResults.Inc(result)
+	log.Printf("[registry] upstream: %s %s from %s (%d bytes in %s)", result, ref.Name, u.url, size, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// due reports whether ref needs a trip upstream: when missing here, or when
+// its copy's TTL is up, with the ETag to revalidate.
+func (u *upstreamProxy) due(ctx context.Context, ref modelRef) (info os.FileInfo, etag string, fetch bool) {
+	info, err := statModel(ctx, ref)
+	if err != nil {
+		if !os.IsNotExist(err) || u.servedElsewhere(ref) {
+			return nil, "", false
+		}
+		return nil, "", true
+	}
+	meta, err := sidecars.Get(ref.Name)
+	if err != nil || meta.Upstream == nil || u.ttl <= 0 || time.Since(meta.Upstream.Checked) < u.ttl {
+		return info, "", false
+	}
+	return info, meta.Upstream.ETag, true
+}
+
+// servedElsewhere reports whether the origin tier or the Hugging Face mirror
+// provides ref.
+func (u *upstreamProxy) servedElsewhere(ref modelRef) bool {
+	if ref.Backend != primaryBackend || ref.Version != "" {
+		return false
+	}
+	if _, mapped := hub.Source(ref.Name); mapped {
+		return true
+	}
+	if tier != nil {
+		if _, err := os.Stat(filepath.Join(tier.origin, ref.File)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// get requests name from the upstream, conditionally when etag is set.
+// Anything but 200, 304 and 404 is an error.
+func (u *upstreamProxy) get(ctx context.Context, name, etag string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url+modelURLPath(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if u.token != "" {
+		req.Header.Set("Authorization", "Bearer "+u.token)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	req.Header.Set("TE", "trailers") // for the checksum trailer
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotModified, http.StatusNotFound:
+		return resp, nil
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("upstream answered %s", resp.Status)
+}
+
+// store publishes the body of resp at ref once it matches the SHA-256 the
+// upstream sent with it.
+func (u *upstreamProxy) store(r *http.Request, ref modelRef, resp *http.Response) (int64, error) {
+	if !writes.Begin(ref.Name) {
+		return 0, errUpstreamBusy
+	}
+	defer writes.End(ref.Name)
+	dst := ref.Path()
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return 0, err
+	}
+	body, err := spoolBody(resp.Body, spoolThreshold, filepath.Dir(dst), nil)
+	if err != nil {
+		return 0, err
+	}
+	want := resp.Trailer.Get(checksumTrailer)
+	if want == "" {
+		want = resp.Header.Get(checksumTrailer)
+	}
+	if want != "" && want != body.Sha256 {
+		body.Discard()
+		return 0, fmt.Errorf("content hashes to %s, upstream reported %s", body.Sha256, want)
+	}
+	st, key := storageFor(ref)
+	if err := st.Put(context.WithoutCancel(r.Context()), key, body); err != nil {
+		return 0, err
+	}
+	if _, _, err := publishModel(r, ref, body.Sha256, nil); err != nil {
+		return 0, err
+	}
+	rec := upstreamRecord{ETag: resp.Header.Get("ETag"), Checked: time.Now().UTC()}
+	if _, err := sidecars.Update(ref.Name, func(m *modelMeta) { m.Upstream = &rec }); err != nil {
+		log.Printf("[registry] upstream: unable to record %s as a copy: %v", ref.Name, err)
+	}
+	return body.Size, nil
+}
+
+// checked restarts the TTL of ref's copy.
+func (u *upstreamProxy) checked(ref modelRef) {
+	now := time.Now().UTC()
+	if _, err := sidecars.Update(ref.Name, func(m *modelMeta) {
+		if m.Upstream != nil {
+			m.Upstream.Checked = now
+		}
+	}); err != nil {
+		log.Printf("[registry] upstream: unable to update %s: %v", ref.Name, err)
+	}
+}
+
+// evict deletes the copy of a model the upstream no longer has.
+func (u *upstreamProxy) evict(ctx context.Context, ref modelRef, info os.FileInfo) {
+	resp, err := deleteModel(ctx, ref, info, "", map[string]any{"reason": "upstream"})
+	switch {
+	case err != nil:
+		log.Printf("[registry] upstream: unable to evict %s: %v", ref.Name, err)
+	case !resp.Deleted:
+		log.Printf("[registry] upstream: %s is gone upstream but kept: %s", ref.Name, resp.Reason)
+		u.checked(ref)
+	default:
+		upstreamResults.Inc("evicted")
+		log.Printf("[registry] upstream: evicted %s, gone from %s", ref.Name, u.url)
+	}
+}
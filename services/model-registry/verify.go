@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Integrity check outcomes for a single model.
+const (
+	verifyOK           = "ok"
+	verifyRecorded     = "recorded"      // no baseline yet; current digest stored
+	verifyMismatch     = "mismatch"      // contents differ from the recorded digest
+	verifyBadSignature = "bad_signature" // stored signature no longer verifies
+	verifyUnverifiable = "unverifiable"  // signature present but its key isn't trusted
+	verifyError        = "error"         // file could not be read
+)
+
+// Verification run states.
+const (
+	verifyIdle    = "idle"
+	verifyRunning = "running"
+	verifyDone    = "done"
+)
+
+// verifyResult is one model that did not pass a verification run.
+type verifyResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// verifyReport is the progress and outcome of the latest run, returned by
+// /admin/verify-all and persisted to MODEL_DIR/.registry/verify.json.
+type verifyReport struct {
+	State      string         `json:"state"`
+	StartedAt  *time.Time     `json:"started_at,omitempty"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	Total      int            `json:"total"`
+	Checked    int            `json:"checked"`
+	Passed     int            `json:"passed"`
+	Recorded   int            `json:"recorded"`
+	Failures   []verifyResult `json:"failures"`
+}
+
+// integrityStats is the integrity section of the /stats response.
+type integrityStats struct {
+	LastRun    *time.Time `json:"last_run,omitempty"`
+	Running    bool       `json:"running"`
+	Failures   int        `json:"failures"`
+	RunsTotal  int64      `json:"runs_total"`
+	FailsTotal int64      `json:"failures_total"`
+}
+
+// integrityChecker re-hashes every model against the digest recorded in its
+// sidecar, and re-verifies stored upload signatures. Files without a recorded
+// digest get one on their first check, which later runs compare against.
+type integrityChecker struct {
+	mu         sync.Mutex
+	path       string
+	report     verifyReport
+	pending    map[string]bool // models not yet checked by the current run
+	runs       int64
+	failsTotal int64
+	version    uint64 // bumped on every change, used for /stats ETags
+}
+
+var integrity = &integrityChecker{report: verifyReport{State: verifyIdle, Failures: []verifyResult{}}}
+
+// newIntegrityChecker loads the last persisted report, if any.
+func newIntegrityChecker(modelDir string) *integrityChecker {
+	c := &integrityChecker{
+		path:   filepath.Join(modelDir, stateDirName, "verify.json"),
+		report: verifyReport{State: verifyIdle, Failures: []verifyResult{}},
+	}
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[registry] unable to read %s: %v", c.path, err)
+		}
+		return c
+	}
+	var rep verifyReport
+	if err := json.Unmarshal(b, &rep); err != nil {
+		log.Printf("[registry] ignoring corrupt %s: %v", c.path, err)
+		return c
+	}
+	if rep.State == verifyRunning {
+		rep.State = verifyIdle // interrupted by a restart
+	}
+	if rep.Failures == nil {
+		rep.Failures = []verifyResult{}
+	}
+	c.report = rep
+	return c
+}
+
+// Start launches a background run over every backend. It returns false if a
+// run is already in progress.
+func (c *integrityChecker) Start(modelDir string) (verifyReport, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.report.State == verifyRunning {
+		return c.snapshot(), false
+	}
+
+	var refs []modelRef
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, backend := range names {
+		found, err := backendStorage(backend, modelDir).List(context.Background())
+		if err != nil {
+			log.Printf("[registry] verify: unable to list backend %s: %v", backend, err)
+			continue
+		}
+		for _, f := range found {
+			refs = append(refs, fileRef(backend, backendDir(backend, modelDir), f))
+		}
+	}
+
+	now := time.Now().UTC()
+	c.report = verifyReport{State: verifyRunning, StartedAt: &now, Total: len(refs), Failures: []verifyResult{}}
+	c.pending = make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		c.pending[ref.Name] = true
+	}
+	c.version++
+	go c.run(refs)
+	return c.snapshot(), true
+}
+
+// run checks refs with as many workers as there are checksum slots.
+func (c *integrityChecker) run(refs []modelRef) {
+	log.Printf("[registry] verify: checking %d models", len(refs))
+	jobs := make(chan modelRef)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(checksumSlots); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ref := range jobs {
+				c.record(verifyModel(ref))
+			}
+		}()
+	}
+	for _, ref := range refs {
+		jobs <- ref
+	}
+	close(jobs)
+	wg.Wait()
+
+	c.mu.Lock()
+	now := time.Now().UTC()
+	c.report.State = verifyDone
+	c.report.FinishedAt = &now
+	sort.Slice(c.report.Failures, func(i, j int) bool { return c.report.Failures[i].Name < c.report.Failures[j].Name })
+	c.runs++
+	c.version++
+	rep := c.snapshot()
+	c.mu.Unlock()
+
+	log.Printf("[registry] verify: done: %d checked, %d passed, %d recorded, %d failed",
+		rep.Checked, rep.Passed, rep.Recorded, len(rep.Failures))
+	if err := c.save(rep); err != nil {
+		log.Printf("[registry] verify: unable to persist result: %v", err)
+	}
+}
+
+// record folds one model's outcome into the running report.
+func (c *integrityChecker) record(res verifyResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, res.Name)
+	c.report.Checked++
+	switch res.Status {
+	case verifyOK:
+		c.report.Passed++
+	case verifyRecorded:
+		c.report.Recorded++
+	default:
+		c.report.Failures = append(c.report.Failures, res)
+		c.failsTotal++
+		log.Printf("[registry] INTEGRITY FAILURE: %s: %s %s", res.Name, res.Status, res.Detail)
+	}
+	c.version++
+}
+
+// snapshot copies the report; the caller must hold c.mu.
+func (c *integrityChecker) snapshot() verifyReport {
+	rep := c.report
+	rep.Failures = append([]verifyResult{}, c.report.Failures...)
+	return rep
+}
+
+// Pending reports whether the running pass has yet to check name.
+func (c *integrityChecker) Pending(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pending[name]
+}
+
+// Report returns the current or most recent run.
+func (c *integrityChecker) Report() verifyReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.snapshot()
+}
+
+// Stats summarizes verification for /stats.
+func (c *integrityChecker) Stats() integrityStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return integrityStats{
+		LastRun:    c.report.FinishedAt,
+		Running:    c.report.State == verifyRunning,
+		Failures:   len(c.report.Failures),
+		RunsTotal:  c.runs,
+		FailsTotal: c.failsTotal,
+	}
+}
+
+// Version changes whenever the checker's state does.
+func (c *integrityChecker) Version() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+// save writes rep atomically next to the other registry state.
+func (c *integrityChecker) save(rep verifyReport) error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// verifyModel re-reads one model in full (ignoring the digest cache, since a
+// tampered file can keep its size and mtime) and checks it against its sidecar.
+func verifyModel(ref modelRef) verifyResult {
+	res := verifyResult{Name: ref.Name}
+
+	checksumSlots <- struct{}{}
+	sum256, sum512, info, err := hashModel(ref)
+	<-checksumSlots
+	if err != nil {
+		res.Status, res.Detail = verifyError, err.Error()
+		return res
+	}
+	hex256 := hex.EncodeToString(sum256)
+	digests.Put(ref.Path(), info, hex256)
+
+	meta, err := sidecars.Get(ref.Name)
+	if err != nil {
+		res.Status, res.Detail = verifyError, err.Error()
+		return res
+	}
+	if meta.Signature != nil {
+		if uploadVerifier == nil {
+			res.Status, res.Detail = verifyUnverifiable, "no signing keys configured"
+			return res
+		}
+		if err := uploadVerifier.Recheck(*meta.Signature, sum512); err != nil {
+			res.Status, res.Detail = verifyBadSignature, err.Error()
+			return res
+		}
+	}
+	if meta.Sha256 != "" {
+		if meta.Sha256 != hex256 {
+			res.Status, res.Detail = verifyMismatch, fmt.Sprintf("sha256 is %s, recorded %s", hex256, meta.Sha256)
+			return res
+		}
+		res.Status = verifyOK
+		return res
+	}
+
+	if _, err := sidecars.Update(ref.Name, func(m *modelMeta) { m.Sha256 = hex256 }); err != nil {
+		res.Status, res.Detail = verifyError, err.Error()
+		return res
+	}
+	res.Status = verifyRecorded
+	return res
+}
+
+// hashModel computes the SHA-256 and SHA-512 of the model at ref in one pass.
+func hashModel(ref modelRef) ([]byte, []byte, os.FileInfo, error) {
+	obj, err := openModel(context.Background(), ref)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer obj.Close()
+	info := obj.Info()
+	body, err := obj.Range(0, info.Size())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer body.Close()
+	h256, h512 := sha256.New(), sha512.New()
+	if _, err := io.Copy(io.MultiWriter(h256, h512), body); err != nil {
+		return nil, nil, nil, err
+	}
+	return h256.Sum(nil), h512.Sum(nil), info, nil
+}
+
+// verifyAllHandler starts a background integrity run; poll GET for progress.
+func verifyAllHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rep, started := integrity.Start(modelDir)
+		if !started {
+			writeJSON(w, http.StatusConflict, rep)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, rep)
+	}
+}
+
+// verifyStatusHandler reports the current or last integrity run.
+func verifyStatusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, integrity.Report())
+}
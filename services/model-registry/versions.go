@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Model versions.
+//
+// A versioned model keeps each version as its own file under the backend's
+// hidden versions directory:
+//
+//	MODEL_DIR/.versions/llama.gguf/1.0.gguf
+//	MODEL_DIR/.versions/llama.gguf/1.1.gguf
+//
+// "llama.gguf@1.0" names one version anywhere a model name is accepted, and
+// the plain "llama.gguf" resolves to the newest one. Registry state
+// (sidecars, quarantine, stats) is kept per version under the "@" name. A
+// plain file MODEL_DIR/llama.gguf shadows any versions of the same name.
+const (
+	versionsDirName = ".versions"
+	versionSep      = "@"
+
+	// versionHeader tells clients which version a download resolved to.
+	versionHeader = "X-Model-Version"
+)
+
+// versionPattern restricts version labels to something safe as a file name.
+var versionPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+var errVersionedModel = errors.New("model is versioned; specify a version")
+
+// validVersion checks a version label.
+func validVersion(v string) error {
+	if !versionPattern.MatchString(v) || strings.Contains(v, "..") {
+		return fmt.Errorf("invalid version %q", v)
+	}
+	return nil
+}
+
+// versionsDir is where the versions of file in the backend rooted at dir live.
+func versionsDir(dir, file string) string {
+	return filepath.Join(dir, versionsDirName, filepath.FromSlash(file))
+}
+
+// modelVersion is one stored version of a model.
+type modelVersion struct {
+	Version string
+	Info    os.FileInfo
+}
+
+// listVersions returns the versions of file, oldest first. A model without
+// versions yields none and no error.
+func listVersions(dir, file string) ([]modelVersion, error) {
+	entries, err := os.ReadDir(versionsDir(dir, file))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var out []modelVersion
+	for _, e := range entries {
+		v, ok := strings.CutSuffix(e.Name(), filepath.Ext(file))
+		if e.IsDir() || !ok || validVersion(v) != nil {
+			continue // includes hidden in-progress uploads
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		out = append(out, modelVersion{Version: v, Info: info})
+	}
+	sort.Slice(out, func(i, j int) bool { return compareVersions(out[i].Version, out[j].Version) < 0 })
+	return out, nil
+}
+
+// compareVersions orders labels naturally: runs of digits compare as
+// numbers, everything else byte-wise, so 1.10 sorts after 1.9.
+func compareVersions(a, b string) int {
+	for a != "" && b != "" {
+		ca, ra := versionChunk(a)
+		cb, rb := versionChunk(b)
+		if c := compareChunks(ca, cb); c != 0 {
+			return c
+		}
+		a, b = ra, rb
+	}
+	return len(a) - len(b)
+}
+
+// versionChunk splits off a leading run of digits or of non-digits.
+func versionChunk(s string) (string, string) {
+	digit := s[0] >= '0' && s[0] <= '9'
+	i := 1
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9') == digit {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func compareChunks(a, b string) int {
+	if a[0] >= '0' && a[0] <= '9' && b[0] >= '0' && b[0] <= '9' {
+		a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// scanVersioned returns the newest (or "latest"-tagged) version of every
+// versioned model under dir, for merging into scanModels. Names follow the same rules as plain
+// files: nested ones only in recursive mode.
+func scanVersioned(dir string) ([]modelFile, error) {
+	root := filepath.Join(dir, versionsDirName)
+	var out []modelFile
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() || p == root || !isModelFile(d.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		if !recursive && strings.Contains(name, "/") {
+			return filepath.SkipDir
+		}
+		versions, err := listVersions(dir, name)
+		if err != nil || len(versions) == 0 {
+			return filepath.SkipDir
+		}
+		newest := versions[len(versions)-1]
+		if v, ok := tags.Lookup(qualifiedName(backendOf(dir), name), latestTag); ok {
+			for _, mv := range versions {
+				if mv.Version == v {
+					newest = mv
+				}
+			}
+		}
+		out = append(out, modelFile{Name: name, Path: filepath.Join(p, newest.Version+filepath.Ext(name)), Info: newest.Info, Version: newest.Version})
+		return filepath.SkipDir
+	})
+	return out, err
+}
+
+// Base is the model's name without any "@<version>".
+func (m modelRef) Base() string {
+	return strings.TrimSuffix(m.Name, versionSep+m.Version)
+}
+
+// withVersion points ref at one stored version.
+func (m modelRef) withVersion(v string) (modelRef, error) {
+	if err := validVersion(v); err != nil {
+		return m, err
+	}
+	m.Version = v
+	m.Name += versionSep + v
+	return m, nil
+}
+
+// resolveLatest points a ref without a version at the one its "latest" tag
+// names, or else the newest version, unless a plain file of that name exists
+// or the model has no versions. A version that isn't stored is looked up as
+// a tag.
+func (m modelRef) resolveLatest() modelRef {
+	if m.Version != "" {
+		if _, err := os.Stat(m.Path()); err == nil {
+			return m
+		}
+		base := m.Base()
+		if v, ok := tags.Lookup(base, m.Version); ok {
+			m.Name, m.Version = base, ""
+			tagged, _ := m.withVersion(v)
+			return tagged
+		}
+		return m
+	}
+	if _, err := os.Stat(m.Path()); err == nil {
+		return m
+	}
+	if v, ok := tags.Lookup(m.Name, latestTag); ok {
+		tagged, _ := m.withVersion(v)
+		return tagged
+	}
+	versions, err := listVersions(m.Dir, m.File)
+	if err != nil || len(versions) == 0 {
+		return m
+	}
+	latest, _ := m.withVersion(versions[len(versions)-1].Version)
+	return latest
+}
+
+// backendOf returns the name of the backend rooted at dir.
+func backendOf(dir string) string {
+	for name, d := range backends {
+		if d == dir && name != primaryBackend {
+			return name
+		}
+	}
+	return primaryBackend
+}
+
+// versionEntry is one element of /models/{name}/versions
+type versionEntry struct {
+	Version  string    `json:"version"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Status   string    `json:"status"`
+	Stage    string    `json:"stage"`
+	Tags     []string  `json:"tags,omitempty"`
+}
+
+// versionsResponse is used by /models/{name}/versions
+type versionsResponse struct {
+	Name     string         `json:"name"`
+	Latest   string         `json:"latest"`
+	Versions []versionEntry `json:"versions"`
+}
+
+// versionsHandler lists the stored versions of {name}, oldest first.
+func versionsHandler(modelDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref, err := parseModelRef(r, modelDir, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ref.Version != "" {
+			http.Error(w, "name must not include a version", http.StatusBadRequest)
+			return
+		}
+		versions, err := listVersions(ref.Dir, ref.File)
+		if err != nil {
+			http.Error(w, "unable to list versions", http.StatusInternalServerError)
+			return
+		}
+		if len(versions) == 0 {
+			http.Error(w, "model has no versions", http.StatusNotFound)
+			return
+		}
+		resp := versionsResponse{Name: ref.Name, Latest: versions[len(versions)-1].Version, Versions: []versionEntry{}}
+		if v, ok := tags.Lookup(ref.Name, latestTag); ok {
+			resp.Latest = v
+		}
+		for _, v := range versions {
+			resp.Versions = append(resp.Versions, versionEntry{
+				Version:  v.Version,
+				Size:     v.Info.Size(),
+				Modified: v.Info.ModTime().UTC(),
+				Status:   modelStatus(ref.Name+versionSep+v.Version, v.Info),
+				Stage:    stageOf(ref.Name + versionSep + v.Version),
+				Tags:     tags.TagsOf(ref.Name, v.Version),
+			})
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// versionRoute rewrites /models/{name}/versions/{version} to {name}@{version}
+// for handlers shared with the plain model routes.
+func versionRoute(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if strings.Contains(vars["name"], versionSep) {
+			http.Error(w, "name must not include a version", http.StatusBadRequest)
+			return
+		}
+		r = mux.SetURLVars(r, map[string]string{"name": vars["name"] + versionSep + vars["version"]})
+		next(w, r)
+	}
+}
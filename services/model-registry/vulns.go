@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Lab weaknesses that can be switched at runtime. The registry is part of
+// an intentionally vulnerable lab; these flags let an instructor move one
+// instance between the secure and the insecure behavior of an exercise
+// without a redeploy. MODEL_REGISTRY_VULNS lists the flags on at startup.
+// GET /admin/vulns shows them and PUT flips them. Because the API weakens
+// the registry, it only answers once admin credentials are configured.
+
+const (
+	vulnPathTraversal = "path_traversal"
+	vulnUnauthPulls   = "unauthenticated_pulls"
+	vulnWildcardCORS  = "wildcard_cors"
+)
+
+// vulnDescriptions lists every flag with what it does when on.
+var vulnDescriptions = map[string]string{
+	vulnPathTraversal: "GET /models/{name} follows ../ segments in the name out of MODEL_DIR",
+	vulnUnauthPulls:   "model downloads over HTTP and gRPC skip API key and bearer token checks",
+	vulnWildcardCORS:  "every origin is reflected with credentials allowed, whatever MODEL_REGISTRY_CORS_ORIGINS says",
+}
+
+// vulnFlags is the set of flags that are on.
+type vulnFlags struct {
+	mu sync.Mutex
+	on map[string]bool
+}
+
+var vulns = &vulnFlags{on: map[string]bool{}}
+
+// vulnView is one flag in GET /admin/vulns.
+type vulnView struct {
+	Name        string `json:"name"`
+	Enabled     bool   `json:"enabled"`
+	Description string `json:"description"`
+}
+
+// parseVulns parses MODEL_REGISTRY_VULNS, a comma separated list of flags.
+func parseVulns(spec string) (map[string]bool, error) {
+	on := map[string]bool{}
+	for _, name := range splitList(spec) {
+		if _, ok := vulnDescriptions[name]; !ok {
+			return nil, fmt.Errorf("unknown flag %q (want %s)", name, strings.Join(vulnNames(), ", "))
+		}
+		on[name] = true
+	}
+	return on, nil
+}
+
+// vulnNames returns the flag names, sorted.
+func vulnNames() []string {
+	names := make([]string, 0, len(vulnDescriptions))
+	for name := range vulnDescriptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Enabled reports whether flag name is on.
+func (v *vulnFlags) Enabled(name string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.on[name]
+}
+
+// Set applies changes, a flag-to-state map; nothing changes if any name is
+// unknown.
+func (v *vulnFlags) Set(changes map[string]bool) error {
+	for name := range changes {
+		if _, ok := vulnDescriptions[name]; !ok {
+			return fmt.Errorf("unknown flag %q (want %s)", name, strings.Join(vulnNames(), ", "))
+		}
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for name, on := range changes {
+		v.on[name] = on
+	}
+	return nil
+}
+
+// List returns every flag, by name.
+func (v *vulnFlags) List() []vulnView {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	out := []vulnView{}
+	for _, name := range vulnNames() {
+		out = append(out, vulnView{Name: name, Enabled: v.on[name], Description: vulnDescriptions[name]})
+	}
+	return out
+}
+
+// EnabledNames returns the names of the flags that are on.
+func (v *vulnFlags) EnabledNames() []string {
+	var names []string
+	for _, f := range v.List() {
+		if f.Enabled {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+// requireVulnAdmin is requireAdmin that also refuses while admin routes are
+// open to everyone, so students can't flip the flags themselves.
+func requireVulnAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions && !rolesEnforced() {
+			http.Error(w, "the vulnerability API needs admin credentials configured (MODEL_REGISTRY_ADMIN_TOKEN, an admin API key, identity or JWT role)", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// listVulnsHandler serves GET /admin/vulns.
+func listVulnsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"vulns": vulns.List()})
+}
+
+// setVulnsHandler serves PUT /admin/vulns: a {"flag": true|false} object
+// with the flags to change; the rest keep their state.
+func setVulnsHandler(w http.ResponseWriter, r *http.Request) {
+	var changes map[string]bool
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&changes); err != nil {
+		http.Error(w, `body must be a JSON object of flags, e.g. {"path_traversal": true}`, http.StatusBadRequest)
+		return
+	}
+	if err := vulns.Set(changes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	by := clientIP(r)
+	if p := requestPrincipals(r); len(p) > 0 {
+		by = p[0]
+	}
+	for _, name := range vulnNames() {
+		if on, ok := changes[name]; ok {
+			log.Printf("[registry] vuln %s set to %t by %s", name, on, by)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"vulns": vulns.List()})
+}
+
+// traversalKey marks the context of a download let through by path_traversal.
+type traversalKey struct{}
+
+// traversalRequest reports whether r is a download let through by
+// path_traversal, whose name is used as given.
+func traversalRequest(r *http.Request) bool {
+	return r != nil && r.Context().Value(traversalKey{}) != nil
+}
+
+// traversalMiddleware, with path_traversal on, hands downloads whose path
+// has ".." segments to traversal instead of next, whose router would clean
+// the path and redirect. traversal authenticates like next but skips the
+// model ACL check.
+func traversalMiddleware(next, traversal http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutPrefix(r.URL.Path, "/models/")
+		if ok && (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+			slices.Contains(strings.Split(name, "/"), "..") && vulns.Enabled(vulnPathTraversal) {
+			traversal.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), traversalKey{}, true)))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unauthenticatedPull reports whether r is a download let through without
+// credentials by unauthenticated_pulls.
+func unauthenticatedPull(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	route := mux.CurrentRoute(r)
+	return route != nil && route.GetName() == downloadRouteName && vulns.Enabled(vulnUnauthPulls)
+}
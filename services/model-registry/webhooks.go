@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Webhook notifications.
+//
+// Operators register URLs, in MODEL_REGISTRY_WEBHOOKS or through the admin
+// API, that are POSTed a JSON payload when a model is uploaded, tagged or
+// deleted. The payload is the event as /events sends it, signed with
+// HMAC-SHA256 when the hook has a secret. Failed deliveries are retried with
+// exponential backoff, and the latest deliveries of each hook are kept for
+// GET /webhooks/{id}/deliveries.
+const (
+	webhookSignatureHeader = "X-Registry-Signature"
+	webhookEventHeader     = "X-Registry-Event"
+	webhookDeliveryHeader  = "X-Registry-Delivery"
+
+	defaultWebhookAttempts = 5
+	defaultWebhookBackoff  = time.Second
+	maxWebhookBackoff      = 5 * time.Minute
+	webhookTimeout         = 10 * time.Second
+	webhookHistory         = 50 // deliveries kept per hook
+)
+
+// Webhook sources.
+const (
+	webhookSourceConfig = "config"
+	webhookSourceAPI    = "api"
+)
+
+// Delivery states.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// webhookEvents are the event types hooks can subscribe to.
+var webhookEvents = []string{eventModelUploaded, eventModelTagged, eventModelPromoted, eventApprovalRequested, eventApprovalDecided, eventModelDeleted, eventHoneypot}
+
+// webhooks holds the registered hooks; set up in main.
+var webhooks *webhookStore
+
+// webhook is one registered URL.
+type webhook struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Events  []string  `json:"events"` // subscribed types, sorted
+	Secret  string    `json:"secret,omitempty"`
+	Source  string    `json:"source"`
+	Created time.Time `json:"created"`
+}
+
+// webhookDelivery is one event's delivery to one hook.
+type webhookDelivery struct {
+	ID          string     `json:"id"`
+	Event       string     `json:"event"`
+	Model       string     `json:"model"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	LastCode    int        `json:"last_status_code,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Created     time.Time  `json:"created"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+// webhookView is a hook as the admin API shows it: without the secret, with
+// delivery counts.
+type webhookView struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Signed    bool      `json:"signed"`
+	Source    string    `json:"source"`
+	Created   time.Time `json:"created"`
+	Delivered int64     `json:"delivered"`
+	Failed    int64     `json:"failed"`
+	Pending   int       `json:"pending"`
+}
+
+// webhookRequest is the body of POST /webhooks.
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+// webhookState is a hook with its delivery history.
+type webhookState struct {
+	hook       webhook
+	deliveries []*webhookDelivery // oldest first, at most webhookHistory
+	delivered  int64
+	failed     int64
+	removed    bool // stops retries once the hook is deleted
+}
+
+// webhookStore keeps the hooks and delivers events to them. Hooks added
+// through the API are written through to MODEL_DIR/.registry/webhooks.json;
+// delivery history lives in memory.
+type webhookStore struct {
+	mu       sync.Mutex
+	path     string
+	secret   string // for hooks without their own
+	attempts int
+	backoff  time.Duration
+	hooks    map[string]*webhookState
+	client   *http.Client
+}
+
+// newWebhookStore loads the persisted hooks and adds one per configured URL.
+func newWebhookStore(modelDir string, urls []string, secret string, attempts int, backoff time.Duration) (*webhookStore, error) {
+	s := &webhookStore{
+		path:     filepath.Join(modelDir, stateDirName, "webhooks.json"),
+		secret:   secret,
+		attempts: max(attempts, 1),
+		backoff:  backoff,
+		hooks:    map[string]*webhookState{},
+		client:   &http.Client{Timeout: webhookTimeout},
+	}
+	for i, u := range urls {
+		if err := validWebhookURL(u); err != nil {
+			return nil, err
+		}
+		st := configWebhook(i, u)
+		s.hooks[st.hook.ID] = st
+	}
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[registry] unable to read %s: %v", s.path, err)
+		}
+		return s, nil
+	}
+	var saved []webhook
+	if err := json.Unmarshal(b, &saved); err != nil {
+		log.Printf("[registry] ignoring corrupt %s: %v", s.path, err)
+		return s, nil
+	}
+	for _, h := range saved {
+		s.hooks[h.ID] = &webhookState{hook: h}
+	}
+	return s, nil
+}
+
+// configWebhook is the i'th hook of MODEL_REGISTRY_WEBHOOKS.
+func configWebhook(i int, u string) *webhookState {
+	id := fmt.Sprintf("config-%d", i+1)
+	return &webhookState{hook: webhook{ID: id, URL: u, Events: webhookEvents, Source: webhookSourceConfig, Created: time.Now().UTC()}}
+}
+
+// Reconfigure replaces the hooks of MODEL_REGISTRY_WEBHOOKS and the default
+// secret, and reports whether anything changed. Hooks whose URL stays keep
+// their history; pending retries to removed ones stop.
+func (s *webhookStore) Reconfigure(urls []string, secret string) (bool, error) {
+	for _, u := range urls {
+		if err := validWebhookURL(u); err != nil {
+			return false, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := secret != s.secret
+	s.secret = secret
+	want := map[string]*webhookState{}
+	for i, u := range urls {
+		st := configWebhook(i, u)
+		want[st.hook.ID] = st
+	}
+	for id, st := range s.hooks {
+		if st.hook.Source == webhookSourceConfig && (want[id] == nil || want[id].hook.URL != st.hook.URL) {
+			delete(s.hooks, id)
+			st.removed = true
+			changed = true
+		}
+	}
+	for id, st := range want {
+		if _, ok := s.hooks[id]; !ok {
+			s.hooks[id] = st
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+func validWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook URL %q is not an http(s) URL", raw)
+	}
+	return nil
+}
+
+// save writes the API-registered hooks atomically; the caller must hold s.mu.
+func (s *webhookStore) save() error {
+	saved := []webhook{}
+	for _, st := range s.hooks {
+		if st.hook.Source == webhookSourceAPI {
+			saved = append(saved, st.hook)
+		}
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].ID < saved[j].ID })
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Add registers a hook from the API.
+func (s *webhookStore) Add(h webhook) (webhookView, error) {
+	var raw [8]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return webhookView{}, err
+	}
+	h.ID = hex.EncodeToString(raw[:])
+	h.Source = webhookSourceAPI
+	h.Created = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &webhookState{hook: h}
+	s.hooks[h.ID] = st
+	if err := s.save(); err != nil {
+		delete(s.hooks, h.ID)
+		return webhookView{}, err
+	}
+	return s.view(st), nil
+}
+
+// Remove deletes an API-registered hook; pending retries are dropped.
+func (s *webhookStore) Remove(id string) (found bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.hooks[id]
+	if !ok {
+		return false, nil
+	}
+	if st.hook.Source != webhookSourceAPI {
+		return true, fmt.Errorf("webhook %s is configured by MODEL_REGISTRY_WEBHOOKS", id)
+	}
+	delete(s.hooks, id)
+	if err := s.save(); err != nil {
+		s.hooks[id] = st
+		return true, err
+	}
+	st.removed = true
+	return true, nil
+}
+
+// view renders st; the caller must hold s.mu.
+func (s *webhookStore) view(st *webhookState) webhookView {
+	v := webhookView{
+		ID:        st.hook.ID,
+		URL:       st.hook.URL,
+		Events:    st.hook.Events,
+		Signed:    st.hook.Secret != "" || s.secret != "",
+		Source:    st.hook.Source,
+		Created:   st.hook.Created,
+		Delivered: st.delivered,
+		Failed:    st.failed,
+	}
+	for _, d := range st.deliveries {
+		if d.Status == deliveryPending {
+			v.Pending++
+		}
+	}
+	return v
+}
+
+// List returns every hook, sorted by id.
+func (s *webhookStore) List() []webhookView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]webhookView, 0, len(s.hooks))
+	for _, st := range s.hooks {
+		out = append(out, s.view(st))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Deliveries returns copies of a hook's latest deliveries, newest first.
+func (s *webhookStore) Deliveries(id string) ([]webhookDelivery, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.hooks[id]
+	if !ok {
+		return nil, false
+	}
+	out := make([]webhookDelivery, 0, len(st.deliveries))
+	for i := len(st.deliveries) - 1; i >= 0; i-- {
+		out = append(out, *st.deliveries[i])
+	}
+	return out, true
+}
+
+// Notify starts delivering ev to every hook subscribed to its type. It
+// doesn't block: each delivery runs, and retries, in its own goroutine.
+func (s *webhookStore) Notify(ev registryEvent) {
+	if s == nil || !slices.Contains(webhookEvents, ev.Type) {
+		return
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range s.hooks {
+		if !slices.Contains(st.hook.Events, ev.Type) {
+			continue
+		}
+		var raw [8]byte
+		rand.Read(raw[:])
+		d := &webhookDelivery{
+			ID:      hex.EncodeToString(raw[:]),
+			Event:   ev.Type,
+			Model:   ev.Model,
+			Status:  deliveryPending,
+			Created: time.Now().UTC(),
+		}
+		st.deliveries = append(st.deliveries, d)
+		if len(st.deliveries) > webhookHistory {
+			st.deliveries = st.deliveries[len(st.deliveries)-webhookHistory:]
+		}
+		secret := st.hook.Secret
+		if secret == "" {
+			secret = s.secret
+		}
+		go s.deliver(st, d, payload, secret)
+	}
+}
+
+// deliver POSTs payload until the hook answers 2xx or the attempts run out,
+// doubling the wait after each failure.
+func (s *webhookStore) deliver(st *webhookState, d *webhookDelivery, payload []byte, secret string) {
+	var sig string
+	if secret != "" {
+		m := hmac.New(sha256.New, []byte(secret))
+		m.Write(payload)
+		sig = "sha256=" + hex.EncodeToString(m.Sum(nil))
+	}
+	wait := s.backoff
+	for attempt := 1; ; attempt++ {
+		code, err := s.post(st.hook.URL, d, payload, sig)
+
+		s.mu.Lock()
+		d.Attempts, d.LastCode, d.LastError, d.NextAttempt = attempt, code, "", nil
+		if err != nil {
+			d.LastError = err.Error()
+		}
+		done := err == nil
+		if done {
+			now := time.Now().UTC()
+			d.Status, d.DeliveredAt = deliveryDelivered, &now
+			st.delivered++
+		} else if attempt >= s.attempts || st.removed {
+			d.Status = deliveryFailed
+			st.failed++
+			log.Printf("[registry] webhook %s: giving up on %s delivery %s after %d attempts: %v", st.hook.ID, d.Event, d.ID, attempt, err)
+			done = true
+		} else {
+			next := time.Now().UTC().Add(wait)
+			d.NextAttempt = &next
+		}
+		s.mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(wait)
+		wait = min(wait*2, maxWebhookBackoff)
+	}
+}
+
+// post makes one delivery attempt; non-2xx answers are errors.
+func (s *webhookStore) post(target string, d *webhookDelivery, payload []byte, sig string) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "model-registry-webhooks")
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookDeliveryHeader, d.ID)
+	if sig != "" {
+		req.Header.Set(webhookSignatureHeader, sig)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhooksResponse is used by GET /webhooks
+type webhooksResponse struct {
+	Webhooks []webhookView `json:"webhooks"`
+}
+
+// deliveriesResponse is used by /webhooks/{id}/deliveries
+type deliveriesResponse struct {
+	ID         string            `json:"id"`
+	Deliveries []webhookDelivery `json:"deliveries"`
+}
+
+// listWebhooksHandler lists the registered hooks.
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, webhooksResponse{Webhooks: webhooks.List()})
+}
+
+// addWebhookHandler registers the hook in the body, e.g.
+// {"url": "https://ci/hook", "events": ["model.uploaded"], "secret": "..."};
+// events defaults to all of them.
+func addWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var req webhookRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "body must be a JSON object with url, events and secret", http.StatusBadRequest)
+		return
+	}
+	if err := validWebhookURL(req.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	evs := webhookEvents
+	if len(req.Events) > 0 {
+		evs = nil
+		for _, ev := range req.Events {
+			if !slices.Contains(webhookEvents, ev) {
+				http.Error(w, fmt.Sprintf("unknown event %q (want one of %v)", ev, webhookEvents), http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(evs, ev) {
+				evs = append(evs, ev)
+			}
+		}
+		sort.Strings(evs)
+	}
+	v, err := webhooks.Add(webhook{URL: req.URL, Events: evs, Secret: req.Secret})
+	if err != nil {
+		log.Printf("[registry] unable to save webhook: %v", err)
+		http.Error(w, "unable to save webhook", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[registry] webhook %s registered for %s", v.ID, v.URL)
+	writeJSON(w, http.StatusCreated, v)
+}
+
+// deleteWebhookHandler removes a hook registered through the API.
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	found, err := webhooks.Remove(id)
+	switch {
+	case !found:
+		http.Error(w, "webhook not found", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("[registry] webhook %s removed", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// webhookDeliveriesHandler returns a hook's latest deliveries, newest first.
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	ds, ok := webhooks.Deliveries(id)
+	if !ok {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveriesResponse{ID: id, Deliveries: ds})
+}